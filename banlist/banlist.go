@@ -0,0 +1,42 @@
+package banlist
+
+import (
+	"sync"
+	"time"
+)
+
+type Banlist struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func New() *Banlist {
+	return &Banlist{
+		until: map[string]time.Time{},
+	}
+}
+
+func (b *Banlist) Ban(key string, d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until := time.Now().Add(d)
+	if until.After(b.until[key]) {
+		b.until[key] = until
+	}
+}
+
+func (b *Banlist) Banned(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until, ok := b.until[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(b.until, key)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"go-chat/contacts"
+	"go-chat/handler"
+	"go-chat/model"
+	"go-chat/session"
+	wrtc "go-chat/webrtc"
+	"log"
+	"sync"
+)
+
+var errNoCall = errors.New("no call with contact")
+
+// calls keeps the session of the call with a contact by its key. Calls of
+// contacts are taken with the media of the files in media, calls of other
+// nodes are refused.
+type calls struct {
+	privsign ed25519.PrivateKey
+	contact  func(sign []byte) (contacts.Contact, bool)
+	media    []string
+	send     func(hash []byte, s model.Signal) bool
+
+	mu       sync.Mutex
+	sessions map[string]*session.Session
+}
+
+func newCalls(
+	privsign ed25519.PrivateKey,
+	contact func(sign []byte) (contacts.Contact, bool),
+	media []string,
+	send func(hash []byte, s model.Signal) bool,
+) *calls {
+	return &calls{
+		privsign: privsign,
+		contact:  contact,
+		media:    media,
+		send:     send,
+		sessions: map[string]*session.Session{},
+	}
+}
+
+// serve handles the calls on sess and drains the media of the remote side.
+func (cs *calls) serve(sess *session.Session) {
+	send := func(s model.Signal) { cs.send(sess.Hash(), s) }
+	sess.OnCall(func(s model.Signal) {
+		c, ok := cs.contact(sess.Sign())
+		if !ok {
+			log.Printf("call of %x refused", sess.Sign())
+			return
+		}
+		switch s.Type() {
+		case model.SignalTypeCallStart:
+			srcs, err := openMedia(cs.media)
+			if err != nil {
+				log.Println("serve: openMedia:", err)
+				return
+			}
+			cs.add(c, sess)
+			go handler.AcceptCall(context.Background(), s, sess, cs.privsign, srcs, send)
+			log.Printf("call with %s", c.Name)
+		case model.SignalTypeCallAccept:
+			handler.CallAccepted(s, sess)
+		case model.SignalTypeCallEnd:
+			if handler.CallEnded(s, sess) {
+				cs.remove(c, sess)
+				log.Printf("call with %s ended", c.Name)
+			}
+		}
+	})
+	sess.Peer().OnTrack(func(t *wrtc.RemoteTrack) {
+		log.Printf("receiving %s from %x", t.Codec(), sess.Sign())
+		go func() {
+			for {
+				if _, err := t.ReadRTP(); err != nil {
+					return
+				}
+			}
+		}()
+	})
+}
+
+// start calls the contact over sess with the media of the files in paths.
+func (cs *calls) start(c contacts.Contact, sess *session.Session, paths []string) error {
+	srcs, err := openMedia(paths)
+	if err != nil {
+		return err
+	}
+	cs.add(c, sess)
+	handler.StartCall(context.Background(), sess, cs.privsign, srcs, func(s model.Signal) { cs.send(sess.Hash(), s) })
+	return nil
+}
+
+// hangup ends the call with the contact.
+func (cs *calls) hangup(c contacts.Contact) error {
+	cs.mu.Lock()
+	sess, ok := cs.sessions[c.Key()]
+	delete(cs.sessions, c.Key())
+	cs.mu.Unlock()
+	if !ok {
+		return errNoCall
+	}
+	handler.EndCall(sess, cs.privsign, func(s model.Signal) { cs.send(sess.Hash(), s) })
+	return nil
+}
+
+func (cs *calls) add(c contacts.Contact, sess *session.Session) {
+	cs.mu.Lock()
+	cs.sessions[c.Key()] = sess
+	cs.mu.Unlock()
+
+	go func() {
+		<-sess.Done()
+		cs.remove(c, sess)
+	}()
+}
+
+func (cs *calls) remove(c contacts.Contact, sess *session.Session) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.sessions[c.Key()] == sess {
+		delete(cs.sessions, c.Key())
+	}
+}
+
+// openMedia opens the files played in a call, IVF with VP8 or Ogg with
+// Opus.
+func openMedia(paths []string) ([]wrtc.Source, error) {
+	var srcs []wrtc.Source
+	for _, path := range paths {
+		src, err := wrtc.OpenFile(path)
+		if err != nil {
+			for _, src := range srcs {
+				src.(*wrtc.FileSource).Close()
+			}
+			return nil, err
+		}
+		srcs = append(srcs, src)
+	}
+	return srcs, nil
+}
@@ -0,0 +1,243 @@
+package chat
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"go-chat/storage"
+	mrand "math/rand/v2"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func author(t *testing.T, now *time.Time) *Author {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	a := NewAuthor(priv)
+	a.now = func() time.Time { *now = now.Add(time.Second); return *now }
+	return a
+}
+
+func history(t *testing.T) *storage.History {
+	db, err := storage.Open(filepath.Join(t.TempDir(), "chat.db"), "")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return storage.NewHistory(db, storage.Retention{})
+}
+
+func must(t *testing.T) func(Content, error) Content {
+	return func(c Content, err error) Content {
+		require.NoError(t, err)
+		return c
+	}
+}
+
+func fold(t *testing.T, h *storage.History) map[string]Message {
+	entries, err := h.Page("conv", storage.Query{})
+	require.NoError(t, err)
+	out := map[string]Message{}
+	for _, m := range Fold(entries) {
+		out[m.ID] = m
+	}
+	return out
+}
+
+func Test_Content(t *testing.T) {
+	now := time.Now()
+	alice := author(t, &now)
+
+	t.Run("signed", func(t *testing.T) {
+		c := must(t)(alice.Text("hello", ""))
+		b, err := c.Marshal()
+		require.NoError(t, err)
+		parsed, err := Parse(b)
+		require.NoError(t, err)
+		assert.Equal(t, c, parsed)
+
+		c.Text = "goodbye"
+		b, _ = c.Marshal()
+		_, err = Parse(b)
+		assert.ErrorIs(t, err, ErrInvalidContent)
+	})
+
+	t.Run("invalid kinds", func(t *testing.T) {
+		_, err := alice.Edit("", "text")
+		assert.ErrorIs(t, err, ErrInvalidContent)
+		_, err = alice.React("id", "", false)
+		assert.ErrorIs(t, err, ErrInvalidContent)
+		_, err = alice.Text(string(make([]byte, MaxText+1)), "")
+		assert.ErrorIs(t, err, ErrInvalidContent)
+	})
+}
+
+func Test_Merge(t *testing.T) {
+	now := time.Now()
+	alice, bob := author(t, &now), author(t, &now)
+
+	t.Run("operations", func(t *testing.T) {
+		h := history(t)
+		msg := must(t)(alice.Text("helo", ""))
+		reply := must(t)(bob.Text("hi", msg.ID))
+		nested := must(t)(alice.Text("how are you", reply.ID))
+		for _, c := range []Content{msg, reply, nested} {
+			_, err := Apply(h, "conv", "x", c)
+			require.NoError(t, err)
+		}
+
+		_, err := Apply(h, "conv", "bob", must(t)(bob.Edit(msg.ID, "spoofed")))
+		assert.ErrorIs(t, err, ErrNotAuthor)
+		for _, c := range []Content{
+			must(t)(alice.Edit(msg.ID, "hello")),
+			must(t)(bob.React(msg.ID, "👍", false)),
+			must(t)(alice.React(msg.ID, "👍", false)),
+			must(t)(bob.React(msg.ID, "👍", true)),
+		} {
+			_, err := Apply(h, "conv", "x", c)
+			require.NoError(t, err)
+		}
+
+		got := fold(t, h)
+		assert.Equal(t, "hello", got[msg.ID].Text)
+		assert.False(t, got[msg.ID].Edited.IsZero())
+		assert.Equal(t, map[string][]string{"👍": {hex.EncodeToString(alice.priv.Public().(ed25519.PublicKey))}}, got[msg.ID].Reactions)
+		assert.Equal(t, msg.ID, got[nested.ID].Thread)
+		assert.Equal(t, reply.ID, got[nested.ID].ReplyTo)
+
+		_, err = Apply(h, "conv", "x", must(t)(alice.Delete(msg.ID)))
+		require.NoError(t, err)
+		got = fold(t, h)
+		assert.True(t, got[msg.ID].Deleted)
+		assert.Empty(t, got[msg.ID].Text)
+		assert.Empty(t, got[msg.ID].Reactions)
+
+		// The text and its edits are gone from the store.
+		stored, _ := h.Get("conv", msg.ID)
+		assert.NotContains(t, string(stored.Body), "hel")
+		entries, _ := h.Page("conv", storage.Query{})
+		for _, e := range entries {
+			assert.NotContains(t, string(e.Body), "hello")
+		}
+	})
+
+	t.Run("any arrival order", func(t *testing.T) {
+		msg := must(t)(alice.Text("one", ""))
+		ops := []Content{
+			msg,
+			must(t)(alice.Edit(msg.ID, "two")),
+			must(t)(alice.Edit(msg.ID, "three")),
+			must(t)(bob.Edit(msg.ID, "spoofed")),
+			must(t)(bob.React(msg.ID, "🎉", false)),
+			must(t)(bob.React(msg.ID, "🎉", true)),
+			must(t)(bob.React(msg.ID, "🎉", false)),
+		}
+		var want map[string]Message
+		for range 5 {
+			h := history(t)
+			for _, i := range mrand.Perm(len(ops)) {
+				Apply(h, "conv", "x", ops[i])
+			}
+			got := fold(t, h)
+			assert.Equal(t, "three", got[msg.ID].Text)
+			assert.Len(t, got[msg.ID].Reactions["🎉"], 1)
+			m := got[msg.ID]
+			m.Time = time.Time{}
+			got[msg.ID] = m
+			if want == nil {
+				want = got
+			}
+			assert.Equal(t, want, got)
+		}
+	})
+
+	t.Run("plain texts", func(t *testing.T) {
+		h := history(t)
+		require.NoError(t, h.Append("conv", storage.Message{ID: "old", From: "x", Body: []byte("from before")}))
+		assert.Equal(t, "from before", fold(t, h)["old"].Text)
+	})
+
+	t.Run("merge from another device", func(t *testing.T) {
+		phone, laptop := history(t), history(t)
+		msg := must(t)(alice.Text("hello", ""))
+		edit := must(t)(alice.Edit(msg.ID, "hello there"))
+		del := must(t)(alice.Delete(msg.ID))
+		for _, c := range []Content{msg, edit} {
+			_, err := Apply(laptop, "conv", "x", c)
+			require.NoError(t, err)
+		}
+		for _, c := range []Content{msg, del} {
+			_, err := Apply(phone, "conv", "x", c)
+			require.NoError(t, err)
+		}
+		entries := func(h *storage.History) []storage.Message {
+			page, err := h.Page("conv", storage.Query{})
+			require.NoError(t, err)
+			return page
+		}
+
+		// The phone keeps the edit out, the laptop drops the text on the
+		// deletion whatever order the entries come in.
+		for _, m := range entries(laptop) {
+			require.NoError(t, Merge(phone, "conv", m))
+		}
+		for _, m := range entries(phone) {
+			require.NoError(t, Merge(laptop, "conv", m))
+		}
+		for _, h := range []*storage.History{phone, laptop} {
+			assert.True(t, fold(t, h)[msg.ID].Deleted)
+			for _, e := range entries(h) {
+				assert.NotContains(t, string(e.Body), "hello")
+			}
+		}
+		bodies := func(h *storage.History) map[string]string {
+			out := map[string]string{}
+			for _, e := range entries(h) {
+				out[e.ID] = string(e.Body)
+			}
+			return out
+		}
+		assert.Equal(t, bodies(phone), bodies(laptop))
+
+		// A deletion that comes before its text drops the text too.
+		tablet := history(t)
+		deletion, ok := phone.Get("conv", del.ID)
+		require.True(t, ok)
+		require.NoError(t, Merge(tablet, "conv", deletion))
+		original, err := msg.Marshal()
+		require.NoError(t, err)
+		require.NoError(t, Merge(tablet, "conv", storage.Message{ID: msg.ID, Body: original}))
+		assert.True(t, fold(t, tablet)[msg.ID].Deleted)
+	})
+
+	t.Run("forged content stays plain", func(t *testing.T) {
+		h := history(t)
+		msg := must(t)(alice.Text("hello", ""))
+		_, err := Apply(h, "conv", "x", msg)
+		require.NoError(t, err)
+
+		edit := must(t)(alice.Edit(msg.ID, "hello"))
+		edit.Text = "forged"
+		body, err := edit.Marshal()
+		require.NoError(t, err)
+		_, err = Parse(body)
+		require.ErrorIs(t, err, ErrInvalidContent)
+
+		wrapped, err := Plain(body)
+		require.NoError(t, err)
+		require.NoError(t, h.Append("conv", storage.Message{ID: edit.ID, From: "eve", Body: wrapped}))
+		got := fold(t, h)
+		assert.Equal(t, "hello", got[msg.ID].Text)
+		assert.True(t, got[msg.ID].Edited.IsZero())
+		assert.Equal(t, string(body), got[edit.ID].Text)
+
+		// Stored as it came by an older node, the signature is checked again.
+		h = history(t)
+		_, err = Apply(h, "conv", "x", msg)
+		require.NoError(t, err)
+		require.NoError(t, h.Append("conv", storage.Message{ID: edit.ID, From: "eve", Body: body}))
+		assert.Equal(t, "hello", fold(t, h)[msg.ID].Text)
+	})
+}
@@ -0,0 +1,183 @@
+package chat
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	ErrInvalidContent = errors.New("invalid chat content")
+	ErrNotAuthor      = errors.New("only the author may change a message")
+)
+
+const (
+	// MaxText leaves room for the signature and the framing in a signal.
+	MaxText  = 2048
+	MaxEmoji = 32
+	idLen    = 16
+)
+
+type Kind uint8
+
+const (
+	KindText Kind = iota
+	KindEdit
+	KindDelete
+	KindReact
+)
+
+// Content is the body of a chat message or of an operation on one,
+// signed by its author. Operations name the message they change by
+// Target.
+type Content struct {
+	Kind   Kind              `json:"kind"`
+	ID     string            `json:"id"`
+	Author ed25519.PublicKey `json:"author"`
+	Target string            `json:"target,omitempty"`
+	// ReplyTo makes a text a reply, replies to replies form a thread.
+	ReplyTo string `json:"reply_to,omitempty"`
+	Text    string `json:"text,omitempty"`
+	Emoji   string `json:"emoji,omitempty"`
+	// Remove takes a reaction back.
+	Remove bool `json:"remove,omitempty"`
+	// Time is the clock of the author, the latest edit or reaction wins.
+	Time time.Time `json:"time"`
+	// Tombstone marks a deleted text in the history, it is never sent.
+	Tombstone bool   `json:"tombstone,omitempty"`
+	Sig       []byte `json:"sig,omitempty"`
+}
+
+func (c Content) signed() ([]byte, error) {
+	c.Sig = nil
+	return json.Marshal(c)
+}
+
+func (c Content) Marshal() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+// Parse checks the signature and the fields the kind needs.
+func Parse(b []byte) (Content, error) {
+	var c Content
+	if err := json.Unmarshal(b, &c); err != nil || !c.valid() || c.Tombstone {
+		return Content{}, ErrInvalidContent
+	}
+	if !c.verify() {
+		return Content{}, ErrInvalidContent
+	}
+	return c, nil
+}
+
+func (c Content) verify() bool {
+	data, err := c.signed()
+	return err == nil && ed25519.Verify(c.Author, data, c.Sig)
+}
+
+// plain is how a body that is no content is stored. Stored as it came, a
+// forged body could pass for content of someone else once read back.
+type plain struct {
+	Plain []byte `json:"plain"`
+}
+
+// Plain wraps a body that didn't parse as content for the history.
+func Plain(body []byte) ([]byte, error) {
+	return json.Marshal(plain{Plain: body})
+}
+
+// unwrap returns the text of a stored body that is no content. Older nodes
+// stored such bodies as they came.
+func unwrap(body []byte) []byte {
+	var p plain
+	if err := json.Unmarshal(body, &p); err != nil || p.Plain == nil {
+		return body
+	}
+	return p.Plain
+}
+
+func (c Content) valid() bool {
+	if len(c.Author) != ed25519.PublicKeySize || c.ID == "" || len(c.Text) > MaxText || !utf8.ValidString(c.Text) {
+		return false
+	}
+	switch c.Kind {
+	case KindText:
+		return c.Target == ""
+	case KindEdit:
+		return c.Target != "" && c.ReplyTo == ""
+	case KindDelete:
+		return c.Target != "" && c.ReplyTo == "" && c.Text == ""
+	case KindReact:
+		return c.Target != "" && c.Emoji != "" && len(c.Emoji) <= MaxEmoji && utf8.ValidString(c.Emoji)
+	}
+	return false
+}
+
+func (c Content) String() string {
+	switch c.Kind {
+	case KindEdit:
+		return fmt.Sprintf("edited %s: %s", c.Target, c.Text)
+	case KindDelete:
+		return "deleted " + c.Target
+	case KindReact:
+		if c.Remove {
+			return fmt.Sprintf("took back %s on %s", c.Emoji, c.Target)
+		}
+		return fmt.Sprintf("reacted %s on %s", c.Emoji, c.Target)
+	}
+	if c.ReplyTo != "" {
+		return fmt.Sprintf("in reply to %s: %s", c.ReplyTo, c.Text)
+	}
+	return c.Text
+}
+
+// Author signs the contents of the own messages.
+type Author struct {
+	priv ed25519.PrivateKey
+	now  func() time.Time
+}
+
+func NewAuthor(priv ed25519.PrivateKey) *Author {
+	return &Author{priv: priv, now: time.Now}
+}
+
+// Text writes a message, a reply when replyTo is set.
+func (a *Author) Text(text, replyTo string) (Content, error) {
+	return a.sign(Content{Kind: KindText, Text: text, ReplyTo: replyTo})
+}
+
+func (a *Author) Edit(target, text string) (Content, error) {
+	return a.sign(Content{Kind: KindEdit, Target: target, Text: text})
+}
+
+func (a *Author) Delete(target string) (Content, error) {
+	return a.sign(Content{Kind: KindDelete, Target: target})
+}
+
+// React adds the emoji to the target, or takes it back.
+func (a *Author) React(target, emoji string, remove bool) (Content, error) {
+	return a.sign(Content{Kind: KindReact, Target: target, Emoji: emoji, Remove: remove})
+}
+
+func (a *Author) sign(c Content) (Content, error) {
+	id := make([]byte, idLen)
+	rand.Read(id)
+	c.ID = hex.EncodeToString(id)
+	c.Author = a.priv.Public().(ed25519.PublicKey)
+	// A time with a zone would come back from JSON as another value and
+	// break the signature.
+	c.Time = a.now().UTC()
+	if !c.valid() {
+		return Content{}, ErrInvalidContent
+	}
+	data, err := c.signed()
+	if err != nil {
+		return Content{}, err
+	}
+	c.Sig = ed25519.Sign(a.priv, data)
+	return c, nil
+}
@@ -0,0 +1,267 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"go-chat/storage"
+	"sort"
+	"time"
+)
+
+// Apply stores content received in conv from the sender. Every content is
+// kept as its own history entry, so the entries sync between devices like
+// any message and Fold gives the same result whatever order they came in.
+// An edit or deletion of a known message by another author is refused,
+// one that comes before its message is kept and ignored by Fold.
+func Apply(h *storage.History, conv, from string, c Content) (storage.Message, error) {
+	body, err := c.Marshal()
+	if err != nil {
+		return storage.Message{}, err
+	}
+	m := storage.Message{ID: c.ID, From: from, Time: time.Now(), Body: body}
+	if err := apply(h, conv, m, c); err != nil {
+		return storage.Message{}, err
+	}
+	return m, nil
+}
+
+// Merge stores an entry of the history of another own device. Content goes
+// through the same rules as when received, so a deletion drops the text on
+// every device and edits of a deleted text don't come back. A tombstone
+// only fills a gap, the deletion that made it drops a text kept here.
+func Merge(h *storage.History, conv string, m storage.Message) error {
+	if c, err := Parse(m.Body); err == nil {
+		if c.ID != m.ID {
+			return ErrInvalidContent
+		}
+		return apply(h, conv, m, c)
+	}
+	if c, ok := decode(m); ok && c.Tombstone {
+		if _, ok := h.Get(conv, m.ID); ok {
+			return nil
+		}
+	}
+	return h.Append(conv, m)
+}
+
+func apply(h *storage.History, conv string, m storage.Message, c Content) error {
+	if c.Kind == KindEdit || c.Kind == KindDelete {
+		if target, ok := load(h, conv, c.Target); ok {
+			if !bytes.Equal(target.Author, c.Author) {
+				return ErrNotAuthor
+			}
+			// The text is gone, so are its edits.
+			if c.Kind == KindEdit && target.Tombstone {
+				return nil
+			}
+		}
+	}
+	if err := h.Append(conv, m); err != nil {
+		return err
+	}
+	switch {
+	case c.Kind == KindDelete:
+		return tombstone(h, conv, c.Target)
+	case c.Kind == KindText && deleted(h, conv, c):
+		return tombstone(h, conv, c.ID)
+	}
+	return nil
+}
+
+// deleted reports whether the deletion of the text came before it.
+func deleted(h *storage.History, conv string, text Content) bool {
+	msgs, err := h.Page(conv, storage.Query{})
+	if err != nil {
+		return false
+	}
+	for _, m := range msgs {
+		if c, ok := decode(m); ok && c.Kind == KindDelete && c.Target == text.ID && bytes.Equal(c.Author, text.Author) {
+			return true
+		}
+	}
+	return false
+}
+
+// tombstone drops the text of a deleted message and its edits from the
+// history. The deletion itself stays, it hides the message on devices
+// that still have it.
+func tombstone(h *storage.History, conv, id string) error {
+	target, ok := load(h, conv, id)
+	if !ok || target.Tombstone {
+		return nil
+	}
+	stored, _ := h.Get(conv, id)
+	body, err := json.Marshal(Content{
+		Kind:      KindText,
+		ID:        target.ID,
+		Author:    target.Author,
+		ReplyTo:   target.ReplyTo,
+		Time:      target.Time,
+		Tombstone: true,
+	})
+	if err != nil {
+		return err
+	}
+	stored.Body = body
+	if err := h.Put(conv, stored); err != nil {
+		return err
+	}
+
+	msgs, err := h.Page(conv, storage.Query{})
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if c, ok := decode(m); ok && c.Kind == KindEdit && c.Target == id && bytes.Equal(c.Author, target.Author) {
+			if err := h.Delete(conv, m.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Message is a text as shown: its latest edit, its reactions and its
+// place in a thread.
+type Message struct {
+	ID     string
+	From   string
+	Author []byte
+	Time   time.Time
+	Text   string
+	// Edited is the time of the edit shown, zero when there is none.
+	Edited  time.Time
+	Deleted bool
+	ReplyTo string
+	// Thread is the first message of the chain of replies.
+	Thread string
+	// Reactions are the hex author keys by emoji.
+	Reactions map[string][]string
+}
+
+// Fold merges the entries of a conversation, as returned by History.Page,
+// into the messages to show. Bodies that are not content are plain texts.
+func Fold(entries []storage.Message) []Message {
+	var out []Message
+	index := map[string]int{}
+	var ops []Content
+	for _, e := range entries {
+		c, ok := decode(e)
+		if !ok {
+			index[e.ID] = len(out)
+			out = append(out, Message{ID: e.ID, From: e.From, Time: e.Time, Text: string(unwrap(e.Body))})
+			continue
+		}
+		if c.Kind != KindText {
+			ops = append(ops, c)
+			continue
+		}
+		index[c.ID] = len(out)
+		out = append(out, Message{
+			ID:      c.ID,
+			From:    e.From,
+			Author:  c.Author,
+			Time:    e.Time,
+			Text:    c.Text,
+			Deleted: c.Tombstone,
+			ReplyTo: c.ReplyTo,
+		})
+	}
+
+	// The latest operation wins, ties go to the higher id.
+	sort.Slice(ops, func(i, j int) bool {
+		if !ops[i].Time.Equal(ops[j].Time) {
+			return ops[i].Time.Before(ops[j].Time)
+		}
+		return ops[i].ID < ops[j].ID
+	})
+	// Reactions by target, emoji and author.
+	reactions := map[string]map[string]map[string]bool{}
+	for _, op := range ops {
+		i, ok := index[op.Target]
+		if !ok {
+			continue
+		}
+		m := &out[i]
+		switch op.Kind {
+		case KindEdit:
+			if bytes.Equal(op.Author, m.Author) && !m.Deleted {
+				m.Text, m.Edited = op.Text, op.Time
+			}
+		case KindDelete:
+			if bytes.Equal(op.Author, m.Author) {
+				m.Text, m.Edited, m.Deleted = "", time.Time{}, true
+			}
+		case KindReact:
+			if reactions[op.Target] == nil {
+				reactions[op.Target] = map[string]map[string]bool{}
+			}
+			if reactions[op.Target][op.Emoji] == nil {
+				reactions[op.Target][op.Emoji] = map[string]bool{}
+			}
+			reactions[op.Target][op.Emoji][hex.EncodeToString(op.Author)] = !op.Remove
+		}
+	}
+
+	for i := range out {
+		m := &out[i]
+		m.Thread = thread(out, index, m.ID)
+		if m.Deleted {
+			continue
+		}
+		for emoji, authors := range reactions[m.ID] {
+			for a, on := range authors {
+				if !on {
+					continue
+				}
+				if m.Reactions == nil {
+					m.Reactions = map[string][]string{}
+				}
+				m.Reactions[emoji] = append(m.Reactions[emoji], a)
+			}
+			sort.Strings(m.Reactions[emoji])
+		}
+	}
+	return out
+}
+
+// thread follows the replies up to the first message, a missing or looping
+// link ends the chain.
+func thread(msgs []Message, index map[string]int, id string) string {
+	seen := map[string]bool{}
+	for {
+		seen[id] = true
+		i, ok := index[id]
+		if !ok {
+			return id
+		}
+		parent := msgs[i].ReplyTo
+		if _, known := index[parent]; parent == "" || !known || seen[parent] {
+			return id
+		}
+		id = parent
+	}
+}
+
+func load(h *storage.History, conv, id string) (Content, bool) {
+	m, ok := h.Get(conv, id)
+	if !ok {
+		return Content{}, false
+	}
+	return decode(m)
+}
+
+// decode reads a stored content. The signature is checked again, entries
+// stored as they came by older nodes may be forged. Tombstones are written
+// here only and carry no signature.
+func decode(m storage.Message) (Content, bool) {
+	var c Content
+	if err := json.Unmarshal(m.Body, &c); err != nil || !c.valid() || c.ID != m.ID {
+		return Content{}, false
+	}
+	if !c.Tombstone && !c.verify() {
+		return Content{}, false
+	}
+	return c, true
+}
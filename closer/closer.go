@@ -9,8 +9,9 @@ import (
 )
 
 var (
-	mu  sync.Mutex
-	fns []func() error
+	mu   sync.Mutex
+	fns  []func() error
+	done = make(chan struct{})
 )
 
 func init() {
@@ -25,6 +26,7 @@ func init() {
 				log.Printf("closing err: %v", err)
 			}
 		}
+		close(done)
 	}()
 }
 
@@ -34,3 +36,8 @@ func Add(fn func() error) {
 
 	fns = append(fns, fn)
 }
+
+// Done is closed once every function added ran.
+func Done() <-chan struct{} {
+	return done
+}
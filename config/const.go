@@ -1,11 +1,102 @@
 package config
 
+import "time"
+
 const (
-	MaxInputLen       = 1024 * 5
-	AESKeyLen         = 60
-	SignatureLen      = 32
-	CacheBucketsCount = 10
-	CacheBucketSize   = 5000
-	NonceLen          = 12
-	MaxPeersCount     = 20
+	MaxInputLen        = 1024 * 5
+	AESKeyLen          = 60
+	SignatureLen       = 32
+	CacheBucketsCount  = 10
+	CacheBucketSize    = 5000
+	NonceLen           = 12
+	MaxPeersCount      = 20
+	PeersPerSubnet     = 2
+	PeersPerASN        = 4
+	PeersPerPrefix     = 2
+	PeerPrefixBits     = 8
+	ProtectByRTT       = 4
+	ProtectByAge       = 4
+	ProtectByGroup     = 4
+	CompressMinLen     = 256
+	MuxWindowSize      = 64 * 1024
+	OutboxSize         = 256
+	OutboxTimeout      = time.Second
+	OutboxChatFull     = "drop-priority"
+	OutboxSignalFull   = "drop-priority"
+	OutboxControlFull  = "block"
+	PingInterval       = 15 * time.Second
+	IdleTimeout        = time.Minute
+	MaxMissedPongs     = 3
+	PeerRate           = 50
+	PeerBurst          = 100
+	TypeRate           = 20
+	TypeBurst          = 40
+	BanScore           = 100
+	BanDuration        = time.Hour
+	PenaltyChecksum    = 20
+	PenaltySign        = 50
+	PenaltyMalformed   = 20
+	PenaltyDuplicate   = 5
+	PenaltyRate        = 2
+	PenaltyWork        = 10
+	PowNeedConnect     = 12
+	PowOffer           = 12
+	PowMaxExtra        = 8
+	PowLoadHigh        = 200
+	PowLoadLow         = 50
+	PowWindow          = time.Second
+	GatherTimeout      = 5 * time.Second
+	OfferTimeout       = 30 * time.Second
+	PendingOffers      = 4
+	NeedConnectEvery   = time.Minute
+	TURNCredentialsTTL = 24 * time.Hour
+	RelayAnnounceTTL   = 2 * time.Hour
+	RelayAnnounceEvery = 30 * time.Minute
+	RelayMaxClients    = 64
+	RelayClientRate    = 256 * 1024
+	RelayClientBurst   = 1024 * 1024
+	RelayClientIdle    = 5 * time.Minute
+	RelayDirectorySize = 16
+	FallbackTimeout    = 10 * time.Second
+	FallbackRate       = 32 * 1024
+	FallbackBurst      = 64 * 1024
+	RelayFanout        = 2
+	RelaySessionRate   = 32 * 1024
+	RelaySessionBurst  = 64 * 1024
+	RelayTotalRate     = 256 * 1024
+	RelayTotalBurst    = 512 * 1024
+	RelayMaxSessions   = 128
+	RelaySessionIdle   = 5 * time.Minute
+	FileChunkSize      = 16 * 1024
+	FileBufferHigh     = 1024 * 1024
+	FileBufferLow      = 256 * 1024
+	FileAcceptTimeout  = 5 * time.Minute
+	FileResumeTimeout  = 24 * time.Hour
+	MailMaxLen         = 2048
+	MailTTL            = 7 * 24 * time.Hour
+	MailMaxTTL         = 14 * 24 * time.Hour
+	MailPerRecipient   = 100
+	MailBytesPerBox    = 256 * 1024
+	MailTotal          = 10000
+	MailReplicas       = 3
+	MailFetchAge       = 5 * time.Minute
+	MailFetchEvery     = time.Minute
+	HistoryMaxAge      = 365 * 24 * time.Hour
+	HistoryMaxCount    = 10000
+	HistoryShown       = 50
+	ChatRetryAfter     = 2 * time.Second
+	ChatMaxRetry       = time.Minute
+	ChatWindow         = 256
+	ChatRetransmit     = time.Second
+	DeviceListMax      = 16
+	DeviceSyncBytes    = 3 * 1024
+	DeviceSyncEvery    = 5 * time.Minute
+	InviteTTL          = 24 * time.Hour
+	PresenceEvery      = 30 * time.Second
+	PresenceTimeout    = 90 * time.Second
+	PresenceAwayAfter  = 5 * time.Minute
+	PresenceSkew       = time.Minute
+	PresenceRate       = 1
+	PresenceBurst      = 5
+	TypingTimeout      = 6 * time.Second
 )
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-chat/chat"
+	"go-chat/contacts"
+	"go-chat/group"
+	"io"
+	"log"
+	"sort"
+	"strings"
+)
+
+var (
+	errUsage        = errors.New("usage")
+	errUnknownGroup = errors.New("unknown group")
+)
+
+// command runs a console command with the rest of its line.
+type command func(args string) error
+
+// console runs the commands typed on r, e.g. "/msg alice hello". Every line
+// typed counts as activity of the user.
+func console(r io.Reader, commands map[string]command, activity func()) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		activity()
+		name, args, _ := strings.Cut(line, " ")
+		cmd, ok := commands[name]
+		if !ok {
+			log.Println("console: unknown command", name)
+			continue
+		}
+		if err := cmd(strings.TrimSpace(args)); err != nil {
+			log.Printf("console: %s: %v", name, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		log.Println("console: bufio.Scanner:", err)
+	}
+}
+
+// text splits "<name> <text>" arguments.
+func text(args string) (string, string, error) {
+	name, msg, ok := strings.Cut(args, " ")
+	if !ok || strings.TrimSpace(msg) == "" {
+		return "", "", errUsage
+	}
+	return name, strings.TrimSpace(msg), nil
+}
+
+// changeGroup applies change to the group and the contact named by
+// "<group id> <petname>" arguments.
+func changeGroup(
+	groups *group.Set,
+	book *contacts.Book,
+	args string,
+	change func(*group.Group, group.Member) error,
+) error {
+	id, name, err := text(args)
+	if err != nil {
+		return err
+	}
+	g, err := groupOf(groups, id)
+	if err != nil {
+		return err
+	}
+	c, ok := book.ByName(name)
+	if !ok {
+		return contacts.ErrUnknownContact
+	}
+	return change(g, group.Member{Sign: c.Sign, DH: c.Identity})
+}
+
+// onMessage splits "<to> <message id> <text>" arguments of the commands
+// that act on a message. The text is optional.
+func onMessage(args string) (to, id, rest string, err error) {
+	to, rest, _ = strings.Cut(args, " ")
+	id, rest, _ = strings.Cut(strings.TrimSpace(rest), " ")
+	if to == "" || id == "" {
+		return "", "", "", errUsage
+	}
+	return to, id, strings.TrimSpace(rest), nil
+}
+
+// conversation is a contact by petname, or else a group by hex id.
+func conversation(book *contacts.Book, groups *group.Set, to string) (contacts.Contact, *group.Group, error) {
+	if c, ok := book.ByName(to); ok {
+		return c, nil, nil
+	}
+	g, err := groupOf(groups, to)
+	if err != nil {
+		return contacts.Contact{}, nil, contacts.ErrUnknownContact
+	}
+	return contacts.Contact{}, g, nil
+}
+
+// show writes the messages of a conversation as chat.Fold merged them,
+// with the id the other commands take.
+func show(w io.Writer, msgs []chat.Message, who func(from string) string) {
+	for _, m := range msgs {
+		line := fmt.Sprintf("[%s] %s %s: ", m.ID, m.Time.Local().Format("Jan 2 15:04"), who(m.From))
+		if m.ReplyTo != "" {
+			line += "(re " + m.ReplyTo + ") "
+		}
+		switch {
+		case m.Deleted:
+			line += "(deleted)"
+		case !m.Edited.IsZero():
+			line += m.Text + " (edited)"
+		default:
+			line += m.Text
+		}
+		emojis := make([]string, 0, len(m.Reactions))
+		for emoji := range m.Reactions {
+			emojis = append(emojis, emoji)
+		}
+		sort.Strings(emojis)
+		for _, emoji := range emojis {
+			line += fmt.Sprintf(" %s%d", emoji, len(m.Reactions[emoji]))
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+func groupOf(groups *group.Set, id string) (*group.Group, error) {
+	b, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, errUsage
+	}
+	g := groups.Get(b)
+	if g == nil {
+		return nil, errUnknownGroup
+	}
+	return g, nil
+}
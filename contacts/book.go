@@ -0,0 +1,244 @@
+package contacts
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"go-chat/e2e"
+	"go-chat/storage"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNameTaken      = errors.New("petname already taken")
+	ErrUnknownContact = errors.New("unknown contact")
+	ErrSafetyMismatch = errors.New("safety number mismatch")
+)
+
+type Contact struct {
+	Name     string    `json:"name"`
+	Identity []byte    `json:"identity"`
+	Sign     []byte    `json:"sign"`
+	Addrs    []string  `json:"addrs,omitempty"`
+	Verified bool      `json:"verified"`
+	Added    time.Time `json:"added"`
+}
+
+// Key is the e2e contact name, the hex of the identity key.
+func (c Contact) Key() string {
+	return hex.EncodeToString(c.Identity)
+}
+
+// keys are what the safety number covers, both identity keys.
+func (c Contact) keys() []byte {
+	return append(append([]byte(nil), c.Identity...), c.Sign...)
+}
+
+func (c Contact) Fingerprint() string {
+	return Fingerprint(c.keys())
+}
+
+// String is how a contact shows up in the UI and the logs.
+func (c Contact) String() string {
+	if c.Verified {
+		return c.Name + " [verified]"
+	}
+	return c.Name + " [unverified]"
+}
+
+// Book keeps the contacts under their petnames. Petnames are local and
+// unique, the identity key is what a contact is.
+type Book struct {
+	mu       sync.Mutex
+	store    storage.Store
+	contacts map[string]Contact
+}
+
+func NewBook(store storage.Store) (*Book, error) {
+	b := &Book{store: store, contacts: map[string]Contact{}}
+	keys, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		data, err := store.Load(key)
+		if err != nil {
+			return nil, err
+		}
+		var c Contact
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, err
+		}
+		b.contacts[key] = c
+	}
+	return b, nil
+}
+
+// Add stores a new contact or updates the addresses of a known one. The
+// verified flag is never set this way.
+func (b *Book) Add(c Contact) (Contact, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if old, ok := b.contacts[c.Key()]; ok {
+		old.Addrs = c.Addrs
+		return old, b.save(old)
+	}
+	if b.taken(c.Name, c.Key()) {
+		return Contact{}, ErrNameTaken
+	}
+	c.Verified = false
+	if c.Added.IsZero() {
+		c.Added = time.Now()
+	}
+	return c, b.save(c)
+}
+
+func (b *Book) Get(key string) (Contact, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.contacts[key]
+	return c, ok
+}
+
+func (b *Book) ByName(name string) (Contact, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, c := range b.contacts {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Contact{}, false
+}
+
+// BySign finds the contact by its sign key, as given in a handshake.
+func (b *Book) BySign(sign []byte) (Contact, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, c := range b.contacts {
+		if bytes.Equal(c.Sign, sign) {
+			return c, true
+		}
+	}
+	return Contact{}, false
+}
+
+// List returns the contacts sorted by petname.
+func (b *Book) List() []Contact {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := make([]Contact, 0, len(b.contacts))
+	for _, c := range b.contacts {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (b *Book) Rename(key, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.contacts[key]
+	if !ok {
+		return ErrUnknownContact
+	}
+	if b.taken(name, key) {
+		return ErrNameTaken
+	}
+	c.Name = name
+	return b.save(c)
+}
+
+func (b *Book) Remove(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.store.Delete(key); err != nil {
+		return err
+	}
+	delete(b.contacts, key)
+	return nil
+}
+
+// SafetyNumber is the number to compare with the contact out of band.
+func (b *Book) SafetyNumber(key string, own e2e.Identity) (string, error) {
+	c, ok := b.Get(key)
+	if !ok {
+		return "", ErrUnknownContact
+	}
+	return SafetyNumber(IdentityKeys(own), c.keys()), nil
+}
+
+// Verify marks the contact verified when the safety number read out of
+// band matches the one computed from both identities.
+func (b *Book) Verify(key string, own e2e.Identity, number string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.contacts[key]
+	if !ok {
+		return ErrUnknownContact
+	}
+	if !sameNumber(SafetyNumber(IdentityKeys(own), c.keys()), number) {
+		return ErrSafetyMismatch
+	}
+	c.Verified = true
+	return b.save(c)
+}
+
+func (b *Book) Unverify(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.contacts[key]
+	if !ok {
+		return ErrUnknownContact
+	}
+	c.Verified = false
+	return b.save(c)
+}
+
+// Display names the contact by its petname, unknown keys by their start.
+func (b *Book) Display(key string) string {
+	if c, ok := b.Get(key); ok {
+		return c.String()
+	}
+	return key[:min(len(key), 12)] + " [unknown]"
+}
+
+func (b *Book) taken(name, key string) bool {
+	for k, c := range b.contacts {
+		if c.Name == name && k != key {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Book) save(c Contact) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := b.store.Save(c.Key(), data); err != nil {
+		return err
+	}
+	b.contacts[c.Key()] = c
+	return nil
+}
+
+// IdentityKeys are the own keys as a contact sees them, what fingerprints
+// and safety numbers are computed from.
+func IdentityKeys(id e2e.Identity) []byte {
+	return append(id.DH.PublicKey().Bytes(), id.Sign.Public().(ed25519.PublicKey)...)
+}
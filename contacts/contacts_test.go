@@ -0,0 +1,185 @@
+package contacts
+
+import (
+	"go-chat/e2e"
+	"go-chat/storage"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bucket(t *testing.T) storage.Bucket {
+	db, err := storage.Open(filepath.Join(t.TempDir(), "test.db"), "")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db.Bucket("test")
+}
+
+func identity(t *testing.T) e2e.Identity {
+	id, err := e2e.NewIdentity()
+	require.NoError(t, err)
+	return id
+}
+
+func Test_Invitation(t *testing.T) {
+	id := identity(t)
+	inv := NewInvitation(id, "alice", []string{"203.0.113.7:4000", "[2001:db8::1]:4000"})
+
+	t.Run("round trip", func(t *testing.T) {
+		s := inv.String()
+		assert.True(t, strings.HasPrefix(s, "GOCHAT:"))
+		// Only characters of the QR alphanumeric mode.
+		assert.Equal(t, -1, strings.IndexFunc(s, func(r rune) bool {
+			return !strings.ContainsRune("0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:", r)
+		}))
+
+		parsed, err := ParseInvitation(s)
+		require.NoError(t, err)
+		assert.Equal(t, inv, parsed)
+
+		parsed, err = ParseInvitation(" " + strings.ToLower(s) + "\n")
+		require.NoError(t, err)
+		assert.Equal(t, inv, parsed)
+	})
+
+	t.Run("typos are caught", func(t *testing.T) {
+		s := []byte(inv.String())
+		if s[20] == 'A' {
+			s[20] = 'B'
+		} else {
+			s[20] = 'A'
+		}
+		_, err := ParseInvitation(string(s))
+		assert.ErrorIs(t, err, ErrInvalidInvitation)
+
+		_, err = ParseInvitation(inv.String()[:40])
+		assert.ErrorIs(t, err, ErrInvalidInvitation)
+		_, err = ParseInvitation(strings.TrimPrefix(inv.String(), "GOCHAT:"))
+		assert.ErrorIs(t, err, ErrInvalidInvitation)
+	})
+}
+
+func Test_Book(t *testing.T) {
+	own, alice := identity(t), identity(t)
+	inv := NewInvitation(alice, "alice", []string{"203.0.113.7:4000"})
+
+	t.Run("petnames", func(t *testing.T) {
+		book, err := NewBook(bucket(t))
+		require.NoError(t, err)
+
+		c, err := book.Add(inv.Contact(""))
+		require.NoError(t, err)
+		assert.Equal(t, "alice", c.Name)
+		assert.False(t, c.Verified)
+
+		_, err = book.Add(NewInvitation(identity(t), "alice", nil).Contact(""))
+		assert.ErrorIs(t, err, ErrNameTaken)
+
+		require.NoError(t, book.Rename(c.Key(), "Al"))
+		got, ok := book.ByName("Al")
+		require.True(t, ok)
+		assert.Equal(t, c.Key(), got.Key())
+		assert.Equal(t, "Al [unverified]", book.Display(c.Key()))
+		assert.Contains(t, book.Display("00112233445566778899"), "[unknown]")
+
+		require.NoError(t, book.Remove(c.Key()))
+		assert.Empty(t, book.List())
+	})
+
+	t.Run("verification", func(t *testing.T) {
+		store := bucket(t)
+		book, err := NewBook(store)
+		require.NoError(t, err)
+		c, err := book.Add(inv.Contact("al"))
+		require.NoError(t, err)
+
+		// Both sides compute the same number.
+		number, err := book.SafetyNumber(c.Key(), own)
+		require.NoError(t, err)
+		theirs := SafetyNumber(IdentityKeys(alice), IdentityKeys(own))
+		assert.Equal(t, theirs, number)
+		assert.Len(t, strings.Fields(number), 12)
+
+		other := SafetyNumber(IdentityKeys(identity(t)), IdentityKeys(alice))
+		assert.ErrorIs(t, book.Verify(c.Key(), own, other), ErrSafetyMismatch)
+		require.NoError(t, book.Verify(c.Key(), own, strings.ReplaceAll(number, " ", "")))
+		assert.Equal(t, "al [verified]", book.Display(c.Key()))
+
+		// Adding the invitation again keeps the flag, and it survives a restart.
+		_, err = book.Add(inv.Contact(""))
+		require.NoError(t, err)
+		book, err = NewBook(store)
+		require.NoError(t, err)
+		got, ok := book.Get(c.Key())
+		require.True(t, ok)
+		assert.True(t, got.Verified)
+
+		require.NoError(t, book.Unverify(c.Key()))
+		got, _ = book.Get(c.Key())
+		assert.False(t, got.Verified)
+	})
+
+	t.Run("fingerprints", func(t *testing.T) {
+		keys := IdentityKeys(alice)
+		assert.Len(t, strings.Fields(Fingerprint(keys)), 8)
+		assert.Len(t, Words(keys), 6)
+		assert.Equal(t, Words(keys), Words(IdentityKeys(alice)))
+		assert.NotEqual(t, Fingerprint(keys), Fingerprint(IdentityKeys(own)))
+	})
+}
+
+func Test_Token(t *testing.T) {
+	inviter, redeemer := identity(t), identity(t)
+	invites := NewInvites(bucket(t))
+	card := NewInvitation(redeemer, "bob", []string{"198.51.100.2:4000"})
+
+	t.Run("redeemed once", func(t *testing.T) {
+		tok, err := invites.Issue(inviter, "alice", []string{"203.0.113.7:4000"}, time.Hour)
+		require.NoError(t, err)
+		parsed, err := ParseToken(tok.String())
+		require.NoError(t, err)
+		assert.Equal(t, tok, parsed)
+		assert.False(t, parsed.Expired(time.Now()))
+		assert.True(t, parsed.Expired(time.Now().Add(2*time.Hour)))
+
+		sealed, err := parsed.Redeem(redeemer, card)
+		require.NoError(t, err)
+		_, err = invites.Accept(redeemer, sealed)
+		assert.ErrorIs(t, err, ErrInvalidRedemption)
+
+		got, err := invites.Accept(inviter, sealed)
+		require.NoError(t, err)
+		assert.Equal(t, card, got)
+
+		_, err = invites.Accept(inviter, sealed)
+		assert.ErrorIs(t, err, ErrTokenUsed)
+	})
+
+	t.Run("tampering", func(t *testing.T) {
+		tok, err := invites.Issue(inviter, "alice", []string{"203.0.113.7:4000"}, 0)
+		require.NoError(t, err)
+		assert.False(t, tok.Expired(time.Now().Add(1000*time.Hour)))
+
+		tok.Addrs = []string{"192.0.2.66:4000"}
+		_, err = ParseToken(tok.String())
+		assert.ErrorIs(t, err, ErrInvalidToken)
+		_, err = ParseToken(NewInvitation(inviter, "alice", nil).String())
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		tok, err := invites.Issue(inviter, "alice", nil, time.Minute)
+		require.NoError(t, err)
+		sealed, err := tok.Redeem(redeemer, card)
+		require.NoError(t, err)
+
+		invites.now = func() time.Time { return time.Now().Add(time.Hour) }
+		defer func() { invites.now = time.Now }()
+		_, err = invites.Accept(inviter, sealed)
+		assert.ErrorIs(t, err, ErrTokenExpired)
+	})
+}
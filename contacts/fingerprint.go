@@ -0,0 +1,74 @@
+package contacts
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// safetyRounds makes finding a key with a chosen safety number costly.
+	safetyRounds = 5200
+	// safetyGroups of five digits per side.
+	safetyGroups = 6
+)
+
+// Fingerprint shows the hash of a key as groups of hex digits.
+func Fingerprint(key []byte) string {
+	sum := sha512.Sum512(key)
+	h := hex.EncodeToString(sum[:16])
+	groups := make([]string, 0, len(h)/4)
+	for i := 0; i < len(h); i += 4 {
+		groups = append(groups, h[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// Words shows the start of the fingerprint as words, easier to compare
+// over a call.
+func Words(key []byte) []string {
+	sum := sha512.Sum512(key)
+	out := make([]string, 6)
+	for i := range out {
+		out[i] = words[sum[i]]
+	}
+	return out
+}
+
+// SafetyNumber is the same on both sides of a conversation. Reading it
+// out of band proves that neither key was swapped on the way.
+func SafetyNumber(own, their []byte) string {
+	a, b := safetyHalf(own), safetyHalf(their)
+	if a > b {
+		a, b = b, a
+	}
+	return a + " " + b
+}
+
+func safetyHalf(key []byte) string {
+	h := append([]byte("go-chat safety"), key...)
+	for range safetyRounds {
+		sum := sha512.Sum512(append(h, key...))
+		h = sum[:]
+	}
+	groups := make([]string, safetyGroups)
+	for i := range groups {
+		chunk := h[i*5 : i*5+5]
+		var n uint64
+		for _, c := range chunk {
+			n = n<<8 | uint64(c)
+		}
+		groups[i] = fmt.Sprintf("%05d", n%100000)
+	}
+	return strings.Join(groups, " ")
+}
+
+// sameNumber compares safety numbers ignoring spacing.
+func sameNumber(a, b string) bool {
+	strip := func(s string) []byte {
+		return []byte(strings.Join(strings.Fields(s), ""))
+	}
+	return bytes.Equal(strip(a), strip(b))
+}
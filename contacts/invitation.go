@@ -0,0 +1,135 @@
+package contacts
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"go-chat/e2e"
+	"strings"
+)
+
+var ErrInvalidInvitation = errors.New("invalid invitation")
+
+const (
+	invitationPrefix  = "GOCHAT:"
+	invitationVersion = 1
+	keyLen            = 32
+	checksumLen       = 4
+)
+
+// Base32 without padding uses only characters of the QR alphanumeric mode.
+var invitationEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Invitation is a contact card: the identity keys, a suggested name and
+// the addresses the node is reachable at.
+type Invitation struct {
+	Name     string
+	Identity []byte
+	Sign     []byte
+	Addrs    []string
+}
+
+func NewInvitation(id e2e.Identity, name string, addrs []string) Invitation {
+	return Invitation{
+		Name:     name,
+		Identity: id.DH.PublicKey().Bytes(),
+		Sign:     id.Sign.Public().(ed25519.PublicKey),
+		Addrs:    addrs,
+	}
+}
+
+func (inv Invitation) String() string {
+	b := inv.append([]byte{invitationVersion})
+	sum := sha256.Sum256(b)
+	b = append(b, sum[:checksumLen]...)
+	return invitationPrefix + invitationEncoding.EncodeToString(b)
+}
+
+func ParseInvitation(s string) (Invitation, error) {
+	b, err := decode(s, invitationPrefix)
+	if err != nil || len(b) < 1+checksumLen {
+		return Invitation{}, ErrInvalidInvitation
+	}
+	body, check := b[:len(b)-checksumLen], b[len(b)-checksumLen:]
+	if sum := sha256.Sum256(body); !bytes.Equal(sum[:checksumLen], check) || body[0] != invitationVersion {
+		return Invitation{}, ErrInvalidInvitation
+	}
+	inv, rest, err := readInvitation(body[1:])
+	if err != nil || len(rest) != 0 {
+		return Invitation{}, ErrInvalidInvitation
+	}
+	return inv, nil
+}
+
+// Contact makes an unverified contact of the invitation, named by the
+// petname when one is given.
+func (inv Invitation) Contact(petname string) Contact {
+	if petname == "" {
+		petname = inv.Name
+	}
+	c := Contact{Name: petname, Identity: inv.Identity, Sign: inv.Sign, Addrs: inv.Addrs}
+	if c.Name == "" {
+		c.Name = c.Key()[:12]
+	}
+	return c
+}
+
+func (inv Invitation) append(b []byte) []byte {
+	b = append(b, inv.Identity...)
+	b = append(b, inv.Sign...)
+	b = appendString(b, inv.Name)
+	b = append(b, byte(len(inv.Addrs)))
+	for _, a := range inv.Addrs {
+		b = appendString(b, a)
+	}
+	return b
+}
+
+func readInvitation(b []byte) (Invitation, []byte, error) {
+	if len(b) < 2*keyLen {
+		return Invitation{}, nil, ErrInvalidInvitation
+	}
+	inv := Invitation{Identity: b[:keyLen], Sign: b[keyLen : 2*keyLen]}
+	rest := b[2*keyLen:]
+	var err error
+	if inv.Name, rest, err = readString(rest); err != nil {
+		return Invitation{}, nil, err
+	}
+	if len(rest) < 1 {
+		return Invitation{}, nil, ErrInvalidInvitation
+	}
+	n := int(rest[0])
+	rest = rest[1:]
+	for range n {
+		var a string
+		if a, rest, err = readString(rest); err != nil {
+			return Invitation{}, nil, err
+		}
+		inv.Addrs = append(inv.Addrs, a)
+	}
+	return inv, rest, nil
+}
+
+func decode(s, prefix string) ([]byte, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if !strings.HasPrefix(s, prefix) {
+		return nil, ErrInvalidInvitation
+	}
+	return invitationEncoding.DecodeString(strings.TrimPrefix(s, prefix))
+}
+
+func appendString(b []byte, s string) []byte {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	return append(append(b, byte(len(s))), s...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return "", nil, ErrInvalidInvitation
+	}
+	return string(b[1 : 1+b[0]]), b[1+b[0]:], nil
+}
@@ -0,0 +1,189 @@
+package contacts
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"go-chat/e2e"
+	"go-chat/netcrypt"
+	"go-chat/storage"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidToken      = errors.New("invalid invite token")
+	ErrTokenExpired      = errors.New("invite token expired")
+	ErrTokenUsed         = errors.New("invite token unknown or used")
+	ErrInvalidRedemption = errors.New("invalid invite redemption")
+)
+
+const (
+	tokenPrefix  = "GOCHAT-INVITE:"
+	tokenVersion = 1
+	secretLen    = 16
+)
+
+// Token is an invitation signed by the inviter, with an optional expiry
+// and a secret that lets the first redeemer become a contact of the
+// inviter without further confirmation.
+type Token struct {
+	Invitation
+	Expires time.Time
+	Secret  []byte
+	Sig     []byte
+}
+
+func (t Token) signed() []byte {
+	b := t.Invitation.append([]byte{tokenVersion})
+	var exp uint64
+	if !t.Expires.IsZero() {
+		exp = uint64(t.Expires.Unix())
+	}
+	b = binary.BigEndian.AppendUint64(b, exp)
+	return append(b, t.Secret...)
+}
+
+func (t Token) String() string {
+	return tokenPrefix + invitationEncoding.EncodeToString(append(t.signed(), t.Sig...))
+}
+
+// ParseToken checks the signature, not the expiry: see Expired.
+func ParseToken(s string) (Token, error) {
+	b, err := decode(s, tokenPrefix)
+	if err != nil || len(b) < 1+ed25519.SignatureSize || b[0] != tokenVersion {
+		return Token{}, ErrInvalidToken
+	}
+	inv, rest, err := readInvitation(b[1:])
+	if err != nil || len(rest) != 8+secretLen+ed25519.SignatureSize {
+		return Token{}, ErrInvalidToken
+	}
+	t := Token{Invitation: inv, Secret: rest[8 : 8+secretLen], Sig: rest[8+secretLen:]}
+	if exp := binary.BigEndian.Uint64(rest[:8]); exp != 0 {
+		t.Expires = time.Unix(int64(exp), 0)
+	}
+	if !ed25519.Verify(t.Sign, t.signed(), t.Sig) {
+		return Token{}, ErrInvalidToken
+	}
+	return t, nil
+}
+
+func (t Token) Expired(now time.Time) bool {
+	return !t.Expires.IsZero() && now.After(t.Expires)
+}
+
+// Redeem seals the own card and the secret to the inviter's identity key,
+// only the inviter can read the secret even if the connection is not the
+// one it appears to be.
+func (t Token) Redeem(id e2e.Identity, card Invitation) ([]byte, error) {
+	to, err := ecdh.X25519().NewPublicKey(t.Identity)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	body := card.append(append([]byte(nil), t.Secret...))
+	body = append(body, ed25519.Sign(id.Sign, body)...)
+	ct, err := netcrypt.Encrypt(body, eph, to)
+	if err != nil {
+		return nil, err
+	}
+	return append(eph.PublicKey().Bytes(), ct...), nil
+}
+
+// Invites keeps the secrets of issued tokens until they are redeemed or
+// expire. Each secret is accepted once.
+type Invites struct {
+	mu    sync.Mutex
+	store storage.Store
+	now   func() time.Time
+}
+
+func NewInvites(store storage.Store) *Invites {
+	return &Invites{store: store, now: time.Now}
+}
+
+// Issue signs a token for the addresses, valid for ttl or forever when
+// ttl is zero.
+func (iv *Invites) Issue(id e2e.Identity, name string, addrs []string, ttl time.Duration) (Token, error) {
+	iv.mu.Lock()
+	defer iv.mu.Unlock()
+
+	if err := iv.expire(); err != nil {
+		return Token{}, err
+	}
+	t := Token{Invitation: NewInvitation(id, name, addrs), Secret: make([]byte, secretLen)}
+	rand.Read(t.Secret)
+	if ttl > 0 {
+		t.Expires = iv.now().Add(ttl).Truncate(time.Second)
+	}
+	t.Sig = ed25519.Sign(id.Sign, t.signed())
+
+	var exp int64
+	if !t.Expires.IsZero() {
+		exp = t.Expires.Unix()
+	}
+	return t, iv.store.Save(hex.EncodeToString(t.Secret), binary.BigEndian.AppendUint64(nil, uint64(exp)))
+}
+
+// Accept opens a redemption sealed to the identity and consumes its
+// secret. It returns the card of the redeemer.
+func (iv *Invites) Accept(id e2e.Identity, sealed []byte) (Invitation, error) {
+	if len(sealed) < keyLen {
+		return Invitation{}, ErrInvalidRedemption
+	}
+	eph, err := ecdh.X25519().NewPublicKey(sealed[:keyLen])
+	if err != nil {
+		return Invitation{}, ErrInvalidRedemption
+	}
+	body, err := netcrypt.Decrypt(sealed[keyLen:], id.DH, eph)
+	if err != nil || len(body) < secretLen+ed25519.SignatureSize {
+		return Invitation{}, ErrInvalidRedemption
+	}
+	body, sig := body[:len(body)-ed25519.SignatureSize], body[len(body)-ed25519.SignatureSize:]
+	card, rest, err := readInvitation(body[secretLen:])
+	if err != nil || len(rest) != 0 || !ed25519.Verify(card.Sign, body, sig) {
+		return Invitation{}, ErrInvalidRedemption
+	}
+
+	iv.mu.Lock()
+	defer iv.mu.Unlock()
+
+	key := hex.EncodeToString(body[:secretLen])
+	b, err := iv.store.Load(key)
+	if err != nil || len(b) != 8 {
+		return Invitation{}, ErrTokenUsed
+	}
+	if err := iv.store.Delete(key); err != nil {
+		return Invitation{}, err
+	}
+	if exp := int64(binary.BigEndian.Uint64(b)); exp != 0 && iv.now().Unix() > exp {
+		return Invitation{}, ErrTokenExpired
+	}
+	return card, nil
+}
+
+func (iv *Invites) expire() error {
+	keys, err := iv.store.List()
+	if err != nil {
+		return err
+	}
+	now := iv.now().Unix()
+	for _, k := range keys {
+		b, err := iv.store.Load(k)
+		if err != nil || len(b) != 8 {
+			continue
+		}
+		if exp := int64(binary.BigEndian.Uint64(b)); exp != 0 && now > exp {
+			if err := iv.store.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package contacts
+
+// words maps every byte to a word, for fingerprints read out loud.
+var words = [256]string{
+	"acid", "acorn", "actor", "adult", "agent", "alarm", "album", "alley",
+	"amber", "angel", "ankle", "anvil", "apple", "apron", "arena", "armor",
+	"arrow", "aspen", "atlas", "attic", "autumn", "axis", "bacon", "badge",
+	"bagel", "baker", "bamboo", "banjo", "barn", "basil", "basket", "beach",
+	"beacon", "beard", "beaver", "bell", "berry", "bison", "blade", "blanket",
+	"blossom", "board", "boat", "bonnet", "bottle", "boulder", "bracket", "branch",
+	"bread", "brick", "bridge", "broom", "bubble", "bucket", "buffalo", "bugle",
+	"button", "cabin", "cable", "cactus", "camel", "camera", "canal", "candle",
+	"canoe", "canyon", "carpet", "carrot", "castle", "cedar", "cellar", "chalk",
+	"cherry", "chess", "chimney", "circle", "clock", "cloud", "clover", "coast",
+	"cobra", "coconut", "comet", "compass", "copper", "coral", "cotton", "cougar",
+	"crane", "crater", "crayon", "cricket", "crown", "crystal", "cube", "daisy",
+	"dancer", "delta", "desert", "diamond", "dinner", "dolphin", "donkey", "dragon",
+	"drum", "duck", "dune", "eagle", "easel", "echo", "eclipse", "elbow",
+	"ember", "engine", "falcon", "feather", "fence", "ferry", "fiddle", "field",
+	"flame", "flute", "forest", "fossil", "fountain", "fox", "frost", "galaxy",
+	"garden", "garlic", "gecko", "ginger", "giraffe", "glacier", "globe", "goat",
+	"gold", "gorilla", "grape", "gravel", "guitar", "hammer", "harbor", "harp",
+	"hawk", "hazel", "helmet", "heron", "hill", "honey", "hornet", "horse",
+	"igloo", "island", "ivory", "jacket", "jaguar", "jasmine", "jelly", "jungle",
+	"kayak", "kettle", "kiwi", "koala", "ladder", "lagoon", "lake", "lantern",
+	"lemon", "leopard", "lettuce", "lily", "lime", "lizard", "lobster", "locket",
+	"lotus", "magnet", "mango", "maple", "marble", "meadow", "melon", "meteor",
+	"mirror", "mitten", "monkey", "moose", "mosaic", "mountain", "muffin", "mushroom",
+	"napkin", "nectar", "needle", "nest", "nickel", "noodle", "oasis", "ocean",
+	"octopus", "olive", "onion", "orange", "orchid", "otter", "owl", "paddle",
+	"palace", "panda", "paper", "parrot", "peach", "peanut", "pebble", "pelican",
+	"pepper", "piano", "pillow", "pine", "planet", "plum", "pocket", "pony",
+	"potato", "pumpkin", "puzzle", "quartz", "quilt", "rabbit", "raccoon", "radio",
+	"rain", "raven", "reef", "ribbon", "river", "robin", "rocket", "rose",
+	"ruby", "saddle", "salmon", "sandal", "satin", "saturn", "scarf", "shadow",
+	"shell", "silver", "sketch", "sled", "snail", "socket", "spider", "spoon",
+}
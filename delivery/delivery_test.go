@@ -0,0 +1,164 @@
+package delivery
+
+import (
+	"go-chat/storage"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bucket(t *testing.T) storage.Bucket {
+	db, err := storage.Open(filepath.Join(t.TempDir(), "test.db"), "")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db.Bucket("test")
+}
+
+func tracker(t *testing.T, store storage.Store) *Tracker {
+	tr, err := NewTracker(store, Limits{RetryAfter: time.Second, MaxRetry: 4 * time.Second, Window: 4})
+	require.NoError(t, err)
+	return tr
+}
+
+func bodies(ms []Message) []string {
+	var out []string
+	for _, m := range ms {
+		out = append(out, string(m.Body))
+	}
+	return out
+}
+
+func kinds(fs []Frame) []Kind {
+	var out []Kind
+	for _, f := range fs {
+		out = append(out, f.Kind)
+	}
+	return out
+}
+
+func Test_Tracker(t *testing.T) {
+	t.Run("in order and exactly once", func(t *testing.T) {
+		alice, bob := tracker(t, bucket(t)), tracker(t, bucket(t))
+		var frames []Frame
+		for _, text := range []string{"1", "2", "3"} {
+			_, f, err := alice.Send("bob", []byte(text))
+			require.NoError(t, err)
+			frames = append(frames, f)
+		}
+
+		r, err := bob.Receive("alice", frames[2])
+		require.NoError(t, err)
+		assert.Empty(t, r.Messages)
+		assert.Equal(t, []Kind{KindSync, KindAck}, kinds(r.Replies))
+		assert.Equal(t, uint64(1), r.Replies[0].Seq)
+
+		r, _ = bob.Receive("alice", frames[0])
+		assert.Equal(t, []string{"1"}, bodies(r.Messages))
+		r, _ = bob.Receive("alice", frames[1])
+		assert.Equal(t, []string{"2", "3"}, bodies(r.Messages))
+		ack := r.Replies[len(r.Replies)-1]
+		assert.Equal(t, Frame{Kind: KindAck, Seq: 3}, ack)
+
+		r, _ = bob.Receive("alice", frames[1])
+		assert.Empty(t, r.Messages)
+		assert.Equal(t, []Frame{ack}, r.Replies)
+
+		r, _ = alice.Receive("bob", ack)
+		assert.Equal(t, uint64(3), r.Delivered)
+		retry, err := alice.Retransmit()
+		require.NoError(t, err)
+		assert.Empty(t, retry)
+	})
+
+	t.Run("sync resends missing", func(t *testing.T) {
+		alice := tracker(t, bucket(t))
+		alice.Send("bob", []byte("1"))
+		alice.Send("bob", []byte("2"))
+		alice.Receive("bob", Frame{Kind: KindAck, Seq: 1})
+
+		r, err := alice.Receive("bob", Frame{Kind: KindSync, Seq: 1})
+		require.NoError(t, err)
+		require.Len(t, r.Replies, 1)
+		assert.Equal(t, []byte("2"), r.Replies[0].Body)
+	})
+
+	t.Run("coalesce syncs", func(t *testing.T) {
+		alice, bob := tracker(t, bucket(t)), tracker(t, bucket(t))
+		now := time.Now()
+		bob.now = func() time.Time { return now }
+		var frames []Frame
+		for _, text := range []string{"1", "2", "3", "4"} {
+			_, f, _ := alice.Send("bob", []byte(text))
+			frames = append(frames, f)
+		}
+
+		r, _ := bob.Receive("alice", frames[1])
+		assert.Equal(t, []Kind{KindSync, KindAck}, kinds(r.Replies))
+		r, _ = bob.Receive("alice", frames[2])
+		assert.Equal(t, []Kind{KindAck}, kinds(r.Replies))
+
+		now = now.Add(time.Second)
+		r, _ = bob.Receive("alice", frames[3])
+		assert.Equal(t, []Kind{KindSync, KindAck}, kinds(r.Replies))
+	})
+
+	t.Run("retransmit with backoff", func(t *testing.T) {
+		alice := tracker(t, bucket(t))
+		now := time.Now()
+		alice.now = func() time.Time { return now }
+		alice.Send("bob", []byte("hi"))
+
+		for _, step := range []struct {
+			after time.Duration
+			sent  int
+		}{{500 * time.Millisecond, 0}, {time.Second, 1}, {time.Second, 0}, {2 * time.Second, 1}, {4 * time.Second, 1}, {4 * time.Second, 1}} {
+			now = now.Add(step.after)
+			retry, err := alice.Retransmit()
+			require.NoError(t, err)
+			assert.Len(t, retry["bob"], step.sent)
+		}
+	})
+
+	t.Run("window", func(t *testing.T) {
+		alice := tracker(t, bucket(t))
+		for range 4 {
+			_, _, err := alice.Send("bob", nil)
+			require.NoError(t, err)
+		}
+		_, _, err := alice.Send("bob", nil)
+		assert.ErrorIs(t, err, ErrBacklog)
+
+		bob := tracker(t, bucket(t))
+		for seq := range uint64(6) {
+			bob.Receive("alice", Frame{Kind: KindMessage, ID: string(rune('a' + seq)), Seq: seq + 2})
+		}
+		assert.Len(t, bob.convs["alice"].Buffer, 4)
+		// The dropped message is taken once there is room.
+		r, _ := bob.Receive("alice", Frame{Kind: KindMessage, ID: "z", Seq: 1})
+		assert.Len(t, r.Messages, 5)
+		r, _ = bob.Receive("alice", Frame{Kind: KindMessage, ID: "e", Seq: 6})
+		assert.Len(t, r.Messages, 1)
+	})
+
+	t.Run("state survives restart", func(t *testing.T) {
+		store := bucket(t)
+		alice := tracker(t, store)
+		bob := tracker(t, bucket(t))
+		_, f, _ := alice.Send("bob", []byte("1"))
+		bob.Receive("alice", f)
+		read, ok, err := bob.MarkRead("alice", 5)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, Frame{Kind: KindRead, Seq: 1}, read)
+
+		alice = tracker(t, store)
+		r, _ := alice.Receive("bob", read)
+		assert.Equal(t, uint64(1), r.Read)
+		_, f, _ = alice.Send("bob", []byte("2"))
+		assert.Equal(t, uint64(2), f.Seq)
+		assert.Greater(t, f.Clock, uint64(1))
+	})
+}
@@ -0,0 +1,43 @@
+package delivery
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+var ErrInvalidFrame = errors.New("invalid chat frame")
+
+type Kind uint8
+
+const (
+	KindMessage Kind = iota
+	KindAck
+	KindRead
+	KindSync
+)
+
+// Frame is the plaintext of a direct message. Acks and reads are
+// cumulative: they cover every sequence number up to Seq. Sync asks for
+// everything from Seq on.
+type Frame struct {
+	Kind  Kind   `json:"k"`
+	ID    string `json:"id,omitempty"`
+	Seq   uint64 `json:"seq"`
+	Clock uint64 `json:"clock,omitempty"`
+	Body  []byte `json:"body,omitempty"`
+}
+
+func (f Frame) Marshal() ([]byte, error) {
+	return json.Marshal(f)
+}
+
+func ParseFrame(b []byte) (Frame, error) {
+	var f Frame
+	if err := json.Unmarshal(b, &f); err != nil {
+		return Frame{}, ErrInvalidFrame
+	}
+	if f.Kind > KindSync || (f.Kind == KindMessage && (f.ID == "" || f.Seq == 0)) {
+		return Frame{}, ErrInvalidFrame
+	}
+	return f, nil
+}
@@ -0,0 +1,281 @@
+package delivery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"go-chat/cache"
+	"go-chat/config"
+	"go-chat/storage"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrBacklog = errors.New("too many unacknowledged messages")
+
+type Limits struct {
+	// RetryAfter is the first retransmission delay, doubled on every attempt
+	// up to MaxRetry.
+	RetryAfter time.Duration
+	MaxRetry   time.Duration
+	// Window bounds the unacknowledged messages and the messages buffered
+	// behind a gap.
+	Window int
+}
+
+type Message struct {
+	Contact string
+	ID      string
+	Seq     uint64
+	Clock   uint64
+	Body    []byte
+}
+
+// Result is what a received frame caused: messages to hand to the user in
+// order, frames to send back and the progress of own messages.
+type Result struct {
+	Messages  []Message
+	Replies   []Frame
+	Delivered uint64
+	Read      uint64
+}
+
+type pending struct {
+	Frame    Frame     `json:"frame"`
+	Sent     time.Time `json:"sent"`
+	Attempts int       `json:"attempts"`
+}
+
+type conv struct {
+	Clock    uint64           `json:"clock"`
+	Next     uint64           `json:"next"`
+	Acked    uint64           `json:"acked"`
+	ReadUpTo uint64           `json:"read_up_to"`
+	Pending  []pending        `json:"pending,omitempty"`
+	Recv     uint64           `json:"recv"`
+	Buffer   map[uint64]Frame `json:"buffer,omitempty"`
+	Read     uint64           `json:"read"`
+	// The last sync asked for, a gap is asked for again only once the
+	// answer is overdue.
+	SyncSeq uint64    `json:"sync_seq,omitempty"`
+	SyncAt  time.Time `json:"sync_at,omitzero"`
+}
+
+// Tracker numbers outgoing messages per conversation, keeps them until
+// acknowledged and delivers incoming ones exactly once and in order.
+type Tracker struct {
+	mu     sync.Mutex
+	store  storage.Store
+	limits Limits
+	seen   *cache.Cache
+	convs  map[string]*conv
+	now    func() time.Time
+}
+
+func NewTracker(store storage.Store, limits Limits) (*Tracker, error) {
+	t := &Tracker{
+		store:  store,
+		limits: limits,
+		seen:   cache.New(config.CacheBucketsCount, config.CacheBucketSize),
+		convs:  map[string]*conv{},
+		now:    time.Now,
+	}
+	contacts, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, contact := range contacts {
+		b, err := store.Load(contact)
+		if err != nil {
+			return nil, err
+		}
+		c := &conv{}
+		if err := json.Unmarshal(b, c); err != nil {
+			return nil, err
+		}
+		t.convs[contact] = c
+	}
+	return t, nil
+}
+
+// Send numbers a new message. The frame is kept for retransmission until
+// the contact acknowledges it.
+func (t *Tracker) Send(contact string, body []byte) (Message, Frame, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.conv(contact)
+	if t.limits.Window > 0 && len(c.Pending) >= t.limits.Window {
+		return Message{}, Frame{}, ErrBacklog
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	c.Clock++
+	c.Next++
+	f := Frame{
+		Kind:  KindMessage,
+		ID:    hex.EncodeToString(id),
+		Seq:   c.Next,
+		Clock: c.Clock,
+		Body:  body,
+	}
+	c.Pending = append(c.Pending, pending{Frame: f, Sent: t.now(), Attempts: 1})
+	if err := t.save(contact, c); err != nil {
+		return Message{}, Frame{}, err
+	}
+	return message(contact, f), f, nil
+}
+
+func (t *Tracker) Receive(contact string, f Frame) (Result, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.conv(contact)
+	var r Result
+	switch f.Kind {
+	case KindMessage:
+		r = t.message(contact, c, f)
+	case KindAck:
+		if f.Seq > c.Acked && f.Seq <= c.Next {
+			c.Acked = f.Seq
+			c.Pending = after(c.Pending, f.Seq)
+			r.Delivered = f.Seq
+		}
+	case KindRead:
+		if f.Seq > c.ReadUpTo && f.Seq <= c.Next {
+			c.ReadUpTo = f.Seq
+			r.Read = f.Seq
+		}
+	case KindSync:
+		now := t.now()
+		for i := range c.Pending {
+			if c.Pending[i].Frame.Seq >= f.Seq {
+				c.Pending[i].Sent = now
+				r.Replies = append(r.Replies, c.Pending[i].Frame)
+			}
+		}
+	}
+	return r, t.save(contact, c)
+}
+
+func (t *Tracker) message(contact string, c *conv, f Frame) Result {
+	var r Result
+	c.Clock = max(c.Clock, f.Clock)
+	_, buffered := c.Buffer[f.Seq]
+	inOrder := f.Seq == c.Recv+1
+	fits := inOrder || t.limits.Window == 0 || len(c.Buffer) < t.limits.Window
+	// The id is only marked seen once the message is taken, a message
+	// dropped for lack of room comes again.
+	if f.Seq > c.Recv && !buffered && fits && t.seen.PutIfAbsent(contact+"/"+f.ID) {
+		if inOrder {
+			c.Recv++
+			r.Messages = append(r.Messages, message(contact, f))
+			for {
+				next, ok := c.Buffer[c.Recv+1]
+				if !ok {
+					break
+				}
+				delete(c.Buffer, c.Recv+1)
+				c.Recv++
+				r.Messages = append(r.Messages, message(contact, next))
+			}
+		} else {
+			// A gap: keep the message and ask for what's missing.
+			if c.Buffer == nil {
+				c.Buffer = map[uint64]Frame{}
+			}
+			c.Buffer[f.Seq] = f
+			now := t.now()
+			if c.SyncSeq != c.Recv+1 || now.Sub(c.SyncAt) >= t.limits.RetryAfter {
+				c.SyncSeq, c.SyncAt = c.Recv+1, now
+				r.Replies = append(r.Replies, Frame{Kind: KindSync, Seq: c.Recv + 1})
+			}
+		}
+	}
+	// Duplicates are acknowledged too, the first ack may have been lost.
+	r.Replies = append(r.Replies, Frame{Kind: KindAck, Seq: c.Recv})
+	return r
+}
+
+// MarkRead returns the read receipt for everything up to seq, or false
+// when it was sent already.
+func (t *Tracker) MarkRead(contact string, seq uint64) (Frame, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.conv(contact)
+	seq = min(seq, c.Recv)
+	if seq <= c.Read {
+		return Frame{}, false, nil
+	}
+	c.Read = seq
+	return Frame{Kind: KindRead, Seq: seq}, true, t.save(contact, c)
+}
+
+// Retransmit returns the frames whose ack is overdue, by contact.
+func (t *Tracker) Retransmit() (map[string][]Frame, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	out := map[string][]Frame{}
+	for contact, c := range t.convs {
+		changed := false
+		for i := range c.Pending {
+			p := &c.Pending[i]
+			if now.Sub(p.Sent) < t.backoff(p.Attempts) {
+				continue
+			}
+			p.Sent = now
+			p.Attempts++
+			out[contact] = append(out[contact], p.Frame)
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+		if err := t.save(contact, c); err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+func (t *Tracker) backoff(attempts int) time.Duration {
+	d := t.limits.RetryAfter
+	for range attempts - 1 {
+		d *= 2
+		if d >= t.limits.MaxRetry {
+			return t.limits.MaxRetry
+		}
+	}
+	return d
+}
+
+func (t *Tracker) conv(contact string) *conv {
+	c, ok := t.convs[contact]
+	if !ok {
+		c = &conv{}
+		t.convs[contact] = c
+	}
+	return c
+}
+
+func (t *Tracker) save(contact string, c *conv) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return t.store.Save(contact, b)
+}
+
+func after(ps []pending, seq uint64) []pending {
+	i := sort.Search(len(ps), func(i int) bool { return ps[i].Frame.Seq > seq })
+	return append([]pending(nil), ps[i:]...)
+}
+
+func message(contact string, f Frame) Message {
+	return Message{Contact: contact, ID: f.ID, Seq: f.Seq, Clock: f.Clock, Body: f.Body}
+}
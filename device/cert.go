@@ -0,0 +1,207 @@
+package device
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"go-chat/e2e"
+	"go-chat/storage"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidCert  = errors.New("invalid device certificate")
+	ErrInvalidCode  = errors.New("invalid device code")
+	ErrOtherAccount = errors.New("device of another account")
+)
+
+const keyLen = 32
+
+// Cert binds the keys of a device to an account. The account key stays on
+// the device that created the account and signs the certificates.
+type Cert struct {
+	Account []byte `json:"account"`
+	Sign    []byte `json:"sign"`
+	DH      []byte `json:"dh"`
+	Name    string `json:"name"`
+	Issued  int64  `json:"issued"`
+	Sig     []byte `json:"sig,omitempty"`
+}
+
+// Code is what a new device shows so an existing one can link it.
+func Code(id e2e.Identity) string {
+	return hex.EncodeToString(append(id.Sign.Public().(ed25519.PublicKey), id.DH.PublicKey().Bytes()...))
+}
+
+func ParseCode(code string) ([]byte, []byte, error) {
+	b, err := hex.DecodeString(code)
+	if err != nil || len(b) != ed25519.PublicKeySize+keyLen {
+		return nil, nil, ErrInvalidCode
+	}
+	return b[:ed25519.PublicKeySize], b[ed25519.PublicKeySize:], nil
+}
+
+func Issue(account ed25519.PrivateKey, sign, dh []byte, name string) (Cert, error) {
+	c := Cert{
+		Account: account.Public().(ed25519.PublicKey),
+		Sign:    sign,
+		DH:      dh,
+		Name:    name,
+		Issued:  time.Now().Unix(),
+	}
+	data, err := c.signed()
+	if err != nil {
+		return Cert{}, err
+	}
+	c.Sig = ed25519.Sign(account, data)
+	return c, nil
+}
+
+func (c Cert) Marshal() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+func ParseCert(b []byte) (Cert, error) {
+	var c Cert
+	if err := json.Unmarshal(b, &c); err != nil {
+		return Cert{}, ErrInvalidCert
+	}
+	if len(c.Account) != ed25519.PublicKeySize || len(c.Sign) != ed25519.PublicKeySize || len(c.DH) != keyLen {
+		return Cert{}, ErrInvalidCert
+	}
+	data, err := c.signed()
+	if err != nil || !ed25519.Verify(c.Account, data, c.Sig) {
+		return Cert{}, ErrInvalidCert
+	}
+	return c, nil
+}
+
+// Contact is the e2e contact name of the device.
+func (c Cert) Contact() string {
+	return hex.EncodeToString(c.DH)
+}
+
+func (c Cert) signed() ([]byte, error) {
+	c.Sig = nil
+	return json.Marshal(c)
+}
+
+// Roster is the set of devices of the own account.
+type Roster struct {
+	mu    sync.Mutex
+	store storage.Store
+	self  Cert
+	certs map[string]Cert
+}
+
+// NewRoster loads the devices of the account of self. Certificates of
+// other accounts left from before an adoption are skipped.
+func NewRoster(self Cert, store storage.Store) (*Roster, error) {
+	r := &Roster{store: store, self: self, certs: map[string]Cert{}}
+	contacts, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, contact := range contacts {
+		b, err := store.Load(contact)
+		if err != nil {
+			return nil, err
+		}
+		c, err := ParseCert(b)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(c.Account, self.Account) {
+			r.certs[contact] = c
+		}
+	}
+	return r, r.save(self)
+}
+
+func (r *Roster) Account() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.self.Account
+}
+
+func (r *Roster) Add(c Cert) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !bytes.Equal(c.Account, r.self.Account) {
+		return ErrOtherAccount
+	}
+	return r.save(c)
+}
+
+// Adopt moves this device to the account of the certs, if one of them is
+// for this device and the account is the expected one.
+func (r *Roster) Adopt(account []byte, certs []Cert) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range certs {
+		if bytes.Equal(c.Account, account) && bytes.Equal(c.DH, r.self.DH) && bytes.Equal(c.Sign, r.self.Sign) {
+			r.self = c
+			r.certs = map[string]Cert{}
+			return true, r.save(c)
+		}
+	}
+	return false, nil
+}
+
+func (r *Roster) save(c Cert) error {
+	b, err := c.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := r.store.Save(c.Contact(), b); err != nil {
+		return err
+	}
+	r.certs[c.Contact()] = c
+	return nil
+}
+
+func (r *Roster) Self() Cert {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.self
+}
+
+func (r *Roster) Certs() []Cert {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]Cert, 0, len(r.certs))
+	for _, c := range r.certs {
+		out = append(out, c)
+	}
+	return out
+}
+
+// Siblings are the contacts of the other devices of the account.
+func (r *Roster) Siblings() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var out []string
+	for contact := range r.certs {
+		if contact != r.self.Contact() {
+			out = append(out, contact)
+		}
+	}
+	return out
+}
+
+func (r *Roster) Has(contact string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.certs[contact]
+	return ok && contact != r.self.Contact()
+}
@@ -0,0 +1,161 @@
+package device
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"go-chat/e2e"
+	"go-chat/storage"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bucket(t *testing.T) storage.Bucket {
+	db, err := storage.Open(filepath.Join(t.TempDir(), "test.db"), "")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db.Bucket("test")
+}
+
+func newDevice(t *testing.T, account ed25519.PrivateKey) (e2e.Identity, Cert) {
+	id, err := e2e.NewIdentity()
+	require.NoError(t, err)
+	sign, dh, err := ParseCode(Code(id))
+	require.NoError(t, err)
+	c, err := Issue(account, sign, dh, "laptop")
+	require.NoError(t, err)
+	return id, c
+}
+
+func Test_Roster(t *testing.T) {
+	_, account, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+
+	t.Run("certificates", func(t *testing.T) {
+		_, c := newDevice(t, account)
+		b, err := c.Marshal()
+		require.NoError(t, err)
+		parsed, err := ParseCert(b)
+		require.NoError(t, err)
+		assert.Equal(t, c, parsed)
+
+		c.Name = "desktop"
+		b, _ = c.Marshal()
+		_, err = ParseCert(b)
+		assert.ErrorIs(t, err, ErrInvalidCert)
+
+		_, _, err = ParseCode("abcd")
+		assert.ErrorIs(t, err, ErrInvalidCode)
+	})
+
+	t.Run("members and persistence", func(t *testing.T) {
+		store := bucket(t)
+		_, self := newDevice(t, account)
+		_, sibling := newDevice(t, account)
+		_, stranger := newDevice(t, other)
+
+		r, err := NewRoster(self, store)
+		require.NoError(t, err)
+		require.NoError(t, r.Add(sibling))
+		assert.ErrorIs(t, r.Add(stranger), ErrOtherAccount)
+		assert.Equal(t, []string{sibling.Contact()}, r.Siblings())
+		assert.False(t, r.Has(self.Contact()))
+
+		r, err = NewRoster(self, store)
+		require.NoError(t, err)
+		assert.True(t, r.Has(sibling.Contact()))
+	})
+
+	t.Run("adopt only the expected account", func(t *testing.T) {
+		id, own := newDevice(t, other)
+		r, err := NewRoster(own, bucket(t))
+		require.NoError(t, err)
+
+		sign, dh, _ := ParseCode(Code(id))
+		linked, err := Issue(account, sign, dh, "phone")
+		require.NoError(t, err)
+
+		ok, err := r.Adopt(other.Public().(ed25519.PublicKey), []Cert{linked})
+		require.NoError(t, err)
+		assert.False(t, ok)
+		ok, err = r.Adopt(account.Public().(ed25519.PublicKey), []Cert{linked})
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, linked, r.Self())
+	})
+}
+
+func Test_Reconcile(t *testing.T) {
+	history := func(t *testing.T) *storage.History {
+		db, err := storage.Open(filepath.Join(t.TempDir(), "chat.db"), "")
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		return storage.NewHistory(db, storage.Retention{})
+	}
+	add := func(h *storage.History, conv string, ids ...string) {
+		for _, id := range ids {
+			require.NoError(t, h.Append(conv, storage.Message{ID: id, Body: []byte(id)}))
+		}
+	}
+	ids := func(h *storage.History, conv string) []string {
+		page, err := h.Page(conv, storage.Query{})
+		require.NoError(t, err)
+		var out []string
+		for _, m := range page {
+			out = append(out, m.ID)
+		}
+		return out
+	}
+
+	a, b := history(t), history(t)
+	for i := range 300 {
+		id := fmt.Sprint("common", i)
+		add(a, "bob", id)
+		add(b, "bob", id)
+	}
+	add(a, "bob", "only-a-1", "only-a-2")
+	add(a, "carol", "only-a-3")
+	add(b, "bob", "only-b-1")
+
+	limits := Limits{ListMax: 8, MaxBytes: 3 * 1024}
+	sides := []*storage.History{a, b}
+	exchanged := 0
+	for round := 0; round < 5; round++ {
+		r, err := NewReconciler(a, limits)
+		require.NoError(t, err)
+		p := r.Start()
+		for turn := 1; !p.Empty(); turn++ {
+			require.Less(t, turn, 50)
+			to := sides[turn%2]
+			r, err := NewReconciler(to, limits)
+			require.NoError(t, err)
+			var items []Item
+			p, items = r.Process(p)
+			b, _ := p.Marshal()
+			exchanged += len(b)
+			for _, it := range items {
+				require.NoError(t, to.Append(it.Conv, it.Message))
+			}
+		}
+	}
+
+	assert.ElementsMatch(t, ids(a, "bob"), ids(b, "bob"))
+	assert.Len(t, ids(b, "bob"), 303)
+	assert.Equal(t, []string{"only-a-3"}, ids(b, "carol"))
+	// Far less than sending the whole history.
+	assert.Less(t, exchanged, 300*40)
+
+	// A body changed on one side, as by a deletion, is a difference too.
+	stored, _ := a.Get("bob", "common0")
+	stored.Body = []byte("tombstone")
+	require.NoError(t, a.Put("bob", stored))
+	ra, err := NewReconciler(a, limits)
+	require.NoError(t, err)
+	rb, err := NewReconciler(b, limits)
+	require.NoError(t, err)
+	reply, _ := rb.Process(ra.Start())
+	assert.False(t, reply.Empty())
+}
@@ -0,0 +1,225 @@
+package device
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"go-chat/storage"
+	"math/rand/v2"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidPacket = errors.New("invalid device packet")
+
+const itemKeyLen = 16
+
+type Kind uint8
+
+const (
+	KindRoster Kind = iota
+	KindCopy
+	KindSync
+)
+
+// Item is one message of the history, synced between devices.
+type Item struct {
+	Conv    string          `json:"conv"`
+	Message storage.Message `json:"msg"`
+}
+
+// key covers the body too, so a text and its tombstone differ and the
+// deletion reaches every device.
+func (it Item) key() string {
+	h := sha256.New()
+	h.Write([]byte(it.Conv + "\x00" + it.Message.ID + "\x00"))
+	h.Write(it.Message.Body)
+	return hex.EncodeToString(h.Sum(nil)[:itemKeyLen])
+}
+
+// Range covers the item keys starting with Prefix, in hex. Keys lists all
+// of them once the range is small, otherwise only the fingerprint is sent.
+type Range struct {
+	Prefix      string   `json:"prefix"`
+	Fingerprint []byte   `json:"fp,omitempty"`
+	Count       int      `json:"count"`
+	Keys        []string `json:"keys,omitempty"`
+	Listed      bool     `json:"listed,omitempty"`
+}
+
+// Packet is the plaintext of a DeviceSync signal.
+type Packet struct {
+	Kind   Kind     `json:"k"`
+	Certs  [][]byte `json:"certs,omitempty"`
+	Items  []Item   `json:"items,omitempty"`
+	Ranges []Range  `json:"ranges,omitempty"`
+	Want   []string `json:"want,omitempty"`
+}
+
+func (p Packet) Marshal() ([]byte, error) {
+	return json.Marshal(p)
+}
+
+func ParsePacket(b []byte) (Packet, error) {
+	var p Packet
+	if err := json.Unmarshal(b, &p); err != nil || p.Kind > KindSync {
+		return Packet{}, ErrInvalidPacket
+	}
+	return p, nil
+}
+
+type Limits struct {
+	// ListMax is the size of a range below which its keys are listed
+	// instead of split.
+	ListMax int
+	// MaxBytes bounds the items and ranges of a reply, so it fits a signal.
+	MaxBytes int
+}
+
+// Reconciler finds the difference of two histories by comparing
+// fingerprints of key ranges and splitting the ones that differ, so the
+// traffic grows with the difference rather than the history.
+type Reconciler struct {
+	limits Limits
+	keys   []string
+	items  map[string]Item
+}
+
+// NewReconciler takes a snapshot of the history.
+func NewReconciler(h *storage.History, limits Limits) (*Reconciler, error) {
+	r := &Reconciler{limits: limits, items: map[string]Item{}}
+	for _, conv := range h.Conversations() {
+		msgs, err := h.Page(conv, storage.Query{})
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			it := Item{Conv: conv, Message: m}
+			r.items[it.key()] = it
+			r.keys = append(r.keys, it.key())
+		}
+	}
+	sort.Strings(r.keys)
+	return r, nil
+}
+
+// Start opens a round with the fingerprint of the whole history.
+func (r *Reconciler) Start() Packet {
+	return Packet{Kind: KindSync, Ranges: []Range{r.summary("")}}
+}
+
+// Process answers a sync packet. It returns the reply, empty when the
+// round is over, and the items received.
+func (r *Reconciler) Process(p Packet) (Packet, []Item) {
+	reply := Packet{Kind: KindSync}
+	budget := r.limits.MaxBytes
+
+	var received []Item
+	for _, it := range p.Items {
+		if it.Message.ID == "" {
+			continue
+		}
+		received = append(received, it)
+	}
+	for _, k := range p.Want {
+		if it, ok := r.items[k]; ok && budget > 0 {
+			budget -= size(it)
+			reply.Items = append(reply.Items, it)
+		}
+	}
+
+	// Ranges over the budget are left for the next round. Starting at a
+	// random one keeps the same ranges from being dropped every time.
+	start := 0
+	if len(p.Ranges) > 0 {
+		start = rand.IntN(len(p.Ranges))
+	}
+	for i := range p.Ranges {
+		if budget <= 0 {
+			break
+		}
+		rg := p.Ranges[(start+i)%len(p.Ranges)]
+		if !validPrefix(rg.Prefix) {
+			continue
+		}
+		mine := r.inRange(rg.Prefix)
+
+		if rg.Listed {
+			theirs := map[string]bool{}
+			for _, k := range rg.Keys {
+				theirs[k] = true
+			}
+			for _, k := range mine {
+				if !theirs[k] && budget > 0 {
+					budget -= size(r.items[k])
+					reply.Items = append(reply.Items, r.items[k])
+				}
+				delete(theirs, k)
+			}
+			for k := range theirs {
+				reply.Want = append(reply.Want, k)
+				budget -= len(k)
+			}
+			continue
+		}
+
+		own := r.summary(rg.Prefix)
+		if own.Count == rg.Count && bytes.Equal(own.Fingerprint, rg.Fingerprint) {
+			continue
+		}
+		if len(mine) <= r.limits.ListMax || len(rg.Prefix) == 2*itemKeyLen {
+			own.Keys, own.Listed = mine, true
+			own.Fingerprint = nil
+			reply.Ranges = append(reply.Ranges, own)
+			budget -= len(mine) * (2*itemKeyLen + 3)
+			continue
+		}
+		for _, nibble := range "0123456789abcdef" {
+			child := r.summary(rg.Prefix + string(nibble))
+			reply.Ranges = append(reply.Ranges, child)
+			budget -= len(child.Prefix) + 64
+		}
+	}
+	return reply, received
+}
+
+// Empty reports whether a reply ends the round.
+func (p Packet) Empty() bool {
+	return len(p.Items) == 0 && len(p.Ranges) == 0 && len(p.Want) == 0
+}
+
+func (r *Reconciler) inRange(prefix string) []string {
+	lo := sort.SearchStrings(r.keys, prefix)
+	hi := lo
+	for hi < len(r.keys) && strings.HasPrefix(r.keys[hi], prefix) {
+		hi++
+	}
+	return r.keys[lo:hi]
+}
+
+func (r *Reconciler) summary(prefix string) Range {
+	keys := r.inRange(prefix)
+	h := sha256.New()
+	for _, k := range keys {
+		h.Write([]byte(k))
+	}
+	return Range{Prefix: prefix, Fingerprint: h.Sum(nil)[:itemKeyLen], Count: len(keys)}
+}
+
+func validPrefix(p string) bool {
+	if len(p) > 2*itemKeyLen {
+		return false
+	}
+	for _, c := range p {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func size(it Item) int {
+	return len(it.Conv) + len(it.Message.ID) + len(it.Message.From) + len(it.Message.Body)*4/3 + 96
+}
@@ -2,31 +2,114 @@ package dispatcher
 
 import (
 	"context"
+	"encoding/hex"
+	"go-chat/banlist"
+	"go-chat/cache"
 	"go-chat/config"
 	"go-chat/model"
+	"go-chat/mux"
+	"go-chat/pow"
+	"go-chat/ratelimit"
 	"io"
+	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// MaxSignal is the longest signal a peer connection carries. Longer ones are
+// refused when sent, written they would take the connection down.
+const MaxSignal = mux.MaxPayload
+
 type Dispatcher struct {
-	mu       sync.Mutex
-	peers    map[string]*Node
-	typemu   sync.Mutex
-	typesubs map[model.SignalType][]chan model.Signal
-	keymu    sync.Mutex
-	keysubs  map[string]chan model.Signal
+	mu        sync.Mutex
+	peers     map[string]*Node
+	typemu    sync.Mutex
+	typesubs  map[model.SignalType][]chan model.Signal
+	fromsubs  map[model.SignalType][]chan Inbound
+	keymu     sync.Mutex
+	keysubs   map[string]chan model.Signal
+	outbox    outboxConfig
+	keepalive keepaliveConfig
+	limits    limitConfig
+	bans      *banlist.Banlist
+	pow       *pow.Policy
+	seen      *cache.Cache
+	dups      *cache.Cache
+	onDrop    func(hash []byte)
 }
 
 type Node struct {
-	close  func()
-	outbox chan<- []byte
+	hash       string
+	ip         string
+	close      func()
+	outbox     *outbox
+	lastSeen   atomic.Int64
+	rtt        atomic.Int64
+	pingmu     sync.Mutex
+	ping       string
+	pingAt     time.Time
+	missed     atomic.Int32
+	extra      atomic.Int32
+	score      atomic.Int32
+	limiter    *ratelimit.Bucket
+	typeLimits map[model.SignalType]*ratelimit.Bucket
+}
+
+type Option func(*Dispatcher)
+
+type outboxConfig struct {
+	size    int
+	policy  [ClassesCount]OverflowPolicy
+	timeout time.Duration
 }
 
-func New() *Dispatcher {
-	return &Dispatcher{
+// WithOutbox sizes the outbox of every peer, policy is what a full outbox
+// does with a signal of each class.
+func WithOutbox(size int, policy [ClassesCount]OverflowPolicy, timeout time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.outbox = outboxConfig{size: size, policy: policy, timeout: timeout}
+	}
+}
+
+// WithOnDisconnect registers fn to be called once a peer is gone, unless
+// another connection took its hash meanwhile.
+func WithOnDisconnect(fn func(hash []byte)) Option {
+	return func(d *Dispatcher) {
+		d.onDrop = fn
+	}
+}
+
+func New(opts ...Option) *Dispatcher {
+	d := &Dispatcher{
 		peers:    map[string]*Node{},
 		typesubs: map[model.SignalType][]chan model.Signal{},
+		fromsubs: map[model.SignalType][]chan Inbound{},
+		keysubs:  map[string]chan model.Signal{},
+		outbox: outboxConfig{
+			size:    config.OutboxSize,
+			policy:  [ClassesCount]OverflowPolicy{OverflowDisconnect, OverflowDisconnect, OverflowDisconnect},
+			timeout: config.OutboxTimeout,
+		},
+		keepalive: keepaliveConfig{
+			interval:  config.PingInterval,
+			idle:      config.IdleTimeout,
+			maxMissed: config.MaxMissedPongs,
+		},
+		limits: limitConfig{
+			peerRate:  config.PeerRate,
+			peerBurst: config.PeerBurst,
+			typeRate:  config.TypeRate,
+			typeBurst: config.TypeBurst,
+		},
+		bans: banlist.New(),
+		seen: cache.New(config.CacheBucketsCount, config.CacheBucketSize),
+		dups: cache.New(config.CacheBucketsCount, config.CacheBucketSize),
 	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
 }
 
 func (d *Dispatcher) SubscribeType(st model.SignalType) <-chan model.Signal {
@@ -54,6 +137,14 @@ func (d *Dispatcher) SubscribeKey(key string) <-chan model.Signal {
 	return ch
 }
 
+func (d *Dispatcher) Subscribed(key string) bool {
+	d.keymu.Lock()
+	defer d.keymu.Unlock()
+
+	_, ok := d.keysubs[key]
+	return ok
+}
+
 func (d *Dispatcher) UnsbribeKey(key string) {
 	d.keymu.Lock()
 	defer d.keymu.Unlock()
@@ -71,34 +162,56 @@ func (d *Dispatcher) Dispatch(hash []byte, rwc io.ReadWriteCloser) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	outbox := make(chan []byte, 256)
+	outbox := newOutbox(d.outbox.size, d.outbox.policy, d.outbox.timeout)
 
 	ctx, cancel := context.WithCancel(context.Background())
-	d.peers[string(hash)] = &Node{
-		close:  cancel,
-		outbox: outbox,
+	node := &Node{
+		hash:       string(hash),
+		ip:         remoteIP(rwc),
+		close:      cancel,
+		outbox:     outbox,
+		typeLimits: map[model.SignalType]*ratelimit.Bucket{},
+	}
+	if d.banned(node) {
+		cancel()
+		rwc.Close()
+		if _, live := d.peers[string(hash)]; !live && d.onDrop != nil {
+			d.onDrop(hash)
+		}
+		return
 	}
+	if d.limits.peerRate > 0 {
+		node.limiter = ratelimit.NewBucket(d.limits.peerRate, d.limits.peerBurst)
+	}
+	node.lastSeen.Store(time.Now().UnixNano())
+	d.peers[string(hash)] = node
+
+	go d.heartbeat(ctx, node)
 
 	go func() {
 		defer func() {
+			// A connection replaced by a newer one with the same hash must
+			// not drop the newer one.
 			d.mu.Lock()
-			defer d.mu.Unlock()
-			delete(d.peers, string(hash))
+			current := d.peers[string(hash)] == node
+			if current {
+				delete(d.peers, string(hash))
+			}
+			d.mu.Unlock()
 			rwc.Close()
+			if current && d.onDrop != nil {
+				d.onDrop(hash)
+			}
 		}()
 
 		for {
-			select {
-			case <-ctx.Done():
+			out, ok := outbox.pop(ctx)
+			if !ok {
+				return
+			}
+			_, err := rwc.Write(out)
+			if err != nil {
 				return
-			case out, ok := <-outbox:
-				if !ok {
-					return
-				}
-				_, err := rwc.Write(out)
-				if err != nil {
-					return
-				}
 			}
 		}
 	}()
@@ -112,23 +225,63 @@ func (d *Dispatcher) Dispatch(hash []byte, rwc io.ReadWriteCloser) {
 			if err != nil {
 				return
 			}
+			node.lastSeen.Store(time.Now().UnixNano())
 			tmp := make([]byte, n)
 			copy(tmp, buf[:n])
 			s, err := model.FormatSignal(tmp)
-			if err != nil {
-				return
+			if err != nil || !s.Type().IsValid() {
+				d.penalize(node, config.PenaltyMalformed)
+				continue
 			}
 
-			for _, typesub := range d.typesubs[s.Type()] {
-				typesub <- s
+			if !d.allow(node, s.Type()) {
+				d.penalize(node, config.PenaltyRate)
+				continue
 			}
 
-			keysub, ok := d.keysubs[s.KeyString()]
-			if !ok {
+			if d.control(node, s) {
 				continue
 			}
 
-			keysub <- s
+			if d.pow != nil {
+				if err := d.pow.Admit(s); err == pow.ErrWeakStamp {
+					d.penalize(node, config.PenaltyWork)
+					continue
+				} else if err != nil {
+					continue
+				}
+			}
+
+			if !d.dups.PutIfAbsent(node.hash + s.NonceString()) {
+				d.penalize(node, config.PenaltyDuplicate)
+				continue
+			}
+			if !d.seen.PutIfAbsent(s.NonceString()) {
+				continue
+			}
+
+			d.typemu.Lock()
+			typesubs := d.typesubs[s.Type()]
+			fromsubs := d.fromsubs[s.Type()]
+			d.typemu.Unlock()
+			for _, typesub := range typesubs {
+				typesub <- s
+			}
+			for _, fromsub := range fromsubs {
+				fromsub <- Inbound{From: hash, Signal: s}
+			}
+
+			// Sent under the lock, UnsbribeKey closes the chan. A key
+			// subscriber falling behind loses signals instead of stalling
+			// the peer.
+			d.keymu.Lock()
+			if keysub, ok := d.keysubs[s.KeyString()]; ok {
+				select {
+				case keysub <- s:
+				default:
+				}
+			}
+			d.keymu.Unlock()
 		}
 	}()
 }
@@ -144,19 +297,38 @@ func (d *Dispatcher) Disconnect(hash []byte) {
 }
 
 func (d *Dispatcher) Send(s model.Signal) {
+	if len(s) > MaxSignal {
+		log.Println("Send: signal too big:", s.Type(), len(s))
+		return
+	}
+	d.mu.Lock()
+	nodes := make([]*Node, 0, len(d.peers))
+	for _, n := range d.peers {
+		nodes = append(nodes, n)
+	}
+	d.mu.Unlock()
+
+	d.seen.Put(s.NonceString())
+
+	c := ClassOf(s.Type())
+	for _, n := range nodes {
+		send(n, c, s)
+	}
+}
+
+func (d *Dispatcher) Stats() map[string]Stats {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	b := []byte(s)
-	for _, n := range d.peers {
-		send(n, b)
+	out := make(map[string]Stats, len(d.peers))
+	for hash, n := range d.peers {
+		out[hex.EncodeToString([]byte(hash))] = n.outbox.stats()
 	}
+	return out
 }
 
-func send(n *Node, b []byte) {
-	select {
-	case n.outbox <- b:
-	default:
+func send(n *Node, c Class, b []byte) {
+	if !n.outbox.push(c, b) {
 		n.close()
 	}
 }
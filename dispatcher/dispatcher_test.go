@@ -6,6 +6,7 @@ import (
 	"go-chat/model"
 	"io"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -37,6 +38,25 @@ func Test_Dispatch(t *testing.T) {
 		assert.Len(t, d.peers, 0)
 	})
 
+	t.Run("keep replacing connection", func(t *testing.T) {
+		var dropped atomic.Int32
+		d := New(WithOnDisconnect(func([]byte) { dropped.Add(1) }))
+		hash := []byte(rand.Text())
+		old, oldw := io.Pipe()
+		d.Dispatch(hash, &rwcadap{Reader: old, Writer: io.Discard})
+		r, _ := io.Pipe()
+		d.Dispatch(hash, &rwcadap{Reader: r, Writer: io.Discard})
+
+		oldw.Close()
+		assert.Never(t, func() bool { return dropped.Load() > 0 }, 50*time.Millisecond, 10*time.Millisecond)
+		d.mu.Lock()
+		assert.Len(t, d.peers, 1)
+		d.mu.Unlock()
+
+		d.Disconnect(hash)
+		assert.Eventually(t, func() bool { return dropped.Load() == 1 }, time.Second, 10*time.Millisecond)
+	})
+
 	t.Run(
 		"should publish",
 		func(t *testing.T) {
@@ -48,12 +68,11 @@ func Test_Dispatch(t *testing.T) {
 			randPayload := make([]byte, 12)
 			rand.Read(randPayload)
 			expected, _ := model.NewSignal(
-				model.SignalTypeNeedInvite,
-				make([]byte, 32),
-				make([]byte, 32),
+				model.SignalTypeNeedConnect,
+				make([]byte, model.KeyLen),
 				randPayload,
 			)
-			ch := d.SubscribeType(model.SignalTypeNeedInvite)
+			ch := d.SubscribeType(model.SignalTypeNeedConnect)
 			assert.Len(t, d.typesubs, 1)
 
 			wg := sync.WaitGroup{}
@@ -79,9 +98,8 @@ func Test_Dispatch(t *testing.T) {
 		d.Dispatch(hash, rwc)
 		randPayload := make([]byte, 12)
 		expected, _ := model.NewSignal(
-			model.SignalTypeNeedInvite,
-			make([]byte, 32),
-			make([]byte, 32),
+			model.SignalTypeNeedConnect,
+			make([]byte, model.KeyLen),
 			randPayload,
 		)
 		d.Send(expected)
@@ -0,0 +1,116 @@
+package dispatcher
+
+import (
+	"context"
+	"go-chat/model"
+	"log"
+	"time"
+)
+
+type keepaliveConfig struct {
+	interval  time.Duration
+	idle      time.Duration
+	maxMissed int32
+}
+
+// WithKeepalive pings every peer each interval. A peer is disconnected when
+// nothing was read from it for idle or when maxMissed pings stay unanswered.
+// Zero interval disables pings.
+func WithKeepalive(interval, idle time.Duration, maxMissed int) Option {
+	return func(d *Dispatcher) {
+		d.keepalive = keepaliveConfig{
+			interval:  interval,
+			idle:      idle,
+			maxMissed: int32(maxMissed),
+		}
+	}
+}
+
+func (d *Dispatcher) RTT(hash []byte) (time.Duration, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n, ok := d.peers[string(hash)]
+	if !ok {
+		return 0, false
+	}
+	rtt := n.rtt.Load()
+	if rtt == 0 {
+		return 0, false
+	}
+	return time.Duration(rtt), true
+}
+
+func (d *Dispatcher) heartbeat(ctx context.Context, n *Node) {
+	if d.keepalive.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(d.keepalive.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, n.lastSeen.Load())) > d.keepalive.idle {
+				n.close()
+				return
+			}
+			if n.missed.Load() >= d.keepalive.maxMissed {
+				n.close()
+				return
+			}
+
+			key := model.GenerateKey()
+			ping, err := model.NewSignal(model.SignalTypePing, key, nil)
+			if err != nil {
+				log.Println("heartbeat: model.NewSignal:", err)
+				continue
+			}
+			n.pingmu.Lock()
+			n.ping, n.pingAt = string(key), now
+			n.pingmu.Unlock()
+			n.missed.Add(1)
+			send(n, ClassControl, ping)
+		}
+	}
+}
+
+// control answers pings and records pongs. Only the pong of the last ping
+// counts, timed from when it was sent, so a peer can't fake its RTT. A pong
+// carries how far the PoW difficulty is raised. It reports whether the
+// signal was consumed and must not reach subscribers.
+func (d *Dispatcher) control(n *Node, s model.Signal) bool {
+	switch s.Type() {
+	case model.SignalTypePing:
+		var extra byte
+		if d.pow != nil {
+			extra = byte(d.pow.Extra())
+		}
+		pong, err := model.NewSignal(model.SignalTypePong, s.Key(), []byte{extra})
+		if err != nil {
+			return true
+		}
+		send(n, ClassControl, pong)
+		return true
+	case model.SignalTypePong:
+		n.pingmu.Lock()
+		if n.ping == "" || n.ping != s.KeyString() {
+			n.pingmu.Unlock()
+			return true
+		}
+		rtt := time.Since(n.pingAt)
+		n.ping = ""
+		n.pingmu.Unlock()
+		n.rtt.Store(int64(max(rtt, 1)))
+		n.missed.Store(0)
+		if p := s.Payload(); len(p) == 1 {
+			n.extra.Store(int32(p[0]))
+		}
+		return true
+	default:
+		return false
+	}
+}
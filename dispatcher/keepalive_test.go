@@ -0,0 +1,105 @@
+package dispatcher
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"go-chat/model"
+	"go-chat/pow"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Keepalive(t *testing.T) {
+	t.Run("measure rtt", func(t *testing.T) {
+		l, r := net.Pipe()
+		lhash, rhash := []byte(rand.Text()), []byte(rand.Text())
+		ld := New(WithKeepalive(10*time.Millisecond, time.Second, 3))
+		rd := New(WithKeepalive(0, time.Second, 3))
+		ld.Dispatch(rhash, l)
+		rd.Dispatch(lhash, r)
+		defer ld.Disconnect(rhash)
+
+		assert.Eventually(t, func() bool {
+			rtt, ok := ld.RTT(rhash)
+			return ok && rtt > 0
+		}, time.Second, 10*time.Millisecond)
+
+		_, ok := rd.RTT(lhash)
+		assert.False(t, ok)
+	})
+
+	t.Run("learn raised difficulty", func(t *testing.T) {
+		raised := pow.NewPolicy(map[model.SignalType]int{model.SignalTypeOffer: 1}, 4, 0, 0, time.Nanosecond)
+		for range 3 {
+			s, _ := model.NewSignal(model.SignalTypeOffer, model.GenerateKey(), nil)
+			raised.Admit(s)
+			time.Sleep(time.Millisecond)
+		}
+		require.Positive(t, raised.Extra())
+		base := pow.NewPolicy(map[model.SignalType]int{model.SignalTypeOffer: 1}, 4, 100, 0, time.Hour)
+
+		l, r := net.Pipe()
+		lhash, rhash := []byte(rand.Text()), []byte(rand.Text())
+		ld := New(WithKeepalive(10*time.Millisecond, time.Second, 3), WithPoW(base))
+		rd := New(WithKeepalive(0, time.Second, 3), WithPoW(raised))
+		assert.Equal(t, 1, ld.Difficulty(model.SignalTypeOffer))
+		ld.Dispatch(rhash, l)
+		rd.Dispatch(lhash, r)
+		defer ld.Disconnect(rhash)
+
+		assert.Eventually(t, func() bool {
+			return ld.Difficulty(model.SignalTypeOffer) == 1+raised.Extra()
+		}, time.Second, 10*time.Millisecond)
+		assert.Equal(t, 0, ld.Difficulty(model.SignalTypeAnswer))
+	})
+
+	t.Run("ignore unsolicited pong", func(t *testing.T) {
+		l, r := net.Pipe()
+		hash := []byte(rand.Text())
+		d := New(WithKeepalive(0, time.Second, 3))
+		d.Dispatch(hash, l)
+		defer d.Disconnect(hash)
+
+		payload := binary.LittleEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+		pong, err := model.NewSignal(model.SignalTypePong, model.GenerateKey(), payload)
+		require.NoError(t, err)
+		_, err = r.Write(pong)
+		require.NoError(t, err)
+
+		assert.Never(t, func() bool {
+			_, ok := d.RTT(hash)
+			return ok
+		}, 50*time.Millisecond, 10*time.Millisecond)
+	})
+
+	t.Run("disconnect dead peer", func(t *testing.T) {
+		r, _ := io.Pipe()
+		hash := []byte(rand.Text())
+		d := New(WithKeepalive(10*time.Millisecond, time.Second, 2))
+		d.Dispatch(hash, &rwcadap{Reader: r, Writer: io.Discard})
+
+		assert.Eventually(t, func() bool {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			return len(d.peers) == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("disconnect idle peer", func(t *testing.T) {
+		r, _ := io.Pipe()
+		hash := []byte(rand.Text())
+		d := New(WithKeepalive(10*time.Millisecond, 30*time.Millisecond, 100))
+		d.Dispatch(hash, &rwcadap{Reader: r, Writer: io.Discard})
+
+		assert.Eventually(t, func() bool {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			return len(d.peers) == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+}
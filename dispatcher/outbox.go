@@ -0,0 +1,241 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"go-chat/model"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type OverflowPolicy uint8
+
+const (
+	OverflowDisconnect OverflowPolicy = iota
+	OverflowBlock
+	OverflowDropOldest
+	OverflowDropPriority
+)
+
+var ErrUnknownPolicy = errors.New("unknown overflow policy")
+
+var policyNames = map[string]OverflowPolicy{
+	"disconnect":    OverflowDisconnect,
+	"block":         OverflowBlock,
+	"drop-oldest":   OverflowDropOldest,
+	"drop-priority": OverflowDropPriority,
+}
+
+// ParseOverflowPolicy reads the policy names used in config.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	p, ok := policyNames[name]
+	if !ok {
+		return 0, ErrUnknownPolicy
+	}
+	return p, nil
+}
+
+type Class uint8
+
+const (
+	ClassChat Class = iota
+	ClassSignaling
+	ClassControl
+
+	ClassesCount = 3
+)
+
+type Stats struct {
+	Depth   [ClassesCount]int
+	Dropped [ClassesCount]uint64
+}
+
+func ClassOf(t model.SignalType) Class {
+	switch t {
+	case model.SignalTypeNeedConnect,
+		model.SignalTypeOffer,
+		model.SignalTypeAnswer,
+		model.SignalTypeCandidate,
+		model.SignalTypeRelayAnnounce,
+		model.SignalTypeCallStart,
+		model.SignalTypeCallAccept,
+		model.SignalTypeCallEnd:
+		return ClassSignaling
+	case model.SignalTypePing, model.SignalTypePong:
+		return ClassControl
+	default:
+		return ClassChat
+	}
+}
+
+type entry struct {
+	seq uint64
+	b   []byte
+}
+
+type outbox struct {
+	mu      sync.Mutex
+	queues  [ClassesCount][]entry
+	len     int
+	seq     uint64
+	size    int
+	policy  [ClassesCount]OverflowPolicy
+	timeout time.Duration
+	ready   chan struct{}
+	space   chan struct{}
+	dropped [ClassesCount]atomic.Uint64
+}
+
+// newOutbox makes room for a signal of a full outbox by the policy of its
+// class.
+func newOutbox(size int, policy [ClassesCount]OverflowPolicy, timeout time.Duration) *outbox {
+	return &outbox{
+		size:    size,
+		policy:  policy,
+		timeout: timeout,
+		ready:   make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+	}
+}
+
+// push reports false when the peer has to be disconnected.
+func (o *outbox) push(c Class, b []byte) bool {
+	o.mu.Lock()
+	if o.len < o.size {
+		o.add(c, b)
+		o.mu.Unlock()
+		return true
+	}
+
+	switch o.policy[c] {
+	case OverflowBlock:
+		o.mu.Unlock()
+		return o.wait(c, b)
+	case OverflowDropOldest:
+		o.drop(o.oldest())
+		o.add(c, b)
+	case OverflowDropPriority:
+		victim, ok := o.lowest(c)
+		if !ok {
+			o.dropped[c].Add(1)
+			break
+		}
+		o.drop(victim)
+		o.add(c, b)
+	default:
+		o.mu.Unlock()
+		return false
+	}
+	o.mu.Unlock()
+
+	return true
+}
+
+func (o *outbox) wait(c Class, b []byte) bool {
+	timer := time.NewTimer(o.timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			o.dropped[c].Add(1)
+			return false
+		case <-o.space:
+		}
+
+		o.mu.Lock()
+		if o.len < o.size {
+			o.add(c, b)
+			o.mu.Unlock()
+			return true
+		}
+		o.mu.Unlock()
+	}
+}
+
+func (o *outbox) pop(ctx context.Context) ([]byte, bool) {
+	for {
+		o.mu.Lock()
+		for c := ClassesCount - 1; c >= 0; c-- {
+			q := o.queues[c]
+			if len(q) == 0 {
+				continue
+			}
+			b := q[0].b
+			q[0] = entry{}
+			o.queues[c] = q[1:]
+			o.len--
+			o.mu.Unlock()
+			notify(o.space)
+			return b, true
+		}
+		o.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-o.ready:
+		}
+	}
+}
+
+func (o *outbox) stats() Stats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var s Stats
+	for c := range ClassesCount {
+		s.Depth[c] = len(o.queues[c])
+		s.Dropped[c] = o.dropped[c].Load()
+	}
+	return s
+}
+
+func (o *outbox) add(c Class, b []byte) {
+	o.seq++
+	o.queues[c] = append(o.queues[c], entry{seq: o.seq, b: b})
+	o.len++
+	notify(o.ready)
+}
+
+func (o *outbox) drop(c Class) {
+	q := o.queues[c]
+	q[0] = entry{}
+	o.queues[c] = q[1:]
+	o.len--
+	o.dropped[c].Add(1)
+}
+
+func (o *outbox) oldest() Class {
+	var (
+		res Class
+		seq uint64
+	)
+	for c := range Class(ClassesCount) {
+		q := o.queues[c]
+		if len(q) == 0 {
+			continue
+		}
+		if seq == 0 || q[0].seq < seq {
+			res, seq = c, q[0].seq
+		}
+	}
+	return res
+}
+
+func (o *outbox) lowest(than Class) (Class, bool) {
+	for c := range than {
+		if len(o.queues[c]) > 0 {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,99 @@
+package dispatcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func every(p OverflowPolicy) [ClassesCount]OverflowPolicy {
+	return [ClassesCount]OverflowPolicy{p, p, p}
+}
+
+func Test_Outbox(t *testing.T) {
+	t.Run("pop by class", func(t *testing.T) {
+		o := newOutbox(10, every(OverflowDisconnect), 0)
+		o.push(ClassChat, []byte("chat"))
+		o.push(ClassSignaling, []byte("signaling"))
+		o.push(ClassControl, []byte("control"))
+
+		for _, expected := range []string{"control", "signaling", "chat"} {
+			b, ok := o.pop(t.Context())
+			assert.True(t, ok)
+			assert.Equal(t, expected, string(b))
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		o := newOutbox(1, every(OverflowDisconnect), 0)
+		assert.True(t, o.push(ClassChat, []byte("1")))
+		assert.False(t, o.push(ClassChat, []byte("2")))
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		o := newOutbox(2, every(OverflowDropOldest), 0)
+		o.push(ClassSignaling, []byte("1"))
+		o.push(ClassChat, []byte("2"))
+		assert.True(t, o.push(ClassChat, []byte("3")))
+
+		s := o.stats()
+		assert.Equal(t, 0, s.Depth[ClassSignaling])
+		assert.Equal(t, 2, s.Depth[ClassChat])
+		assert.Equal(t, uint64(1), s.Dropped[ClassSignaling])
+	})
+
+	t.Run("drop by priority", func(t *testing.T) {
+		o := newOutbox(2, every(OverflowDropPriority), 0)
+		o.push(ClassChat, []byte("1"))
+		o.push(ClassSignaling, []byte("2"))
+
+		assert.True(t, o.push(ClassControl, []byte("3")))
+		assert.True(t, o.push(ClassChat, []byte("4")))
+
+		s := o.stats()
+		assert.Equal(t, [ClassesCount]int{0, 1, 1}, s.Depth)
+		assert.Equal(t, [ClassesCount]uint64{2, 0, 0}, s.Dropped)
+	})
+
+	t.Run("block with timeout", func(t *testing.T) {
+		o := newOutbox(1, every(OverflowBlock), 50*time.Millisecond)
+		o.push(ClassChat, []byte("1"))
+		assert.False(t, o.push(ClassChat, []byte("2")))
+
+		go func() {
+			<-time.After(10 * time.Millisecond)
+			o.pop(context.Background())
+		}()
+		assert.True(t, o.push(ClassChat, []byte("3")))
+	})
+
+	t.Run("policy per class", func(t *testing.T) {
+		o := newOutbox(1, [ClassesCount]OverflowPolicy{OverflowDropPriority, OverflowDropPriority, OverflowDisconnect}, 0)
+		o.push(ClassChat, []byte("1"))
+		assert.True(t, o.push(ClassChat, []byte("2")))
+		assert.True(t, o.push(ClassSignaling, []byte("3")))
+		assert.False(t, o.push(ClassControl, []byte("4")))
+
+		s := o.stats()
+		assert.Equal(t, [ClassesCount]int{0, 1, 0}, s.Depth)
+		assert.Equal(t, [ClassesCount]uint64{2, 0, 0}, s.Dropped)
+	})
+
+	t.Run("parse policy", func(t *testing.T) {
+		p, err := ParseOverflowPolicy("drop-priority")
+		assert.NoError(t, err)
+		assert.Equal(t, OverflowDropPriority, p)
+		_, err = ParseOverflowPolicy("drop")
+		assert.ErrorIs(t, err, ErrUnknownPolicy)
+	})
+
+	t.Run("pop canceled", func(t *testing.T) {
+		o := newOutbox(1, every(OverflowDisconnect), 0)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, ok := o.pop(ctx)
+		assert.False(t, ok)
+	})
+}
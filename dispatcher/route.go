@@ -0,0 +1,72 @@
+package dispatcher
+
+import (
+	"go-chat/model"
+	"sort"
+)
+
+// Inbound is a signal together with the peer it came from.
+type Inbound struct {
+	From []byte
+	model.Signal
+}
+
+// SubscribeTypeFrom is SubscribeType for handlers that must not send the
+// signal back to where it came from.
+func (d *Dispatcher) SubscribeTypeFrom(st model.SignalType) <-chan Inbound {
+	d.typemu.Lock()
+	defer d.typemu.Unlock()
+
+	x := make(chan Inbound, 100)
+	d.fromsubs[st] = append(d.fromsubs[st], x)
+	return x
+}
+
+// Fastest returns up to n connected peers ordered by measured round trip
+// time, peers without a measurement come last.
+func (d *Dispatcher) Fastest(n int) [][]byte {
+	d.mu.Lock()
+	nodes := make([]*Node, 0, len(d.peers))
+	for _, node := range d.peers {
+		nodes = append(nodes, node)
+	}
+	d.mu.Unlock()
+
+	sort.Slice(nodes, func(i, j int) bool {
+		ri, rj := nodes[i].rtt.Load(), nodes[j].rtt.Load()
+		if (ri == 0) != (rj == 0) {
+			return rj == 0
+		}
+		if ri != rj {
+			return ri < rj
+		}
+		return nodes[i].hash < nodes[j].hash
+	})
+	if n > len(nodes) {
+		n = len(nodes)
+	}
+
+	out := make([][]byte, 0, n)
+	for _, node := range nodes[:n] {
+		out = append(out, []byte(node.hash))
+	}
+	return out
+}
+
+// SendTo sends the signal to a single peer instead of the whole mesh. It
+// reports false for an unknown peer or a signal longer than MaxSignal.
+func (d *Dispatcher) SendTo(hash []byte, s model.Signal) bool {
+	if len(s) > MaxSignal {
+		return false
+	}
+	d.mu.Lock()
+	n, ok := d.peers[string(hash)]
+	d.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	d.seen.Put(s.NonceString())
+	send(n, ClassOf(s.Type()), s)
+	return true
+}
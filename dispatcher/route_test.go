@@ -0,0 +1,61 @@
+package dispatcher
+
+import (
+	"go-chat/model"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Route(t *testing.T) {
+	t.Run("fastest peers first", func(t *testing.T) {
+		d := New(WithKeepalive(0, time.Second, 3))
+		for _, h := range []string{"slow", "fast", "unknown"} {
+			r, _ := io.Pipe()
+			d.Dispatch([]byte(h), &rwcadap{Reader: r, Writer: io.Discard})
+		}
+		d.mu.Lock()
+		d.peers["slow"].rtt.Store(int64(time.Second))
+		d.peers["fast"].rtt.Store(int64(time.Millisecond))
+		d.mu.Unlock()
+
+		assert.Equal(t, [][]byte{[]byte("fast"), []byte("slow")}, d.Fastest(2))
+		assert.Len(t, d.Fastest(10), 3)
+	})
+
+	t.Run("send to single peer", func(t *testing.T) {
+		d := New(WithKeepalive(0, time.Second, 3))
+		l, r := net.Pipe()
+		d.Dispatch([]byte("peer"), l)
+
+		big, _ := model.NewSignal(model.SignalTypeRelayData, model.GenerateKey(), make([]byte, MaxSignal))
+		assert.False(t, d.SendTo([]byte("peer"), big))
+		d.Send(big)
+
+		s, _ := model.NewSignal(model.SignalTypeRelayData, model.GenerateKey(), []byte("data"))
+		assert.True(t, d.SendTo([]byte("peer"), s))
+		assert.False(t, d.SendTo([]byte("other"), s))
+
+		buf := make([]byte, 1024)
+		n, err := r.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(s), buf[:n])
+	})
+
+	t.Run("subscribe with source", func(t *testing.T) {
+		d := New(WithKeepalive(0, time.Second, 3))
+		l, r := net.Pipe()
+		d.Dispatch([]byte("peer"), l)
+		from := d.SubscribeTypeFrom(model.SignalTypeRelayData)
+
+		s, _ := model.NewSignal(model.SignalTypeRelayData, model.GenerateKey(), []byte("data"))
+		_, err := r.Write(s)
+		assert.NoError(t, err)
+		in := <-from
+		assert.Equal(t, []byte("peer"), in.From)
+		assert.Equal(t, s, in.Signal)
+	})
+}
@@ -0,0 +1,142 @@
+package dispatcher
+
+import (
+	"errors"
+	"go-chat/banlist"
+	"go-chat/config"
+	"go-chat/middleware"
+	"go-chat/model"
+	"go-chat/pow"
+	"go-chat/ratelimit"
+	"net"
+)
+
+type limitConfig struct {
+	peerRate  float64
+	peerBurst int
+	typeRate  float64
+	typeBurst int
+}
+
+// WithRateLimit limits signals accepted from every peer in total and per
+// SignalType. Zero rate disables the corresponding limit.
+func WithRateLimit(peerRate float64, peerBurst int, typeRate float64, typeBurst int) Option {
+	return func(d *Dispatcher) {
+		d.limits = limitConfig{
+			peerRate:  peerRate,
+			peerBurst: peerBurst,
+			typeRate:  typeRate,
+			typeBurst: typeBurst,
+		}
+	}
+}
+
+// WithBanlist shares the list of banned peer hashes and IPs, e.g. with
+// network.Listen.
+func WithBanlist(b *banlist.Banlist) Option {
+	return func(d *Dispatcher) {
+		d.bans = b
+	}
+}
+
+// WithPoW requires proof of work stamps on inbound signals before they are
+// fanned out to subscribers.
+func WithPoW(p *pow.Policy) Option {
+	return func(d *Dispatcher) {
+		d.pow = p
+	}
+}
+
+// Difficulty is what signals of type t are minted with: the base of the PoW
+// policy raised as far as the peers raised theirs under load.
+func (d *Dispatcher) Difficulty(t model.SignalType) int {
+	if d.pow == nil {
+		return 0
+	}
+	d.mu.Lock()
+	var extra int32
+	for _, n := range d.peers {
+		extra = max(extra, n.extra.Load())
+	}
+	d.mu.Unlock()
+	return d.pow.Raised(t, int(extra))
+}
+
+// Misbehaved penalizes the peer for a frame rejected by the middleware.
+func (d *Dispatcher) Misbehaved(hash []byte, err error) {
+	d.Penalize(hash, penaltyOf(err))
+}
+
+func (d *Dispatcher) Penalize(hash []byte, points int) {
+	d.mu.Lock()
+	n, ok := d.peers[string(hash)]
+	d.mu.Unlock()
+	if !ok {
+		return
+	}
+	d.penalize(n, points)
+}
+
+func (d *Dispatcher) Score(hash []byte) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n, ok := d.peers[string(hash)]
+	if !ok {
+		return 0, false
+	}
+	return int(n.score.Load()), true
+}
+
+func (d *Dispatcher) penalize(n *Node, points int) {
+	if n.score.Add(int32(points)) < config.BanScore {
+		return
+	}
+	d.bans.Ban(n.hash, config.BanDuration)
+	if n.ip != "" {
+		d.bans.Ban(n.ip, config.BanDuration)
+	}
+	n.close()
+}
+
+func (d *Dispatcher) allow(n *Node, t model.SignalType) bool {
+	if n.limiter != nil && !n.limiter.Allow() {
+		return false
+	}
+	if d.limits.typeRate <= 0 {
+		return true
+	}
+	b, ok := n.typeLimits[t]
+	if !ok {
+		b = ratelimit.NewBucket(d.limits.typeRate, d.limits.typeBurst)
+		n.typeLimits[t] = b
+	}
+	return b.Allow()
+}
+
+func (d *Dispatcher) banned(n *Node) bool {
+	return d.bans.Banned(n.hash) || (n.ip != "" && d.bans.Banned(n.ip))
+}
+
+func penaltyOf(err error) int {
+	switch {
+	case errors.Is(err, middleware.ErrInvalidChecksum):
+		return config.PenaltyChecksum
+	case errors.Is(err, middleware.ErrInvalidSign):
+		return config.PenaltySign
+	default:
+		return config.PenaltyMalformed
+	}
+}
+
+func remoteIP(rwc any) string {
+	a, ok := rwc.(interface{ RemoteAddr() net.Addr })
+	if !ok || a.RemoteAddr() == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(a.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
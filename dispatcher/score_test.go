@@ -0,0 +1,94 @@
+package dispatcher
+
+import (
+	"crypto/rand"
+	"go-chat/banlist"
+	"go-chat/config"
+	"go-chat/middleware"
+	"go-chat/model"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Score(t *testing.T) {
+	t.Run("ban on malformed signals", func(t *testing.T) {
+		bans := banlist.New()
+		d := New(WithBanlist(bans))
+		hash := []byte(rand.Text())
+		r, w := io.Pipe()
+		d.Dispatch(hash, &rwcadap{Reader: r, Writer: io.Discard})
+
+		go func() {
+			for range config.BanScore/config.PenaltyMalformed + 1 {
+				w.Write([]byte("short"))
+			}
+		}()
+
+		assert.Eventually(t, func() bool {
+			return bans.Banned(string(hash))
+		}, time.Second, 10*time.Millisecond)
+		assert.Eventually(t, func() bool {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			return len(d.peers) == 0
+		}, time.Second, 10*time.Millisecond)
+
+		d.Dispatch(hash, &rwcadap{Reader: r, Writer: io.Discard})
+		d.mu.Lock()
+		assert.Len(t, d.peers, 0)
+		d.mu.Unlock()
+	})
+
+	t.Run("penalize middleware errors", func(t *testing.T) {
+		d := New()
+		hash := []byte(rand.Text())
+		r, _ := io.Pipe()
+		d.Dispatch(hash, &rwcadap{Reader: r, Writer: io.Discard})
+
+		d.Misbehaved(hash, middleware.ErrInvalidChecksum)
+		score, ok := d.Score(hash)
+		assert.True(t, ok)
+		assert.Equal(t, config.PenaltyChecksum, score)
+	})
+
+	t.Run("drop duplicates", func(t *testing.T) {
+		d := New()
+		hash := []byte(rand.Text())
+		r, w := io.Pipe()
+		d.Dispatch(hash, &rwcadap{Reader: r, Writer: io.Discard})
+		ch := d.SubscribeType(model.SignalTypeOffer)
+
+		s, _ := model.NewSignal(model.SignalTypeOffer, model.GenerateKey(), []byte("offer"))
+		w.Write(s)
+		w.Write(s)
+		other, _ := model.NewSignal(model.SignalTypeOffer, model.GenerateKey(), []byte("other"))
+		w.Write(other)
+
+		assert.Equal(t, s, <-ch)
+		assert.Equal(t, other, <-ch)
+		score, _ := d.Score(hash)
+		assert.Equal(t, config.PenaltyDuplicate, score)
+	})
+
+	t.Run("rate limit per type", func(t *testing.T) {
+		d := New(WithRateLimit(0, 0, 0.001, 2))
+		hash := []byte(rand.Text())
+		r, w := io.Pipe()
+		d.Dispatch(hash, &rwcadap{Reader: r, Writer: io.Discard})
+		ch := d.SubscribeType(model.SignalTypeOffer)
+
+		for range 3 {
+			s, _ := model.NewSignal(model.SignalTypeOffer, model.GenerateKey(), nil)
+			w.Write(s)
+		}
+		answer, _ := model.NewSignal(model.SignalTypeAnswer, model.GenerateKey(), nil)
+		w.Write(answer)
+
+		assert.Len(t, ch, 2)
+		score, _ := d.Score(hash)
+		assert.Equal(t, config.PenaltyRate, score)
+	})
+}
@@ -0,0 +1,61 @@
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// messageInfo separates the keys of pairwise messages from other users of
+// the chain, like group sender keys.
+const messageInfo = "go-chat message"
+
+// StepChain advances a symmetric chain key, it returns the next chain key
+// and the message key of this step.
+func StepChain(ck []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x02})
+	next := mac.Sum(nil)
+	mac = hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x01})
+	return next, mac.Sum(nil)
+}
+
+func aead(info string, mk []byte) (cipher.AEAD, []byte, error) {
+	out, err := hkdf.Key(sha256.New, mk, nil, info, keyLen+12)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(out[:keyLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, out[keyLen:], nil
+}
+
+// Seal encrypts pt with the message key mk and appends it to dst.
+func Seal(info string, mk, ad, pt, dst []byte) ([]byte, error) {
+	gcm, nonce, err := aead(info, mk)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(dst, nonce, pt, ad), nil
+}
+
+func Open(info string, mk, ad, ct []byte) ([]byte, error) {
+	gcm, nonce, err := aead(info, mk)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := gcm.Open(nil, nonce, ct, ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return pt, nil
+}
@@ -0,0 +1,274 @@
+package e2e
+
+import (
+	"encoding/hex"
+	"go-chat/storage"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bucket(t *testing.T) storage.Bucket {
+	db, err := storage.Open(filepath.Join(t.TempDir(), "test.db"), "")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db.Bucket("test")
+}
+
+func identity(t *testing.T) (Identity, *PreKeys) {
+	id, err := NewIdentity()
+	require.NoError(t, err)
+	pk, err := NewPreKeys(id, bucket(t))
+	require.NoError(t, err)
+	return id, pk
+}
+
+func pair(t *testing.T) (*Session, *Session) {
+	alice, _ := identity(t)
+	bob, bobKeys := identity(t)
+
+	b, err := ParseBundle(mustMarshal(t, bobKeys.Bundle(bob)))
+	require.NoError(t, err)
+	a, err := Initiate(alice, b)
+	require.NoError(t, err)
+	msg, err := a.Encrypt([]byte("hello"))
+	require.NoError(t, err)
+
+	s, pt, err := Respond(bob, bobKeys, msg)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), pt)
+	assert.Equal(t, a.ID(), s.ID())
+	return a, s
+}
+
+func Test_Session(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		a, b := pair(t)
+		for i, text := range []string{"one", "two", "three"} {
+			from, to := a, b
+			if i%2 == 1 {
+				from, to = b, a
+			}
+			msg, err := from.Encrypt([]byte(text))
+			require.NoError(t, err)
+			pt, err := to.Decrypt(msg)
+			require.NoError(t, err)
+			assert.Equal(t, text, string(pt))
+		}
+		assert.Nil(t, a.pending)
+	})
+
+	t.Run("out of order", func(t *testing.T) {
+		a, b := pair(t)
+		var msgs [][]byte
+		for _, text := range []string{"1", "2", "3"} {
+			msg, err := a.Encrypt([]byte(text))
+			require.NoError(t, err)
+			msgs = append(msgs, msg)
+		}
+		for _, i := range []int{2, 0, 1} {
+			pt, err := b.Decrypt(msgs[i])
+			require.NoError(t, err)
+			assert.Equal(t, []byte{byte('1' + i)}, pt)
+		}
+		assert.Empty(t, b.skipped)
+
+		_, err := b.Decrypt(msgs[0])
+		assert.Error(t, err)
+	})
+
+	t.Run("tampered message", func(t *testing.T) {
+		a, b := pair(t)
+		msg, err := a.Encrypt([]byte("hi"))
+		require.NoError(t, err)
+
+		before, err := b.Marshal()
+		require.NoError(t, err)
+		bad := append([]byte(nil), msg...)
+		bad[len(bad)-1] ^= 1
+		_, err = b.Decrypt(bad)
+		assert.ErrorIs(t, err, ErrDecrypt)
+		after, err := b.Marshal()
+		require.NoError(t, err)
+		assert.Equal(t, before, after)
+
+		pt, err := b.Decrypt(msg)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("hi"), pt)
+	})
+
+	t.Run("too many skipped", func(t *testing.T) {
+		a, b := pair(t)
+		a.ns = MaxSkip + 2
+		msg, err := a.Encrypt([]byte("late"))
+		require.NoError(t, err)
+		_, err = b.Decrypt(msg)
+		assert.ErrorIs(t, err, ErrTooManySkipped)
+	})
+
+	t.Run("responder waits", func(t *testing.T) {
+		_, b := pair(t)
+		s := responder(b.rk, b.ad, b.dhs)
+		_, err := s.Encrypt([]byte("early"))
+		assert.ErrorIs(t, err, ErrNotReady)
+	})
+}
+
+func Test_PreKeys(t *testing.T) {
+	t.Run("first message taken once", func(t *testing.T) {
+		alice, _ := identity(t)
+		bob, bobKeys := identity(t)
+		a, err := Initiate(alice, bobKeys.Bundle(bob))
+		require.NoError(t, err)
+		msg, err := a.Encrypt([]byte("hi"))
+		require.NoError(t, err)
+
+		bad := append([]byte(nil), msg...)
+		bad[len(bad)-1] ^= 1
+		_, _, err = Respond(bob, bobKeys, bad)
+		assert.ErrorIs(t, err, ErrDecrypt)
+
+		_, _, err = Respond(bob, bobKeys, msg)
+		require.NoError(t, err)
+		_, _, err = Respond(bob, bobKeys, msg)
+		assert.ErrorIs(t, err, ErrReplayed)
+	})
+
+	t.Run("survive restart", func(t *testing.T) {
+		alice, _ := identity(t)
+		bob, err := NewIdentity()
+		require.NoError(t, err)
+		store := bucket(t)
+		bobKeys, err := NewPreKeys(bob, store)
+		require.NoError(t, err)
+		a, err := Initiate(alice, bobKeys.Bundle(bob))
+		require.NoError(t, err)
+		msg, err := a.Encrypt([]byte("hi"))
+		require.NoError(t, err)
+		_, _, err = Respond(bob, bobKeys, msg)
+		require.NoError(t, err)
+
+		bobKeys, err = NewPreKeys(bob, store)
+		require.NoError(t, err)
+		_, _, err = Respond(bob, bobKeys, msg)
+		assert.ErrorIs(t, err, ErrReplayed)
+
+		a, err = Initiate(alice, bobKeys.Bundle(bob))
+		require.NoError(t, err)
+		msg, err = a.Encrypt([]byte("again"))
+		require.NoError(t, err)
+		_, pt, err := Respond(bob, bobKeys, msg)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("again"), pt)
+	})
+
+	t.Run("forged bundle", func(t *testing.T) {
+		bob, bobKeys := identity(t)
+		eve, _ := identity(t)
+		b := bobKeys.Bundle(bob)
+		b.SignedPreKey = eve.DH.PublicKey().Bytes()
+		_, err := ParseBundle(mustMarshal(t, b))
+		assert.ErrorIs(t, err, ErrInvalidBundle)
+	})
+
+	t.Run("identity round trip", func(t *testing.T) {
+		id, _ := identity(t)
+		parsed, err := ParseIdentity(id.Marshal())
+		require.NoError(t, err)
+		assert.True(t, id.DH.Equal(parsed.DH))
+		assert.True(t, id.Sign.Equal(parsed.Sign))
+	})
+}
+
+func Test_Manager(t *testing.T) {
+	manager := func(t *testing.T, dir string, id Identity, pk *PreKeys) *Manager {
+		store, err := NewFileStore(dir)
+		require.NoError(t, err)
+		m, err := NewManager(id, pk, store)
+		require.NoError(t, err)
+		return m
+	}
+
+	aliceID, aliceKeys := identity(t)
+	bobID, bobKeys := identity(t)
+	aliceDir, bobDir := t.TempDir(), t.TempDir()
+	alice := manager(t, aliceDir, aliceID, aliceKeys)
+	bob := manager(t, bobDir, bobID, bobKeys)
+
+	contact, err := alice.Start(bob.Bundle())
+	require.NoError(t, err)
+	id, msg, err := alice.Encrypt(contact, []byte("hi bob"))
+	require.NoError(t, err)
+
+	assert.True(t, bob.Addressed(id, msg))
+	other, _ := identity(t)
+	assert.False(t, manager(t, t.TempDir(), other, bobKeys).Addressed(id, msg))
+
+	from, pt, err := bob.Decrypt(id, msg)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hi bob"), pt)
+
+	// Both sides survive a restart.
+	alice = manager(t, aliceDir, aliceID, aliceKeys)
+	bob = manager(t, bobDir, bobID, bobKeys)
+
+	id, msg, err = bob.Encrypt(from, []byte("hi alice"))
+	require.NoError(t, err)
+	assert.Equal(t, byte(msgNormal), msg[0])
+	_, pt, err = alice.Decrypt(id, msg)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hi alice"), pt)
+
+	_, _, err = alice.Encrypt("unknown", []byte("hi"))
+	assert.ErrorIs(t, err, ErrNoSession)
+
+	carolID, carolKeys := identity(t)
+	carol := manager(t, t.TempDir(), carolID, carolKeys)
+	alice.Remember(carol.Bundle())
+	id, msg, err = alice.Encrypt(hex.EncodeToString(carolID.DH.PublicKey().Bytes()), []byte("hi carol"))
+	require.NoError(t, err)
+	first := msg
+	_, pt, err = carol.Decrypt(id, msg)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hi carol"), pt)
+
+	t.Run("replay keeps the session", func(t *testing.T) {
+		reply, answer, err := carol.Encrypt(hex.EncodeToString(aliceID.DH.PublicKey().Bytes()), []byte("hi"))
+		require.NoError(t, err)
+		_, _, err = carol.Decrypt(id, first)
+		assert.ErrorIs(t, err, ErrReplayed)
+
+		_, pt, err := alice.Decrypt(reply, answer)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("hi"), pt)
+	})
+
+	t.Run("new bundle while pending", func(t *testing.T) {
+		daveID, err := NewIdentity()
+		require.NoError(t, err)
+		lost, err := NewPreKeys(daveID, bucket(t))
+		require.NoError(t, err)
+		alice.Remember(lost.Bundle(daveID))
+		dave := hex.EncodeToString(daveID.DH.PublicKey().Bytes())
+		_, _, err = alice.Encrypt(dave, []byte("lost"))
+		require.NoError(t, err)
+
+		keys, err := NewPreKeys(daveID, bucket(t))
+		require.NoError(t, err)
+		m := manager(t, t.TempDir(), daveID, keys)
+		alice.Remember(m.Bundle())
+		id, msg, err := alice.Encrypt(dave, []byte("found"))
+		require.NoError(t, err)
+		_, pt, err := m.Decrypt(id, msg)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("found"), pt)
+	})
+}
+
+func mustMarshal(t *testing.T, b Bundle) []byte {
+	data, err := b.Marshal()
+	require.NoError(t, err)
+	return data
+}
@@ -0,0 +1,248 @@
+package e2e
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"go-chat/storage"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var ErrNoSession = errors.New("no session with contact")
+
+// FileStore keeps every session in its own file of dir.
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (f *FileStore) Save(contact string, state []byte) error {
+	// Write and rename, so a crash never leaves a half written state behind.
+	tmp := f.path(contact) + ".tmp"
+	if err := os.WriteFile(tmp, state, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path(contact))
+}
+
+func (f *FileStore) Load(contact string) ([]byte, error) {
+	return os.ReadFile(f.path(contact))
+}
+
+func (f *FileStore) Delete(contact string) error {
+	return os.Remove(f.path(contact))
+}
+
+func (f *FileStore) List() ([]string, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, e := range entries {
+		if name, ok := strings.CutSuffix(e.Name(), ".session"); ok {
+			out = append(out, name)
+		}
+	}
+	return out, nil
+}
+
+func (f *FileStore) path(contact string) string {
+	return filepath.Join(f.dir, contact+".session")
+}
+
+// Manager keeps a session per contact. Contacts are named by the hex of
+// their identity key.
+type Manager struct {
+	mu       sync.Mutex
+	id       Identity
+	prekeys  *PreKeys
+	store    storage.Store
+	sessions map[string]*Session
+	byID     map[string]string
+	bundles  map[string]Bundle
+}
+
+func NewManager(id Identity, prekeys *PreKeys, store storage.Store) (*Manager, error) {
+	m := &Manager{
+		id:       id,
+		prekeys:  prekeys,
+		store:    store,
+		sessions: map[string]*Session{},
+		byID:     map[string]string{},
+		bundles:  map[string]Bundle{},
+	}
+	contacts, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range contacts {
+		b, err := store.Load(c)
+		if err != nil {
+			return nil, err
+		}
+		s, err := LoadSession(b)
+		if err != nil {
+			return nil, err
+		}
+		m.add(c, s)
+	}
+	return m, nil
+}
+
+func (m *Manager) Identity() Identity {
+	return m.id
+}
+
+func (m *Manager) Bundle() Bundle {
+	return m.prekeys.Bundle(m.id)
+}
+
+// Start begins a session with the owner of the bundle. It returns the
+// contact name.
+func (m *Manager) Start(b Bundle) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.start(b)
+}
+
+// Remember keeps the bundle, so the first message to its owner starts a
+// session without one. A session the owner never answered starts over with
+// a bundle of another signed prekey, the old one may be lost.
+func (m *Manager) Remember(b Bundle) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.bundles[hex.EncodeToString(b.Identity)] = b
+}
+
+func (m *Manager) start(b Bundle) (string, error) {
+	s, err := Initiate(m.id, b)
+	if err != nil {
+		return "", err
+	}
+	contact := hex.EncodeToString(b.Identity)
+	if err := m.save(contact, s); err != nil {
+		return "", err
+	}
+	m.add(contact, s)
+	return contact, nil
+}
+
+// Encrypt returns the session id, used as the signal key, and the message.
+func (m *Manager) Encrypt(contact string, pt []byte) ([]byte, []byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[contact]
+	if b, known := m.bundles[contact]; known && (!ok || s.stale(b)) {
+		if _, err := m.start(b); err != nil {
+			return nil, nil, err
+		}
+		s, ok = m.sessions[contact]
+	}
+	if !ok {
+		return nil, nil, ErrNoSession
+	}
+	next := s.clone()
+	msg, err := next.Encrypt(pt)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The state is saved before the message leaves, a message key must
+	// never be used twice after a restart.
+	if err := m.save(contact, next); err != nil {
+		return nil, nil, err
+	}
+	*s = *next
+	return s.ID(), msg, nil
+}
+
+// Decrypt finds the session by the signal key, prekey messages of unknown
+// sessions start a new one. A replayed prekey message is refused and leaves
+// the session in place.
+func (m *Manager) Decrypt(id []byte, msg []byte) (string, []byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	contact, ok := m.byID[string(id)]
+	if !ok {
+		return m.respond(msg)
+	}
+
+	s := m.sessions[contact]
+	next := s.clone()
+	pt, err := next.Decrypt(msg)
+	if err != nil && len(msg) > 0 && msg[0] == msgPreKey {
+		// The contact lost its state and started over, with a new ephemeral
+		// key or Respond refuses it.
+		return m.respond(msg)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if err := m.save(contact, next); err != nil {
+		return "", nil, err
+	}
+	*s = *next
+	return contact, pt, nil
+}
+
+func (m *Manager) respond(msg []byte) (string, []byte, error) {
+	s, pt, err := Respond(m.id, m.prekeys, msg)
+	if err != nil {
+		return "", nil, err
+	}
+	contact := hex.EncodeToString(s.ad[:keyLen])
+	if err := m.save(contact, s); err != nil {
+		return "", nil, err
+	}
+	m.add(contact, s)
+	return contact, pt, nil
+}
+
+func (m *Manager) add(contact string, s *Session) {
+	if old, ok := m.sessions[contact]; ok {
+		delete(m.byID, string(old.ID()))
+	}
+	m.sessions[contact] = s
+	m.byID[string(s.ID())] = contact
+}
+
+func (m *Manager) save(contact string, s *Session) error {
+	b, err := s.Marshal()
+	if err != nil {
+		return err
+	}
+	return m.store.Save(contact, b)
+}
+
+// Addressed reports whether the message belongs to one of the sessions or
+// starts a new one with this identity, without decrypting it.
+func (m *Manager) Addressed(id []byte, msg []byte) bool {
+	m.mu.Lock()
+	_, ok := m.byID[string(id)]
+	m.mu.Unlock()
+	if ok {
+		return true
+	}
+	if len(msg) < 1 || msg[0] != msgPreKey {
+		return false
+	}
+	h, err := decodePreKeyHeader(msg[1:])
+	if err != nil {
+		return false
+	}
+	s := Session{ad: associated(h.identity, m.id.DH.PublicKey().Bytes())}
+	return bytes.Equal(s.ID(), id)
+}
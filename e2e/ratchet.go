@@ -0,0 +1,334 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+const (
+	msgNormal byte = iota
+	msgPreKey
+)
+
+const (
+	headerLen = keyLen + 4 + 4
+	// MaxSkip bounds message keys derived ahead for a single chain, so a
+	// forged header can't make the receiver spin.
+	MaxSkip = 1000
+	// maxSkipped bounds the message keys kept for late messages.
+	maxSkipped = 2 * MaxSkip
+)
+
+var (
+	ErrInvalidMessage = errors.New("invalid message")
+	ErrDecrypt        = errors.New("message authentication failed")
+	ErrTooManySkipped = errors.New("too many skipped messages")
+	ErrNotReady       = errors.New("session can't send yet")
+)
+
+type header struct {
+	dh []byte
+	pn uint32
+	n  uint32
+}
+
+func (h header) encode() []byte {
+	out := make([]byte, 0, headerLen)
+	out = append(out, h.dh...)
+	out = binary.BigEndian.AppendUint32(out, h.pn)
+	return binary.BigEndian.AppendUint32(out, h.n)
+}
+
+func decodeHeader(b []byte) (header, error) {
+	if len(b) < headerLen {
+		return header{}, ErrInvalidMessage
+	}
+	return header{
+		dh: b[:keyLen],
+		pn: binary.BigEndian.Uint32(b[keyLen:]),
+		n:  binary.BigEndian.Uint32(b[keyLen+4:]),
+	}, nil
+}
+
+type skipped struct {
+	dh []byte
+	n  uint32
+	mk []byte
+}
+
+// Session is the Double Ratchet state of a conversation with one contact.
+type Session struct {
+	ad      []byte
+	dhs     *ecdh.PrivateKey
+	dhr     *ecdh.PublicKey
+	rk      []byte
+	cks     []byte
+	ckr     []byte
+	ns      uint32
+	nr      uint32
+	pn      uint32
+	skipped []skipped
+	pending *preKeyHeader
+}
+
+func initiator(sk, ad []byte, remote *ecdh.PublicKey) (*Session, error) {
+	dhs, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{ad: ad, dhs: dhs, dhr: remote}
+	dh, err := dhs.ECDH(remote)
+	if err != nil {
+		return nil, err
+	}
+	s.rk, s.cks, err = kdfRK(sk, dh)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func responder(sk, ad []byte, spk *ecdh.PrivateKey) *Session {
+	return &Session{ad: ad, dhs: spk, rk: sk}
+}
+
+// ID identifies the session on both sides without revealing the identities,
+// it is used as the key of signals carrying the messages.
+func (s *Session) ID() []byte {
+	sum := sha256.Sum256(s.ad)
+	return sum[:16]
+}
+
+func (s *Session) Encrypt(pt []byte) ([]byte, error) {
+	if s.cks == nil {
+		return nil, ErrNotReady
+	}
+	ck, mk := StepChain(s.cks)
+	h := header{dh: s.dhs.PublicKey().Bytes(), pn: s.pn, n: s.ns}
+
+	out := []byte{msgNormal}
+	if s.pending != nil {
+		out = append([]byte{msgPreKey}, s.pending.encode()...)
+	}
+	hb := h.encode()
+	out = append(out, hb...)
+	out, err := Seal(messageInfo, mk, append(append([]byte(nil), s.ad...), hb...), pt, out)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cks = ck
+	s.ns++
+	return out, nil
+}
+
+// Decrypt leaves the session untouched when the message doesn't
+// authenticate.
+func (s *Session) Decrypt(msg []byte) ([]byte, error) {
+	if len(msg) < 1 {
+		return nil, ErrInvalidMessage
+	}
+	body := msg[1:]
+	switch msg[0] {
+	case msgNormal:
+	case msgPreKey:
+		if len(body) < preKeyHeaderLen {
+			return nil, ErrInvalidMessage
+		}
+		body = body[preKeyHeaderLen:]
+	default:
+		return nil, ErrInvalidMessage
+	}
+	h, err := decodeHeader(body)
+	if err != nil {
+		return nil, err
+	}
+	ad := append(append([]byte(nil), s.ad...), body[:headerLen]...)
+	ct := body[headerLen:]
+
+	for i, sk := range s.skipped {
+		if sk.n == h.n && bytes.Equal(sk.dh, h.dh) {
+			pt, err := Open(messageInfo, sk.mk, ad, ct)
+			if err != nil {
+				return nil, err
+			}
+			s.skipped = append(s.skipped[:i], s.skipped[i+1:]...)
+			return pt, nil
+		}
+	}
+
+	next := s.clone()
+	if next.dhr == nil || !bytes.Equal(next.dhr.Bytes(), h.dh) {
+		if err := next.skip(h.pn); err != nil {
+			return nil, err
+		}
+		if err := next.ratchet(h); err != nil {
+			return nil, err
+		}
+	}
+	if err := next.skip(h.n); err != nil {
+		return nil, err
+	}
+	ck, mk := StepChain(next.ckr)
+	pt, err := Open(messageInfo, mk, ad, ct)
+	if err != nil {
+		return nil, err
+	}
+	next.ckr = ck
+	next.nr++
+	// The responder answered, so it knows the session.
+	next.pending = nil
+	*s = *next
+	return pt, nil
+}
+
+func (s *Session) skip(until uint32) error {
+	if s.ckr == nil {
+		return nil
+	}
+	if until < s.nr || until-s.nr > MaxSkip {
+		return ErrTooManySkipped
+	}
+	for s.nr < until {
+		ck, mk := StepChain(s.ckr)
+		s.skipped = append(s.skipped, skipped{dh: s.dhr.Bytes(), n: s.nr, mk: mk})
+		s.ckr = ck
+		s.nr++
+	}
+	if len(s.skipped) > maxSkipped {
+		s.skipped = s.skipped[len(s.skipped)-maxSkipped:]
+	}
+	return nil
+}
+
+func (s *Session) ratchet(h header) error {
+	dhr, err := ecdh.X25519().NewPublicKey(h.dh)
+	if err != nil {
+		return ErrInvalidMessage
+	}
+	s.pn = s.ns
+	s.ns, s.nr = 0, 0
+	s.dhr = dhr
+
+	dh, err := s.dhs.ECDH(dhr)
+	if err != nil {
+		return ErrInvalidMessage
+	}
+	if s.rk, s.ckr, err = kdfRK(s.rk, dh); err != nil {
+		return err
+	}
+	if s.dhs, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		return err
+	}
+	if dh, err = s.dhs.ECDH(dhr); err != nil {
+		return ErrInvalidMessage
+	}
+	s.rk, s.cks, err = kdfRK(s.rk, dh)
+	return err
+}
+
+// stale reports whether the session waits for an answer to a signed prekey
+// the bundle no longer publishes.
+func (s *Session) stale(b Bundle) bool {
+	return s.pending != nil && s.pending.signedID != b.SignedPreKeyID
+}
+
+func (s *Session) clone() *Session {
+	c := *s
+	c.skipped = append([]skipped(nil), s.skipped...)
+	return &c
+}
+
+type sessionState struct {
+	AD      []byte         `json:"ad"`
+	DHs     []byte         `json:"dhs"`
+	DHr     []byte         `json:"dhr,omitempty"`
+	RK      []byte         `json:"rk"`
+	CKs     []byte         `json:"cks,omitempty"`
+	CKr     []byte         `json:"ckr,omitempty"`
+	Ns      uint32         `json:"ns"`
+	Nr      uint32         `json:"nr"`
+	PN      uint32         `json:"pn"`
+	Skipped []skippedState `json:"skipped,omitempty"`
+	Pending []byte         `json:"pending,omitempty"`
+}
+
+type skippedState struct {
+	DH []byte `json:"dh"`
+	N  uint32 `json:"n"`
+	MK []byte `json:"mk"`
+}
+
+func (s *Session) Marshal() ([]byte, error) {
+	st := sessionState{
+		AD:  s.ad,
+		DHs: s.dhs.Bytes(),
+		RK:  s.rk,
+		CKs: s.cks,
+		CKr: s.ckr,
+		Ns:  s.ns,
+		Nr:  s.nr,
+		PN:  s.pn,
+	}
+	if s.dhr != nil {
+		st.DHr = s.dhr.Bytes()
+	}
+	for _, sk := range s.skipped {
+		st.Skipped = append(st.Skipped, skippedState{DH: sk.dh, N: sk.n, MK: sk.mk})
+	}
+	if s.pending != nil {
+		st.Pending = s.pending.encode()
+	}
+	return json.Marshal(st)
+}
+
+func LoadSession(b []byte) (*Session, error) {
+	var st sessionState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, err
+	}
+	dhs, err := ecdh.X25519().NewPrivateKey(st.DHs)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		ad:  st.AD,
+		dhs: dhs,
+		rk:  st.RK,
+		cks: st.CKs,
+		ckr: st.CKr,
+		ns:  st.Ns,
+		nr:  st.Nr,
+		pn:  st.PN,
+	}
+	if st.DHr != nil {
+		if s.dhr, err = ecdh.X25519().NewPublicKey(st.DHr); err != nil {
+			return nil, err
+		}
+	}
+	for _, sk := range st.Skipped {
+		s.skipped = append(s.skipped, skipped{dh: sk.DH, n: sk.N, mk: sk.MK})
+	}
+	if st.Pending != nil {
+		h, err := decodePreKeyHeader(st.Pending)
+		if err != nil {
+			return nil, err
+		}
+		s.pending = &h
+	}
+	return s, nil
+}
+
+func kdfRK(rk, dh []byte) ([]byte, []byte, error) {
+	out, err := hkdf.Key(sha256.New, dh, rk, "go-chat ratchet", 2*keyLen)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out[:keyLen], out[keyLen:], nil
+}
@@ -0,0 +1,344 @@
+package e2e
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"go-chat/storage"
+	"sync"
+)
+
+const keyLen = 32
+
+var (
+	ErrInvalidBundle   = errors.New("invalid prekey bundle")
+	ErrUnknownPreKey   = errors.New("unknown prekey")
+	ErrInvalidIdentity = errors.New("invalid identity")
+	ErrReplayed        = errors.New("prekey message replayed")
+)
+
+// Identity is the long term key pair of a user: an X25519 key for the key
+// agreement and an ed25519 key signing the prekeys.
+type Identity struct {
+	DH   *ecdh.PrivateKey
+	Sign ed25519.PrivateKey
+}
+
+func NewIdentity() (Identity, error) {
+	dh, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return Identity{}, err
+	}
+	_, sign, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{DH: dh, Sign: sign}, nil
+}
+
+func (id Identity) Marshal() []byte {
+	return append(id.DH.Bytes(), id.Sign.Seed()...)
+}
+
+func ParseIdentity(b []byte) (Identity, error) {
+	if len(b) != keyLen+ed25519.SeedSize {
+		return Identity{}, ErrInvalidIdentity
+	}
+	dh, err := ecdh.X25519().NewPrivateKey(b[:keyLen])
+	if err != nil {
+		return Identity{}, ErrInvalidIdentity
+	}
+	return Identity{DH: dh, Sign: ed25519.NewKeyFromSeed(b[keyLen:])}, nil
+}
+
+// Bundle is published so others can start a session while the owner is
+// offline.
+type Bundle struct {
+	Identity       []byte `json:"ik"`
+	SignKey        []byte `json:"sk"`
+	SignedPreKey   []byte `json:"spk"`
+	SignedPreKeyID uint32 `json:"spk_id"`
+	Signature      []byte `json:"sig"`
+}
+
+func (b Bundle) Marshal() ([]byte, error) {
+	return json.Marshal(b)
+}
+
+func ParseBundle(data []byte) (Bundle, error) {
+	var b Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return Bundle{}, ErrInvalidBundle
+	}
+	if len(b.Identity) != keyLen || len(b.SignedPreKey) != keyLen || len(b.SignKey) != ed25519.PublicKeySize {
+		return Bundle{}, ErrInvalidBundle
+	}
+	if !ed25519.Verify(b.SignKey, signedPreKeyData(b.Identity, b.SignedPreKey), b.Signature) {
+		return Bundle{}, ErrInvalidBundle
+	}
+	return b, nil
+}
+
+// PreKeys holds the private half of the published signed prekey and the
+// ephemeral keys of the sessions started with it. A first message is taken
+// once, a replayed one would reset the session.
+type PreKeys struct {
+	mu       sync.Mutex
+	store    storage.Store
+	signed   *ecdh.PrivateKey
+	signedID uint32
+	sig      []byte
+	used     map[string]bool
+}
+
+type preKeysState struct {
+	Signed []byte `json:"spk"`
+	ID     uint32 `json:"spk_id"`
+	Sig    []byte `json:"sig"`
+}
+
+// signedKey names the signed prekey in the store, the other keys are the
+// hex of used ephemeral keys.
+const signedKey = "signed"
+
+// NewPreKeys loads the prekeys of the store, or creates them, so bundles
+// published before a restart still match.
+func NewPreKeys(id Identity, store storage.Store) (*PreKeys, error) {
+	p := &PreKeys{store: store, used: map[string]bool{}}
+	b, err := store.Load(signedKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		return p, p.generate(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st preKeysState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, err
+	}
+	if p.signed, err = ecdh.X25519().NewPrivateKey(st.Signed); err != nil {
+		return nil, err
+	}
+	p.signedID, p.sig = st.ID, st.Sig
+	keys, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if k != signedKey {
+			p.used[k] = true
+		}
+	}
+	return p, nil
+}
+
+func (p *PreKeys) generate(id Identity) error {
+	spk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	// A random id makes bundles of a lost store fail to match instead of
+	// deriving a wrong key.
+	var sid [4]byte
+	rand.Read(sid[:])
+	p.signed, p.signedID = spk, binary.BigEndian.Uint32(sid[:])
+	p.sig = ed25519.Sign(id.Sign, signedPreKeyData(id.DH.PublicKey().Bytes(), spk.PublicKey().Bytes()))
+	b, err := json.Marshal(preKeysState{Signed: spk.Bytes(), ID: p.signedID, Sig: p.sig})
+	if err != nil {
+		return err
+	}
+	return p.store.Save(signedKey, b)
+}
+
+// Bundle publishes the signed prekey.
+func (p *PreKeys) Bundle(id Identity) Bundle {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return Bundle{
+		Identity:       id.DH.PublicKey().Bytes(),
+		SignKey:        id.Sign.Public().(ed25519.PublicKey),
+		SignedPreKey:   p.signed.PublicKey().Bytes(),
+		SignedPreKeyID: p.signedID,
+		Signature:      p.sig,
+	}
+}
+
+func (p *PreKeys) lookup(h preKeyHeader) (*ecdh.PrivateKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if h.signedID != p.signedID {
+		return nil, ErrUnknownPreKey
+	}
+	if p.used[hex.EncodeToString(h.ephemeral)] {
+		return nil, ErrReplayed
+	}
+	return p.signed, nil
+}
+
+// use keeps the ephemeral key of a session that started, before the session
+// is handed out.
+func (p *PreKeys) use(ephemeral []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	k := hex.EncodeToString(ephemeral)
+	if p.used[k] {
+		return ErrReplayed
+	}
+	if err := p.store.Save(k, []byte{1}); err != nil {
+		return err
+	}
+	p.used[k] = true
+	return nil
+}
+
+// preKeyHeader is sent with every message of the initiator until the
+// responder answers, so the responder can derive the same session.
+type preKeyHeader struct {
+	identity  []byte
+	ephemeral []byte
+	signedID  uint32
+}
+
+const preKeyHeaderLen = keyLen*2 + 4
+
+func (h preKeyHeader) encode() []byte {
+	out := make([]byte, 0, preKeyHeaderLen)
+	out = append(out, h.identity...)
+	out = append(out, h.ephemeral...)
+	return binary.BigEndian.AppendUint32(out, h.signedID)
+}
+
+func decodePreKeyHeader(b []byte) (preKeyHeader, error) {
+	if len(b) < preKeyHeaderLen {
+		return preKeyHeader{}, ErrInvalidMessage
+	}
+	return preKeyHeader{
+		identity:  b[:keyLen],
+		ephemeral: b[keyLen : 2*keyLen],
+		signedID:  binary.BigEndian.Uint32(b[2*keyLen:]),
+	}, nil
+}
+
+// Initiate runs the sender side of X3DH against a published bundle.
+func Initiate(id Identity, b Bundle) (*Session, error) {
+	spk, err := ecdh.X25519().NewPublicKey(b.SignedPreKey)
+	if err != nil {
+		return nil, ErrInvalidBundle
+	}
+	ik, err := ecdh.X25519().NewPublicKey(b.Identity)
+	if err != nil {
+		return nil, ErrInvalidBundle
+	}
+	ek, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := [][]byte{}
+	for _, pair := range []struct {
+		priv *ecdh.PrivateKey
+		pub  *ecdh.PublicKey
+	}{{id.DH, spk}, {ek, ik}, {ek, spk}} {
+		dh, err := pair.priv.ECDH(pair.pub)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, dh)
+	}
+	h := preKeyHeader{
+		identity:  id.DH.PublicKey().Bytes(),
+		ephemeral: ek.PublicKey().Bytes(),
+		signedID:  b.SignedPreKeyID,
+	}
+	sk, err := sharedKey(secrets)
+	if err != nil {
+		return nil, err
+	}
+	s, err := initiator(sk, associated(h.identity, b.Identity), spk)
+	if err != nil {
+		return nil, err
+	}
+	s.pending = &h
+	return s, nil
+}
+
+// Respond runs the receiver side of X3DH for the first message of a session
+// and decrypts it. Its ephemeral key is kept only when the message decrypts,
+// the same first message is refused afterwards.
+func Respond(id Identity, pk *PreKeys, msg []byte) (*Session, []byte, error) {
+	if len(msg) < 1 || msg[0] != msgPreKey {
+		return nil, nil, ErrInvalidMessage
+	}
+	h, err := decodePreKeyHeader(msg[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	spk, err := pk.lookup(h)
+	if err != nil {
+		return nil, nil, err
+	}
+	ik, err := ecdh.X25519().NewPublicKey(h.identity)
+	if err != nil {
+		return nil, nil, ErrInvalidMessage
+	}
+	ek, err := ecdh.X25519().NewPublicKey(h.ephemeral)
+	if err != nil {
+		return nil, nil, ErrInvalidMessage
+	}
+
+	secrets := [][]byte{}
+	for _, pair := range []struct {
+		priv *ecdh.PrivateKey
+		pub  *ecdh.PublicKey
+	}{{spk, ik}, {id.DH, ek}, {spk, ek}} {
+		dh, err := pair.priv.ECDH(pair.pub)
+		if err != nil {
+			return nil, nil, ErrInvalidMessage
+		}
+		secrets = append(secrets, dh)
+	}
+
+	sk, err := sharedKey(secrets)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := responder(sk, associated(h.identity, id.DH.PublicKey().Bytes()), spk)
+	pt, err := s.Decrypt(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := pk.use(h.ephemeral); err != nil {
+		return nil, nil, err
+	}
+	return s, pt, nil
+}
+
+func sharedKey(secrets [][]byte) ([]byte, error) {
+	// 32 0xff bytes separate the input from other uses of the same keys, as
+	// the X3DH specification suggests.
+	ikm := make([]byte, keyLen)
+	for i := range ikm {
+		ikm[i] = 0xff
+	}
+	for _, s := range secrets {
+		ikm = append(ikm, s...)
+	}
+	return hkdf.Key(sha256.New, ikm, make([]byte, keyLen), "go-chat x3dh", keyLen)
+}
+
+func associated(initiator, responder []byte) []byte {
+	return append(append([]byte(nil), initiator...), responder...)
+}
+
+func signedPreKeyData(identity, spk []byte) []byte {
+	return append(append([]byte("go-chat prekey"), identity...), spk...)
+}
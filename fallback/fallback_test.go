@@ -0,0 +1,147 @@
+package fallback
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"go-chat/dispatcher"
+	"go-chat/model"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeChannel struct{}
+
+func (fakeChannel) Send([]byte) error      { return nil }
+func (fakeChannel) OnMessage(func([]byte)) {}
+
+func links(t *testing.T, rate float64, burst int) (*Link, *Link, chan model.Signal) {
+	lkey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rkey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	key := model.GenerateKey()
+	wire := make(chan model.Signal, 10)
+	send := func(s model.Signal) { wire <- s }
+	return NewLink(key, lkey, rkey.PublicKey(), send, rate, burst),
+		NewLink(key, rkey, lkey.PublicKey(), send, rate, burst),
+		wire
+}
+
+func Test_Link(t *testing.T) {
+	t.Run("relay encrypted messages", func(t *testing.T) {
+		l, r, wire := links(t, 0, 0)
+		got := make(chan []byte, 1)
+		r.OnMessage(func(b []byte) { got <- b })
+
+		require.NoError(t, l.Send([]byte("hello")))
+		s := <-wire
+		assert.Equal(t, model.SignalTypeRelayData, s.Type())
+		assert.NotContains(t, string(s.Payload()), "hello")
+
+		r.Receive(s)
+		assert.Equal(t, []byte("hello"), <-got)
+	})
+
+	t.Run("ignore foreign payload", func(t *testing.T) {
+		_, r, _ := links(t, 0, 0)
+		other, _, wire := links(t, 0, 0)
+		r.OnMessage(func([]byte) { t.Fatal("unexpected message") })
+
+		require.NoError(t, other.Send([]byte("hello")))
+		r.Receive(<-wire)
+	})
+
+	t.Run("fit in a signal", func(t *testing.T) {
+		l, _, wire := links(t, 0, 0)
+		require.NoError(t, l.Send(make([]byte, MaxData)))
+		assert.Len(t, <-wire, dispatcher.MaxSignal)
+		assert.ErrorIs(t, l.Send(make([]byte, MaxData+1)), ErrTooBig)
+	})
+
+	t.Run("bandwidth cap", func(t *testing.T) {
+		l, _, _ := links(t, 0.001, 10)
+		assert.NoError(t, l.Send(make([]byte, 8)))
+		assert.ErrorIs(t, l.Send(make([]byte, 8)), ErrBandwidth)
+	})
+
+	t.Run("fall back when data channel doesn't open", func(t *testing.T) {
+		l, _, _ := links(t, 0, 0)
+		direct := fakeChannel{}
+
+		assert.Equal(t, Channel(l), Ready(make(chan struct{}), 10*time.Millisecond, direct, l))
+
+		ready := make(chan struct{})
+		close(ready)
+		assert.Equal(t, Channel(direct), Ready(ready, time.Second, direct, l))
+	})
+}
+
+func Test_Router(t *testing.T) {
+	relayData := func(key []byte, n int) model.Signal {
+		s, _ := model.NewSignal(model.SignalTypeRelayData, key, make([]byte, n))
+		return s
+	}
+	fastest := func(n int) [][]byte {
+		return [][]byte{[]byte("a"), []byte("b"), []byte("c")}[:n]
+	}
+
+	t.Run("forward to fastest peers", func(t *testing.T) {
+		var sent []string
+		r := NewRouter(Limits{Fanout: 2}, fastest, func(hash []byte, _ model.Signal) bool {
+			sent = append(sent, string(hash))
+			return true
+		})
+
+		assert.True(t, r.Forward(nil, relayData(model.GenerateKey(), 10)))
+		assert.Equal(t, []string{"a", "b"}, sent)
+
+		ping, _ := model.NewSignal(model.SignalTypePing, model.GenerateKey(), nil)
+		assert.False(t, r.Forward(nil, ping))
+	})
+
+	t.Run("skip source", func(t *testing.T) {
+		var sent []string
+		r := NewRouter(Limits{Fanout: 2}, fastest, func(hash []byte, _ model.Signal) bool {
+			sent = append(sent, string(hash))
+			return true
+		})
+
+		assert.True(t, r.Forward([]byte("a"), relayData(model.GenerateKey(), 10)))
+		assert.Equal(t, []string{"b", "c"}, sent)
+	})
+
+	t.Run("session bandwidth cap", func(t *testing.T) {
+		r := NewRouter(Limits{Fanout: 1, SessionRate: 0.001, SessionBurst: 200}, fastest,
+			func([]byte, model.Signal) bool { return true })
+
+		key := model.GenerateKey()
+		assert.True(t, r.Forward(nil, relayData(key, 100)))
+		assert.False(t, r.Forward(nil, relayData(key, 100)))
+		assert.True(t, r.Forward(nil, relayData(model.GenerateKey(), 100)))
+	})
+
+	t.Run("total bandwidth cap", func(t *testing.T) {
+		r := NewRouter(Limits{Fanout: 1, TotalRate: 0.001, TotalBurst: 200}, fastest,
+			func([]byte, model.Signal) bool { return true })
+
+		assert.True(t, r.Forward(nil, relayData(model.GenerateKey(), 100)))
+		assert.False(t, r.Forward(nil, relayData(model.GenerateKey(), 100)))
+	})
+
+	t.Run("limit sessions", func(t *testing.T) {
+		now := time.Now()
+		r := NewRouter(Limits{Fanout: 1, MaxSessions: 1, Idle: time.Minute}, fastest,
+			func([]byte, model.Signal) bool { return true })
+		r.now = func() time.Time { return now }
+
+		assert.True(t, r.Forward(nil, relayData(model.GenerateKey(), 10)))
+		assert.False(t, r.Forward(nil, relayData(model.GenerateKey(), 10)))
+
+		now = now.Add(2 * time.Minute)
+		assert.True(t, r.Forward(nil, relayData(model.GenerateKey(), 10)))
+	})
+}
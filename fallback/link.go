@@ -0,0 +1,120 @@
+package fallback
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"go-chat/dispatcher"
+	"go-chat/model"
+	"go-chat/netcrypt"
+	"go-chat/ratelimit"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBandwidth = errors.New("relay bandwidth exceeded")
+	ErrTooBig    = errors.New("too big for a relay")
+)
+
+// MaxData is the longest message a Link sends, RelayData around it has to
+// fit in a signal.
+const MaxData = dispatcher.MaxSignal - model.MinLen - netcrypt.Overhead
+
+// Channel is what chat traffic is sent over, either a WebRTC DataChannel or
+// a Link relayed through the mesh.
+type Channel interface {
+	Send(b []byte) error
+	OnMessage(fn func([]byte))
+}
+
+// Ready waits for the DataChannel to open. It returns the link when the
+// DataChannel didn't open in time.
+func Ready(ready <-chan struct{}, timeout time.Duration, direct, link Channel) Channel {
+	select {
+	case <-ready:
+		return direct
+	case <-time.After(timeout):
+		return link
+	}
+}
+
+// Link carries chat traffic of the session identified by key in RelayData
+// signals. Payloads are encrypted end to end, relaying peers only see the
+// session key.
+type Link struct {
+	mu        sync.Mutex
+	key       []byte
+	privkey   *ecdh.PrivateKey
+	pubkey    *ecdh.PublicKey
+	send      func(model.Signal)
+	bucket    *ratelimit.Bucket
+	onMessage func([]byte)
+}
+
+// NewLink creates a link limited to rate bytes per second. Zero rate
+// disables the limit.
+func NewLink(
+	key []byte,
+	privkey *ecdh.PrivateKey,
+	pubkey *ecdh.PublicKey,
+	send func(model.Signal),
+	rate float64,
+	burst int,
+) *Link {
+	l := &Link{
+		key:     key,
+		privkey: privkey,
+		pubkey:  pubkey,
+		send:    send,
+	}
+	if rate > 0 {
+		l.bucket = ratelimit.NewBucket(rate, burst)
+	}
+	return l
+}
+
+func (l *Link) Send(b []byte) error {
+	if len(b) > MaxData {
+		return ErrTooBig
+	}
+	if l.bucket != nil && !l.bucket.AllowN(len(b)) {
+		return ErrBandwidth
+	}
+	encrypted, err := netcrypt.Encrypt(b, l.privkey, l.pubkey)
+	if err != nil {
+		return err
+	}
+	s, err := model.NewSignal(model.SignalTypeRelayData, l.key, encrypted)
+	if err != nil {
+		return err
+	}
+	l.send(s)
+	return nil
+}
+
+func (l *Link) OnMessage(fn func([]byte)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.onMessage = fn
+}
+
+// Receive handles a RelayData signal addressed to the session.
+func (l *Link) Receive(s model.Signal) {
+	if s.Type() != model.SignalTypeRelayData {
+		return
+	}
+	b, err := netcrypt.Decrypt(s.Payload(), l.privkey, l.pubkey)
+	if err != nil {
+		log.Println("Receive: netcrypt.Decrypt:", err)
+		return
+	}
+
+	l.mu.Lock()
+	fn := l.onMessage
+	l.mu.Unlock()
+	if fn != nil {
+		fn(b)
+	}
+}
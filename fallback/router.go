@@ -0,0 +1,106 @@
+package fallback
+
+import (
+	"bytes"
+	"go-chat/model"
+	"go-chat/ratelimit"
+	"sync"
+	"time"
+)
+
+type Limits struct {
+	Fanout       int
+	SessionRate  float64
+	SessionBurst int
+	TotalRate    float64
+	TotalBurst   int
+	MaxSessions  int
+	Idle         time.Duration
+}
+
+type session struct {
+	bucket *ratelimit.Bucket
+	seen   time.Time
+}
+
+// Router forwards RelayData of other sessions to the fastest peers, within
+// per session and total bandwidth caps.
+type Router struct {
+	mu       sync.Mutex
+	limits   Limits
+	total    *ratelimit.Bucket
+	sessions map[string]*session
+	fastest  func(n int) [][]byte
+	sendTo   func(hash []byte, s model.Signal) bool
+	now      func() time.Time
+}
+
+func NewRouter(
+	limits Limits,
+	fastest func(n int) [][]byte,
+	sendTo func(hash []byte, s model.Signal) bool,
+) *Router {
+	r := &Router{
+		limits:   limits,
+		sessions: map[string]*session{},
+		fastest:  fastest,
+		sendTo:   sendTo,
+		now:      time.Now,
+	}
+	if limits.TotalRate > 0 {
+		r.total = ratelimit.NewBucket(limits.TotalRate, limits.TotalBurst)
+	}
+	return r
+}
+
+// Forward reports whether the signal was passed further. It is never sent
+// back to the peer it came from.
+func (r *Router) Forward(from []byte, s model.Signal) bool {
+	if s.Type() != model.SignalTypeRelayData || !r.allow(s.KeyString(), len(s)) {
+		return false
+	}
+
+	sent, n := false, 0
+	for _, hash := range r.fastest(r.limits.Fanout + 1) {
+		if n == r.limits.Fanout {
+			break
+		}
+		if bytes.Equal(hash, from) {
+			continue
+		}
+		n++
+		if r.sendTo(hash, s) {
+			sent = true
+		}
+	}
+	return sent
+}
+
+func (r *Router) allow(key string, n int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	ss, ok := r.sessions[key]
+	if !ok {
+		for k, o := range r.sessions {
+			if r.limits.Idle > 0 && now.Sub(o.seen) > r.limits.Idle {
+				delete(r.sessions, k)
+			}
+		}
+		if r.limits.MaxSessions > 0 && len(r.sessions) >= r.limits.MaxSessions {
+			return false
+		}
+		ss = &session{}
+		if r.limits.SessionRate > 0 {
+			ss.bucket = ratelimit.NewBucket(r.limits.SessionRate, r.limits.SessionBurst)
+		}
+		r.sessions[key] = ss
+	}
+	ss.seen = now
+
+	if ss.bucket != nil && !ss.bucket.AllowN(n) {
+		return false
+	}
+	return r.total == nil || r.total.AllowN(n)
+}
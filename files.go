@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"go-chat/config"
+	"go-chat/dispatcher"
+	"go-chat/handler"
+	"go-chat/model"
+	"go-chat/session"
+	"go-chat/storage"
+	"go-chat/transfer"
+	wrtc "go-chat/webrtc"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+type offered struct {
+	M       transfer.Manifest `json:"manifest"`
+	Sign    []byte            `json:"sign"`
+	Expires time.Time         `json:"expires"`
+}
+
+// incoming keeps the files accepted from contacts by channel label, until
+// they are received. They are saved in store, a transfer cut off by a
+// restart resumes when the contact offers the file again.
+type incoming struct {
+	mu     sync.Mutex
+	store  storage.Store
+	files  map[string]offered
+	active map[string]bool
+}
+
+func newIncoming(store storage.Store) (*incoming, error) {
+	in := &incoming{store: store, files: map[string]offered{}, active: map[string]bool{}}
+	labels, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, label := range labels {
+		b, err := store.Load(label)
+		if err != nil {
+			return nil, err
+		}
+		var o offered
+		if err := json.Unmarshal(b, &o); err != nil {
+			return nil, err
+		}
+		in.files[label] = o
+	}
+	return in, nil
+}
+
+// accept takes the file of m from the contact with sign. A file accepted
+// before is taken again right away, it reports whether m is such a file.
+func (in *incoming) accept(m transfer.Manifest, sign ed25519.PublicKey) (bool, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	now := time.Now()
+	for label, o := range in.files {
+		if now.After(o.Expires) && !in.active[label] {
+			if err := in.store.Delete(label); err != nil {
+				return false, err
+			}
+			delete(in.files, label)
+		}
+	}
+	o, resumed := in.files[m.Label()]
+	resumed = resumed && bytes.Equal(o.Sign, sign)
+	o = offered{M: m, Sign: sign, Expires: now.Add(config.FileResumeTimeout)}
+	b, err := json.Marshal(o)
+	if err != nil {
+		return false, err
+	}
+	if err := in.store.Save(m.Label(), b); err != nil {
+		return false, err
+	}
+	in.files[m.Label()] = o
+	return resumed, nil
+}
+
+// take hands out the file of the channel label once at a time.
+func (in *incoming) take(label string, sign ed25519.PublicKey) (transfer.Manifest, bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	o, ok := in.files[label]
+	if !ok || in.active[label] || !bytes.Equal(o.Sign, sign) || time.Now().After(o.Expires) {
+		return transfer.Manifest{}, false
+	}
+	in.active[label] = true
+	return o.M, true
+}
+
+// done ends the transfer of label. A transfer that failed for good is
+// forgotten, an interrupted one waits for the file to be offered again.
+func (in *incoming) done(label string, err error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	delete(in.active, label)
+	if err != nil && !errors.Is(err, transfer.ErrIntegrity) && !errors.Is(err, transfer.ErrExists) {
+		return
+	}
+	if err := in.store.Delete(label); err != nil {
+		log.Println("done: storage.Delete:", err)
+	}
+	delete(in.files, label)
+}
+
+// receive stores into dir the files accepted from the remote of sess.
+// Channels of files nobody accepted are closed.
+func (in *incoming) receive(sess *session.Session, dir string) {
+	sess.Peer().OnChannel(func(ch *wrtc.Channel) {
+		m, ok := in.take(ch.Label(), sess.Sign())
+		if !ok {
+			ch.Close()
+			return
+		}
+		go func() {
+			err := handler.ReceiveFile(context.Background(), ch, m, dir, nil)
+			in.done(m.Label(), err)
+			if err != nil {
+				log.Println("receive: handler.ReceiveFile:", err)
+				return
+			}
+			log.Printf("file %s received", m.Name)
+		}()
+	})
+}
+
+// sendFile offers the file over sess and sends it once it is accepted.
+func sendFile(
+	ctx context.Context,
+	d *dispatcher.Dispatcher,
+	sess *session.Session,
+	m transfer.Manifest,
+	r io.ReadSeeker,
+) error {
+	key := model.GenerateKey()
+	answers := d.SubscribeKey(string(key))
+	defer d.UnsbribeKey(string(key))
+	handler.OfferFile(key, m, func(s model.Signal) { d.SendTo(sess.Hash(), s) })
+
+	actx, cancel := context.WithTimeout(ctx, config.FileAcceptTimeout)
+	defer cancel()
+	for {
+		select {
+		case <-actx.Done():
+			return actx.Err()
+		case s := <-answers:
+			if string(s.Payload()) != m.ID {
+				continue
+			}
+			return handler.FileAnswered(ctx, s, sess.Peer(), m, r, nil)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package group
+
+import (
+	"bytes"
+	"sort"
+)
+
+// dag is the op log as a hash DAG. Ops with missing ancestors, or a clock
+// that doesn't follow from their parents, are left out until they fit.
+type dag struct {
+	ops    map[string]*Op
+	anc    map[string]map[string]bool
+	before map[string]state
+}
+
+func newDAG(all map[string]*Op) *dag {
+	d := &dag{
+		ops:    map[string]*Op{},
+		anc:    map[string]map[string]bool{},
+		before: map[string]state{},
+	}
+	fits := map[string]bool{}
+	var fit func(op *Op) bool
+	fit = func(op *Op) bool {
+		h := string(op.hash)
+		if ok, seen := fits[h]; seen {
+			return ok
+		}
+		fits[h] = false
+		var clock uint64
+		anc := map[string]bool{}
+		for _, p := range op.Parents {
+			parent, ok := all[string(p)]
+			if !ok || !fit(parent) {
+				return false
+			}
+			clock = max(clock, parent.Clock+1)
+			anc[string(p)] = true
+			for a := range d.anc[string(p)] {
+				anc[a] = true
+			}
+		}
+		if op.Clock != clock {
+			return false
+		}
+		fits[h] = true
+		d.ops[h] = op
+		d.anc[h] = anc
+		return true
+	}
+	for _, op := range all {
+		fit(op)
+	}
+	return d
+}
+
+// heads are the ops no other op names as parent, the parents of the next
+// local op.
+func (d *dag) heads() []*Op {
+	children := map[string]bool{}
+	for _, op := range d.ops {
+		for _, p := range op.Parents {
+			children[string(p)] = true
+		}
+	}
+	var out []*Op
+	for h, op := range d.ops {
+		if !children[h] {
+			out = append(out, op)
+		}
+	}
+	return sorted(out)
+}
+
+func (d *dag) replay() state {
+	all := make([]*Op, 0, len(d.ops))
+	for _, op := range d.ops {
+		all = append(all, op)
+	}
+	return d.run(sorted(all))
+}
+
+// stateOf is the state the author of op saw, the replay of its ancestors.
+func (d *dag) stateOf(op *Op) state {
+	if st, ok := d.before[string(op.hash)]; ok {
+		return st
+	}
+	past := make([]*Op, 0, len(d.anc[string(op.hash)]))
+	for h := range d.anc[string(op.hash)] {
+		past = append(past, d.ops[h])
+	}
+	st := d.run(sorted(past))
+	d.before[string(op.hash)] = st
+	return st
+}
+
+// run applies ops in order. An op counts only if its author held the right
+// in the causal past of the op, and loses to a concurrent removal or
+// demotion of its author. A removed admin can't make up ops that predate the
+// removal.
+func (d *dag) run(ops []*Op) state {
+	var revocations []*Op
+	for _, op := range ops {
+		if (op.Kind == OpRemove || op.Kind == OpDemote) && d.authorized(op) {
+			revocations = append(revocations, op)
+		}
+	}
+	// Of two admins revoking each other concurrently the senior one wins.
+	beaten := map[string]bool{}
+	for _, r := range revocations {
+		for _, m := range revocations {
+			if d.concurrent(r, m) && revokes(m, r.Author) && revokes(r, m.Author) && d.senior(m, r) {
+				beaten[string(r.hash)] = true
+			}
+		}
+	}
+
+	st := state{members: map[string]Member{}, admins: map[string]bool{}, granted: map[string]*Op{}}
+	for _, op := range ops {
+		if !d.authorized(op) || d.revoked(op, revocations, beaten) || !st.apply(op) {
+			continue
+		}
+		if op.Kind != OpPromote && op.Kind != OpDemote {
+			st.epochs = append(st.epochs, op.hash)
+		}
+	}
+	return st
+}
+
+func (d *dag) authorized(op *Op) bool {
+	if !needsAdmin(op) {
+		return true
+	}
+	return d.stateOf(op).admins[string(op.Author)]
+}
+
+func (d *dag) revoked(op *Op, revocations []*Op, beaten map[string]bool) bool {
+	if !needsAdmin(op) {
+		return false
+	}
+	for _, r := range revocations {
+		if !beaten[string(r.hash)] && revokes(r, op.Author) && d.concurrent(r, op) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *dag) concurrent(a, b *Op) bool {
+	return a != b && !d.anc[string(a.hash)][string(b.hash)] && !d.anc[string(b.hash)][string(a.hash)]
+}
+
+// senior reports whether the author of a became admin before the author of b.
+func (d *dag) senior(a, b *Op) bool {
+	ga, gb := d.stateOf(a).granted[string(a.Author)], d.stateOf(b).granted[string(b.Author)]
+	return ga != nil && gb != nil && ga.before(gb)
+}
+
+// needsAdmin is false for the genesis and for leaving, anything else is up
+// to admins.
+func needsAdmin(op *Op) bool {
+	return op.Kind != OpCreate && (op.Kind != OpRemove || !bytes.Equal(op.Author, op.Target.Sign))
+}
+
+func revokes(r *Op, author []byte) bool {
+	return (r.Kind == OpRemove || r.Kind == OpDemote) && bytes.Equal(r.Target.Sign, author)
+}
+
+func sorted(ops []*Op) []*Op {
+	sort.Slice(ops, func(i, j int) bool { return ops[i].before(ops[j]) })
+	return ops
+}
+
+// state is the result of replaying the op log. Each op that changes the
+// member set starts an epoch named by its hash.
+type state struct {
+	members map[string]Member
+	admins  map[string]bool
+	// granted is the op that made each admin one.
+	granted map[string]*Op
+	epochs  [][]byte
+}
+
+// apply skips ops that are invalid at their place in the order.
+func (st *state) apply(op *Op) bool {
+	author, target := string(op.Author), string(op.Target.Sign)
+	_, isMember := st.members[target]
+	switch op.Kind {
+	case OpCreate:
+		if len(st.members) > 0 || author != target {
+			return false
+		}
+		st.members[target] = op.Target
+		st.admins[target] = true
+		st.granted[target] = op
+	case OpAdd:
+		if !st.admins[author] || isMember {
+			return false
+		}
+		st.members[target] = op.Target
+	case OpRemove:
+		if !isMember || (!st.admins[author] && author != target) {
+			return false
+		}
+		delete(st.members, target)
+		delete(st.admins, target)
+		delete(st.granted, target)
+	case OpPromote:
+		if !st.admins[author] || !isMember || st.admins[target] {
+			return false
+		}
+		st.admins[target] = true
+		st.granted[target] = op
+	case OpDemote:
+		if !st.admins[author] || !st.admins[target] {
+			return false
+		}
+		delete(st.admins, target)
+		delete(st.granted, target)
+	}
+	return true
+}
+
+func (st *state) epoch() []byte {
+	if len(st.epochs) == 0 {
+		return nil
+	}
+	return st.epochs[len(st.epochs)-1][:epochLen]
+}
@@ -0,0 +1,429 @@
+package group
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"go-chat/e2e"
+	"go-chat/storage"
+	"sync"
+)
+
+const (
+	IDLen    = 16
+	epochLen = 16
+	// keepEpochs keeps sender keys of the previous epoch for messages sent
+	// before the sender saw the change.
+	keepEpochs = 2
+)
+
+// Update carries the op log and the sender key of the current epoch. It is
+// sent to every member over its pairwise e2e session.
+type Update struct {
+	Ops [][]byte `json:"ops"`
+	Key []byte   `json:"key,omitempty"`
+}
+
+func (u Update) Marshal() ([]byte, error) {
+	return json.Marshal(u)
+}
+
+func ParseUpdate(data []byte) (Update, error) {
+	var u Update
+	if err := json.Unmarshal(data, &u); err != nil {
+		return Update{}, ErrInvalidOp
+	}
+	return u, nil
+}
+
+// Group is the local view of a room: the replicated op log, the own sender
+// key and the sender keys received from the other members. The group is
+// saved in store by the hex of its id on every change, chains included, so
+// no message key is used twice after a restart.
+type Group struct {
+	mu    sync.Mutex
+	id    []byte
+	self  Member
+	sign  ed25519.PrivateKey
+	store storage.Store
+	ops   map[string]*Op
+	heads []*Op
+	state state
+	own   *senderKey
+	keys  map[string]*senderKey
+}
+
+func Create(id e2e.Identity, store storage.Store) (*Group, error) {
+	genesis, err := newOp(id.Sign, nil, OpCreate, MemberOf(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	g := newGroup(id, genesis, store)
+	if err := g.rebuild(); err != nil {
+		return nil, err
+	}
+	return g, g.save()
+}
+
+// Join builds the group from the op log received from a member.
+func Join(id e2e.Identity, ops [][]byte, store storage.Store) (*Group, error) {
+	g, err := build(id, ops, store)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.rebuild(); err != nil {
+		return nil, err
+	}
+	if g.own == nil {
+		return nil, ErrNotMember
+	}
+	return g, g.save()
+}
+
+// Load restores a group saved in store.
+func Load(id e2e.Identity, data []byte, store storage.Store) (*Group, error) {
+	var st groupState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, ErrInvalidOp
+	}
+	g, err := build(id, st.Ops, store)
+	if err != nil {
+		return nil, err
+	}
+	if st.Own != nil {
+		if g.own, err = loadSenderKey(*st.Own); err != nil {
+			return nil, err
+		}
+	}
+	for _, k := range st.Keys {
+		sk, err := loadSenderKey(k)
+		if err != nil {
+			return nil, err
+		}
+		g.keys[keyOf(sk.epoch, sk.sender)] = sk
+	}
+	if err := g.rebuild(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func build(id e2e.Identity, ops [][]byte, store storage.Store) (*Group, error) {
+	var genesis *Op
+	parsed := make([]*Op, 0, len(ops))
+	for _, data := range ops {
+		op, err := ParseOp(data)
+		if err != nil {
+			return nil, err
+		}
+		if op.Kind == OpCreate {
+			genesis = op
+		}
+		parsed = append(parsed, op)
+	}
+	if genesis == nil {
+		return nil, ErrNoGenesis
+	}
+
+	g := newGroup(id, genesis, store)
+	for _, op := range parsed {
+		if err := g.insert(op); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+func newGroup(id e2e.Identity, genesis *Op, store storage.Store) *Group {
+	return &Group{
+		id:    genesis.hash[:IDLen],
+		self:  MemberOf(id),
+		sign:  id.Sign,
+		store: store,
+		ops:   map[string]*Op{string(genesis.hash): genesis},
+		keys:  map[string]*senderKey{},
+	}
+}
+
+func (g *Group) ID() []byte {
+	return g.id
+}
+
+func (g *Group) Self() Member {
+	return g.self
+}
+
+func (g *Group) Members() []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	out := make([]Member, 0, len(g.state.members))
+	for _, m := range g.state.members {
+		out = append(out, m)
+	}
+	return out
+}
+
+// Member reports whether this identity is still in the group.
+func (g *Group) Member() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.own != nil
+}
+
+func (g *Group) IsAdmin(sign []byte) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.state.admins[string(sign)]
+}
+
+func (g *Group) Add(m Member) error {
+	return g.local(OpAdd, m)
+}
+
+func (g *Group) Remove(m Member) error {
+	return g.local(OpRemove, m)
+}
+
+func (g *Group) Leave() error {
+	return g.local(OpRemove, g.self)
+}
+
+func (g *Group) Promote(m Member) error {
+	return g.local(OpPromote, m)
+}
+
+func (g *Group) Demote(m Member) error {
+	return g.local(OpDemote, m)
+}
+
+func (g *Group) local(kind OpKind, target Member) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if kind != OpRemove || !bytes.Equal(target.Sign, g.self.Sign) {
+		if !g.state.admins[string(g.self.Sign)] {
+			return ErrNotAdmin
+		}
+	}
+	op, err := newOp(g.sign, g.id, kind, target, g.heads)
+	if err != nil {
+		return err
+	}
+	if err := g.insert(op); err != nil {
+		return err
+	}
+	if err := g.rebuild(); err != nil {
+		return err
+	}
+	return g.save()
+}
+
+// Update returns the op log and the own sender key for the members.
+func (g *Group) Update() (Update, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var u Update
+	for _, op := range g.ops {
+		data, err := op.Marshal()
+		if err != nil {
+			return Update{}, err
+		}
+		u.Ops = append(u.Ops, data)
+	}
+	if g.own != nil {
+		key, err := g.own.distribution(g.id, g.self.Sign)
+		if err != nil {
+			return Update{}, err
+		}
+		u.Key = key
+	}
+	return u, nil
+}
+
+// Apply merges an update received from the member with the DH key from. It
+// reports whether the own sender key rotated and must be handed out again.
+func (g *Group) Apply(from []byte, u Update) (bool, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, data := range u.Ops {
+		op, err := ParseOp(data)
+		if err != nil {
+			return false, err
+		}
+		if err := g.insert(op); err != nil {
+			return false, err
+		}
+	}
+	before := g.own
+	if err := g.rebuild(); err != nil {
+		return false, err
+	}
+	rotated := g.own != before
+
+	var err error
+	if u.Key != nil {
+		err = g.addKey(from, u.Key)
+	}
+	return rotated, errors.Join(err, g.save())
+}
+
+func (g *Group) insert(op *Op) error {
+	if op.Kind == OpCreate {
+		if !bytes.Equal(op.hash[:IDLen], g.id) {
+			return ErrOtherGroup
+		}
+	} else if !bytes.Equal(op.Group, g.id) {
+		return ErrOtherGroup
+	}
+	g.ops[string(op.hash)] = op
+	return nil
+}
+
+// rebuild replays the log. A new epoch rotates the own sender key and drops
+// the keys of removed members and of old epochs.
+func (g *Group) rebuild() error {
+	d := newDAG(g.ops)
+	g.state = d.replay()
+	g.heads = d.heads()
+	epoch := g.state.epoch()
+
+	if _, ok := g.state.members[string(g.self.Sign)]; !ok {
+		g.own = nil
+	} else if g.own == nil || !bytes.Equal(g.own.epoch, epoch) {
+		own, err := newSenderKey(epoch)
+		if err != nil {
+			return err
+		}
+		g.own = own
+	}
+
+	recent := g.state.epochs[max(0, len(g.state.epochs)-keepEpochs):]
+	for k, sk := range g.keys {
+		_, member := g.state.members[string(sk.sender)]
+		known := false
+		for _, e := range recent {
+			known = known || bytes.Equal(e[:epochLen], sk.epoch)
+		}
+		if !member || !known {
+			delete(g.keys, k)
+		}
+	}
+	return nil
+}
+
+func (g *Group) addKey(from []byte, data []byte) error {
+	sk, err := parseDistribution(data, g.id)
+	if err != nil {
+		return err
+	}
+	m, ok := g.state.members[string(sk.sender)]
+	if !ok || !bytes.Equal(m.DH, from) {
+		return ErrNotMember
+	}
+	if !bytes.Equal(sk.epoch, g.state.epoch()) {
+		// Keys of older epochs are useless, of newer ones the ops are missing.
+		return ErrNoSenderKey
+	}
+	g.keys[keyOf(sk.epoch, sk.sender)] = sk
+	return nil
+}
+
+func (g *Group) Encrypt(pt []byte) ([]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.own == nil {
+		return nil, ErrNotMember
+	}
+	own := g.own
+	g.own = own.clone()
+	msg, err := g.own.encrypt(g.self.Sign, pt)
+	if err == nil {
+		err = g.save()
+	}
+	if err != nil {
+		g.own = own
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Decrypt returns the sender and the plaintext of a group message.
+func (g *Group) Decrypt(msg []byte) (Member, []byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	epoch, sender, err := parseMessage(msg)
+	if err != nil {
+		return Member{}, nil, err
+	}
+	if bytes.Equal(sender, g.self.Sign) {
+		return Member{}, nil, ErrOwnMessage
+	}
+	m, ok := g.state.members[string(sender)]
+	if !ok {
+		return Member{}, nil, ErrNotMember
+	}
+	k := keyOf(epoch, sender)
+	sk, ok := g.keys[k]
+	if !ok {
+		return Member{}, nil, ErrNoSenderKey
+	}
+	g.keys[k] = sk.clone()
+	pt, err := g.keys[k].decrypt(msg)
+	if err == nil {
+		err = g.save()
+	}
+	if err != nil {
+		g.keys[k] = sk
+		return Member{}, nil, err
+	}
+	return m, pt, nil
+}
+
+type groupState struct {
+	Ops  [][]byte   `json:"ops"`
+	Own  *keyState  `json:"own,omitempty"`
+	Keys []keyState `json:"keys,omitempty"`
+}
+
+func (g *Group) save() error {
+	var st groupState
+	for _, op := range g.ops {
+		data, err := op.Marshal()
+		if err != nil {
+			return err
+		}
+		st.Ops = append(st.Ops, data)
+	}
+	if g.own != nil {
+		own := g.own.state()
+		st.Own = &own
+	}
+	for _, sk := range g.keys {
+		st.Keys = append(st.Keys, sk.state())
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return g.store.Save(hex.EncodeToString(g.id), data)
+}
+
+func keyOf(epoch, sender []byte) string {
+	return string(epoch) + string(sender)
+}
+
+func randomKey() ([]byte, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	return b, err
+}
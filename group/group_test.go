@@ -0,0 +1,285 @@
+package group
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"go-chat/e2e"
+	"go-chat/storage"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bucket(t *testing.T) storage.Bucket {
+	db, err := storage.Open(filepath.Join(t.TempDir(), "test.db"), "")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db.Bucket("test")
+}
+
+func newSet(t *testing.T) *Set {
+	id, err := e2e.NewIdentity()
+	require.NoError(t, err)
+	s, err := NewSet(id, bucket(t))
+	require.NoError(t, err)
+	return s
+}
+
+// restart loads the set back from its store.
+func restart(t *testing.T, s *Set) *Set {
+	loaded, err := NewSet(s.id, s.store)
+	require.NoError(t, err)
+	return loaded
+}
+
+// share hands the update of g to the other sets, as the e2e sessions would.
+func share(t *testing.T, g *Group, to ...*Set) {
+	u, err := g.Update()
+	require.NoError(t, err)
+	for _, s := range to {
+		_, _, err := s.Apply(g.Self().DH, u)
+		require.NoError(t, err)
+	}
+}
+
+func roundTrip(t *testing.T, from *Group, to *Group, text string) error {
+	msg, err := from.Encrypt([]byte(text))
+	require.NoError(t, err)
+	m, pt, err := to.Decrypt(msg)
+	if err == nil {
+		assert.Equal(t, from.Self(), m)
+		assert.Equal(t, text, string(pt))
+	}
+	return err
+}
+
+func Test_Group(t *testing.T) {
+	t.Run("members exchange sender keys", func(t *testing.T) {
+		alice, bob := newSet(t), newSet(t)
+		ga, err := alice.Create()
+		require.NoError(t, err)
+		require.NoError(t, ga.Add(MemberOf(bob.id)))
+		share(t, ga, bob)
+		gb := bob.Get(ga.ID())
+		require.NotNil(t, gb)
+		share(t, gb, alice)
+
+		require.NoError(t, roundTrip(t, ga, gb, "hi bob"))
+		require.NoError(t, roundTrip(t, gb, ga, "hi alice"))
+		assert.Len(t, gb.Members(), 2)
+
+		_, _, err = ga.Decrypt(must(ga.Encrypt([]byte("echo"))))
+		assert.ErrorIs(t, err, ErrOwnMessage)
+	})
+
+	t.Run("out of order", func(t *testing.T) {
+		alice, bob := newSet(t), newSet(t)
+		ga, _ := alice.Create()
+		require.NoError(t, ga.Add(MemberOf(bob.id)))
+		share(t, ga, bob)
+		gb := bob.Get(ga.ID())
+
+		first := must(ga.Encrypt([]byte("1")))
+		second := must(ga.Encrypt([]byte("2")))
+		_, pt, err := gb.Decrypt(second)
+		require.NoError(t, err)
+		assert.Equal(t, "2", string(pt))
+		_, pt, err = gb.Decrypt(first)
+		require.NoError(t, err)
+		assert.Equal(t, "1", string(pt))
+		_, _, err = gb.Decrypt(first)
+		assert.Error(t, err)
+	})
+
+	t.Run("removal rotates keys", func(t *testing.T) {
+		alice, bob, carol := newSet(t), newSet(t), newSet(t)
+		ga, _ := alice.Create()
+		require.NoError(t, ga.Add(MemberOf(bob.id)))
+		require.NoError(t, ga.Add(MemberOf(carol.id)))
+		share(t, ga, bob, carol)
+		gb, gc := bob.Get(ga.ID()), carol.Get(ga.ID())
+		share(t, gb, alice, carol)
+		share(t, gc, alice, bob)
+		require.NoError(t, roundTrip(t, ga, gc, "hi carol"))
+
+		require.NoError(t, ga.Remove(MemberOf(carol.id)))
+		share(t, ga, bob)
+		share(t, gb, alice)
+
+		require.NoError(t, roundTrip(t, ga, gb, "carol is gone"))
+		assert.ErrorIs(t, roundTrip(t, ga, gc, "secret"), ErrNoSenderKey)
+		assert.ErrorIs(t, roundTrip(t, gc, ga, "still here"), ErrNotMember)
+	})
+
+	t.Run("survive restart", func(t *testing.T) {
+		alice, bob := newSet(t), newSet(t)
+		ga, _ := alice.Create()
+		require.NoError(t, ga.Add(MemberOf(bob.id)))
+		require.NoError(t, ga.Promote(MemberOf(bob.id)))
+		share(t, ga, bob)
+		gb := bob.Get(ga.ID())
+		share(t, gb, alice)
+		first := must(ga.Encrypt([]byte("before")))
+		_, _, err := gb.Decrypt(first)
+		require.NoError(t, err)
+
+		alice, bob = restart(t, alice), restart(t, bob)
+		ga, gb = alice.Get(ga.ID()), bob.Get(ga.ID())
+		require.NotNil(t, ga)
+		require.NotNil(t, gb)
+		assert.Len(t, gb.Members(), 2)
+		assert.True(t, gb.IsAdmin(gb.Self().Sign))
+
+		_, _, err = gb.Decrypt(first)
+		assert.ErrorIs(t, err, ErrInvalidMessage)
+		require.NoError(t, roundTrip(t, ga, gb, "after"))
+		require.NoError(t, roundTrip(t, gb, ga, "after too"))
+	})
+
+	t.Run("removed group forgotten", func(t *testing.T) {
+		alice, bob := newSet(t), newSet(t)
+		ga, _ := alice.Create()
+		require.NoError(t, ga.Add(MemberOf(bob.id)))
+		share(t, ga, bob)
+
+		require.NoError(t, ga.Remove(MemberOf(bob.id)))
+		u, err := ga.Update()
+		require.NoError(t, err)
+		_, _, err = bob.Apply(ga.Self().DH, u)
+		assert.ErrorIs(t, err, ErrNotMember)
+		assert.Nil(t, restart(t, bob).Get(ga.ID()))
+	})
+
+	t.Run("only admins change membership", func(t *testing.T) {
+		alice, bob, eve := newSet(t), newSet(t), newSet(t)
+		ga, _ := alice.Create()
+		require.NoError(t, ga.Add(MemberOf(bob.id)))
+		share(t, ga, bob)
+		gb := bob.Get(ga.ID())
+
+		assert.ErrorIs(t, gb.Add(MemberOf(eve.id)), ErrNotAdmin)
+
+		// A signed op by a non admin replicates but has no effect.
+		op, err := newOp(bob.id.Sign, ga.ID(), OpAdd, MemberOf(eve.id), gb.heads)
+		require.NoError(t, err)
+		data, _ := op.Marshal()
+		_, err = ga.Apply(gb.Self().DH, Update{Ops: [][]byte{data}})
+		require.NoError(t, err)
+		assert.Len(t, ga.Members(), 2)
+
+		op.Clock++
+		data, _ = json.Marshal(op)
+		_, err = ga.Apply(gb.Self().DH, Update{Ops: [][]byte{data}})
+		assert.ErrorIs(t, err, ErrInvalidOp)
+	})
+
+	t.Run("sender key bound to member", func(t *testing.T) {
+		alice, bob, eve := newSet(t), newSet(t), newSet(t)
+		ga, _ := alice.Create()
+		require.NoError(t, ga.Add(MemberOf(bob.id)))
+		share(t, ga, bob)
+		gb := bob.Get(ga.ID())
+
+		u, err := gb.Update()
+		require.NoError(t, err)
+		_, err = ga.Apply(MemberOf(eve.id).DH, u)
+		assert.ErrorIs(t, err, ErrNotMember)
+	})
+
+	t.Run("concurrent changes converge", func(t *testing.T) {
+		alice, bob, carol := newSet(t), newSet(t), newSet(t)
+		ga, _ := alice.Create()
+		require.NoError(t, ga.Add(MemberOf(bob.id)))
+		require.NoError(t, ga.Promote(MemberOf(bob.id)))
+		require.NoError(t, ga.Add(MemberOf(carol.id)))
+		share(t, ga, bob, carol)
+		gb, gc := bob.Get(ga.ID()), carol.Get(ga.ID())
+
+		// Both admins remove each other concurrently, the senior one wins.
+		require.NoError(t, ga.Remove(MemberOf(bob.id)))
+		require.NoError(t, gb.Remove(MemberOf(alice.id)))
+		// The sender key of the loser is rejected, the ops merge anyway.
+		ua, _ := ga.Update()
+		ub, _ := gb.Update()
+		gc.Apply(ga.Self().DH, ua)
+		gc.Apply(gb.Self().DH, ub)
+		ga.Apply(gb.Self().DH, ub)
+		gb.Apply(ga.Self().DH, ua)
+
+		assert.ElementsMatch(t, gc.Members(), ga.Members())
+		assert.ElementsMatch(t, gc.Members(), gb.Members())
+		assert.Len(t, gc.Members(), 2)
+		assert.True(t, ga.Member())
+		assert.False(t, gb.Member())
+	})
+
+	t.Run("removed admin can't backdate ops", func(t *testing.T) {
+		alice, bob, eve := newSet(t), newSet(t), newSet(t)
+		ga, _ := alice.Create()
+		require.NoError(t, ga.Add(MemberOf(bob.id)))
+		require.NoError(t, ga.Promote(MemberOf(bob.id)))
+		share(t, ga, bob)
+		gb := bob.Get(ga.ID())
+		old := gb.heads
+
+		require.NoError(t, ga.Remove(MemberOf(bob.id)))
+		// Bob signs an add on the heads from before his removal.
+		op, err := newOp(bob.id.Sign, ga.ID(), OpAdd, MemberOf(eve.id), old)
+		require.NoError(t, err)
+		data, _ := op.Marshal()
+		_, err = ga.Apply(gb.Self().DH, Update{Ops: [][]byte{data}})
+		require.NoError(t, err)
+		assert.Len(t, ga.Members(), 1)
+
+		// A clock below the one of its parents doesn't fit the log.
+		op, err = newOp(bob.id.Sign, ga.ID(), OpAdd, MemberOf(eve.id), old)
+		require.NoError(t, err)
+		op.Clock = 1
+		op.Sig = nil
+		signed, _ := op.signed()
+		op.Sig = ed25519.Sign(bob.id.Sign, signed)
+		require.NoError(t, op.setHash())
+		data, _ = op.Marshal()
+		_, err = ga.Apply(gb.Self().DH, Update{Ops: [][]byte{data}})
+		require.NoError(t, err)
+		assert.Len(t, ga.Members(), 1)
+	})
+
+	t.Run("ops wait for their parents", func(t *testing.T) {
+		alice, bob, carol := newSet(t), newSet(t), newSet(t)
+		ga, _ := alice.Create()
+		require.NoError(t, ga.Add(MemberOf(bob.id)))
+		share(t, ga, bob)
+		gb := bob.Get(ga.ID())
+
+		require.NoError(t, ga.Promote(MemberOf(bob.id)))
+		require.NoError(t, ga.Add(MemberOf(carol.id)))
+		u, err := ga.Update()
+		require.NoError(t, err)
+		var last [][]byte
+		for _, data := range u.Ops {
+			op, err := ParseOp(data)
+			require.NoError(t, err)
+			if op.Kind == OpAdd && bytes.Equal(op.Target.Sign, MemberOf(carol.id).Sign) {
+				last = append(last, data)
+			}
+		}
+		_, err = gb.Apply(ga.Self().DH, Update{Ops: last})
+		require.NoError(t, err)
+		assert.Len(t, gb.Members(), 2)
+
+		share(t, ga, bob)
+		assert.Len(t, gb.Members(), 3)
+		assert.True(t, gb.IsAdmin(gb.Self().Sign))
+	})
+}
+
+func must(b []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
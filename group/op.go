@@ -0,0 +1,131 @@
+package group
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"go-chat/e2e"
+)
+
+var (
+	ErrInvalidOp   = errors.New("invalid membership operation")
+	ErrOtherGroup  = errors.New("operation of another group")
+	ErrNoGenesis   = errors.New("group creation missing")
+	ErrNotAdmin    = errors.New("not a group admin")
+	ErrNotMember   = errors.New("not a group member")
+	ErrNoSenderKey = errors.New("no sender key")
+	ErrOwnMessage  = errors.New("own group message")
+)
+
+type OpKind uint8
+
+const (
+	OpCreate OpKind = iota
+	OpAdd
+	OpRemove
+	OpPromote
+	OpDemote
+)
+
+// Member is identified by its signing key, the DH key names the e2e session
+// used to hand out sender keys.
+type Member struct {
+	Sign []byte `json:"sign"`
+	DH   []byte `json:"dh"`
+}
+
+func MemberOf(id e2e.Identity) Member {
+	return Member{Sign: id.Sign.Public().(ed25519.PublicKey), DH: id.DH.PublicKey().Bytes()}
+}
+
+// Op is a signed membership change. It names the heads of the log its
+// author knew as parents, so the log is a hash DAG and the clock is the depth
+// in it. Ops are ordered by clock, ties broken by hash, so every member
+// replays them the same way.
+type Op struct {
+	Group   []byte   `json:"group,omitempty"`
+	Parents [][]byte `json:"parents,omitempty"`
+	Kind    OpKind   `json:"kind"`
+	Target  Member   `json:"target"`
+	Author  []byte   `json:"author"`
+	Clock   uint64   `json:"clock"`
+	Sig     []byte   `json:"sig,omitempty"`
+
+	hash []byte
+}
+
+func newOp(sign ed25519.PrivateKey, group []byte, kind OpKind, target Member, parents []*Op) (*Op, error) {
+	op := &Op{
+		Group:  group,
+		Kind:   kind,
+		Target: target,
+		Author: sign.Public().(ed25519.PublicKey),
+	}
+	for _, p := range parents {
+		op.Parents = append(op.Parents, p.hash)
+		op.Clock = max(op.Clock, p.Clock+1)
+	}
+	data, err := op.signed()
+	if err != nil {
+		return nil, err
+	}
+	op.Sig = ed25519.Sign(sign, data)
+	return op, op.setHash()
+}
+
+func (op *Op) Marshal() ([]byte, error) {
+	return json.Marshal(op)
+}
+
+func ParseOp(data []byte) (*Op, error) {
+	var op Op
+	if err := json.Unmarshal(data, &op); err != nil {
+		return nil, ErrInvalidOp
+	}
+	if len(op.Author) != ed25519.PublicKeySize || len(op.Target.Sign) != ed25519.PublicKeySize {
+		return nil, ErrInvalidOp
+	}
+	// Only the genesis has no parents and clock 0, so it sorts first.
+	if (op.Kind == OpCreate) != (op.Clock == 0) || (op.Kind == OpCreate) != (len(op.Parents) == 0) ||
+		op.Kind > OpDemote {
+		return nil, ErrInvalidOp
+	}
+	for _, p := range op.Parents {
+		if len(p) != sha256.Size {
+			return nil, ErrInvalidOp
+		}
+	}
+	signed, err := op.signed()
+	if err != nil {
+		return nil, ErrInvalidOp
+	}
+	if !ed25519.Verify(op.Author, signed, op.Sig) {
+		return nil, ErrInvalidOp
+	}
+	return &op, op.setHash()
+}
+
+func (op *Op) signed() ([]byte, error) {
+	c := *op
+	c.Sig = nil
+	return json.Marshal(c)
+}
+
+func (op *Op) setHash() error {
+	data, err := op.Marshal()
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	op.hash = sum[:]
+	return nil
+}
+
+func (op *Op) before(other *Op) bool {
+	if op.Clock != other.Clock {
+		return op.Clock < other.Clock
+	}
+	return bytes.Compare(op.hash, other.hash) < 0
+}
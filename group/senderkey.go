@@ -0,0 +1,216 @@
+package group
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"go-chat/e2e"
+	"maps"
+)
+
+// MaxSkip bounds the message keys derived ahead of a sender chain.
+const MaxSkip = 1000
+
+var (
+	ErrInvalidMessage = errors.New("invalid group message")
+	ErrDecrypt        = errors.New("group message authentication failed")
+	ErrTooManySkipped = errors.New("too many skipped messages")
+)
+
+// messageInfo keeps the message keys of sender chains apart from the ones of
+// pairwise sessions.
+const messageInfo = "go-chat group message"
+
+// A message is epoch|sender|n|ciphertext|signature, signed with the key
+// handed out along the chain, so members can't forge each other.
+const prefixLen = epochLen + ed25519.PublicKeySize + 4
+
+// senderKey is the hash chain of one member in one epoch. The private
+// signing key is set only for the own chain.
+type senderKey struct {
+	epoch   []byte
+	sender  []byte
+	chain   []byte
+	n       uint32
+	pub     ed25519.PublicKey
+	priv    ed25519.PrivateKey
+	skipped map[uint32][]byte
+}
+
+func newSenderKey(epoch []byte) (*senderKey, error) {
+	chain, err := randomKey()
+	if err != nil {
+		return nil, err
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &senderKey{epoch: epoch, chain: chain, pub: pub, priv: priv}, nil
+}
+
+// keyState is a sender key as saved with its group.
+type keyState struct {
+	Epoch   []byte            `json:"epoch"`
+	Sender  []byte            `json:"sender,omitempty"`
+	Chain   []byte            `json:"chain"`
+	N       uint32            `json:"n"`
+	Pub     []byte            `json:"pub"`
+	Priv    []byte            `json:"priv,omitempty"`
+	Skipped map[uint32][]byte `json:"skipped,omitempty"`
+}
+
+func (sk *senderKey) state() keyState {
+	return keyState{
+		Epoch:   sk.epoch,
+		Sender:  sk.sender,
+		Chain:   sk.chain,
+		N:       sk.n,
+		Pub:     sk.pub,
+		Priv:    sk.priv,
+		Skipped: sk.skipped,
+	}
+}
+
+func loadSenderKey(st keyState) (*senderKey, error) {
+	if len(st.Epoch) != epochLen || len(st.Chain) != 32 || len(st.Pub) != ed25519.PublicKeySize ||
+		(st.Priv != nil && len(st.Priv) != ed25519.PrivateKeySize) {
+		return nil, ErrInvalidMessage
+	}
+	sk := &senderKey{
+		epoch:   st.Epoch,
+		sender:  st.Sender,
+		chain:   st.Chain,
+		n:       st.N,
+		pub:     st.Pub,
+		priv:    st.Priv,
+		skipped: st.Skipped,
+	}
+	if sk.skipped == nil {
+		sk.skipped = map[uint32][]byte{}
+	}
+	return sk, nil
+}
+
+// clone copies the chain, so it only moves on once the group is saved.
+func (sk *senderKey) clone() *senderKey {
+	c := *sk
+	c.skipped = maps.Clone(sk.skipped)
+	return &c
+}
+
+type distribution struct {
+	Group  []byte `json:"group"`
+	Epoch  []byte `json:"epoch"`
+	Sender []byte `json:"sender"`
+	Chain  []byte `json:"chain"`
+	N      uint32 `json:"n"`
+	Pub    []byte `json:"pub"`
+}
+
+// distribution hands out the chain from the next message on, earlier
+// messages stay unreadable for members who just joined.
+func (sk *senderKey) distribution(group, sender []byte) ([]byte, error) {
+	return json.Marshal(distribution{
+		Group:  group,
+		Epoch:  sk.epoch,
+		Sender: sender,
+		Chain:  sk.chain,
+		N:      sk.n,
+		Pub:    sk.pub,
+	})
+}
+
+func parseDistribution(data, group []byte) (*senderKey, error) {
+	var d distribution
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, ErrInvalidMessage
+	}
+	if !bytes.Equal(d.Group, group) {
+		return nil, ErrOtherGroup
+	}
+	if len(d.Epoch) != epochLen || len(d.Sender) != ed25519.PublicKeySize ||
+		len(d.Chain) != 32 || len(d.Pub) != ed25519.PublicKeySize {
+		return nil, ErrInvalidMessage
+	}
+	return &senderKey{
+		epoch:   d.Epoch,
+		sender:  d.Sender,
+		chain:   d.Chain,
+		n:       d.N,
+		pub:     d.Pub,
+		skipped: map[uint32][]byte{},
+	}, nil
+}
+
+func (sk *senderKey) encrypt(sender, pt []byte) ([]byte, error) {
+	chain, mk := e2e.StepChain(sk.chain)
+	out := make([]byte, 0, prefixLen+len(pt)+16+ed25519.SignatureSize)
+	out = append(out, sk.epoch...)
+	out = append(out, sender...)
+	out = binary.BigEndian.AppendUint32(out, sk.n)
+	ad := append([]byte(nil), out...)
+	out, err := e2e.Seal(messageInfo, mk, ad, pt, out)
+	if err != nil {
+		return nil, err
+	}
+	sk.chain = chain
+	sk.n++
+	return append(out, ed25519.Sign(sk.priv, out)...), nil
+}
+
+func parseMessage(msg []byte) ([]byte, []byte, error) {
+	if len(msg) < prefixLen+ed25519.SignatureSize {
+		return nil, nil, ErrInvalidMessage
+	}
+	return msg[:epochLen], msg[epochLen : epochLen+ed25519.PublicKeySize], nil
+}
+
+func (sk *senderKey) decrypt(msg []byte) ([]byte, error) {
+	body, sig := msg[:len(msg)-ed25519.SignatureSize], msg[len(msg)-ed25519.SignatureSize:]
+	if !ed25519.Verify(sk.pub, body, sig) {
+		return nil, ErrDecrypt
+	}
+	n := binary.BigEndian.Uint32(body[prefixLen-4:])
+
+	if mk, ok := sk.skipped[n]; ok {
+		pt, err := e2e.Open(messageInfo, mk, body[:prefixLen], body[prefixLen:])
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		delete(sk.skipped, n)
+		return pt, nil
+	}
+	if n < sk.n {
+		return nil, ErrInvalidMessage
+	}
+	if n-sk.n > MaxSkip {
+		return nil, ErrTooManySkipped
+	}
+
+	chain, i := sk.chain, sk.n
+	skipped := map[uint32][]byte{}
+	for ; i < n; i++ {
+		var mk []byte
+		chain, mk = e2e.StepChain(chain)
+		skipped[i] = mk
+	}
+	chain, mk := e2e.StepChain(chain)
+	pt, err := e2e.Open(messageInfo, mk, body[:prefixLen], body[prefixLen:])
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	sk.chain, sk.n = chain, n+1
+	for i, mk := range skipped {
+		sk.skipped[i] = mk
+	}
+	for i := range sk.skipped {
+		if i+MaxSkip < sk.n {
+			delete(sk.skipped, i)
+		}
+	}
+	return pt, nil
+}
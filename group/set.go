@@ -0,0 +1,93 @@
+package group
+
+import (
+	"encoding/hex"
+	"go-chat/e2e"
+	"go-chat/storage"
+	"sync"
+)
+
+// Set holds the groups this identity belongs to, keyed by group id. The
+// groups are saved in store and loaded back by NewSet.
+type Set struct {
+	mu     sync.Mutex
+	id     e2e.Identity
+	store  storage.Store
+	groups map[string]*Group
+}
+
+func NewSet(id e2e.Identity, store storage.Store) (*Set, error) {
+	s := &Set{id: id, store: store, groups: map[string]*Group{}}
+	keys, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		data, err := store.Load(k)
+		if err != nil {
+			return nil, err
+		}
+		g, err := Load(id, data, store)
+		if err != nil {
+			return nil, err
+		}
+		s.groups[string(g.ID())] = g
+	}
+	return s, nil
+}
+
+func (s *Set) Get(id []byte) *Group {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.groups[string(id)]
+}
+
+func (s *Set) Create() (*Group, error) {
+	g, err := Create(s.id, s.store)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.groups[string(g.ID())] = g
+	s.mu.Unlock()
+	return g, nil
+}
+
+// Apply merges the update into its group, joining groups this identity was
+// added to. Groups it was removed from are dropped.
+func (s *Set) Apply(from []byte, u Update) (*Group, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var g *Group
+	for _, data := range u.Ops {
+		op, err := ParseOp(data)
+		if err != nil {
+			return nil, false, err
+		}
+		if op.Kind == OpCreate {
+			g = s.groups[string(op.hash[:IDLen])]
+			break
+		}
+	}
+	// A new group has a fresh sender key to hand out.
+	joined := g == nil
+	if joined {
+		var err error
+		if g, err = Join(s.id, u.Ops, s.store); err != nil {
+			return nil, false, err
+		}
+		s.groups[string(g.ID())] = g
+	}
+
+	rotated, err := g.Apply(from, u)
+	if !g.Member() {
+		delete(s.groups, string(g.ID()))
+		if err := s.store.Delete(hex.EncodeToString(g.ID())); err != nil {
+			return g, false, err
+		}
+		return g, false, ErrNotMember
+	}
+	return g, joined || rotated, err
+}
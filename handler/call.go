@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"go-chat/config"
+	"go-chat/model"
+	"go-chat/session"
+	wrtc "go-chat/webrtc"
+	"io"
+	"log"
+	"strconv"
+)
+
+// StartCall adds the local media of srcs to the connected session and sends
+// the renegotiation offer as CallStart. The media plays until the call ends.
+func StartCall(
+	ctx context.Context,
+	sess *session.Session,
+	privsign ed25519.PrivateKey,
+	srcs []wrtc.Source,
+	send func(model.Signal),
+) {
+	id := model.GenerateKey()
+	cctx, cancel := context.WithCancel(ctx)
+	sess.Begin(id, cancel)
+	if !addSources(cctx, sess.Peer(), srcs) {
+		sess.End(id)
+		return
+	}
+
+	gctx, gcancel := context.WithTimeout(ctx, config.GatherTimeout)
+	defer gcancel()
+	sdp, err := sess.Peer().Offer(gctx, wrtc.GatherComplete)
+	if err != nil {
+		log.Println("StartCall: wrtc.Offer:", err)
+		sess.End(id)
+		return
+	}
+	sendCall(model.SignalTypeCallStart, sess, privsign, session.Call{ID: id, SDP: sdp}, send)
+}
+
+// AcceptCall answers CallStart with the local media of srcs.
+func AcceptCall(
+	ctx context.Context,
+	s model.Signal,
+	sess *session.Session,
+	privsign ed25519.PrivateKey,
+	srcs []wrtc.Source,
+	send func(model.Signal),
+) {
+	if s.Type() != model.SignalTypeCallStart {
+		return
+	}
+	c, err := sess.OpenCall(s.Type(), s.Payload())
+	if err != nil {
+		log.Println("AcceptCall: session.OpenCall:", err)
+		return
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	sess.Begin(c.ID, cancel)
+	if !addSources(cctx, sess.Peer(), srcs) {
+		sess.End(c.ID)
+		return
+	}
+
+	gctx, gcancel := context.WithTimeout(ctx, config.GatherTimeout)
+	defer gcancel()
+	sdp, err := sess.Peer().Answer(gctx, c.SDP, wrtc.GatherComplete)
+	if err != nil {
+		log.Println("AcceptCall: wrtc.Answer:", err)
+		sess.End(c.ID)
+		return
+	}
+	sendCall(model.SignalTypeCallAccept, sess, privsign, session.Call{ID: c.ID, SDP: sdp}, send)
+}
+
+// CallAccepted applies the answer to the call of the session.
+func CallAccepted(s model.Signal, sess *session.Session) {
+	if s.Type() != model.SignalTypeCallAccept {
+		return
+	}
+	c, err := sess.OpenCall(s.Type(), s.Payload())
+	if err != nil {
+		log.Println("CallAccepted: session.OpenCall:", err)
+		return
+	}
+	if !bytes.Equal(c.ID, sess.Current()) {
+		return
+	}
+	if err := sess.Peer().Accept(c.SDP); err != nil {
+		log.Println("CallAccepted: wrtc.Accept:", err)
+	}
+}
+
+// EndCall stops local media and tells the other side with CallEnd, which is
+// handled by CallEnded.
+func EndCall(sess *session.Session, privsign ed25519.PrivateKey, send func(model.Signal)) {
+	id := sess.Current()
+	if id == nil || !endCall(sess, id) {
+		return
+	}
+	sendCall(model.SignalTypeCallEnd, sess, privsign, session.Call{ID: id}, send)
+}
+
+// CallEnded stops local media of the call the other side ended.
+func CallEnded(s model.Signal, sess *session.Session) bool {
+	if s.Type() != model.SignalTypeCallEnd {
+		return false
+	}
+	c, err := sess.OpenCall(s.Type(), s.Payload())
+	if err != nil {
+		log.Println("CallEnded: session.OpenCall:", err)
+		return false
+	}
+	return endCall(sess, c.ID)
+}
+
+func endCall(sess *session.Session, id []byte) bool {
+	if !sess.End(id) {
+		return false
+	}
+	if err := sess.Peer().RemoveTracks(); err != nil {
+		log.Println("endCall: wrtc.RemoveTracks:", err)
+	}
+	return true
+}
+
+func sendCall(t model.SignalType, sess *session.Session, privsign ed25519.PrivateKey, c session.Call, send func(model.Signal)) {
+	payload, err := sess.SealCall(t, privsign, c)
+	if err != nil {
+		log.Println("sendCall: session.SealCall:", err)
+		return
+	}
+	reply(t, sess.Key(), payload, send)
+}
+
+// addSources plays srcs until ctx is done. Sources that are io.Closers are
+// closed once they stop playing, or right away when they don't start.
+func addSources(ctx context.Context, pc *wrtc.Peer, srcs []wrtc.Source) bool {
+	for i, src := range srcs {
+		t, err := pc.AddTrack(src.Codec(), "track"+strconv.Itoa(i))
+		if err != nil {
+			log.Println("addSources: wrtc.AddTrack:", err)
+			for _, src := range srcs[i:] {
+				closeSource(src)
+			}
+			return false
+		}
+		go func() {
+			defer closeSource(src)
+			if err := wrtc.Play(ctx, t, src); err != nil && ctx.Err() == nil {
+				log.Println("addSources: wrtc.Play:", err)
+			}
+		}()
+	}
+	return true
+}
+
+func closeSource(src wrtc.Source) {
+	if c, ok := src.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func reply(t model.SignalType, key, payload []byte, send func(model.Signal)) {
+	s, err := model.NewSignal(t, key, payload)
+	if err != nil {
+		log.Println("reply: model.NewSignal:", err)
+		return
+	}
+	send(s)
+}
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"crypto/ecdh"
+	"go-chat/model"
+	"go-chat/netcrypt"
+	"go-chat/session"
+	wrtc "go-chat/webrtc"
+	"log"
+)
+
+// Trickle sends local candidates of the session as Candidate signals,
+// encrypted to the remote side. Empty candidate marks the end of candidates.
+func Trickle(sess *session.Session, send func(model.Signal)) {
+	sess.Peer().OnCandidate(func(candidate []byte) {
+		payload, err := netcrypt.Encrypt(candidate, sess.PrivKey(), sess.PubKey())
+		if err != nil {
+			log.Println("Trickle: netcrypt.Encrypt:", err)
+			return
+		}
+		reply(model.SignalTypeCandidate, sess.Key(), payload, send)
+	})
+}
+
+func addCandidate(s model.Signal, pc *wrtc.Peer, privkey *ecdh.PrivateKey, pubkey *ecdh.PublicKey) {
+	candidate, err := netcrypt.Decrypt(s.Payload(), privkey, pubkey)
+	if err != nil {
+		log.Println("addCandidate: netcrypt.Decrypt:", err)
+		return
+	}
+	if err := pc.AddCandidate(candidate); err != nil {
+		log.Println("addCandidate: wrtc.AddCandidate:", err)
+	}
+}
+
+// Forward passes signals of remote sessions further into the mesh.
+func Forward(s model.Signal, isLocal func(key string) bool, send func(model.Signal)) {
+	if isLocal(s.KeyString()) {
+		return
+	}
+	send(s)
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"go-chat/delivery"
+	"go-chat/e2e"
+	"go-chat/model"
+	"log"
+)
+
+// SendChat numbers the message and sends it over the e2e session. It is
+// retransmitted by Retransmit until the contact acknowledges it.
+func SendChat(t *delivery.Tracker, m *e2e.Manager, contact string, body []byte, send func(model.Signal)) (delivery.Message, error) {
+	msg, f, err := t.Send(contact, body)
+	if err != nil {
+		return delivery.Message{}, err
+	}
+	return msg, sendFrame(m, contact, f, send)
+}
+
+// ChatReceived handles the plaintext of a direct message: messages reach
+// deliver exactly once and in order, acks and syncs are answered.
+func ChatReceived(
+	t *delivery.Tracker,
+	m *e2e.Manager,
+	contact string,
+	payload []byte,
+	send func(model.Signal),
+	deliver func(delivery.Message),
+	progress func(contact string, delivered, read uint64),
+) {
+	f, err := delivery.ParseFrame(payload)
+	if err != nil {
+		log.Println("ChatReceived: delivery.ParseFrame:", err)
+		return
+	}
+	r, err := t.Receive(contact, f)
+	if err != nil {
+		log.Println("ChatReceived: delivery.Receive:", err)
+	}
+	for _, msg := range r.Messages {
+		deliver(msg)
+	}
+	for _, reply := range r.Replies {
+		if err := sendFrame(m, contact, reply, send); err != nil {
+			log.Println("ChatReceived: sendFrame:", err)
+		}
+	}
+	if r.Delivered > 0 || r.Read > 0 {
+		progress(contact, r.Delivered, r.Read)
+	}
+}
+
+func MarkRead(t *delivery.Tracker, m *e2e.Manager, contact string, seq uint64, send func(model.Signal)) error {
+	f, ok, err := t.MarkRead(contact, seq)
+	if err != nil || !ok {
+		return err
+	}
+	return sendFrame(m, contact, f, send)
+}
+
+// Retransmit resends the messages whose ack is overdue.
+func Retransmit(t *delivery.Tracker, m *e2e.Manager, send func(model.Signal)) {
+	frames, err := t.Retransmit()
+	if err != nil {
+		log.Println("Retransmit: delivery.Retransmit:", err)
+	}
+	for contact, fs := range frames {
+		for _, f := range fs {
+			if err := sendFrame(m, contact, f, send); err != nil {
+				log.Println("Retransmit: sendFrame:", err)
+			}
+		}
+	}
+}
+
+func sendFrame(m *e2e.Manager, contact string, f delivery.Frame, send func(model.Signal)) error {
+	payload, err := f.Marshal()
+	if err != nil {
+		return err
+	}
+	return SendDirect(m, contact, payload, send)
+}
@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"go-chat/chat"
+	"go-chat/storage"
+	"time"
+)
+
+// ContentReceived stores a received text, edit, deletion or reaction in
+// conv. Bodies that are not signed content, as sent by older nodes, are
+// kept as plain texts under id.
+func ContentReceived(h *storage.History, conv, from, id string, body []byte) (storage.Message, error) {
+	c, err := chat.Parse(body)
+	if err != nil {
+		wrapped, err := chat.Plain(body)
+		if err != nil {
+			return storage.Message{}, err
+		}
+		m := storage.Message{ID: id, From: from, Time: time.Now(), Body: wrapped}
+		return m, h.Append(conv, m)
+	}
+	return chat.Apply(h, conv, from, c)
+}
@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"go-chat/chat"
+	"go-chat/device"
+	"go-chat/e2e"
+	"go-chat/model"
+	"go-chat/storage"
+	"log"
+)
+
+// LinkDevice certifies the device showing code for the account and hands
+// the roster to every device.
+func LinkDevice(
+	account ed25519.PrivateKey,
+	code, name string,
+	roster *device.Roster,
+	m *e2e.Manager,
+	send func(model.Signal),
+) error {
+	sign, dh, err := device.ParseCode(code)
+	if err != nil {
+		return err
+	}
+	c, err := device.Issue(account, sign, dh, name)
+	if err != nil {
+		return err
+	}
+	if err := roster.Add(c); err != nil {
+		return err
+	}
+	ShareRoster(roster, m, send)
+	return nil
+}
+
+func ShareRoster(roster *device.Roster, m *e2e.Manager, send func(model.Signal)) {
+	p, err := rosterPacket(roster)
+	if err != nil {
+		log.Println("ShareRoster: device.Marshal:", err)
+		return
+	}
+	toDevices(roster, m, p, send)
+}
+
+// SiblingOnline hands the roster to a device of the account once its bundle
+// arrives. A device is linked by its code alone, its bundle may be unknown
+// until it publishes one.
+func SiblingOnline(b e2e.Bundle, roster *device.Roster, m *e2e.Manager, send func(model.Signal)) {
+	contact := hex.EncodeToString(b.Identity)
+	if !roster.Has(contact) {
+		return
+	}
+	p, err := rosterPacket(roster)
+	if err != nil {
+		log.Println("SiblingOnline: device.Marshal:", err)
+		return
+	}
+	sendPacket(m, contact, p, send)
+}
+
+func rosterPacket(roster *device.Roster) (device.Packet, error) {
+	p := device.Packet{Kind: device.KindRoster}
+	for _, c := range roster.Certs() {
+		b, err := c.Marshal()
+		if err != nil {
+			return device.Packet{}, err
+		}
+		p.Certs = append(p.Certs, b)
+	}
+	return p, nil
+}
+
+// FanOut copies a message of the history to the other devices.
+func FanOut(roster *device.Roster, m *e2e.Manager, conv string, msg storage.Message, send func(model.Signal)) {
+	p := device.Packet{Kind: device.KindCopy, Items: []device.Item{{Conv: conv, Message: msg}}}
+	toDevices(roster, m, p, send)
+}
+
+// SyncDevices starts a reconciliation round with every other device.
+func SyncDevices(roster *device.Roster, m *e2e.Manager, h *storage.History, limits device.Limits, send func(model.Signal)) {
+	r, err := device.NewReconciler(h, limits)
+	if err != nil {
+		log.Println("SyncDevices: device.NewReconciler:", err)
+		return
+	}
+	toDevices(roster, m, r.Start(), send)
+}
+
+// DeviceSynced handles packets of the own devices. A roster from another
+// device is only taken to join the account this device was told to join.
+func DeviceSynced(
+	s model.Signal,
+	m *e2e.Manager,
+	roster *device.Roster,
+	join []byte,
+	h *storage.History,
+	limits device.Limits,
+	send func(model.Signal),
+) bool {
+	if s.Type() != model.SignalTypeDeviceSync {
+		return false
+	}
+	return openSealed(s, m, func(contact string, msg []byte) {
+		p, err := device.ParsePacket(msg)
+		if err != nil {
+			log.Println("DeviceSynced: device.ParsePacket:", err)
+			return
+		}
+		if p.Kind == device.KindRoster {
+			rosterReceived(p, roster, join)
+			return
+		}
+		if !roster.Has(contact) {
+			log.Println("DeviceSynced: packet of a foreign device", contact)
+			return
+		}
+
+		var items []device.Item
+		switch p.Kind {
+		case device.KindCopy:
+			items = p.Items
+		case device.KindSync:
+			r, err := device.NewReconciler(h, limits)
+			if err != nil {
+				log.Println("DeviceSynced: device.NewReconciler:", err)
+				return
+			}
+			var reply device.Packet
+			reply, items = r.Process(p)
+			if !reply.Empty() {
+				sendPacket(m, contact, reply, send)
+			}
+		}
+		for _, it := range items {
+			if err := chat.Merge(h, it.Conv, it.Message); err != nil {
+				log.Println("DeviceSynced: chat.Merge:", err)
+			}
+		}
+	})
+}
+
+func rosterReceived(p device.Packet, roster *device.Roster, join []byte) {
+	var certs []device.Cert
+	for _, b := range p.Certs {
+		c, err := device.ParseCert(b)
+		if err != nil {
+			log.Println("rosterReceived: device.ParseCert:", err)
+			return
+		}
+		certs = append(certs, c)
+	}
+	if join != nil {
+		if _, err := roster.Adopt(join, certs); err != nil {
+			log.Println("rosterReceived: device.Adopt:", err)
+		}
+	}
+	for _, c := range certs {
+		// Certs of other accounts are refused by the roster.
+		roster.Add(c)
+	}
+}
+
+func toDevices(roster *device.Roster, m *e2e.Manager, p device.Packet, send func(model.Signal)) {
+	for _, contact := range roster.Siblings() {
+		sendPacket(m, contact, p, send)
+	}
+}
+
+func sendPacket(m *e2e.Manager, contact string, p device.Packet, send func(model.Signal)) {
+	payload, err := p.Marshal()
+	if err != nil {
+		log.Println("sendPacket: device.Marshal:", err)
+		return
+	}
+	if err := sendSealed(model.SignalTypeDeviceSync, m, contact, payload, send); err != nil {
+		log.Println("sendPacket: sendSealed:", err)
+	}
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"go-chat/e2e"
+	"go-chat/model"
+	"log"
+)
+
+// PublishBundle floods the prekey bundle so contacts can start a session
+// while this node is offline.
+func PublishBundle(m *e2e.Manager, send func(model.Signal)) {
+	payload, err := m.Bundle().Marshal()
+	if err != nil {
+		log.Println("PublishBundle: e2e.Marshal:", err)
+		return
+	}
+	reply(model.SignalTypePreKeyBundle, model.GenerateKey(), payload, send)
+}
+
+func BundleReceived(s model.Signal, received func(e2e.Bundle)) {
+	if s.Type() != model.SignalTypePreKeyBundle {
+		return
+	}
+	b, err := e2e.ParseBundle(s.Payload())
+	if err != nil {
+		log.Println("BundleReceived: e2e.ParseBundle:", err)
+		return
+	}
+	received(b)
+}
+
+// SendDirect encrypts msg for the contact. The signal key is the session id,
+// so relaying nodes learn neither the identities nor the content.
+func SendDirect(m *e2e.Manager, contact string, msg []byte, send func(model.Signal)) error {
+	return sendSealed(model.SignalTypeDirect, m, contact, msg, send)
+}
+
+// Direct decrypts messages of own sessions. It reports false for messages
+// of other nodes, which are forwarded as they are.
+func Direct(s model.Signal, m *e2e.Manager, deliver func(contact string, msg []byte)) bool {
+	if s.Type() != model.SignalTypeDirect {
+		return false
+	}
+	return openSealed(s, m, deliver)
+}
+
+func sendSealed(t model.SignalType, m *e2e.Manager, contact string, msg []byte, send func(model.Signal)) error {
+	id, ct, err := m.Encrypt(contact, msg)
+	if err != nil {
+		return err
+	}
+	s, err := model.NewSignal(t, id, ct)
+	if err != nil {
+		return err
+	}
+	send(s)
+	return nil
+}
+
+func openSealed(s model.Signal, m *e2e.Manager, deliver func(contact string, msg []byte)) bool {
+	if !m.Addressed(s.Key(), s.Payload()) {
+		return false
+	}
+	contact, msg, err := m.Decrypt(s.Key(), s.Payload())
+	if err != nil {
+		log.Println("openSealed: e2e.Decrypt:", err)
+		return true
+	}
+	deliver(contact, msg)
+	return true
+}
@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"go-chat/config"
+	"go-chat/fallback"
+	"go-chat/model"
+	"go-chat/session"
+)
+
+// Channel returns the DataChannel of the session once it is open, or a link
+// relayed through the mesh when ICE doesn't connect in time. The session
+// reads both, remote candidates and relayed data among the signals of the
+// session are applied until they are unsubscribed. Calls go to the session.
+func Channel(sess *session.Session, signals <-chan model.Signal, send func(model.Signal)) fallback.Channel {
+	link := fallback.NewLink(sess.Key(), sess.PrivKey(), sess.PubKey(), send, config.FallbackRate, config.FallbackBurst)
+	sess.Listen(sess.Peer())
+	sess.Listen(link)
+	go func() {
+		for s := range signals {
+			switch s.Type() {
+			case model.SignalTypeCandidate:
+				addCandidate(s, sess.Peer(), sess.PrivKey(), sess.PubKey())
+			case model.SignalTypeRelayData:
+				link.Receive(s)
+			case model.SignalTypeCallStart, model.SignalTypeCallAccept, model.SignalTypeCallEnd:
+				sess.Called(s)
+			}
+		}
+	}()
+	return fallback.Ready(sess.Peer().Ready(), config.FallbackTimeout, sess.Peer(), link)
+}
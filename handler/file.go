@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"context"
+	"go-chat/model"
+	"go-chat/transfer"
+	wrtc "go-chat/webrtc"
+	"io"
+	"log"
+)
+
+func OfferFile(key []byte, m transfer.Manifest, send func(model.Signal)) {
+	payload, err := m.Marshal()
+	if err != nil {
+		log.Println("OfferFile: transfer.Marshal:", err)
+		return
+	}
+	reply(model.SignalTypeFileOffer, key, payload, send)
+}
+
+// FileOffered asks prompt whether to take the offered file and answers with
+// FileAccept or FileReject carrying the manifest id.
+func FileOffered(s model.Signal, prompt func(transfer.Manifest) bool, send func(model.Signal)) (transfer.Manifest, bool) {
+	if s.Type() != model.SignalTypeFileOffer {
+		return transfer.Manifest{}, false
+	}
+	m, err := transfer.ParseManifest(s.Payload())
+	if err != nil {
+		log.Println("FileOffered: transfer.ParseManifest:", err)
+		return transfer.Manifest{}, false
+	}
+
+	accepted := prompt(m)
+	t := model.SignalTypeFileReject
+	if accepted {
+		t = model.SignalTypeFileAccept
+	}
+	reply(t, s.Key(), []byte(m.ID), send)
+	return m, accepted
+}
+
+// FileAnswered starts sending the file once the remote side accepted it.
+func FileAnswered(
+	ctx context.Context,
+	s model.Signal,
+	pc *wrtc.Peer,
+	m transfer.Manifest,
+	r io.ReadSeeker,
+	progress func(transfer.Progress),
+) error {
+	if string(s.Payload()) != m.ID {
+		return nil
+	}
+	if s.Type() == model.SignalTypeFileReject {
+		return transfer.ErrRejected
+	}
+	if s.Type() != model.SignalTypeFileAccept {
+		return nil
+	}
+
+	ch, err := pc.OpenChannel(m.Label())
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return transfer.Send(ctx, ch, m, r, progress)
+}
+
+// ReceiveFile stores the file of an accepted offer into dir once the sender
+// opened its channel.
+func ReceiveFile(
+	ctx context.Context,
+	ch *wrtc.Channel,
+	m transfer.Manifest,
+	dir string,
+	progress func(transfer.Progress),
+) error {
+	if ch.Label() != m.Label() {
+		return nil
+	}
+	// The sender closes the channel after reading the result.
+	return transfer.Receive(ctx, ch, m, dir, progress)
+}
@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"go-chat/e2e"
+	"go-chat/group"
+	"go-chat/model"
+	"log"
+)
+
+// ShareGroup sends the op log and the own sender key to every other member
+// over their e2e sessions.
+func ShareGroup(m *e2e.Manager, g *group.Group, send func(model.Signal)) {
+	u, err := g.Update()
+	if err != nil {
+		log.Println("ShareGroup: group.Update:", err)
+		return
+	}
+	payload, err := u.Marshal()
+	if err != nil {
+		log.Println("ShareGroup: group.Marshal:", err)
+		return
+	}
+	for _, member := range g.Members() {
+		if bytes.Equal(member.Sign, g.Self().Sign) {
+			continue
+		}
+		err := sendSealed(model.SignalTypeGroupUpdate, m, hex.EncodeToString(member.DH), payload, send)
+		if err != nil {
+			log.Println("ShareGroup: sendSealed:", err)
+		}
+	}
+}
+
+// GroupUpdated merges updates sent to this node and hands the own sender key
+// out again when it rotated. It reports false for updates of other nodes.
+func GroupUpdated(s model.Signal, m *e2e.Manager, groups *group.Set, send func(model.Signal)) bool {
+	if s.Type() != model.SignalTypeGroupUpdate {
+		return false
+	}
+	return openSealed(s, m, func(contact string, msg []byte) {
+		u, err := group.ParseUpdate(msg)
+		if err != nil {
+			log.Println("GroupUpdated: group.ParseUpdate:", err)
+			return
+		}
+		from, err := hex.DecodeString(contact)
+		if err != nil {
+			log.Println("GroupUpdated: hex.DecodeString:", err)
+			return
+		}
+		g, rotated, err := groups.Apply(from, u)
+		if err != nil {
+			log.Println("GroupUpdated: group.Apply:", err)
+		}
+		if rotated {
+			ShareGroup(m, g, send)
+		}
+	})
+}
+
+// SendGroup floods a message encrypted with the own sender key, keyed by
+// the group id.
+func SendGroup(g *group.Group, msg []byte, send func(model.Signal)) error {
+	ct, err := g.Encrypt(msg)
+	if err != nil {
+		return err
+	}
+	s, err := model.NewSignal(model.SignalTypeGroupMessage, g.ID(), ct)
+	if err != nil {
+		return err
+	}
+	send(s)
+	return nil
+}
+
+func GroupMessage(s model.Signal, groups *group.Set, deliver func(*group.Group, group.Member, []byte)) {
+	if s.Type() != model.SignalTypeGroupMessage {
+		return
+	}
+	g := groups.Get(s.Key())
+	if g == nil {
+		return
+	}
+	from, msg, err := g.Decrypt(s.Payload())
+	if errors.Is(err, group.ErrOwnMessage) {
+		return
+	}
+	if err != nil {
+		log.Println("GroupMessage: group.Decrypt:", err)
+		return
+	}
+	deliver(g, from, msg)
+}
@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"go-chat/contacts"
+	"go-chat/e2e"
+	"go-chat/model"
+	"log"
+)
+
+// RedeemInvite sends the own card with the secret of the token. send has
+// to reach the inviter directly, the signal is not forwarded.
+func RedeemInvite(t contacts.Token, id e2e.Identity, card contacts.Invitation, send func(model.Signal)) error {
+	sealed, err := t.Redeem(id, card)
+	if err != nil {
+		return err
+	}
+	s, err := model.NewSignal(model.SignalTypeInviteRedeem, model.GenerateKey(), sealed)
+	if err != nil {
+		return err
+	}
+	send(s)
+	return nil
+}
+
+// InviteRedeemed adds the redeemer of an own token as a contact.
+func InviteRedeemed(s model.Signal, invites *contacts.Invites, id e2e.Identity, book *contacts.Book, added func(contacts.Contact)) {
+	if s.Type() != model.SignalTypeInviteRedeem {
+		return
+	}
+	card, err := invites.Accept(id, s.Payload())
+	if err != nil {
+		log.Println("InviteRedeemed: invites.Accept:", err)
+		return
+	}
+	c := card.Contact("")
+	if _, taken := book.ByName(c.Name); taken {
+		c.Name += " " + c.Key()[:8]
+	}
+	if c, err = book.Add(c); err != nil {
+		log.Println("InviteRedeemed: book.Add:", err)
+		return
+	}
+	added(c)
+}
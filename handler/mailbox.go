@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"errors"
+	"go-chat/config"
+	"go-chat/mailbox"
+	"go-chat/model"
+	"log"
+	"time"
+)
+
+var ErrNoStoragePeer = errors.New("no storage peer")
+
+// AnnounceMailbox tells a linked peer that this node keeps mail. The
+// announce goes no further than the peer.
+func AnnounceMailbox(hash []byte, sendTo func(hash []byte, s model.Signal) bool) {
+	s, err := model.NewSignal(model.SignalTypeMailboxAnnounce, model.GenerateKey(), nil)
+	if err != nil {
+		log.Println("AnnounceMailbox: model.NewSignal:", err)
+		return
+	}
+	sendTo(hash, s)
+}
+
+// MailboxAnnounced records the peer the announce came from as a storage
+// peer.
+func MailboxAnnounced(from []byte, s model.Signal, peers *mailbox.Peers) {
+	if s.Type() != model.SignalTypeMailboxAnnounce {
+		return
+	}
+	peers.Add(from)
+}
+
+// SendMail stores the message on the storage peers closest to the recipient
+// address, peers should be the ones that announced a mailbox. It returns the
+// envelope id reported back by receipts.
+func SendMail(
+	c *mailbox.Client,
+	to *ecdh.PublicKey,
+	toSign ed25519.PublicKey,
+	msg []byte,
+	peers [][]byte,
+	sendTo func(hash []byte, s model.Signal) bool,
+) (string, error) {
+	env, err := c.Seal(to, toSign, msg, config.MailTTL)
+	if err != nil {
+		return "", err
+	}
+	payload, err := env.Marshal()
+	if err != nil {
+		return "", err
+	}
+
+	stored := false
+	for _, hash := range mailbox.Closest(peers, env.To, config.MailReplicas) {
+		s, err := model.NewSignal(model.SignalTypeMailStore, model.GenerateKey(), payload)
+		if err != nil {
+			return "", err
+		}
+		if sendTo(hash, s) {
+			stored = true
+		}
+	}
+	if !stored {
+		return "", ErrNoStoragePeer
+	}
+	return env.ID, nil
+}
+
+func StoreMail(s model.Signal, store *mailbox.Store) {
+	if s.Type() != model.SignalTypeMailStore {
+		return
+	}
+	env, err := mailbox.ParseEnvelope(s.Payload())
+	if err != nil {
+		log.Println("StoreMail: mailbox.ParseEnvelope:", err)
+		return
+	}
+	if err := store.Put(env); err != nil {
+		log.Println("StoreMail: mailbox.Put:", err)
+	}
+}
+
+// FetchMail asks the mesh for mail of the client. Envelopes come back as
+// MailDeliver signals with the same key.
+func FetchMail(c *mailbox.Client, key []byte, send func(model.Signal)) {
+	reply(model.SignalTypeMailFetch, key, c.Fetch(), send)
+}
+
+// ServeMail answers MailFetch with the envelopes kept for the recipient.
+// Only fetches signed by the owner of the box are served, it reports false
+// for the others, which go no further.
+func ServeMail(s model.Signal, store *mailbox.Store, send func(model.Signal)) bool {
+	if s.Type() != model.SignalTypeMailFetch {
+		return false
+	}
+	to, err := mailbox.ParseFetch(s.Payload(), time.Now(), config.MailFetchAge)
+	if err != nil {
+		log.Println("ServeMail: mailbox.ParseFetch:", err)
+		return false
+	}
+	for _, env := range store.Fetch(to) {
+		payload, err := env.Marshal()
+		if err != nil {
+			log.Println("ServeMail: mailbox.Marshal:", err)
+			continue
+		}
+		reply(model.SignalTypeMailDeliver, s.Key(), payload, send)
+	}
+	return true
+}
+
+// Delivered opens a MailDeliver envelope and acknowledges it.
+func Delivered(s model.Signal, c *mailbox.Client, send func(model.Signal), deliver func(mailbox.Message)) {
+	if s.Type() != model.SignalTypeMailDeliver {
+		return
+	}
+	env, err := mailbox.ParseEnvelope(s.Payload())
+	if err != nil {
+		log.Println("Delivered: mailbox.ParseEnvelope:", err)
+		return
+	}
+	m, err := c.Open(env)
+	if errors.Is(err, mailbox.ErrSeen) {
+		return
+	}
+	if err != nil {
+		log.Println("Delivered: mailbox.Open:", err)
+		return
+	}
+	deliver(m)
+	reply(model.SignalTypeMailAck, model.GenerateKey(), m.Ack, send)
+}
+
+// Acked releases the stored copy and reports receipts of own mail.
+func Acked(s model.Signal, store *mailbox.Store, c *mailbox.Client, receipt func(mailbox.Receipt)) {
+	if s.Type() != model.SignalTypeMailAck {
+		return
+	}
+	id, token, err := mailbox.ParseAck(s.Payload())
+	if err != nil {
+		log.Println("Acked: mailbox.ParseAck:", err)
+		return
+	}
+	if _, err := store.Ack(id, token); err != nil {
+		log.Println("Acked: mailbox.Ack:", err)
+	}
+	if r, ok := c.Receipt(s.Payload()); ok {
+		receipt(r)
+	}
+}
@@ -1,60 +1,196 @@
 package handler
 
 import (
+	"bytes"
+	"context"
 	"crypto/ecdh"
 	"crypto/ed25519"
 	"crypto/rand"
+	"errors"
+	"go-chat/config"
+	"go-chat/fallback"
 	"go-chat/model"
+	"go-chat/pow"
+	"go-chat/session"
 	wrtc "go-chat/webrtc"
 	"log"
 )
 
-func NeedConn(s model.Signal, hasFree func() bool, send func(model.Signal)) {
-	if !hasFree() {
-		send(s)
-		return
-	}
+var ErrUntrusted = errors.New("session requested by a stranger")
+
+// Mesh is what sessions are negotiated over, e.g. dispatcher.Dispatcher.
+// Requests and offers are stamped with the difficulty it asks for.
+type Mesh interface {
+	Send(s model.Signal)
+	Difficulty(t model.SignalType) int
+	SubscribeKey(key string) <-chan model.Signal
+	UnsbribeKey(key string)
+}
+
+// RequestConn asks the mesh for a session with a node that has a free slot
+// and returns the session of the first valid offer. With to set, only the
+// node of that sign key is asked.
+func RequestConn(
+	ctx context.Context,
+	m Mesh,
+	cfg wrtc.Config,
+	privsign ed25519.PrivateKey,
+	to ed25519.PublicKey,
+) (*session.Session, error) {
 	key, err := ecdh.P256().GenerateKey(rand.Reader)
 	if err != nil {
-		log.Println("NeedConn: ecdh.GenerateKey:", err)
-		return
+		return nil, err
 	}
+	reqKey := model.GenerateKey()
+	req := session.Request{PubKey: key.PublicKey()}
+	if to != nil {
+		req.To = session.Target(to)
+	}
+	offers := m.SubscribeKey(string(reqKey))
+	defer m.UnsbribeKey(string(reqKey))
 
-	pubsign, privsign, err := ed25519.GenerateKey(rand.Reader)
+	s, err := model.NewSignal(model.SignalTypeNeedConnect, reqKey, req.Marshal())
 	if err != nil {
-		log.Println("NeedConn: ed25519.GenerateKey:", err)
-		return
+		return nil, err
+	}
+	pow.Mint(s, m.Difficulty(model.SignalTypeNeedConnect))
+	m.Send(s)
+
+	var o session.Offer
+	for o.Key == nil {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case s := <-offers:
+			if s.Type() != model.SignalTypeOffer {
+				continue
+			}
+			if o, err = session.OpenOffer(s.Payload(), reqKey, key); err != nil {
+				log.Println("RequestConn: session.OpenOffer:", err)
+			}
+			if to != nil && !bytes.Equal(o.Sign, to) {
+				o = session.Offer{}
+			}
+		}
 	}
 
-	pc, err := wrtc.Setup()
+	pc, err := wrtc.Setup(cfg)
 	if err != nil {
-		log.Println("NeedConn: wrtc.Setup:", err)
-		return
+		return nil, err
 	}
-	sdp, err := wrtc.BuildOffer(pc)
+	signals := m.SubscribeKey(string(o.Key))
+	sess := session.New(o.Key, pc, key, o.PubKey, o.Sign, func() { m.UnsbribeKey(string(o.Key)) })
+	Trickle(sess, m.Send)
+	ready := make(chan fallback.Channel, 1)
+	go func() { ready <- Channel(sess, signals, m.Send) }()
+
+	gctx, cancel := context.WithTimeout(ctx, config.GatherTimeout)
+	defer cancel()
+	sdp, err := pc.Answer(gctx, o.SDP, wrtc.GatherTrickle)
 	if err != nil {
-		log.Println("NeedConn: wrtc.BuildOffer:", err)
-		return
+		sess.Close()
+		return nil, err
 	}
+	payload, err := session.SealAnswer(o, key, privsign, sdp)
+	if err != nil {
+		sess.Close()
+		return nil, err
+	}
+	reply(model.SignalTypeAnswer, o.Key, payload, m.Send)
+	sess.Use(<-ready)
+	return sess, nil
+}
 
-	payload := make([]byte, len(sdp)+len(pubsign)+len(key.PublicKey().Bytes()), ed25519.SignatureSize)
-	pos := ed25519.SignatureSize
-	pos += copy(payload[pos:], pubsign)
-	pos += copy(payload[pos:], key.PublicKey().Bytes())
-	pos += copy(payload[pos:], sdp)
-	signature := ed25519.Sign(privsign, payload)
-	copy(payload[0:ed25519.SignatureSize], signature)
+// NeedConn offers a session to the requester when there is a free slot and
+// passes the request further otherwise. A request for this node is taken
+// without a free slot, but only from a trusted requester, one for another
+// node is passed on. The session is returned once the requester answered.
+func NeedConn(
+	ctx context.Context,
+	s model.Signal,
+	m Mesh,
+	cfg wrtc.Config,
+	privsign ed25519.PrivateKey,
+	hasFree func() bool,
+	trusted func(ed25519.PublicKey) bool,
+) (*session.Session, error) {
+	req, err := session.ParseRequest(s.Payload())
+	if err != nil {
+		return nil, err
+	}
+	if !req.For(privsign.Public().(ed25519.PublicKey)) || req.To == nil && !hasFree() {
+		m.Send(s)
+		return nil, nil
+	}
 
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := wrtc.Setup(cfg)
+	if err != nil {
+		return nil, err
+	}
 	mkey := model.GenerateKey()
-	signal, err := model.NewSignal(
-		model.SignalTypeOffer,
-		mkey,
-		payload,
-	)
+	// Subscribed before the offer is out, so the answer can't be missed.
+	signals := m.SubscribeKey(string(mkey))
+	abort := func() {
+		pc.Close()
+		m.UnsbribeKey(string(mkey))
+	}
+
+	gctx, cancel := context.WithTimeout(ctx, config.GatherTimeout)
+	defer cancel()
+	sdp, err := pc.Offer(gctx, wrtc.GatherTrickle)
+	if err != nil {
+		abort()
+		return nil, err
+	}
+	payload, err := session.SealOffer(s.Key(), req, key, privsign, mkey, sdp)
+	if err != nil {
+		abort()
+		return nil, err
+	}
+	offer, err := model.NewSignal(model.SignalTypeOffer, s.Key(), payload)
 	if err != nil {
-		log.Println("NeedConn: model.NewSignal:", err)
-		return
+		abort()
+		return nil, err
+	}
+	pow.Mint(offer, m.Difficulty(model.SignalTypeOffer))
+	m.Send(offer)
+
+	actx, acancel := context.WithTimeout(ctx, config.OfferTimeout)
+	defer acancel()
+	var a session.Answer
+	for a.Sign == nil {
+		select {
+		case <-actx.Done():
+			abort()
+			return nil, actx.Err()
+		case s := <-signals:
+			switch s.Type() {
+			case model.SignalTypeCandidate:
+				// Candidates of the requester may overtake its answer.
+				addCandidate(s, pc, key, req.PubKey)
+			case model.SignalTypeAnswer:
+				if a, err = session.OpenAnswer(s.Payload(), mkey, key, req.PubKey); err != nil {
+					log.Println("NeedConn: session.OpenAnswer:", err)
+				}
+			}
+		}
+	}
+	if req.To != nil && !trusted(a.Sign) {
+		abort()
+		return nil, ErrUntrusted
+	}
+	if err := pc.Accept(a.SDP); err != nil {
+		abort()
+		return nil, err
 	}
 
-	send(signal)
+	sess := session.New(mkey, pc, key, req.PubKey, a.Sign, func() { m.UnsbribeKey(string(mkey)) })
+	// Local candidates wait until now, when the requester listens for them.
+	Trickle(sess, m.Send)
+	sess.Use(Channel(sess, signals, m.Send))
+	return sess, nil
 }
@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"go-chat/model"
+	"go-chat/presence"
+	"log"
+	"slices"
+)
+
+// SendPresence sends a Presence or Typing update to each of the peers, it
+// goes no further than one hop.
+func SendPresence(t model.SignalType, u presence.Update, to [][]byte, sendTo func([]byte, model.Signal) bool) {
+	payload, err := u.Marshal()
+	if err != nil {
+		log.Println("SendPresence: presence.Marshal:", err)
+		return
+	}
+	s, err := model.NewSignal(t, model.GenerateKey(), payload)
+	if err != nil {
+		log.Println("SendPresence: model.NewSignal:", err)
+		return
+	}
+	for _, hash := range to {
+		sendTo(hash, s)
+	}
+}
+
+// PresenceReceived applies updates of contacts, and typing of room
+// members. resolve names the sender, or refuses it. Updates are never
+// forwarded.
+func PresenceReceived(
+	s model.Signal,
+	view *presence.View,
+	resolve func(sign []byte, conv string) (string, bool),
+	changed func(key string, st presence.Status),
+) {
+	if s.Type() != model.SignalTypePresence && s.Type() != model.SignalTypeTyping {
+		return
+	}
+	u, err := presence.ParseUpdate(s.Payload())
+	if err != nil {
+		log.Println("PresenceReceived: presence.ParseUpdate:", err)
+		return
+	}
+	if s.Type() == model.SignalTypePresence {
+		u.Conv = ""
+	}
+	key, ok := resolve(u.Sign, u.Conv)
+	if !ok {
+		return
+	}
+
+	before := view.Get(key)
+	apply := view.ApplyPresence
+	if s.Type() == model.SignalTypeTyping {
+		apply = view.ApplyTyping
+	}
+	if !apply(key, u) {
+		return
+	}
+	if after := view.Get(key); after.State != before.State || !slices.Equal(after.Typing, before.Typing) {
+		changed(key, after)
+	}
+}
@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"go-chat/config"
+	"go-chat/model"
+	"go-chat/relay"
+	"log"
+)
+
+// AnnounceRelay offers the relay to the peer signing with sign, with
+// credentials issued to it alone. Announces are never forwarded, so the
+// credentials don't spread through the mesh.
+func AnnounceRelay(
+	srv *relay.Server,
+	privsign ed25519.PrivateKey,
+	hash []byte,
+	sign ed25519.PublicKey,
+	sendTo func([]byte, model.Signal) bool,
+) {
+	a, err := srv.Announce(hex.EncodeToString(sign), config.RelayAnnounceTTL)
+	if err != nil {
+		log.Println("AnnounceRelay: relay.Announce:", err)
+		return
+	}
+	payload, err := a.Marshal(privsign)
+	if err != nil {
+		log.Println("AnnounceRelay: relay.Marshal:", err)
+		return
+	}
+	s, err := model.NewSignal(model.SignalTypeRelayAnnounce, model.GenerateKey(), payload)
+	if err != nil {
+		log.Println("AnnounceRelay: model.NewSignal:", err)
+		return
+	}
+	sendTo(hash, s)
+}
+
+// RelayAnnounce remembers relays offered by trusted peers.
+func RelayAnnounce(s model.Signal, dir *relay.Directory) {
+	if _, err := dir.Add(s.Payload()); err != nil {
+		log.Println("RelayAnnounce: relay.Add:", err)
+	}
+}
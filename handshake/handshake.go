@@ -9,36 +9,79 @@ import (
 	"io"
 )
 
+var ErrUnproven = errors.New("peer didn't prove its sign key")
+
+const label = "go-chat handshake"
+
 type Handshake struct {
 	PubKey  *ecdh.PublicKey
 	PubSign ed25519.PublicKey
 }
 
+// With exchanges the keys with the peer. Each side then signs both ECDH
+// keys with its sign key, so a peer can't claim a sign key it doesn't hold.
 func With(
 	ctx context.Context,
 	rw io.ReadWriter,
 	pubkey *ecdh.PublicKey,
-	pubsign ed25519.PublicKey,
+	privsign ed25519.PrivateKey,
 ) (Handshake, error) {
-	input := make(chan []byte)
-	errCh := make(chan error)
-	defer close(errCh)
+	pubsign := privsign.Public().(ed25519.PublicKey)
+	payload := make([]byte, 0, len(pubsign)+len(pubkey.Bytes()))
+	payload = append(payload, pubsign...)
+	payload = append(payload, pubkey.Bytes()...)
+	b, err := exchange(ctx, rw, payload, len(payload))
+	if err != nil {
+		return Handshake{}, err
+	}
+
+	sigBytes, keyBytes := b[:ed25519.PublicKeySize], b[ed25519.PublicKeySize:]
+	peerPubKey, err := ecdh.P256().NewPublicKey(keyBytes)
+	if err != nil {
+		return Handshake{}, fmt.Errorf("parse public key: %w", err)
+	}
+	peerPubSign := ed25519.PublicKey(sigBytes)
+
+	sig, err := exchange(ctx, rw, ed25519.Sign(privsign, transcript(pubkey, peerPubKey)), ed25519.SignatureSize)
+	if err != nil {
+		return Handshake{}, err
+	}
+	if !ed25519.Verify(peerPubSign, transcript(peerPubKey, pubkey), sig) {
+		return Handshake{}, ErrUnproven
+	}
+	return Handshake{
+		PubKey:  peerPubKey,
+		PubSign: peerPubSign,
+	}, nil
+}
+
+// Transcript is what the side with the key own signs.
+func transcript(own, remote *ecdh.PublicKey) []byte {
+	b := []byte(label)
+	b = append(b, own.Bytes()...)
+	return append(b, remote.Bytes()...)
+}
+
+// exchange writes out and reads n bytes of the peer at the same time.
+func exchange(ctx context.Context, rw io.ReadWriter, out []byte, n int) ([]byte, error) {
+	input := make(chan []byte, 1)
+	written := make(chan struct{})
+	errCh := make(chan error, 2)
 
 	go func() {
-		payload := append(pubsign, pubkey.Bytes()...)
-		for written := 0; written < len(payload); {
-			n, err := rw.Write(payload[written:])
+		for written := 0; written < len(out); {
+			n, err := rw.Write(out[written:])
 			if err != nil {
 				errCh <- err
 				return
 			}
 			written += n
 		}
+		close(written)
 	}()
 
 	go func() {
-		defer close(input)
-		payload := make([]byte, len(pubkey.Bytes())+ed25519.PublicKeySize)
+		payload := make([]byte, n)
 		for read := 0; read < len(payload); {
 			n, err := rw.Read(payload[read:])
 			if errors.Is(err, io.EOF) {
@@ -53,21 +96,22 @@ func With(
 		input <- payload
 	}()
 
-	select {
-	case <-ctx.Done():
-		return Handshake{}, errors.New("context closed")
-	case e := <-errCh:
-		return Handshake{}, e
-	case b := <-input:
-		sigBytes, keyBytes := b[:ed25519.PublicKeySize], b[ed25519.PublicKeySize:]
-		peerPubKey, err := ecdh.P256().NewPublicKey(keyBytes)
-		if err != nil {
-			return Handshake{}, fmt.Errorf("parse public key: %w", err)
+	// Own bytes have to be fully written before the caller starts sending
+	// frames over the same connection.
+	var b []byte
+	for sent := false; b == nil || !sent; {
+		if ctx.Err() != nil {
+			return nil, errors.New("context closed")
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.New("context closed")
+		case e := <-errCh:
+			return nil, e
+		case <-written:
+			sent, written = true, nil
+		case b = <-input:
 		}
-		peerPubSign := ed25519.PublicKey(sigBytes)
-		return Handshake{
-			PubKey:  peerPubKey,
-			PubSign: peerPubSign,
-		}, nil
 	}
+	return b, nil
 }
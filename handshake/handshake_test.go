@@ -20,26 +20,30 @@ func Test_With(t *testing.T) {
 		io.Writer
 	}
 
+	// peer is what the peer with the keys sends to the side with pubkey.
+	peer := func(privsign ed25519.PrivateKey, key *ecdh.PrivateKey, pubkey *ecdh.PublicKey, signed *ecdh.PublicKey) *bytes.Buffer {
+		buf := new(bytes.Buffer)
+		buf.Write(privsign.Public().(ed25519.PublicKey))
+		buf.Write(key.PublicKey().Bytes())
+		buf.Write(ed25519.Sign(privsign, transcript(signed, pubkey)))
+		return buf
+	}
+
 	t.Run("success", func(t *testing.T) {
 		r, w := io.Pipe()
-		peerPubSign, _, err := ed25519.GenerateKey(rand.Reader)
+		peerPubSign, peerPrivSign, err := ed25519.GenerateKey(rand.Reader)
 		assert.NoError(t, err)
 		peerPrivKey, err := ecdh.P256().GenerateKey(rand.Reader)
 		assert.NoError(t, err)
 
-		pubSign, _, err := ed25519.GenerateKey(rand.Reader)
+		pubSign, privSign, err := ed25519.GenerateKey(rand.Reader)
 		assert.NoError(t, err)
 		privKey, err := ecdh.P256().GenerateKey(rand.Reader)
 		assert.NoError(t, err)
 
-		peerPayload := make([]byte, len(peerPrivKey.PublicKey().Bytes())+ed25519.PublicKeySize)
-		copy(peerPayload[:ed25519.PublicKeySize], peerPubSign)
-		copy(peerPayload[ed25519.PublicKeySize:], peerPrivKey.PublicKey().Bytes())
-		buf := new(bytes.Buffer)
-		buf.Write(peerPayload)
 		a := adapter{
 			Writer: w,
-			Reader: buf,
+			Reader: peer(peerPrivSign, peerPrivKey, privKey.PublicKey(), peerPrivKey.PublicKey()),
 		}
 
 		wg := sync.WaitGroup{}
@@ -47,7 +51,7 @@ func Test_With(t *testing.T) {
 		go func() {
 			defer wg.Done()
 
-			in := make([]byte, len(peerPayload))
+			in := make([]byte, ed25519.PublicKeySize+len(privKey.PublicKey().Bytes())+ed25519.SignatureSize)
 			for read := 0; read < len(in); {
 				n, err := r.Read(in[read:])
 				if errors.Is(err, io.EOF) {
@@ -56,21 +60,51 @@ func Test_With(t *testing.T) {
 				assert.NoError(t, err)
 				read += n
 			}
-			expected := make([]byte, len(in))
-			copy(expected[:ed25519.PublicKeySize], pubSign)
-			copy(expected[ed25519.PublicKeySize:], privKey.PublicKey().Bytes())
-			assert.Equal(t, expected, in)
+			keys, sig := in[:len(in)-ed25519.SignatureSize], in[len(in)-ed25519.SignatureSize:]
+			expected := append(append([]byte{}, pubSign...), privKey.PublicKey().Bytes()...)
+			assert.Equal(t, expected, keys)
+			assert.True(t, ed25519.Verify(pubSign, transcript(privKey.PublicKey(), peerPrivKey.PublicKey()), sig))
 		}()
 
-		h, err := With(t.Context(), a, privKey.PublicKey(), pubSign)
+		h, err := With(t.Context(), a, privKey.PublicKey(), privSign)
 		assert.NoError(t, err)
 		assert.Equal(t, peerPrivKey.PublicKey(), h.PubKey)
 		assert.Equal(t, peerPubSign, h.PubSign)
 		wg.Wait()
 	})
 
+	t.Run("reject unproven sign key", func(t *testing.T) {
+		_, privSign, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		privKey, err := ecdh.P256().GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		_, peerPrivSign, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		peerPrivKey, err := ecdh.P256().GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+
+		// The signature was made for another ECDH key, e.g. replayed from
+		// another connection.
+		other, err := ecdh.P256().GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		a := adapter{
+			Writer: new(bytes.Buffer),
+			Reader: peer(peerPrivSign, peerPrivKey, privKey.PublicKey(), other.PublicKey()),
+		}
+		_, err = With(t.Context(), a, privKey.PublicKey(), privSign)
+		assert.ErrorIs(t, err, ErrUnproven)
+
+		// A sign key claimed without any signature.
+		buf := new(bytes.Buffer)
+		buf.Write(peerPrivSign.Public().(ed25519.PublicKey))
+		buf.Write(peerPrivKey.PublicKey().Bytes())
+		a = adapter{Writer: new(bytes.Buffer), Reader: buf}
+		_, err = With(t.Context(), a, privKey.PublicKey(), privSign)
+		assert.ErrorIs(t, err, ErrUnproven)
+	})
+
 	t.Run("invalid pubkey", func(t *testing.T) {
-		pubSign, _, err := ed25519.GenerateKey(rand.Reader)
+		_, privSign, err := ed25519.GenerateKey(rand.Reader)
 		assert.NoError(t, err)
 		privKey, err := ecdh.P256().GenerateKey(rand.Reader)
 		assert.NoError(t, err)
@@ -89,12 +123,12 @@ func Test_With(t *testing.T) {
 			Writer: new(bytes.Buffer),
 			Reader: buf,
 		}
-		_, err = With(t.Context(), a, privKey.PublicKey(), pubSign)
+		_, err = With(t.Context(), a, privKey.PublicKey(), privSign)
 		assert.ErrorContains(t, err, "parse public key")
 	})
 
 	t.Run("context closed", func(t *testing.T) {
-		pubSign, _, err := ed25519.GenerateKey(rand.Reader)
+		_, privSign, err := ed25519.GenerateKey(rand.Reader)
 		assert.NoError(t, err)
 		privKey, err := ecdh.P256().GenerateKey(rand.Reader)
 		assert.NoError(t, err)
@@ -102,7 +136,7 @@ func Test_With(t *testing.T) {
 		ctx, cancel := context.WithCancel(context.Background())
 		cancel()
 
-		_, err = With(ctx, new(bytes.Buffer), privKey.PublicKey(), pubSign)
+		_, err = With(ctx, new(bytes.Buffer), privKey.PublicKey(), privSign)
 		assert.ErrorContains(t, err, "context closed")
 	})
 }
@@ -0,0 +1,173 @@
+package simnet
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Epoch is where every simulation starts, the time of a new synctest
+// bubble, so runs with the same seed produce the same times.
+var Epoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type event struct {
+	at    time.Time
+	seq   uint64
+	fn    func()
+	index int
+}
+
+type events []*event
+
+func (e events) Len() int { return len(e) }
+func (e events) Less(i, j int) bool {
+	if !e[i].at.Equal(e[j].at) {
+		return e[i].at.Before(e[j].at)
+	}
+	return e[i].seq < e[j].seq
+}
+func (e events) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+	e[i].index, e[j].index = i, j
+}
+func (e *events) Push(x any) {
+	ev := x.(*event)
+	ev.index = len(*e)
+	*e = append(*e, ev)
+}
+func (e *events) Pop() any {
+	old := *e
+	ev := old[len(old)-1]
+	*e = old[:len(old)-1]
+	ev.index = -1
+	return ev
+}
+
+// Clock is virtual time, the fake clock of the synctest bubble it runs in.
+// It only moves when the simulation runs, from one scheduled event to the
+// next; events at the same time run in the order they were scheduled.
+// Timers of the code under test fire in between and Wake the clock.
+type Clock struct {
+	seq    uint64
+	queue  events
+	events uint64
+	wake   chan struct{}
+	// settle runs after every event and wakeup, the network pumps its
+	// nodes in it.
+	settle func()
+}
+
+// NewClock must be called inside a synctest bubble.
+func NewClock() *Clock {
+	return &Clock{wake: make(chan struct{}, 1)}
+}
+
+func (c *Clock) Now() time.Time {
+	return time.Now().UTC()
+}
+
+// Since is time.Since on the virtual clock.
+func (c *Clock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+type Timer struct {
+	c  *Clock
+	ev *event
+}
+
+// AfterFunc runs fn once d has passed on the clock.
+func (c *Clock) AfterFunc(d time.Duration, fn func()) *Timer {
+	c.seq++
+	ev := &event{at: c.Now().Add(max(d, 0)), seq: c.seq, fn: fn}
+	heap.Push(&c.queue, ev)
+	return &Timer{c: c, ev: ev}
+}
+
+// Stop reports whether the timer was stopped before it fired.
+func (t *Timer) Stop() bool {
+	if t.ev.index < 0 {
+		return false
+	}
+	heap.Remove(&t.c.queue, t.ev.index)
+	return true
+}
+
+// Wake makes a running clock settle before its next event. It is safe to
+// call from any goroutine of the bubble.
+func (c *Clock) Wake() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run runs the events due within d and leaves the clock d later.
+func (c *Clock) Run(d time.Duration) {
+	until := c.Now().Add(d)
+	for {
+		if c.due(until) {
+			c.step()
+			continue
+		}
+		if !c.Now().Before(until) {
+			return
+		}
+		c.sleep(until)
+	}
+}
+
+// Settle runs events until none is left or limit has passed, and reports
+// whether the simulation went idle. Periodic timers keep it from idling.
+func (c *Clock) Settle(limit time.Duration) bool {
+	until := c.Now().Add(limit)
+	for len(c.queue) > 0 {
+		if c.due(until) {
+			c.step()
+			continue
+		}
+		if !c.Now().Before(until) {
+			return false
+		}
+		c.sleep(until)
+	}
+	return true
+}
+
+// Events is the number of events run so far.
+func (c *Clock) Events() uint64 {
+	return c.events
+}
+
+// due reports whether the next event is due now and not after until.
+func (c *Clock) due(until time.Time) bool {
+	return len(c.queue) > 0 && !c.queue[0].at.After(c.Now()) && !c.queue[0].at.After(until)
+}
+
+// sleep lets the bubble time pass up to the next event or until, whichever
+// comes first, or until something wakes the clock.
+func (c *Clock) sleep(until time.Time) {
+	at := until
+	if len(c.queue) > 0 && c.queue[0].at.Before(at) {
+		at = c.queue[0].at
+	}
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.wake:
+		c.run()
+	}
+}
+
+func (c *Clock) step() {
+	ev := heap.Pop(&c.queue).(*event)
+	c.events++
+	ev.fn()
+	c.run()
+}
+
+func (c *Clock) run() {
+	if c.settle != nil {
+		c.settle()
+	}
+}
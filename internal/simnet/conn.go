@@ -0,0 +1,92 @@
+package simnet
+
+import (
+	"io"
+	"sync"
+)
+
+// conn is the end of a simulated link a dispatcher reads and writes. Each
+// Write is one message and each Read returns one, as a data channel does.
+// Writes wait in out until the event loop puts them on the link, so they
+// leave in the same order every run.
+type conn struct {
+	mu     sync.Mutex
+	in     [][]byte
+	out    [][]byte
+	ready  chan struct{}
+	closed chan struct{}
+	once   sync.Once
+	wake   func()
+}
+
+func newConn(wake func()) *conn {
+	return &conn{
+		ready:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		wake:   wake,
+	}
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.in) > 0 {
+			b := c.in[0]
+			c.in = c.in[1:]
+			c.mu.Unlock()
+			return copy(p, b), nil
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-c.closed:
+			return 0, io.EOF
+		case <-c.ready:
+		}
+	}
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	if c.isClosed() {
+		return 0, io.ErrClosedPipe
+	}
+	c.mu.Lock()
+	c.out = append(c.out, append([]byte(nil), p...))
+	c.mu.Unlock()
+	c.wake()
+	return len(p), nil
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+// deliver hands a message from the link to the reader.
+func (c *conn) deliver(b []byte) {
+	c.mu.Lock()
+	c.in = append(c.in, b)
+	c.mu.Unlock()
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the messages written since the last call.
+func (c *conn) take() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := c.out
+	c.out = nil
+	return out
+}
+
+func (c *conn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
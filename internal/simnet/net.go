@@ -0,0 +1,307 @@
+package simnet
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"sort"
+	"testing/synctest"
+	"time"
+)
+
+var (
+	ErrUnknownNode = errors.New("unknown node")
+	ErrConnected   = errors.New("nodes are already connected")
+	ErrPartitioned = errors.New("nodes are partitioned")
+	ErrDown        = errors.New("node is down")
+)
+
+// Link shapes the traffic between two nodes. Messages keep their order
+// unless Reorder lets one fall behind the ones sent after it.
+type Link struct {
+	Latency time.Duration
+	// Jitter adds up to this much to the latency of each message.
+	Jitter time.Duration
+	// Loss and Reorder are probabilities per message.
+	Loss    float64
+	Reorder float64
+}
+
+// Handler is what runs on a node. It is called from the event loop only,
+// never concurrently.
+type Handler interface {
+	Connected(peer string)
+	Disconnected(peer string)
+	Receive(from string, b []byte)
+}
+
+// pumper is a Handler running goroutines of its own. pump is called once
+// they are all blocked, and reports whether it handed them more work.
+type pumper interface {
+	pump() bool
+}
+
+type Stats struct {
+	Sent      uint64
+	Delivered uint64
+	Lost      uint64
+}
+
+type pair struct{ a, b string }
+
+func pairOf(a, b string) pair {
+	if a > b {
+		a, b = b, a
+	}
+	return pair{a, b}
+}
+
+type wire struct {
+	// last is the delivery time of the latest message each way, by sender.
+	last map[string]time.Time
+}
+
+// Net is a simulated network of nodes wired with in-memory connections.
+// All randomness comes from the seed and all time from the virtual clock,
+// so a run is the same every time. It runs inside a synctest bubble and is
+// driven from its root goroutine only.
+type Net struct {
+	*Clock
+	rand  *rand.Rand
+	link  Link
+	links map[pair]Link
+	nodes map[string]Handler
+	down  map[string]bool
+	conns map[pair]*wire
+	group map[string]int
+	stats Stats
+}
+
+// New makes an empty network, link is the default for every pair.
+func New(seed uint64, link Link) *Net {
+	n := &Net{
+		Clock: NewClock(),
+		rand:  rand.New(rand.NewPCG(seed, seed)),
+		link:  link,
+		links: map[pair]Link{},
+		nodes: map[string]Handler{},
+		down:  map[string]bool{},
+		conns: map[pair]*wire{},
+		group: map[string]int{},
+	}
+	n.settle = n.pump
+	return n
+}
+
+// Rand is the seeded source, for handlers that need randomness.
+func (n *Net) Rand() *rand.Rand {
+	return n.rand
+}
+
+func (n *Net) Add(id string, h Handler) {
+	n.nodes[id] = h
+}
+
+// Nodes returns the ids in order.
+func (n *Net) Nodes() []string {
+	out := make([]string, 0, len(n.nodes))
+	for id := range n.nodes {
+		out = append(out, id)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// SetLink overrides the default link between a and b.
+func (n *Net) SetLink(a, b string, l Link) {
+	n.links[pairOf(a, b)] = l
+}
+
+func (n *Net) Link(a, b string) Link {
+	if l, ok := n.links[pairOf(a, b)]; ok {
+		return l
+	}
+	return n.link
+}
+
+// Connect opens a connection, both sides learn of it in the next event.
+func (n *Net) Connect(a, b string) error {
+	if _, ok := n.nodes[a]; !ok {
+		return ErrUnknownNode
+	}
+	if _, ok := n.nodes[b]; !ok || a == b {
+		return ErrUnknownNode
+	}
+	if n.down[a] || n.down[b] {
+		return ErrDown
+	}
+	if n.group[a] != n.group[b] {
+		return ErrPartitioned
+	}
+	p := pairOf(a, b)
+	if _, ok := n.conns[p]; ok {
+		return ErrConnected
+	}
+	c := &wire{last: map[string]time.Time{}}
+	n.conns[p] = c
+	n.AfterFunc(0, func() {
+		if n.conns[p] == c {
+			n.nodes[a].Connected(b)
+		}
+	})
+	n.AfterFunc(0, func() {
+		if n.conns[p] == c {
+			n.nodes[b].Connected(a)
+		}
+	})
+	return nil
+}
+
+// Disconnect closes the connection, messages on the way are lost.
+func (n *Net) Disconnect(a, b string) {
+	p := pairOf(a, b)
+	if _, ok := n.conns[p]; !ok {
+		return
+	}
+	delete(n.conns, p)
+	n.AfterFunc(0, func() { n.nodes[a].Disconnected(b) })
+	n.AfterFunc(0, func() { n.nodes[b].Disconnected(a) })
+}
+
+func (n *Net) Connected(a, b string) bool {
+	_, ok := n.conns[pairOf(a, b)]
+	return ok
+}
+
+// Peers returns the nodes connected to id, in order.
+func (n *Net) Peers(id string) []string {
+	var out []string
+	for p := range n.conns {
+		switch id {
+		case p.a:
+			out = append(out, p.b)
+		case p.b:
+			out = append(out, p.a)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Partition splits the network into the groups, nodes left out form one
+// more group. Connections across groups are closed and can't be opened
+// until Heal.
+func (n *Net) Partition(groups ...[]string) {
+	clear(n.group)
+	for i, g := range groups {
+		for _, id := range g {
+			n.group[id] = i + 1
+		}
+	}
+	n.cut(func(p pair) bool { return n.group[p.a] != n.group[p.b] })
+}
+
+func (n *Net) Heal() {
+	clear(n.group)
+}
+
+// Stop takes a node down, as if it crashed. Start brings it back without
+// connections.
+func (n *Net) Stop(id string) {
+	n.down[id] = true
+	n.cut(func(p pair) bool { return p.a == id || p.b == id })
+}
+
+func (n *Net) Start(id string) {
+	delete(n.down, id)
+}
+
+// Send puts b on the connection from one node to the other. It reports
+// false when they are not connected; a message lost on the way still
+// counts as sent.
+func (n *Net) Send(from, to string, b []byte) bool {
+	p := pairOf(from, to)
+	c, ok := n.conns[p]
+	if !ok {
+		return false
+	}
+	n.stats.Sent++
+	l := n.Link(from, to)
+	if l.Loss > 0 && n.rand.Float64() < l.Loss {
+		n.stats.Lost++
+		return true
+	}
+	d := l.Latency
+	if l.Jitter > 0 {
+		d += time.Duration(n.rand.Int64N(int64(l.Jitter)))
+	}
+	at := n.Now().Add(d)
+	if l.Reorder > 0 && n.rand.Float64() < l.Reorder {
+		// Held back behind the messages that follow it.
+		at = at.Add(l.Latency + l.Jitter + time.Millisecond)
+	} else {
+		if last := c.last[from]; at.Before(last) {
+			at = last
+		}
+		c.last[from] = at
+	}
+
+	msg := append([]byte(nil), b...)
+	n.AfterFunc(at.Sub(n.Now()), func() {
+		if n.conns[p] != c {
+			n.stats.Lost++
+			return
+		}
+		n.stats.Delivered++
+		n.nodes[to].Receive(from, msg)
+	})
+	return true
+}
+
+func (n *Net) Stats() Stats {
+	return n.stats
+}
+
+// Close stops the goroutines of every node, the bubble can't end before.
+func (n *Net) Close() {
+	for _, id := range n.Nodes() {
+		if c, ok := n.nodes[id].(io.Closer); ok {
+			c.Close()
+		}
+	}
+	synctest.Wait()
+}
+
+// pump lets the nodes run until all of them wait for the network.
+func (n *Net) pump() {
+	for {
+		synctest.Wait()
+		busy := false
+		for _, id := range n.Nodes() {
+			if p, ok := n.nodes[id].(pumper); ok && p.pump() {
+				busy = true
+			}
+		}
+		if !busy {
+			return
+		}
+	}
+}
+
+func (n *Net) cut(match func(pair) bool) {
+	var cut []pair
+	for p := range n.conns {
+		if match(p) {
+			cut = append(cut, p)
+		}
+	}
+	sort.Slice(cut, func(i, j int) bool {
+		if cut[i].a != cut[j].a {
+			return cut[i].a < cut[j].a
+		}
+		return cut[i].b < cut[j].b
+	})
+	for _, p := range cut {
+		n.Disconnect(p.a, p.b)
+	}
+}
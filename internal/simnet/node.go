@@ -0,0 +1,247 @@
+package simnet
+
+import (
+	"go-chat/config"
+	"go-chat/dispatcher"
+	"go-chat/fallback"
+	"go-chat/handler"
+	"go-chat/model"
+	"sort"
+	"testing/synctest"
+	"time"
+)
+
+type Config struct {
+	// Redial is the first wait before dialing a lost peer again, doubled on
+	// every failure up to MaxRedial. Zero never redials.
+	Redial    time.Duration
+	MaxRedial time.Duration
+	// Router limits the RelayData forwarded for other sessions.
+	Router fallback.Limits
+	// Keepalive is the ping interval of the dispatcher, the round trip times
+	// Fastest goes by come from it. Zero disables pings.
+	Keepalive time.Duration
+}
+
+type keySub struct {
+	ch <-chan model.Signal
+	fn func(s model.Signal)
+}
+
+// Node is a go-chat node on the simulated network: a dispatcher.Dispatcher
+// over one in-memory connection per peer, wired as main does. Signals are
+// flooded on with handler.Forward unless their key is local, RelayData goes
+// to the fastest peers through fallback.Router and one hop signals stop at
+// the first node.
+type Node struct {
+	id      string
+	net     *Net
+	cfg     Config
+	d       *dispatcher.Dispatcher
+	router  *fallback.Router
+	conns   map[string]*conn
+	inbound []<-chan dispatcher.Inbound
+	types   map[model.SignalType][]func(from string, s model.Signal)
+	keys    map[string]keySub
+	known   map[string]bool
+	wait    map[string]time.Duration
+	got     map[string]time.Time
+}
+
+// NewNode adds a node to the network.
+func NewNode(net *Net, id string, cfg Config) *Node {
+	n := &Node{
+		id:    id,
+		net:   net,
+		cfg:   cfg,
+		d:     dispatcher.New(dispatcher.WithKeepalive(cfg.Keepalive, config.IdleTimeout, config.MaxMissedPongs)),
+		conns: map[string]*conn{},
+		types: map[model.SignalType][]func(string, model.Signal){},
+		keys:  map[string]keySub{},
+		known: map[string]bool{},
+		wait:  map[string]time.Duration{},
+		got:   map[string]time.Time{},
+	}
+	for t := model.SignalType(0); t.IsValid(); t++ {
+		n.inbound = append(n.inbound, n.d.SubscribeTypeFrom(t))
+	}
+	n.router = fallback.NewRouter(cfg.Router, n.d.Fastest, n.d.SendTo)
+	net.Add(id, n)
+	return n
+}
+
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Dial connects to the peer and keeps redialing it once lost.
+func (n *Node) Dial(peer string) error {
+	n.known[peer] = true
+	err := n.net.Connect(n.id, peer)
+	if err == ErrConnected {
+		return nil
+	}
+	if err != nil && err != ErrUnknownNode {
+		n.retry(peer)
+	}
+	return err
+}
+
+func (n *Node) SubscribeType(t model.SignalType, fn func(from string, s model.Signal)) {
+	n.types[t] = append(n.types[t], fn)
+}
+
+func (n *Node) SubscribeKey(key string, fn func(s model.Signal)) {
+	n.keys[key] = keySub{ch: n.d.SubscribeKey(key), fn: fn}
+}
+
+func (n *Node) Subscribed(key string) bool {
+	return n.d.Subscribed(key)
+}
+
+// Send floods the signal to every peer.
+func (n *Node) Send(s model.Signal) {
+	n.d.Send(s)
+	n.net.pump()
+}
+
+// SendTo sends the signal to a single peer.
+func (n *Node) SendTo(peer string, s model.Signal) bool {
+	ok := n.d.SendTo([]byte(peer), s)
+	n.net.pump()
+	return ok
+}
+
+// Fastest returns up to count peers by measured round trip time.
+func (n *Node) Fastest(count int) [][]byte {
+	return n.d.Fastest(count)
+}
+
+// Got reports when the signal reached the node.
+func (n *Node) Got(s model.Signal) (time.Time, bool) {
+	at, ok := n.got[s.NonceString()]
+	return at, ok
+}
+
+func (n *Node) Connected(peer string) {
+	delete(n.wait, peer)
+	if old, ok := n.conns[peer]; ok {
+		old.Close()
+	}
+	c := newConn(n.net.Wake)
+	n.conns[peer] = c
+	n.d.Dispatch([]byte(peer), c)
+}
+
+func (n *Node) Disconnected(peer string) {
+	if c, ok := n.conns[peer]; ok {
+		c.Close()
+		delete(n.conns, peer)
+	}
+	if n.known[peer] {
+		n.retry(peer)
+	}
+}
+
+func (n *Node) Receive(from string, b []byte) {
+	if c, ok := n.conns[from]; ok {
+		c.deliver(b)
+	}
+}
+
+// Close closes the connections, the goroutines of the dispatcher end.
+func (n *Node) Close() error {
+	for peer, c := range n.conns {
+		c.Close()
+		delete(n.conns, peer)
+	}
+	return nil
+}
+
+// pump handles what the dispatcher delivered, one signal at a time so the
+// outboxes fill in the same order every run, then puts what it wrote on the
+// links. A connection the dispatcher dropped is closed on the network too.
+func (n *Node) pump() bool {
+	busy := false
+	for n.next() {
+		busy = true
+		synctest.Wait()
+	}
+	for _, peer := range sortedKeys(n.conns) {
+		c := n.conns[peer]
+		for _, b := range c.take() {
+			n.net.Send(n.id, peer, b)
+		}
+		if c.isClosed() {
+			delete(n.conns, peer)
+			n.net.Disconnect(n.id, peer)
+		}
+	}
+	return busy
+}
+
+// next handles one delivered signal and reports whether there was one.
+func (n *Node) next() bool {
+	for _, ch := range n.inbound {
+		select {
+		case in := <-ch:
+			n.handle(string(in.From), in.Signal)
+			return true
+		default:
+		}
+	}
+	for _, key := range sortedKeys(n.keys) {
+		select {
+		case s := <-n.keys[key].ch:
+			n.keys[key].fn(s)
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+func (n *Node) handle(from string, s model.Signal) {
+	n.got[s.NonceString()] = n.net.Now()
+	for _, fn := range n.types[s.Type()] {
+		fn(from, s)
+	}
+
+	switch s.Type() {
+	case model.SignalTypePresence, model.SignalTypeTyping, model.SignalTypeInviteRedeem, model.SignalTypeRelayAnnounce, model.SignalTypeMailboxAnnounce:
+	case model.SignalTypeRelayData:
+		if !n.d.Subscribed(s.KeyString()) {
+			n.router.Forward([]byte(from), s)
+		}
+	default:
+		handler.Forward(s, n.d.Subscribed, n.d.Send)
+	}
+}
+
+func (n *Node) retry(peer string) {
+	if n.cfg.Redial <= 0 {
+		return
+	}
+	wait := n.cfg.Redial
+	if w, ok := n.wait[peer]; ok {
+		wait = 2 * w
+		if n.cfg.MaxRedial > 0 {
+			wait = min(wait, n.cfg.MaxRedial)
+		}
+	}
+	n.wait[peer] = wait
+	n.net.AfterFunc(wait, func() {
+		if !n.net.Connected(n.id, peer) {
+			n.Dial(peer)
+		}
+	})
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,261 @@
+package simnet
+
+import (
+	"fmt"
+	"go-chat/fallback"
+	"go-chat/model"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recorder struct {
+	got   []string
+	peers []string
+}
+
+func (r *recorder) Connected(peer string)         { r.peers = append(r.peers, peer) }
+func (r *recorder) Disconnected(peer string)      {}
+func (r *recorder) Receive(from string, b []byte) { r.got = append(r.got, string(b)) }
+
+func signal(t *testing.T, typ model.SignalType) model.Signal {
+	s, err := model.NewSignal(typ, model.GenerateKey(), []byte("payload"))
+	require.NoError(t, err)
+	return s
+}
+
+// mesh wires n nodes in a ring with a few random chords.
+func mesh(t *testing.T, seed uint64, n int, link Link, cfg Config) (*Net, []*Node) {
+	net := New(seed, link)
+	nodes := make([]*Node, n)
+	for i := range nodes {
+		nodes[i] = NewNode(net, fmt.Sprintf("n%02d", i), cfg)
+	}
+	for i := range nodes {
+		require.NoError(t, nodes[i].Dial(nodes[(i+1)%n].ID()))
+	}
+	for range n / 2 {
+		a, b := net.Rand().IntN(n), net.Rand().IntN(n)
+		if a != b {
+			nodes[a].Dial(nodes[b].ID())
+		}
+	}
+	net.Settle(time.Second)
+	return net, nodes
+}
+
+// run runs a subtest in a synctest bubble of its own, the Net needs one.
+func run(t *testing.T, name string, fn func(t *testing.T)) {
+	t.Run(name, func(t *testing.T) { synctest.Test(t, fn) })
+}
+
+func coverage(nodes []*Node, s model.Signal) int {
+	count := 0
+	for _, n := range nodes {
+		if _, ok := n.Got(s); ok {
+			count++
+		}
+	}
+	return count
+}
+
+func Test_Clock(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		c := NewClock()
+		var order []int
+		c.AfterFunc(2*time.Second, func() { order = append(order, 2) })
+		c.AfterFunc(time.Second, func() { order = append(order, 1) })
+		c.AfterFunc(time.Second, func() { order = append(order, 11) })
+		stopped := c.AfterFunc(time.Second, func() { order = append(order, 0) })
+		assert.True(t, stopped.Stop())
+
+		c.Run(1500 * time.Millisecond)
+		assert.Equal(t, []int{1, 11}, order)
+		assert.Equal(t, Epoch.Add(1500*time.Millisecond), c.Now())
+		assert.True(t, c.Settle(time.Minute))
+		assert.Equal(t, []int{1, 11, 2}, order)
+		assert.Equal(t, Epoch.Add(2*time.Second), c.Now())
+	})
+}
+
+func Test_Net(t *testing.T) {
+	run(t, "latency and order", func(t *testing.T) {
+		net := New(1, Link{Latency: 10 * time.Millisecond, Jitter: 5 * time.Millisecond})
+		a, b := &recorder{}, &recorder{}
+		net.Add("a", a)
+		net.Add("b", b)
+		require.NoError(t, net.Connect("a", "b"))
+		assert.ErrorIs(t, net.Connect("b", "a"), ErrConnected)
+		net.Settle(time.Second)
+		assert.Equal(t, []string{"b"}, a.peers)
+
+		var want []string
+		for i := range 50 {
+			want = append(want, fmt.Sprint(i))
+			net.Send("a", "b", []byte(want[i]))
+		}
+		net.Run(9 * time.Millisecond)
+		assert.Empty(t, b.got)
+		net.Settle(time.Second)
+		assert.Equal(t, want, b.got)
+	})
+
+	run(t, "loss and reorder", func(t *testing.T) {
+		net := New(1, Link{Latency: 10 * time.Millisecond, Loss: 0.2, Reorder: 0.2})
+		a, b := &recorder{}, &recorder{}
+		net.Add("a", a)
+		net.Add("b", b)
+		require.NoError(t, net.Connect("a", "b"))
+		for i := range 200 {
+			net.Send("a", "b", []byte(fmt.Sprintf("%03d", i)))
+		}
+		net.Settle(time.Second)
+
+		st := net.Stats()
+		assert.Equal(t, uint64(200), st.Sent)
+		assert.Equal(t, st.Sent, st.Delivered+st.Lost)
+		assert.InDelta(t, 40, st.Lost, 20)
+		reordered := 0
+		for i := 1; i < len(b.got); i++ {
+			if b.got[i] < b.got[i-1] {
+				reordered++
+			}
+		}
+		assert.NotZero(t, reordered)
+	})
+
+	run(t, "partitions", func(t *testing.T) {
+		net := New(1, Link{Latency: time.Millisecond})
+		for _, id := range []string{"a", "b", "c"} {
+			net.Add(id, &recorder{})
+		}
+		require.NoError(t, net.Connect("a", "b"))
+		require.NoError(t, net.Connect("b", "c"))
+		net.Partition([]string{"a"})
+		assert.False(t, net.Connected("a", "b"))
+		assert.True(t, net.Connected("b", "c"))
+		assert.ErrorIs(t, net.Connect("a", "c"), ErrPartitioned)
+		assert.False(t, net.Send("a", "b", []byte("x")))
+
+		net.Heal()
+		assert.NoError(t, net.Connect("a", "c"))
+		net.Stop("c")
+		assert.Empty(t, net.Peers("c"))
+		assert.ErrorIs(t, net.Connect("a", "c"), ErrDown)
+	})
+}
+
+func Test_Node(t *testing.T) {
+	link := Link{Latency: 20 * time.Millisecond, Jitter: 10 * time.Millisecond}
+
+	run(t, "flood coverage", func(t *testing.T) {
+		net, nodes := mesh(t, 7, 30, link, Config{})
+		defer net.Close()
+		s := signal(t, model.SignalTypeNeedConnect)
+		nodes[0].Send(s)
+		net.Settle(time.Minute)
+		assert.Equal(t, len(nodes)-1, coverage(nodes, s))
+
+		// A signal for a local key is taken, not forwarded.
+		s = signal(t, model.SignalTypeOffer)
+		var taken int
+		nodes[1].SubscribeKey(s.KeyString(), func(model.Signal) { taken++ })
+		nodes[0].Send(s)
+		net.Settle(time.Minute)
+		assert.Equal(t, 1, taken)
+
+		// One hop signals stop at the neighbours.
+		s = signal(t, model.SignalTypePresence)
+		nodes[0].Send(s)
+		net.Settle(time.Minute)
+		assert.Equal(t, len(net.Peers(nodes[0].ID())), coverage(nodes, s))
+	})
+
+	run(t, "same seed same run", func(t *testing.T) {
+		run := func() (Stats, []time.Duration) {
+			lossy := link
+			lossy.Loss, lossy.Reorder = 0.05, 0.1
+			net, nodes := mesh(t, 42, 25, lossy, Config{})
+			defer net.Close()
+			start := net.Now()
+			s := signal(t, model.SignalTypeNeedConnect)
+			nodes[3].Send(s)
+			net.Settle(time.Minute)
+			var times []time.Duration
+			for _, n := range nodes {
+				at, _ := n.Got(s)
+				times = append(times, at.Sub(start))
+			}
+			return net.Stats(), times
+		}
+		st1, times1 := run()
+		st2, times2 := run()
+		assert.Equal(t, st1, st2)
+		assert.Equal(t, times1, times2)
+	})
+
+	run(t, "partition and reconnection", func(t *testing.T) {
+		cfg := Config{Redial: 100 * time.Millisecond, MaxRedial: time.Second}
+		net, nodes := mesh(t, 3, 10, link, cfg)
+		defer net.Close()
+		var left, right []string
+		for i, n := range nodes {
+			if i < 5 {
+				left = append(left, n.ID())
+			} else {
+				right = append(right, n.ID())
+			}
+		}
+		net.Partition(left, right)
+		net.Run(time.Second)
+
+		s := signal(t, model.SignalTypeNeedConnect)
+		nodes[0].Send(s)
+		net.Run(time.Second)
+		assert.Equal(t, 4, coverage(nodes, s))
+
+		// Nodes redial their lost peers with backoff once healed.
+		net.Heal()
+		net.Run(2 * time.Second)
+		s = signal(t, model.SignalTypeNeedConnect)
+		nodes[0].Send(s)
+		net.Run(time.Second)
+		assert.Equal(t, len(nodes)-1, coverage(nodes, s))
+
+		// So does a node that crashed and came back.
+		net.Stop(nodes[9].ID())
+		net.Run(time.Second)
+		net.Start(nodes[9].ID())
+		net.Run(2 * time.Second)
+		assert.NotEmpty(t, net.Peers(nodes[9].ID()))
+	})
+
+	run(t, "relay routing", func(t *testing.T) {
+		net := New(1, Link{Latency: 50 * time.Millisecond})
+		defer net.Close()
+		cfg := Config{Router: fallback.Limits{Fanout: 1}, Keepalive: 250 * time.Millisecond}
+		src, mid := NewNode(net, "src", cfg), NewNode(net, "mid", cfg)
+		// Far sorts first, only the measured round trips put near ahead.
+		near, far := NewNode(net, "near", cfg), NewNode(net, "far", cfg)
+		net.SetLink("mid", "near", Link{Latency: 5 * time.Millisecond})
+		net.SetLink("mid", "far", Link{Latency: 30 * time.Millisecond})
+		require.NoError(t, src.Dial("mid"))
+		require.NoError(t, mid.Dial("near"))
+		require.NoError(t, mid.Dial("far"))
+		net.Run(time.Second)
+		assert.Equal(t, [][]byte{[]byte("near"), []byte("far"), []byte("src")}, mid.Fastest(3))
+
+		s := signal(t, model.SignalTypeRelayData)
+		start := net.Now()
+		src.SendTo("mid", s)
+		net.Settle(time.Second)
+		at, ok := near.Got(s)
+		assert.True(t, ok)
+		assert.Equal(t, start.Add(55*time.Millisecond), at)
+		_, ok = far.Got(s)
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,164 @@
+package mailbox
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"go-chat/cache"
+	"go-chat/config"
+	"go-chat/storage"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotForMe = errors.New("envelope for another recipient")
+	ErrSeen     = errors.New("envelope already delivered")
+)
+
+type Message struct {
+	ID   string
+	From *ecdh.PublicKey
+	Body []byte
+	// Ack is the payload of the MailAck signal.
+	Ack []byte
+}
+
+type Receipt struct {
+	ID string
+	To []byte
+}
+
+type pending struct {
+	Token   []byte `json:"token"`
+	To      []byte `json:"to"`
+	Expires int64  `json:"expires"`
+}
+
+// Client seals outgoing mail, keeping tokens to recognize receipts, and
+// opens mail delivered by storage peers.
+type Client struct {
+	mu       sync.Mutex
+	privkey  *ecdh.PrivateKey
+	privsign ed25519.PrivateKey
+	hash     []byte
+	store    storage.Store
+	pending  map[string]pending
+	seen     *cache.Cache
+}
+
+// NewClient uses the identity keys, mail sealed for them before a restart
+// still opens after it. The tokens of sent mail are saved in store, so
+// receipts are recognized after a restart too.
+func NewClient(privkey *ecdh.PrivateKey, privsign ed25519.PrivateKey, store storage.Store) (*Client, error) {
+	c := &Client{
+		privkey:  privkey,
+		privsign: privsign,
+		hash:     Address(privkey.PublicKey().Bytes(), privsign.Public().(ed25519.PublicKey)),
+		store:    store,
+		pending:  map[string]pending{},
+		seen:     cache.New(config.CacheBucketsCount, config.CacheBucketSize),
+	}
+	ids, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		b, err := store.Load(id)
+		if err != nil {
+			return nil, err
+		}
+		var p pending
+		if err := json.Unmarshal(b, &p); err != nil {
+			return nil, err
+		}
+		c.pending[id] = p
+	}
+	return c, nil
+}
+
+func (c *Client) Hash() []byte {
+	return c.hash
+}
+
+func (c *Client) Seal(to *ecdh.PublicKey, toSign ed25519.PublicKey, msg []byte, ttl time.Duration) (Envelope, error) {
+	if len(msg) > config.MailMaxLen {
+		return Envelope{}, ErrTooLarge
+	}
+	env, token, err := Seal(c.privkey, to, toSign, msg, ttl)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	p := pending{Token: token, To: env.To, Expires: env.Expires}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now().Unix()
+	for id, p := range c.pending {
+		if p.Expires <= now {
+			if err := c.store.Delete(id); err != nil {
+				return Envelope{}, err
+			}
+			delete(c.pending, id)
+		}
+	}
+	if err := c.store.Save(env.ID, b); err != nil {
+		return Envelope{}, err
+	}
+	c.pending[env.ID] = p
+	return env, nil
+}
+
+// Fetch is the payload of a MailFetch for the mail of the client.
+func (c *Client) Fetch() []byte {
+	return fetch(c.privkey.PublicKey().Bytes(), c.privsign, time.Now())
+}
+
+func (c *Client) Open(env Envelope) (Message, error) {
+	if !bytes.Equal(env.To, c.hash) {
+		return Message{}, ErrNotForMe
+	}
+	from, body, token, err := Open(env, c.privkey)
+	if err != nil {
+		return Message{}, err
+	}
+	// Every storage peer delivers its own copy.
+	if !c.seen.PutIfAbsent(env.ID) {
+		return Message{}, ErrSeen
+	}
+	return Message{
+		ID:   env.ID,
+		From: from,
+		Body: body,
+		Ack:  Ack(env.ID, token),
+	}, nil
+}
+
+// Receipt reports mail of this client acknowledged by the recipient.
+func (c *Client) Receipt(ack []byte) (Receipt, bool) {
+	id, token, err := ParseAck(ack)
+	if err != nil {
+		return Receipt{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.pending[id]
+	if !ok || !bytes.Equal(p.Token, token) {
+		return Receipt{}, false
+	}
+	// A token left saved by a failed delete only repeats the receipt after
+	// a restart.
+	_ = c.store.Delete(id)
+	delete(c.pending, id)
+	return Receipt{ID: id, To: p.To}, true
+}
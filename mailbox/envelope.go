@@ -0,0 +1,122 @@
+package mailbox
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"go-chat/netcrypt"
+	"time"
+)
+
+const TokenLen = 16
+
+var (
+	ErrInvalidEnvelope = errors.New("invalid envelope")
+	ErrTooLarge        = errors.New("message too large")
+)
+
+// Envelope is a message stored for an offline recipient. Storage peers see
+// only the recipient address, the body is encrypted to the recipient identity
+// key. The ack token inside the body proves delivery to storage peers and
+// to the sender.
+type Envelope struct {
+	ID      string `json:"id"`
+	To      []byte `json:"to"`
+	From    []byte `json:"from"`
+	Expires int64  `json:"expires"`
+	AckHash []byte `json:"ack"`
+	Body    []byte `json:"body"`
+}
+
+// Address is the mailbox of the owner of the keys. It covers the sign key,
+// so only the owner can sign a fetch of the box.
+func Address(dh []byte, sign ed25519.PublicKey) []byte {
+	h := sha256.New()
+	h.Write(dh)
+	h.Write(sign)
+	return h.Sum(nil)
+}
+
+func Seal(
+	privkey *ecdh.PrivateKey,
+	to *ecdh.PublicKey,
+	toSign ed25519.PublicKey,
+	msg []byte,
+	ttl time.Duration,
+) (Envelope, []byte, error) {
+	token := make([]byte, TokenLen)
+	rand.Read(token)
+
+	body, err := netcrypt.Encrypt(append(token, msg...), privkey, to)
+	if err != nil {
+		return Envelope{}, nil, err
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	ack := sha256.Sum256(token)
+	return Envelope{
+		ID:      hex.EncodeToString(id),
+		To:      Address(to.Bytes(), toSign),
+		From:    privkey.PublicKey().Bytes(),
+		Expires: time.Now().Add(ttl).Unix(),
+		AckHash: ack[:],
+		Body:    body,
+	}, token, nil
+}
+
+// Open decrypts the envelope and returns the sender key, the message and the
+// ack token.
+func Open(env Envelope, privkey *ecdh.PrivateKey) (*ecdh.PublicKey, []byte, []byte, error) {
+	from, err := privkey.Curve().NewPublicKey(env.From)
+	if err != nil {
+		return nil, nil, nil, ErrInvalidEnvelope
+	}
+	plain, err := netcrypt.Decrypt(env.Body, privkey, from)
+	if err != nil || len(plain) < TokenLen {
+		return nil, nil, nil, ErrInvalidEnvelope
+	}
+	token, msg := plain[:TokenLen], plain[TokenLen:]
+	if !env.Acked(token) {
+		return nil, nil, nil, ErrInvalidEnvelope
+	}
+	return from, msg, token, nil
+}
+
+func (e Envelope) Acked(token []byte) bool {
+	sum := sha256.Sum256(token)
+	return subtle.ConstantTimeCompare(sum[:], e.AckHash) == 1
+}
+
+func (e Envelope) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+func ParseEnvelope(b []byte) (Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(b, &e); err != nil {
+		return Envelope{}, ErrInvalidEnvelope
+	}
+	if e.ID == "" || len(e.To) != sha256.Size || len(e.AckHash) != sha256.Size || len(e.Body) == 0 {
+		return Envelope{}, ErrInvalidEnvelope
+	}
+	return e, nil
+}
+
+// Ack is sent by the recipient after reading the envelope, it releases the
+// stored copies and serves as the delivery receipt for the sender.
+func Ack(id string, token []byte) []byte {
+	return append([]byte(id+":"), token...)
+}
+
+func ParseAck(b []byte) (string, []byte, error) {
+	n := len(b) - TokenLen - 1
+	if n <= 0 || b[n] != ':' {
+		return "", nil, ErrInvalidEnvelope
+	}
+	return string(b[:n]), b[n+1:], nil
+}
@@ -0,0 +1,49 @@
+package mailbox
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const fetchLabel = "go-chat mail fetch"
+
+var ErrInvalidFetch = errors.New("invalid mail fetch")
+
+// fetch is sign key | stamp | signature | DH key. The signature covers the
+// address and the stamp, a fetch can't be made for the box of another node.
+func fetch(dh []byte, privsign ed25519.PrivateKey, now time.Time) []byte {
+	sign := privsign.Public().(ed25519.PublicKey)
+	stamp := binary.BigEndian.AppendUint64(nil, uint64(now.Unix()))
+	b := append(append([]byte{}, sign...), stamp...)
+	b = append(b, ed25519.Sign(privsign, fetched(Address(dh, sign), stamp))...)
+	return append(b, dh...)
+}
+
+// ParseFetch returns the address of a fetch signed by the owner of the box
+// no more than maxAge from now.
+func ParseFetch(b []byte, now time.Time, maxAge time.Duration) ([]byte, error) {
+	n := ed25519.PublicKeySize + 8 + ed25519.SignatureSize
+	if len(b) <= n {
+		return nil, ErrInvalidFetch
+	}
+	sign := ed25519.PublicKey(b[:ed25519.PublicKeySize])
+	stamp := b[ed25519.PublicKeySize : ed25519.PublicKeySize+8]
+	sig, dh := b[ed25519.PublicKeySize+8:n], b[n:]
+
+	at := time.Unix(int64(binary.BigEndian.Uint64(stamp)), 0)
+	if at.Before(now.Add(-maxAge)) || at.After(now.Add(maxAge)) {
+		return nil, ErrInvalidFetch
+	}
+	to := Address(dh, sign)
+	if !ed25519.Verify(sign, fetched(to, stamp), sig) {
+		return nil, ErrInvalidFetch
+	}
+	return to, nil
+}
+
+func fetched(to, stamp []byte) []byte {
+	b := append([]byte(fetchLabel), to...)
+	return append(b, stamp...)
+}
@@ -0,0 +1,225 @@
+package mailbox
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"go-chat/storage"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bucket(t *testing.T) storage.Bucket {
+	db, err := storage.Open(filepath.Join(t.TempDir(), "test.db"), "")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db.Bucket("test")
+}
+
+func client(t *testing.T) *Client {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, sign, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	c, err := NewClient(key, sign, bucket(t))
+	require.NoError(t, err)
+	return c
+}
+
+func newStore(t *testing.T, limits Limits) *Store {
+	s, err := NewStore(limits, bucket(t))
+	require.NoError(t, err)
+	return s
+}
+
+func ack(t *testing.T, s *Store, payload []byte) bool {
+	ok, err := s.Ack(parseAck(t, payload))
+	require.NoError(t, err)
+	return ok
+}
+
+func (c *Client) sealFor(to *Client, msg []byte, ttl time.Duration) (Envelope, error) {
+	return c.Seal(to.privkey.PublicKey(), to.privsign.Public().(ed25519.PublicKey), msg, ttl)
+}
+
+func Test_Mailbox(t *testing.T) {
+	t.Run("deliver and receipt", func(t *testing.T) {
+		alice, bob := client(t), client(t)
+		store := newStore(t, Limits{})
+
+		env, err := alice.sealFor(bob, []byte("hi bob"), time.Hour)
+		require.NoError(t, err)
+		b, err := env.Marshal()
+		require.NoError(t, err)
+		parsed, err := ParseEnvelope(b)
+		require.NoError(t, err)
+		require.NoError(t, store.Put(parsed))
+
+		envs := store.Fetch(bob.Hash())
+		require.Len(t, envs, 1)
+		m, err := bob.Open(envs[0])
+		require.NoError(t, err)
+		assert.Equal(t, []byte("hi bob"), m.Body)
+		assert.True(t, alice.privkey.PublicKey().Equal(m.From))
+
+		_, err = bob.Open(envs[0])
+		assert.ErrorIs(t, err, ErrSeen)
+
+		assert.True(t, ack(t, store, m.Ack))
+		assert.Equal(t, 0, store.Len())
+
+		r, ok := alice.Receipt(m.Ack)
+		assert.True(t, ok)
+		assert.Equal(t, Receipt{ID: env.ID, To: bob.Hash()}, r)
+		_, ok = alice.Receipt(m.Ack)
+		assert.False(t, ok)
+	})
+
+	t.Run("only recipient opens", func(t *testing.T) {
+		alice, bob, eve := client(t), client(t), client(t)
+		env, err := alice.sealFor(bob, []byte("secret"), time.Hour)
+		require.NoError(t, err)
+
+		_, err = eve.Open(env)
+		assert.ErrorIs(t, err, ErrNotForMe)
+
+		env.To = eve.Hash()
+		_, err = eve.Open(env)
+		assert.ErrorIs(t, err, ErrInvalidEnvelope)
+	})
+
+	t.Run("forged ack", func(t *testing.T) {
+		alice, bob := client(t), client(t)
+		store := newStore(t, Limits{})
+		env, _ := alice.sealFor(bob, []byte("hi"), time.Hour)
+		require.NoError(t, store.Put(env))
+
+		forged := Ack(env.ID, make([]byte, TokenLen))
+		assert.False(t, ack(t, store, forged))
+		_, ok := alice.Receipt(forged)
+		assert.False(t, ok)
+		assert.Equal(t, 1, store.Len())
+	})
+
+	t.Run("quota and ttl", func(t *testing.T) {
+		alice, bob, carol := client(t), client(t), client(t)
+		store := newStore(t, Limits{MaxTTL: time.Hour, PerRecipient: 2, Total: 3})
+
+		for range 2 {
+			env, _ := alice.sealFor(bob, []byte("hi"), time.Minute)
+			require.NoError(t, store.Put(env))
+		}
+		env, _ := alice.sealFor(bob, []byte("hi"), time.Minute)
+		assert.ErrorIs(t, store.Put(env), ErrQuota)
+
+		env, _ = alice.sealFor(carol, []byte("hi"), 2*time.Hour)
+		assert.ErrorIs(t, store.Put(env), ErrTTL)
+
+		now := time.Now()
+		store.now = func() time.Time { return now.Add(2 * time.Minute) }
+		assert.Empty(t, store.Fetch(bob.Hash()))
+		assert.Equal(t, 0, store.Len())
+	})
+
+	t.Run("survive restart", func(t *testing.T) {
+		alice, bob := client(t), client(t)
+		b := bucket(t)
+		store, err := NewStore(Limits{}, b)
+		require.NoError(t, err)
+		env, err := alice.sealFor(bob, []byte("hi"), time.Hour)
+		require.NoError(t, err)
+		require.NoError(t, store.Put(env))
+
+		store, err = NewStore(Limits{}, b)
+		require.NoError(t, err)
+		envs := store.Fetch(bob.Hash())
+		require.Len(t, envs, 1)
+		m, err := bob.Open(envs[0])
+		require.NoError(t, err)
+
+		alice, err = NewClient(alice.privkey, alice.privsign, alice.store)
+		require.NoError(t, err)
+		assert.True(t, ack(t, store, m.Ack))
+		_, ok := alice.Receipt(m.Ack)
+		assert.True(t, ok)
+
+		store, err = NewStore(Limits{}, b)
+		require.NoError(t, err)
+		assert.Equal(t, 0, store.Len())
+	})
+
+	t.Run("message size", func(t *testing.T) {
+		_, err := client(t).sealFor(client(t), make([]byte, 1<<20), time.Hour)
+		assert.ErrorIs(t, err, ErrTooLarge)
+	})
+}
+
+func Test_Fetch(t *testing.T) {
+	alice, bob := client(t), client(t)
+	now := time.Now()
+
+	t.Run("owner fetches", func(t *testing.T) {
+		to, err := ParseFetch(bob.Fetch(), now, time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, bob.Hash(), to)
+	})
+
+	t.Run("reject fetch of another box", func(t *testing.T) {
+		b := bob.Fetch()
+		// Alice's sign key over Bob's DH key names a box of nobody.
+		forged := fetch(bob.privkey.PublicKey().Bytes(), alice.privsign, now)
+		to, err := ParseFetch(forged, now, time.Minute)
+		require.NoError(t, err)
+		assert.NotEqual(t, bob.Hash(), to)
+
+		copy(b[:ed25519.PublicKeySize], alice.privsign.Public().(ed25519.PublicKey))
+		_, err = ParseFetch(b, now, time.Minute)
+		assert.ErrorIs(t, err, ErrInvalidFetch)
+	})
+
+	t.Run("reject stale fetch", func(t *testing.T) {
+		_, err := ParseFetch(bob.Fetch(), now.Add(time.Hour), time.Minute)
+		assert.ErrorIs(t, err, ErrInvalidFetch)
+		_, err = ParseFetch([]byte("short"), now, time.Minute)
+		assert.ErrorIs(t, err, ErrInvalidFetch)
+	})
+
+	t.Run("box handed out once per interval", func(t *testing.T) {
+		store := newStore(t, Limits{FetchEvery: time.Minute})
+		env, err := alice.sealFor(bob, []byte("hi"), time.Hour)
+		require.NoError(t, err)
+		require.NoError(t, store.Put(env))
+
+		assert.Len(t, store.Fetch(bob.Hash()), 1)
+		assert.Empty(t, store.Fetch(bob.Hash()))
+		store.now = func() time.Time { return time.Now().Add(time.Minute) }
+		assert.Len(t, store.Fetch(bob.Hash()), 1)
+	})
+}
+
+func Test_Peers(t *testing.T) {
+	p := NewPeers()
+	p.Add([]byte{1})
+	p.Add([]byte{3})
+	p.Remove([]byte{3})
+
+	assert.Equal(t, [][]byte{{1}}, p.Of([][]byte{{2}, {1}, {3}}))
+}
+
+func Test_Closest(t *testing.T) {
+	target := []byte{0b1010_0000}
+	peers := [][]byte{{0b0000_0000}, {0b1010_0001}, {0b1110_0000}, {0b1011_0000}}
+
+	assert.Equal(t, [][]byte{{0b1010_0001}, {0b1011_0000}}, Closest(peers, target, 2))
+	assert.Len(t, Closest(peers, target, 10), 4)
+}
+
+func parseAck(t *testing.T, ack []byte) (string, []byte) {
+	id, token, err := ParseAck(ack)
+	require.NoError(t, err)
+	return id, token
+}
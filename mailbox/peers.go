@@ -0,0 +1,42 @@
+package mailbox
+
+import "sync"
+
+// Peers are the linked peers that announced they keep mail. Only they are
+// asked to store it, the others would drop it.
+type Peers struct {
+	mu     sync.Mutex
+	hashes map[string]struct{}
+}
+
+func NewPeers() *Peers {
+	return &Peers{hashes: map[string]struct{}{}}
+}
+
+func (p *Peers) Add(hash []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.hashes[string(hash)] = struct{}{}
+}
+
+func (p *Peers) Remove(hash []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.hashes, string(hash))
+}
+
+// Of keeps the hashes of storage peers, in order.
+func (p *Peers) Of(hashes [][]byte) [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var out [][]byte
+	for _, hash := range hashes {
+		if _, ok := p.hashes[string(hash)]; ok {
+			out = append(out, hash)
+		}
+	}
+	return out
+}
@@ -0,0 +1,229 @@
+package mailbox
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"go-chat/storage"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQuota   = errors.New("mailbox quota exceeded")
+	ErrExpired = errors.New("envelope expired")
+	ErrTTL     = errors.New("envelope ttl too long")
+)
+
+type Limits struct {
+	MaxTTL       time.Duration
+	PerRecipient int
+	BytesPerBox  int
+	Total        int
+	// FetchEvery is how often a box is handed out, every fetch floods all
+	// of its envelopes.
+	FetchEvery time.Duration
+}
+
+type box struct {
+	envs    map[string]Envelope
+	bytes   int
+	fetched time.Time
+}
+
+// Store keeps envelopes for offline recipients on a storage peer. The
+// envelopes are saved by box and id, mail taken before a restart is still handed
+// out after it.
+type Store struct {
+	mu     sync.Mutex
+	limits Limits
+	db     storage.Store
+	boxes  map[string]*box
+	total  int
+	now    func() time.Time
+}
+
+func NewStore(limits Limits, db storage.Store) (*Store, error) {
+	s := &Store{
+		limits: limits,
+		db:     db,
+		boxes:  map[string]*box{},
+		now:    time.Now,
+	}
+	keys, err := db.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		b, err := db.Load(k)
+		if err != nil {
+			return nil, err
+		}
+		env, err := ParseEnvelope(b)
+		if err != nil {
+			return nil, err
+		}
+		s.add(env)
+	}
+	if err := s.expire(s.now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) Put(env Envelope) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if env.Expires <= now.Unix() {
+		return ErrExpired
+	}
+	if s.limits.MaxTTL > 0 && env.Expires > now.Add(s.limits.MaxTTL).Unix() {
+		return ErrTTL
+	}
+	if err := s.expire(now); err != nil {
+		return err
+	}
+
+	b, ok := s.boxes[string(env.To)]
+	if !ok {
+		b = &box{envs: map[string]Envelope{}}
+	}
+	if _, ok := b.envs[env.ID]; ok {
+		return nil
+	}
+	switch {
+	case s.limits.Total > 0 && s.total >= s.limits.Total,
+		s.limits.PerRecipient > 0 && len(b.envs) >= s.limits.PerRecipient,
+		s.limits.BytesPerBox > 0 && b.bytes+len(env.Body) > s.limits.BytesPerBox:
+		return ErrQuota
+	}
+
+	data, err := env.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := s.db.Save(key(env), data); err != nil {
+		return err
+	}
+	s.add(env)
+	return nil
+}
+
+func (s *Store) add(env Envelope) {
+	b, ok := s.boxes[string(env.To)]
+	if !ok {
+		b = &box{envs: map[string]Envelope{}}
+		s.boxes[string(env.To)] = b
+	}
+	b.envs[env.ID] = env
+	b.bytes += len(env.Body)
+	s.total++
+}
+
+// Fetch returns envelopes stored for the recipient address, oldest expiry
+// first. They stay stored until acknowledged or expired. A box fetched less
+// than FetchEvery ago returns nothing.
+func (s *Store) Fetch(to []byte) []Envelope {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	// Envelopes left saved by a failed delete are expired again on load.
+	_ = s.expire(now)
+	b, ok := s.boxes[string(to)]
+	if !ok || now.Sub(b.fetched) < s.limits.FetchEvery {
+		return nil
+	}
+	b.fetched = now
+	out := make([]Envelope, 0, len(b.envs))
+	for _, env := range b.envs {
+		out = append(out, env)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Expires != out[j].Expires {
+			return out[i].Expires < out[j].Expires
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Ack removes the envelope when token matches its ack hash.
+func (s *Store) Ack(id string, token []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for to, b := range s.boxes {
+		env, ok := b.envs[id]
+		if !ok || !env.Acked(token) {
+			continue
+		}
+		return true, s.remove(to, b, env)
+	}
+	return false, nil
+}
+
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.total
+}
+
+func (s *Store) expire(now time.Time) error {
+	var errs []error
+	for to, b := range s.boxes {
+		for _, env := range b.envs {
+			if env.Expires <= now.Unix() {
+				errs = append(errs, s.remove(to, b, env))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Store) remove(to string, b *box, env Envelope) error {
+	delete(b.envs, env.ID)
+	b.bytes -= len(env.Body)
+	s.total--
+	if len(b.envs) == 0 {
+		delete(s.boxes, to)
+	}
+	return s.db.Delete(key(env))
+}
+
+func key(env Envelope) string {
+	return hex.EncodeToString(env.To) + "/" + env.ID
+}
+
+// Closest picks up to n candidates nearest to target by XOR distance, the
+// same metric Kademlia uses, so senders and the recipient agree on where
+// mail for a hash is likely kept.
+func Closest(candidates [][]byte, target []byte, n int) [][]byte {
+	out := append([][]byte(nil), candidates...)
+	sort.Slice(out, func(i, j int) bool {
+		return bytes.Compare(xor(out[i], target), xor(out[j], target)) < 0
+	})
+	if n < len(out) {
+		out = out[:n]
+	}
+	return out
+}
+
+func xor(a, b []byte) []byte {
+	out := make([]byte, max(len(a), len(b)))
+	for i := range out {
+		var x, y byte
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		out[i] = x ^ y
+	}
+	return out
+}
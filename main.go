@@ -1,18 +1,76 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
+	"go-chat/banlist"
+	"go-chat/chat"
 	"go-chat/closer"
+	"go-chat/config"
+	"go-chat/contacts"
+	"go-chat/delivery"
+	"go-chat/device"
 	"go-chat/dispatcher"
+	"go-chat/e2e"
+	"go-chat/fallback"
+	"go-chat/group"
+	"go-chat/handler"
+	"go-chat/mailbox"
+	"go-chat/middleware"
 	"go-chat/model"
+	"go-chat/mux"
 	"go-chat/network"
+	"go-chat/peerset"
+	"go-chat/pow"
+	"go-chat/presence"
+	"go-chat/relay"
+	"go-chat/storage"
+	"go-chat/transfer"
+	wrtc "go-chat/webrtc"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 )
 
 var (
 	attachAddr = flag.String("attach", "", "Attach address")
-	listenAddr = flag.String("attach", "", "Listen address")
+	listenAddr = flag.String("listen", "", "Listen address")
+	asnPath    = flag.String("asn", "", "ASN table path")
+	stunURLs   = flag.String("stun", "stun:stun.l.google.com:19302", "Comma separated STUN URLs")
+	turnURLs   = flag.String("turn", "", "Comma separated TURN URLs")
+	turnUser   = flag.String("turn-user", "", "TURN username")
+	turnPass   = flag.String("turn-pass", "", "TURN password")
+	turnSecret = flag.String("turn-secret", "", "TURN shared secret for time limited credentials")
+	relayOnly  = flag.Bool("relay-only", false, "Use TURN relays only")
+	portMin    = flag.Uint("ice-port-min", 0, "Lowest ICE UDP port")
+	portMax    = flag.Uint("ice-port-max", 0, "Highest ICE UDP port")
+	relayAddr  = flag.String("relay", "", "Embedded TURN relay UDP address")
+	publicIP   = flag.String("public-ip", "", "Public IP advertised for the relay")
+	storeMail  = flag.Bool("mailbox", false, "Keep mail for offline peers")
+	dataDir    = flag.String("data", ".go-chat", "Directory of the encrypted database")
+	linkCode   = flag.String("link", "", "Code of a device to link to the account")
+	linkName   = flag.String("link-name", "", "Name of the linked device")
+	joinAcct   = flag.String("join", "", "Account key this device joins when linked")
+	ownName    = flag.String("name", "", "Name suggested to contacts in the invitation")
+	invitation = flag.String("add", "", "Invitation of a contact to add")
+	petname    = flag.String("petname", "", "Petname of the added contact")
+	verify     = flag.String("verify", "", "Petname=safety number of a contact compared out of band")
+	newInvite  = flag.Bool("invite", false, "Print a one time invite token")
+	inviteTTL  = flag.Duration("invite-ttl", config.InviteTTL, "Lifetime of the invite token, 0 for none")
+	redeemWith = flag.String("redeem", "", "Invite token to connect with and add as a contact")
+	downloads  = flag.String("downloads", "", "Directory of files received from contacts, none to refuse files")
+	callMedia  = flag.String("media", "", "Comma separated IVF or Ogg files played in calls of contacts")
 )
 
 func main() {
@@ -21,27 +79,1157 @@ func main() {
 	inbox := make(chan model.Signal)
 	closer.Add(func() error { close(inbox); return nil })
 
-	d := dispatcher.New()
+	bans := banlist.New()
+	policy := pow.NewPolicy(
+		map[model.SignalType]int{
+			model.SignalTypeNeedConnect: config.PowNeedConnect,
+			model.SignalTypeOffer:       config.PowOffer,
+		},
+		config.PowMaxExtra,
+		config.PowLoadHigh,
+		config.PowLoadLow,
+		config.PowWindow,
+	)
+	var asn *peerset.ASNTable
+	if *asnPath != "" {
+		f, err := os.Open(*asnPath)
+		if err != nil {
+			panic(err)
+		}
+		asn, err = peerset.LoadASN(f)
+		f.Close()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var d *dispatcher.Dispatcher
+	rtt := func(hash []byte) (time.Duration, bool) {
+		return d.RTT(hash)
+	}
+	peers := peerset.New(peerset.Limits{
+		MaxPeers:     config.MaxPeersCount,
+		PerSubnet:    config.PeersPerSubnet,
+		PerASN:       config.PeersPerASN,
+		PerPrefix:    config.PeersPerPrefix,
+		PrefixBits:   config.PeerPrefixBits,
+		ProtectRTT:   config.ProtectByRTT,
+		ProtectAge:   config.ProtectByAge,
+		ProtectGroup: config.ProtectByGroup,
+	}, asn, rtt)
+
+	links := presence.NewLinks()
+	mailboxes := mailbox.NewPeers()
+	d = dispatcher.New(
+		dispatcher.WithBanlist(bans),
+		dispatcher.WithPoW(policy),
+		dispatcher.WithOutbox(config.OutboxSize, outboxPolicy(), config.OutboxTimeout),
+		dispatcher.WithOnDisconnect(func(hash []byte) {
+			peers.Remove(hash)
+			links.Remove(hash)
+			mailboxes.Remove(hash)
+		}),
+	)
+	mailboxAnnounces := d.SubscribeTypeFrom(model.SignalTypeMailboxAnnounce)
+	go func() {
+		for in := range mailboxAnnounces {
+			handler.MailboxAnnounced(in.From, in.Signal, mailboxes)
+		}
+	}()
+
+	db, err := openDB(*dataDir)
+	if err != nil {
+		panic(err)
+	}
+	closer.Add(db.Close)
+	history := storage.NewHistory(db, storage.Retention{
+		MaxAge:   config.HistoryMaxAge,
+		MaxCount: config.HistoryMaxCount,
+	})
+	if _, err := history.Prune(); err != nil {
+		log.Println("main: history.Prune:", err)
+	}
+
+	if err := migrateKeys(*dataDir, db); err != nil {
+		panic(err)
+	}
+	direct, err := directManager(db)
+	if err != nil {
+		panic(err)
+	}
+	// The node signs its frames with the identity key, so invite tokens
+	// can name the node to dial.
+	nodeKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	node := network.NewNodeWith(nodeKey, direct.Identity().Sign)
+	// Only contacts may offer relays, the book is opened below and peers
+	// connect after that.
+	var book *contacts.Book
+	isContact := func(sign ed25519.PublicKey) bool {
+		_, ok := book.BySign(sign)
+		return ok
+	}
+	relays := relay.NewDirectory(config.RelayDirectorySize, isContact)
+	announces := d.SubscribeType(model.SignalTypeRelayAnnounce)
+	go func() {
+		// Announces come from the relay directly and are never forwarded.
+		for s := range announces {
+			handler.RelayAnnounce(s, relays)
+		}
+	}()
+	if *relayAddr != "" {
+		srv, err := startRelay(node)
+		if err != nil {
+			panic(err)
+		}
+		closer.Add(srv.Close)
+		go func() {
+			for {
+				for _, hash := range links.To(isContact) {
+					if sign, ok := links.Sign(hash); ok {
+						handler.AnnounceRelay(srv, node.PrivSign(), hash, sign, d.SendTo)
+					}
+				}
+				time.Sleep(config.RelayAnnounceEvery)
+			}
+		}()
+	}
+
+	router := fallback.NewRouter(fallback.Limits{
+		Fanout:       config.RelayFanout,
+		SessionRate:  config.RelaySessionRate,
+		SessionBurst: config.RelaySessionBurst,
+		TotalRate:    config.RelayTotalRate,
+		TotalBurst:   config.RelayTotalBurst,
+		MaxSessions:  config.RelayMaxSessions,
+		Idle:         config.RelaySessionIdle,
+	}, d.Fastest, d.SendTo)
+	relayed := d.SubscribeTypeFrom(model.SignalTypeRelayData)
+	go func() {
+		for in := range relayed {
+			if !d.Subscribed(in.KeyString()) {
+				router.Forward(in.From, in.Signal)
+			}
+		}
+	}()
 
-	if attachAddr != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-		defer cancel()
+	iceCfg := iceConfig()
+	sessionCfg := func() wrtc.Config {
+		cfg := iceCfg
+		cfg.ICEServers = append(slices.Clip(cfg.ICEServers), relays.ICEServers()...)
+		return cfg
+	}
+	files, err := newIncoming(db.Bucket("incoming"))
+	if err != nil {
+		panic(err)
+	}
+	var media []string
+	if *callMedia != "" {
+		media = strings.Split(*callMedia, ",")
+	}
+	calls := newCalls(node.PrivSign(), func(sign []byte) (contacts.Contact, bool) { return book.BySign(sign) }, media, d.SendTo)
+	needs := d.SubscribeType(model.SignalTypeNeedConnect)
+	go func() {
+		pending := make(chan struct{}, config.PendingOffers)
+		for s := range needs {
+			select {
+			case pending <- struct{}{}:
+			default:
+				// Enough offers wait for their answer already.
+				d.Send(s)
+				continue
+			}
+			go func() {
+				defer func() { <-pending }()
+				sess, err := handler.NeedConn(context.Background(), s, d, sessionCfg(), node.PrivSign(), peers.HasFree, isContact)
+				if err != nil {
+					log.Println("main: handler.NeedConn:", err)
+				} else if sess != nil {
+					files.receive(sess, *downloads)
+					calls.serve(sess)
+					dispatch(d, peers, links, sess)
+				}
+			}()
+		}
+	}()
+	go func() {
+		for range time.Tick(config.NeedConnectEvery) {
+			if !peers.HasFree() {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), config.OfferTimeout)
+			sess, err := handler.RequestConn(ctx, d, sessionCfg(), node.PrivSign(), nil)
+			cancel()
+			if err != nil {
+				log.Println("main: handler.RequestConn:", err)
+				continue
+			}
+			calls.serve(sess)
+			dispatch(d, peers, links, sess)
+		}
+	}()
 
-		p, err := network.Attach(ctx, *attachAddr)
+	mail, err := mailbox.NewClient(direct.Identity().DH, direct.Identity().Sign, db.Bucket("mail-sent"))
+	if err != nil {
+		panic(err)
+	}
+	store, err := mailbox.NewStore(mailbox.Limits{
+		MaxTTL:       config.MailMaxTTL,
+		PerRecipient: config.MailPerRecipient,
+		BytesPerBox:  config.MailBytesPerBox,
+		Total:        config.MailTotal,
+		FetchEvery:   config.MailFetchEvery,
+	}, db.Bucket("mailbox"))
+	if err != nil {
+		panic(err)
+	}
+	if *storeMail {
+		stores := d.SubscribeType(model.SignalTypeMailStore)
+		go func() {
+			for s := range stores {
+				handler.StoreMail(s, store)
+			}
+		}()
+	}
+	fetches := d.SubscribeType(model.SignalTypeMailFetch)
+	go func() {
+		for s := range fetches {
+			if handler.ServeMail(s, store, d.Send) {
+				handler.Forward(s, d.Subscribed, d.Send)
+			}
+		}
+	}()
+	acks := d.SubscribeType(model.SignalTypeMailAck)
+	go func() {
+		for s := range acks {
+			handler.Acked(s, store, mail, func(r mailbox.Receipt) {
+				log.Printf("mail %s delivered", r.ID)
+			})
+			handler.Forward(s, d.Subscribed, d.Send)
+		}
+	}()
+	fetchKey := model.GenerateKey()
+	deliveries := d.SubscribeKey(string(fetchKey))
+	go func() {
+		for s := range deliveries {
+			handler.Delivered(s, mail, d.Send, func(m mailbox.Message) {
+				log.Printf("mail %s: %s", m.ID, m.Body)
+			})
+		}
+	}()
+
+	tracker, err := delivery.NewTracker(db.Bucket("delivery"), delivery.Limits{
+		RetryAfter: config.ChatRetryAfter,
+		MaxRetry:   config.ChatMaxRetry,
+		Window:     config.ChatWindow,
+	})
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		for range time.Tick(config.ChatRetransmit) {
+			handler.Retransmit(tracker, direct, d.Send)
+		}
+	}()
+	account, roster, err := loadDevices(db, direct.Identity())
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("account %x, device code %s", roster.Account(), device.Code(direct.Identity()))
+	bundles := d.SubscribeType(model.SignalTypePreKeyBundle)
+	go func() {
+		for s := range bundles {
+			handler.BundleReceived(s, func(b e2e.Bundle) {
+				direct.Remember(b)
+				handler.SiblingOnline(b, roster, direct, d.Send)
+			})
+			handler.Forward(s, d.Subscribed, d.Send)
+		}
+	}()
+	book, err = contacts.NewBook(db.Bucket("contacts"))
+	if err != nil {
+		panic(err)
+	}
+	manageContacts(book, direct.Identity())
+	invites := contacts.NewInvites(db.Bucket("invites"))
+	if *newInvite {
+		t, err := invites.Issue(direct.Identity(), *ownName, ownAddrs(), *inviteTTL)
 		if err != nil {
 			panic(err)
 		}
+		log.Printf("invite token %s", t)
+	}
+	redemptions := d.SubscribeType(model.SignalTypeInviteRedeem)
+	go func() {
+		// Redemptions come from the redeemer directly and are never forwarded.
+		for s := range redemptions {
+			handler.InviteRedeemed(s, invites, direct.Identity(), book, func(c contacts.Contact) {
+				log.Printf("invite redeemed by %s", c)
+			})
+		}
+	}()
+	var join []byte
+	if *joinAcct != "" {
+		if join, err = hex.DecodeString(*joinAcct); err != nil {
+			panic(err)
+		}
+	}
+	syncLimits := device.Limits{ListMax: config.DeviceListMax, MaxBytes: config.DeviceSyncBytes}
+	deviceSyncs := d.SubscribeType(model.SignalTypeDeviceSync)
+	go func() {
+		for s := range deviceSyncs {
+			if !handler.DeviceSynced(s, direct, roster, join, history, syncLimits, d.Send) {
+				handler.Forward(s, d.Subscribed, d.Send)
+			}
+		}
+	}()
+
+	received := func(m delivery.Message) {
+		log.Printf("%s: %s", book.Display(m.Contact), describe(m.Body))
+		msg := save(history, m.Contact, m.ID, m.Contact, m.Body)
+		handler.FanOut(roster, direct, m.Contact, msg, d.Send)
+	}
+	progress := func(contact string, delivered, read uint64) {
+		log.Printf("%s: delivered up to %d, read up to %d", book.Display(contact), delivered, read)
+	}
+	directs := d.SubscribeType(model.SignalTypeDirect)
+	go func() {
+		for s := range directs {
+			mine := handler.Direct(s, direct, func(contact string, msg []byte) {
+				handler.ChatReceived(tracker, direct, contact, msg, d.Send, received, progress)
+			})
+			if !mine {
+				handler.Forward(s, d.Subscribed, d.Send)
+			}
+		}
+	}()
+	groups, err := group.NewSet(direct.Identity(), db.Bucket("groups"))
+	if err != nil {
+		panic(err)
+	}
+	presenceLimits := presence.Limits{
+		Timeout:       config.PresenceTimeout,
+		AwayAfter:     config.PresenceAwayAfter,
+		TypingTimeout: config.TypingTimeout,
+		Skew:          config.PresenceSkew,
+		Rate:          config.PresenceRate,
+		Burst:         config.PresenceBurst,
+	}
+	sender := presence.NewSender(direct.Identity().Sign, presenceLimits)
+	view := presence.NewView(presenceLimits)
+	resolve := func(sign []byte, conv string) (string, bool) {
+		if c, ok := book.BySign(sign); ok && conv == "" {
+			return c.Key(), true
+		}
+		return roomMember(groups, book, sign, conv)
+	}
+	for _, t := range []model.SignalType{model.SignalTypePresence, model.SignalTypeTyping} {
+		updates := d.SubscribeType(t)
+		go func() {
+			for s := range updates {
+				handler.PresenceReceived(s, view, resolve, func(key string, st presence.Status) {
+					log.Printf("%s is %s, typing in %q", book.Display(key), st.State, st.Typing)
+				})
+			}
+		}()
+	}
+	toContacts := func() [][]byte {
+		return links.To(isContact)
+	}
+	go func() {
+		for {
+			if u, ok, err := sender.Presence(); err != nil {
+				log.Println("main: sender.Presence:", err)
+			} else if ok {
+				handler.SendPresence(model.SignalTypePresence, u, toContacts(), d.SendTo)
+			}
+			time.Sleep(config.PresenceEvery)
+		}
+	}()
+	closer.Add(func() error {
+		u, err := sender.Offline()
+		if err == nil {
+			handler.SendPresence(model.SignalTypePresence, u, toContacts(), d.SendTo)
+		}
+		return err
+	})
+	groupUpdates := d.SubscribeType(model.SignalTypeGroupUpdate)
+	go func() {
+		for s := range groupUpdates {
+			if !handler.GroupUpdated(s, direct, groups, d.Send) {
+				handler.Forward(s, d.Subscribed, d.Send)
+			}
+		}
+	}()
+	fileOffers := d.SubscribeTypeFrom(model.SignalTypeFileOffer)
+	go func() {
+		// Offers come from the sender directly over a session and are never
+		// forwarded.
+		for in := range fileOffers {
+			sign, ok := links.Sign(in.From)
+			if !ok || !isContact(sign) {
+				continue
+			}
+			handler.FileOffered(in.Signal, func(m transfer.Manifest) bool {
+				if *downloads == "" {
+					return false
+				}
+				resumed, err := files.accept(m, sign)
+				if err != nil {
+					log.Println("main: files.accept:", err)
+					return false
+				}
+				if resumed {
+					log.Printf("file %s from %x resumed", m.Name, sign)
+				} else {
+					log.Printf("file %s of %d bytes from %x", m.Name, m.Size, sign)
+				}
+				return true
+			}, func(s model.Signal) { d.SendTo(in.From, s) })
+		}
+	}()
+	groupMessages := d.SubscribeType(model.SignalTypeGroupMessage)
+	go func() {
+		for s := range groupMessages {
+			handler.GroupMessage(s, groups, func(g *group.Group, from group.Member, msg []byte) {
+				log.Printf("%x %x: %s", g.ID(), from.Sign, describe(msg))
+				id := hex.EncodeToString(model.GenerateKey())
+				save(history, hex.EncodeToString(g.ID()), id, hex.EncodeToString(from.Sign), msg)
+			})
+			handler.Forward(s, d.Subscribed, d.Send)
+		}
+	}()
+
+	for _, t := range []model.SignalType{
+		model.SignalTypeMailDeliver,
+		model.SignalTypeOffer,
+		model.SignalTypeAnswer,
+		model.SignalTypeCandidate,
+		model.SignalTypeCallStart,
+		model.SignalTypeCallAccept,
+		model.SignalTypeCallEnd,
+	} {
+		signals := d.SubscribeType(t)
+		go func() {
+			for s := range signals {
+				handler.Forward(s, d.Subscribed, d.Send)
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
 
-		d.Dispatch(p.Hash(), p)
+	var p *network.Peer
+	var token contacts.Token
+	if *redeemWith != "" {
+		token, p, err = attachInviter(ctx, node, db.Bucket("peers"), *redeemWith)
+	} else {
+		p, err = attach(ctx, node, db.Bucket("peers"), *attachAddr)
+	}
+	switch {
+	case err == nil:
+		dispatch(d, peers, links, p)
+		if *redeemWith != "" {
+			redeem(token, book, direct.Identity(), func(s model.Signal) { d.SendTo(p.Hash(), s) })
+		}
+	case *attachAddr != "" || *redeemWith != "":
+		panic(err)
+	default:
+		// The first node of a mesh has nothing to attach to.
+		log.Println("main: attach:", err)
 	}
+	handler.FetchMail(mail, fetchKey, d.Send)
+	handler.PublishBundle(direct, d.Send)
+	if *linkCode != "" {
+		if err := handler.LinkDevice(account, *linkCode, *linkName, roster, direct, d.Send); err != nil {
+			log.Println("main: handler.LinkDevice:", err)
+		}
+	}
+	go func() {
+		for {
+			if join != nil && !bytes.Equal(roster.Account(), join) {
+				// The linking device needs the bundle to hand over the roster
+				// and may have missed the one of the start.
+				handler.PublishBundle(direct, d.Send)
+			}
+			handler.SyncDevices(roster, direct, history, syncLimits, d.Send)
+			time.Sleep(config.DeviceSyncEvery)
+		}
+	}()
 
-	if listenAddr != nil {
+	if *listenAddr != "" {
 		handler := func(p *network.Peer) {
-			d.Dispatch(p.Hash(), p)
+			dispatch(d, peers, links, p)
+		}
+		notBanned := func(addr net.Addr) bool {
+			host, _, err := net.SplitHostPort(addr.String())
+			return err != nil || !bans.Banned(host)
+		}
+		err := node.Listen(*listenAddr, time.Second*3, handler, notBanned)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	author := chat.NewAuthor(direct.Identity().Sign)
+	// typing starts or ends the indicator in the chat with a contact or in a
+	// room. It goes to the linked peers that take part in it.
+	typingIn := map[string]bool{}
+	typing := func(to string, on bool) error {
+		c, g, err := conversation(book, groups, to)
+		if err != nil {
+			return err
+		}
+		conv, member := "", func(sign ed25519.PublicKey) bool { return bytes.Equal(sign, c.Sign) }
+		if g != nil {
+			conv = hex.EncodeToString(g.ID())
+			member = func(sign ed25519.PublicKey) bool {
+				return slices.ContainsFunc(g.Members(), func(m group.Member) bool { return bytes.Equal(m.Sign, sign) })
+			}
+		}
+		typingIn[to] = on
+		u, ok, err := sender.Typing(conv, on)
+		if err != nil || !ok {
+			return err
+		}
+		handler.SendPresence(model.SignalTypeTyping, u, links.To(member), d.SendTo)
+		return nil
+	}
+	// post sends content to a contact or a group and keeps it in the history
+	// of every own device.
+	post := func(to string, content chat.Content) error {
+		body, err := content.Marshal()
+		if err != nil {
+			return err
+		}
+		c, g, err := conversation(book, groups, to)
+		if err != nil {
+			return err
+		}
+		var conv, from string
+		var sendErr error
+		if g != nil {
+			conv, from = hex.EncodeToString(g.ID()), hex.EncodeToString(g.Self().Sign)
+			if err := handler.SendGroup(g, body, d.Send); err != nil {
+				return err
+			}
+		} else {
+			conv, from = c.Key(), roster.Self().Contact()
+			// A message without a session yet is retransmitted once it has one.
+			m, err := handler.SendChat(tracker, direct, conv, body, d.Send)
+			if m.ID == "" {
+				return err
+			}
+			sendErr = err
+		}
+		msg, err := handler.ContentReceived(history, conv, from, content.ID, body)
+		if err != nil {
+			return err
+		}
+		handler.FanOut(roster, direct, conv, msg, d.Send)
+		if typingIn[to] {
+			if err := typing(to, false); err != nil {
+				log.Println("post: typing:", err)
+			}
 		}
-		err := network.Listen(*listenAddr, time.Second*3, handler)
+		return sendErr
+	}
+	// onText runs the commands acting on a message of a conversation.
+	onText := func(write func(id, rest string) (chat.Content, error)) command {
+		return func(args string) error {
+			to, id, rest, err := onMessage(args)
+			if err != nil {
+				return err
+			}
+			content, err := write(id, rest)
+			if err != nil {
+				return err
+			}
+			return post(to, content)
+		}
+	}
+	// message takes a contact petname or a group id, /gmsg is kept for the
+	// latter.
+	message := func(args string) error {
+		to, msg, err := text(args)
+		if err != nil {
+			return err
+		}
+		content, err := author.Text(msg, "")
+		if err != nil {
+			return err
+		}
+		return post(to, content)
+	}
+	go console(os.Stdin, map[string]command{
+		"/msg":  message,
+		"/gmsg": message,
+		"/typing": func(args string) error {
+			to, state, _ := strings.Cut(args, " ")
+			if to == "" || (state != "" && state != "off") {
+				return errUsage
+			}
+			return typing(to, state == "")
+		},
+		"/reply": onText(func(id, msg string) (chat.Content, error) {
+			return author.Text(msg, id)
+		}),
+		"/edit": onText(func(id, msg string) (chat.Content, error) {
+			return author.Edit(id, msg)
+		}),
+		"/delete": onText(func(id, _ string) (chat.Content, error) {
+			return author.Delete(id)
+		}),
+		"/react": onText(func(id, emoji string) (chat.Content, error) {
+			return author.React(id, emoji, false)
+		}),
+		"/unreact": onText(func(id, emoji string) (chat.Content, error) {
+			return author.React(id, emoji, true)
+		}),
+		"/history": func(args string) error {
+			c, g, err := conversation(book, groups, args)
+			if err != nil {
+				return err
+			}
+			conv, self := c.Key(), roster.Self().Contact()
+			if g != nil {
+				conv, self = hex.EncodeToString(g.ID()), hex.EncodeToString(g.Self().Sign)
+			}
+			entries, err := history.Page(conv, storage.Query{})
+			if err != nil {
+				return err
+			}
+			msgs := chat.Fold(entries)
+			show(os.Stdout, msgs[max(0, len(msgs)-config.HistoryShown):], func(from string) string {
+				if from == self {
+					return "me"
+				}
+				return book.Display(from)
+			})
+			return nil
+		},
+		"/mail": func(args string) error {
+			name, msg, err := text(args)
+			if err != nil {
+				return err
+			}
+			c, ok := book.ByName(name)
+			if !ok {
+				return contacts.ErrUnknownContact
+			}
+			to, err := ecdh.X25519().NewPublicKey(c.Identity)
+			if err != nil {
+				return err
+			}
+			id, err := handler.SendMail(mail, to, c.Sign, []byte(msg), mailboxes.Of(d.Fastest(config.MaxPeersCount)), d.SendTo)
+			if err != nil {
+				return err
+			}
+			log.Printf("mail %s stored for %s", id, name)
+			return nil
+		},
+		"/group": func(string) error {
+			g, err := groups.Create()
+			if err != nil {
+				return err
+			}
+			log.Printf("group %x created", g.ID())
+			return nil
+		},
+		"/group-add": func(args string) error {
+			return changeGroup(groups, book, args, func(g *group.Group, m group.Member) error {
+				if err := g.Add(m); err != nil {
+					return err
+				}
+				handler.ShareGroup(direct, g, d.Send)
+				return nil
+			})
+		},
+		"/group-remove": func(args string) error {
+			return changeGroup(groups, book, args, func(g *group.Group, m group.Member) error {
+				if err := g.Remove(m); err != nil {
+					return err
+				}
+				handler.ShareGroup(direct, g, d.Send)
+				return nil
+			})
+		},
+		"/group-promote": func(args string) error {
+			return changeGroup(groups, book, args, func(g *group.Group, m group.Member) error {
+				if err := g.Promote(m); err != nil {
+					return err
+				}
+				handler.ShareGroup(direct, g, d.Send)
+				return nil
+			})
+		},
+		"/group-demote": func(args string) error {
+			return changeGroup(groups, book, args, func(g *group.Group, m group.Member) error {
+				if err := g.Demote(m); err != nil {
+					return err
+				}
+				handler.ShareGroup(direct, g, d.Send)
+				return nil
+			})
+		},
+		"/file": func(args string) error {
+			name, path, err := text(args)
+			if err != nil {
+				return err
+			}
+			c, ok := book.ByName(name)
+			if !ok {
+				return contacts.ErrUnknownContact
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			m, err := transfer.NewManifest(path, f)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			go func() {
+				defer f.Close()
+				ctx, cancel := context.WithTimeout(context.Background(), config.OfferTimeout)
+				sess, err := handler.RequestConn(ctx, d, sessionCfg(), node.PrivSign(), c.Sign)
+				cancel()
+				if err != nil {
+					log.Println("console: /file: handler.RequestConn:", err)
+					return
+				}
+				defer sess.Close()
+				dispatch(d, peers, links, sess)
+				if err := sendFile(context.Background(), d, sess, m, f); err != nil {
+					log.Println("console: /file: sendFile:", err)
+					return
+				}
+				log.Printf("file %s sent to %s", m.Name, name)
+			}()
+			return nil
+		},
+		"/call": func(args string) error {
+			fields := strings.Fields(args)
+			if len(fields) == 0 {
+				return errUsage
+			}
+			c, ok := book.ByName(fields[0])
+			if !ok {
+				return contacts.ErrUnknownContact
+			}
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), config.OfferTimeout)
+				sess, err := handler.RequestConn(ctx, d, sessionCfg(), node.PrivSign(), c.Sign)
+				cancel()
+				if err != nil {
+					log.Println("console: /call: handler.RequestConn:", err)
+					return
+				}
+				calls.serve(sess)
+				dispatch(d, peers, links, sess)
+				if err := calls.start(c, sess, fields[1:]); err != nil {
+					log.Println("console: /call: calls.start:", err)
+					sess.Close()
+				}
+			}()
+			return nil
+		},
+		"/hangup": func(args string) error {
+			c, ok := book.ByName(args)
+			if !ok {
+				return contacts.ErrUnknownContact
+			}
+			return calls.hangup(c)
+		},
+		"/peers": func(string) error {
+			stats := d.Stats()
+			for _, hash := range slices.Sorted(maps.Keys(stats)) {
+				st := stats[hash]
+				log.Printf("%s queued %v dropped %v", hash, st.Depth, st.Dropped)
+			}
+			return nil
+		},
+	}, sender.Touch)
+
+	<-closer.Done()
+}
+
+// outboxPolicy is what the outbox of a peer does with a signal of each class
+// once it is full.
+func outboxPolicy() [dispatcher.ClassesCount]dispatcher.OverflowPolicy {
+	var out [dispatcher.ClassesCount]dispatcher.OverflowPolicy
+	for c, name := range map[dispatcher.Class]string{
+		dispatcher.ClassChat:      config.OutboxChatFull,
+		dispatcher.ClassSignaling: config.OutboxSignalFull,
+		dispatcher.ClassControl:   config.OutboxControlFull,
+	} {
+		p, err := dispatcher.ParseOverflowPolicy(name)
 		if err != nil {
 			panic(err)
 		}
+		out[c] = p
+	}
+	return out
+}
+
+func iceConfig() wrtc.Config {
+	cfg := wrtc.Config{
+		RelayOnly: *relayOnly,
+		PortMin:   uint16(*portMin),
+		PortMax:   uint16(*portMax),
+	}
+	if *stunURLs != "" {
+		cfg.ICEServers = append(cfg.ICEServers, wrtc.ICEServer{
+			URLs: strings.Split(*stunURLs, ","),
+		})
+	}
+	if *turnURLs != "" {
+		cfg.ICEServers = append(cfg.ICEServers, wrtc.ICEServer{
+			URLs:       strings.Split(*turnURLs, ","),
+			Username:   *turnUser,
+			Credential: *turnPass,
+			Secret:     *turnSecret,
+			TTL:        config.TURNCredentialsTTL,
+		})
+	}
+	return cfg
+}
+
+func startRelay(node *network.Node) (*relay.Server, error) {
+	secret, err := relay.Secret(node.PrivSign())
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(*publicIP)
+	if ip == nil {
+		return nil, relay.ErrNoPublicIP
+	}
+	return relay.Start(relay.Config{
+		Addr:       *relayAddr,
+		PublicIP:   ip,
+		MaxClients: config.RelayMaxClients,
+		Rate:       config.RelayClientRate,
+		Burst:      config.RelayClientBurst,
+		Idle:       config.RelayClientIdle,
+	}, secret)
+}
+
+// openDB opens the database in dir with the passphrase of the environment,
+// the history and keys are encrypted with it.
+func openDB(dir string) (*storage.DB, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	passphrase := os.Getenv("GO_CHAT_PASSPHRASE")
+	if passphrase == "" {
+		log.Println("openDB: GO_CHAT_PASSPHRASE is empty, the database is not protected")
+	}
+	return storage.Open(filepath.Join(dir, "chat.db"), passphrase)
+}
+
+// directManager loads the identity kept in the database, or creates it.
+// The prekeys are kept there too, bundles published before a restart still
+// match.
+func directManager(db *storage.DB) (*e2e.Manager, error) {
+	var id e2e.Identity
+	b, ok := db.Get("meta", "identity")
+	if ok {
+		var err error
+		if id, err = e2e.ParseIdentity(b); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if id, err = e2e.NewIdentity(); err != nil {
+			return nil, err
+		}
+		if err := db.Put("meta", "identity", id.Marshal()); err != nil {
+			return nil, err
+		}
+	}
+
+	prekeys, err := e2e.NewPreKeys(id, db.Bucket("prekeys"))
+	if err != nil {
+		return nil, err
+	}
+	return e2e.NewManager(id, prekeys, db.Bucket("sessions"))
+}
+
+// migrateKeys moves the identity and the sessions of the plain files in dir
+// into the database. The files are removed once the database has them.
+func migrateKeys(dir string, db *storage.DB) error {
+	path := filepath.Join(dir, "identity")
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := db.Get("meta", "identity"); !ok {
+		if _, err := e2e.ParseIdentity(b); err != nil {
+			return err
+		}
+		if err := db.Put("meta", "identity", b); err != nil {
+			return err
+		}
+	}
+
+	files, err := e2e.NewFileStore(filepath.Join(dir, "sessions"))
+	if err != nil {
+		return err
+	}
+	keys, err := files.List()
+	if err != nil {
+		return err
+	}
+	sessions := db.Bucket("sessions")
+	for _, c := range keys {
+		if _, err := sessions.Load(c); err == nil {
+			continue
+		}
+		state, err := files.Load(c)
+		if err != nil {
+			return err
+		}
+		if err := sessions.Save(c, state); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "sessions")); err != nil {
+		return err
+	}
+	log.Println("migrateKeys: moved the identity into the database")
+	return os.Remove(path)
+}
+
+// attach connects to addr, or to the peers known from earlier runs when no
+// address is given.
+func attach(ctx context.Context, node *network.Node, peers storage.Bucket, addr string) (*network.Peer, error) {
+	addrs := []string{addr}
+	if addr == "" {
+		addrs, _ = peers.List()
+	}
+	err := error(storage.ErrNotFound)
+	for _, a := range addrs {
+		var p *network.Peer
+		if p, err = node.Attach(ctx, a); err != nil {
+			log.Println("attach: node.Attach:", err)
+			continue
+		}
+		if err := peers.Save(a, nil); err != nil {
+			log.Println("attach: peers.Save:", err)
+		}
+		return p, nil
+	}
+	return nil, err
+}
+
+// loadDevices loads the account key and the devices of the account. The
+// first run creates an account with this device in it.
+func loadDevices(db *storage.DB, id e2e.Identity) (ed25519.PrivateKey, *device.Roster, error) {
+	var account ed25519.PrivateKey
+	if seed, ok := db.Get("meta", "account"); ok {
+		account = ed25519.NewKeyFromSeed(seed)
+	} else {
+		_, priv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := db.Put("meta", "account", priv.Seed()); err != nil {
+			return nil, nil, err
+		}
+		account = priv
+	}
+
+	devices := db.Bucket("devices")
+	self, err := device.Issue(account, id.Sign.Public().(ed25519.PublicKey), id.DH.PublicKey().Bytes(), "")
+	if err != nil {
+		return nil, nil, err
+	}
+	// A device linked to another account keeps the certificate it got.
+	if b, err := devices.Load(self.Contact()); err == nil {
+		if self, err = device.ParseCert(b); err != nil {
+			return nil, nil, err
+		}
+	}
+	roster, err := device.NewRoster(self, devices)
+	return account, roster, err
+}
+
+// roomMember names a member of the group conv by its petname when it is a
+// contact, by its sign key otherwise.
+func roomMember(groups *group.Set, book *contacts.Book, sign []byte, conv string) (string, bool) {
+	id, err := hex.DecodeString(conv)
+	if err != nil || conv == "" {
+		return "", false
+	}
+	g := groups.Get(id)
+	if g == nil {
+		return "", false
+	}
+	for _, m := range g.Members() {
+		if !bytes.Equal(m.Sign, sign) {
+			continue
+		}
+		if c, ok := book.BySign(sign); ok {
+			return c.Key(), true
+		}
+		return hex.EncodeToString(sign), true
+	}
+	return "", false
+}
+
+// attachInviter attaches to the node named by the token, on the first of
+// its addresses where it answers with the identity of the token.
+func attachInviter(ctx context.Context, node *network.Node, peers storage.Bucket, token string) (contacts.Token, *network.Peer, error) {
+	t, err := contacts.ParseToken(token)
+	if err != nil {
+		return t, nil, err
+	}
+	if t.Expired(time.Now()) {
+		return t, nil, contacts.ErrTokenExpired
+	}
+	err = storage.ErrNotFound
+	for _, a := range t.Addrs {
+		var p *network.Peer
+		if p, err = node.AttachTo(ctx, a, t.Sign); err != nil {
+			log.Println("attachInviter: node.AttachTo:", err)
+			continue
+		}
+		if err := peers.Save(a, nil); err != nil {
+			log.Println("attachInviter: peers.Save:", err)
+		}
+		return t, p, nil
+	}
+	return t, nil, err
+}
+
+// redeem sends the own card to the inviter and adds it as a contact.
+func redeem(t contacts.Token, book *contacts.Book, id e2e.Identity, send func(model.Signal)) {
+	card := contacts.NewInvitation(id, *ownName, ownAddrs())
+	if err := handler.RedeemInvite(t, id, card, send); err != nil {
+		log.Println("redeem: handler.RedeemInvite:", err)
+		return
+	}
+	c, err := book.Add(t.Contact(*petname))
+	if err != nil {
+		log.Println("redeem: book.Add:", err)
+		return
+	}
+	log.Printf("added %s", c)
+}
+
+// manageContacts prints the own invitation and applies the contact flags.
+func manageContacts(book *contacts.Book, id e2e.Identity) {
+	keys := contacts.IdentityKeys(id)
+	log.Printf("fingerprint %s (%s)", contacts.Fingerprint(keys), strings.Join(contacts.Words(keys), " "))
+	log.Printf("invitation %s", contacts.NewInvitation(id, *ownName, ownAddrs()))
+
+	if *invitation != "" {
+		inv, err := contacts.ParseInvitation(*invitation)
+		if err != nil {
+			log.Println("manageContacts: contacts.ParseInvitation:", err)
+		} else if c, err := book.Add(inv.Contact(*petname)); err != nil {
+			log.Println("manageContacts: book.Add:", err)
+		} else {
+			number, _ := book.SafetyNumber(c.Key(), id)
+			log.Printf("added %s, safety number %s", c, number)
+		}
+	}
+	if name, number, ok := strings.Cut(*verify, "="); ok {
+		c, found := book.ByName(name)
+		if !found {
+			log.Println("manageContacts: book.ByName:", contacts.ErrUnknownContact)
+		} else if err := book.Verify(c.Key(), id, number); err != nil {
+			log.Println("manageContacts: book.Verify:", err)
+		}
+	}
+	for _, c := range book.List() {
+		log.Printf("contact %s %s", c, c.Fingerprint())
+	}
+}
+
+// ownAddrs are the addresses put in the invitation, the listen port on
+// the public IP when one is known.
+func ownAddrs() []string {
+	if *listenAddr == "" {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(*listenAddr)
+	if *publicIP == "" || err != nil {
+		return []string{*listenAddr}
+	}
+	return []string{net.JoinHostPort(*publicIP, port)}
+}
+
+func save(history *storage.History, conv, id, from string, msg []byte) storage.Message {
+	m, err := handler.ContentReceived(history, conv, from, id, msg)
+	if err != nil {
+		log.Println("save: handler.ContentReceived:", err)
+	}
+	return m
+}
+
+// describe is a message as logged, plain texts as they are.
+func describe(msg []byte) string {
+	if c, err := chat.Parse(msg); err == nil {
+		return c.String()
+	}
+	return string(msg)
+}
+
+// conn is a connection of the mesh, a network.Peer or a session.Session.
+type conn interface {
+	io.ReadWriteCloser
+	Hash() []byte
+	Sign() ed25519.PublicKey
+	RemoteAddr() net.Addr
+}
+
+type signaling struct {
+	*mux.Stream
+	sess *mux.Session
+	peer conn
+}
+
+func (s signaling) Close() error {
+	return s.sess.Close()
+}
+
+func (s signaling) RemoteAddr() net.Addr {
+	return s.peer.RemoteAddr()
+}
+
+func dispatch(d *dispatcher.Dispatcher, peers *peerset.Manager, links *presence.Links, p conn) {
+	evicted, err := peers.Admit(p.Hash(), p.RemoteAddr())
+	if err != nil {
+		log.Println("dispatch: peers.Admit:", err)
+		p.Close()
+		return
+	}
+	if evicted != nil {
+		d.Disconnect(evicted)
+	}
+
+	misbehaved := func(err error) {
+		d.Misbehaved(p.Hash(), err)
+	}
+	sess := mux.New(middleware.Protect(misbehaved, p))
+	st, err := sess.Open(mux.StreamSignaling, mux.PriorityHigh)
+	if err != nil {
+		log.Println("dispatch: mux.Open:", err)
+		sess.Close()
+		peers.Remove(p.Hash())
+		return
+	}
+	links.Add(p.Hash(), p.Sign())
+	d.Dispatch(p.Hash(), signaling{Stream: st, sess: sess, peer: p})
+	if *storeMail {
+		handler.AnnounceMailbox(p.Hash(), d.SendTo)
 	}
 }
@@ -3,7 +3,6 @@ package middleware
 import (
 	"bytes"
 	"crypto/sha256"
-	"errors"
 	"go-chat/config"
 	"go-chat/pack"
 	"io"
@@ -26,10 +25,13 @@ func (s *Sumchecker) Read(b []byte) (int, error) {
 	if err != nil {
 		return n, err
 	}
+	if n < sha256.Size {
+		return 0, ErrInvalidChecksum
+	}
 	checksum, payload := s.buf[:sha256.Size], s.buf[sha256.Size:n]
 	actual := sha256.Sum256(payload)
 	if !bytes.Equal(checksum, actual[:]) {
-		return 0, errors.New("invalid checksum")
+		return 0, ErrInvalidChecksum
 	}
 	return copy(b, payload), nil
 }
@@ -0,0 +1,169 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/lzw"
+	"errors"
+	"fmt"
+	"go-chat/config"
+	"io"
+	"sync/atomic"
+)
+
+type CompressAlgo uint8
+
+const (
+	CompressNone CompressAlgo = iota
+	CompressDeflate
+	CompressLZW
+)
+
+const compressHeaderLen = 2
+
+var DefaultCompressAlgos = []CompressAlgo{CompressDeflate, CompressLZW}
+
+// Compressor prefixes every frame with the algorithm used and the mask of
+// algorithms it accepts, so both sides settle on a common algorithm after
+// the first exchanged frame. Until then frames go uncompressed.
+type Compressor struct {
+	downstream io.ReadWriteCloser
+	prefer     []CompressAlgo
+	accept     uint8
+	peerAccept atomic.Uint32
+	minLen     int
+	buf        []byte
+}
+
+func Compress(minLen int, algos []CompressAlgo, rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	accept := maskOf(CompressNone)
+	for _, a := range algos {
+		accept |= maskOf(a)
+	}
+	c := &Compressor{
+		downstream: rwc,
+		prefer:     algos,
+		accept:     accept,
+		minLen:     minLen,
+		buf:        make([]byte, config.MaxInputLen),
+	}
+	c.peerAccept.Store(uint32(maskOf(CompressNone)))
+	return c
+}
+
+func (c *Compressor) Read(b []byte) (int, error) {
+	n, err := c.downstream.Read(c.buf)
+	if err != nil {
+		return 0, err
+	}
+	if n < compressHeaderLen {
+		return 0, fmt.Errorf("%w: compressed frame too short", ErrMalformed)
+	}
+	algo, mask, body := CompressAlgo(c.buf[0]), c.buf[1], c.buf[compressHeaderLen:n]
+	c.peerAccept.Store(uint32(mask | maskOf(CompressNone)))
+
+	if c.accept&maskOf(algo) == 0 {
+		return 0, fmt.Errorf("%w: unsupported compression: %d", ErrMalformed, algo)
+	}
+	if algo == CompressNone {
+		return copy(b, body), nil
+	}
+
+	out, err := decompress(algo, body)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return copy(b, out), nil
+}
+
+func (c *Compressor) Write(b []byte) (int, error) {
+	algo := c.pick()
+	out := make([]byte, compressHeaderLen, compressHeaderLen+len(b))
+	out[0], out[1] = byte(CompressNone), c.accept
+	body := b
+
+	if algo != CompressNone && len(b) >= c.minLen {
+		compressed, err := compress(algo, b)
+		if err != nil {
+			return 0, err
+		}
+		if len(compressed) < len(b) {
+			out[0] = byte(algo)
+			body = compressed
+		}
+	}
+
+	_, err := c.downstream.Write(append(out, body...))
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Compressor) Close() error {
+	return c.downstream.Close()
+}
+
+func (c *Compressor) pick() CompressAlgo {
+	peer := uint8(c.peerAccept.Load())
+	for _, a := range c.prefer {
+		if peer&maskOf(a) != 0 {
+			return a
+		}
+	}
+	return CompressNone
+}
+
+func maskOf(a CompressAlgo) uint8 {
+	if a > 7 {
+		return 0
+	}
+	return 1 << a
+}
+
+func compress(algo CompressAlgo, b []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	var w io.WriteCloser
+	switch algo {
+	case CompressDeflate:
+		fw, err := flate.NewWriter(buf, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		w = fw
+	case CompressLZW:
+		w = lzw.NewWriter(buf, lzw.LSB, 8)
+	default:
+		return nil, fmt.Errorf("unsupported compression: %d", algo)
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(algo CompressAlgo, b []byte) ([]byte, error) {
+	var r io.ReadCloser
+	switch algo {
+	case CompressDeflate:
+		r = flate.NewReader(bytes.NewReader(b))
+	case CompressLZW:
+		r = lzw.NewReader(bytes.NewReader(b), lzw.LSB, 8)
+	default:
+		return nil, fmt.Errorf("unsupported compression: %d", algo)
+	}
+	defer r.Close()
+
+	// Never inflate more than one frame worth of data.
+	out, err := io.ReadAll(io.LimitReader(r, config.MaxInputLen+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %w", err)
+	}
+	if len(out) > config.MaxInputLen {
+		return nil, errors.New("decompressed frame too big")
+	}
+	return out, nil
+}
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/flate"
+	"go-chat/config"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type msgconn struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func msgpair() (*msgconn, *msgconn) {
+	a, b := make(chan []byte, 10), make(chan []byte, 10)
+	return &msgconn{in: a, out: b}, &msgconn{in: b, out: a}
+}
+
+func (m *msgconn) Read(b []byte) (int, error) {
+	in, ok := <-m.in
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b, in), nil
+}
+
+func (m *msgconn) Write(b []byte) (int, error) {
+	m.out <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (m *msgconn) Close() error {
+	return nil
+}
+
+func Test_Compress(t *testing.T) {
+	payload := bytes.Repeat([]byte(`{"type":"offer","sdp":"a=candidate"}`), 50)
+
+	t.Run("negotiate and compress", func(t *testing.T) {
+		l, r := msgpair()
+		lc := Compress(config.CompressMinLen, DefaultCompressAlgos, l)
+		rc := Compress(config.CompressMinLen, []CompressAlgo{CompressLZW}, r)
+		buf := make([]byte, config.MaxInputLen)
+
+		_, err := lc.Write(payload)
+		assert.NoError(t, err)
+		raw := <-r.in
+		assert.Equal(t, byte(CompressNone), raw[0])
+		r.in <- raw
+		n, err := rc.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, payload, buf[:n])
+
+		_, err = rc.Write(payload)
+		assert.NoError(t, err)
+		raw = <-l.in
+		assert.Equal(t, byte(CompressLZW), raw[0])
+		assert.Less(t, len(raw), len(payload))
+		l.in <- raw
+		n, err = lc.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, payload, buf[:n])
+
+		_, err = lc.Write(payload)
+		assert.NoError(t, err)
+		raw = <-r.in
+		assert.Equal(t, byte(CompressLZW), raw[0])
+	})
+
+	t.Run("skip small frames", func(t *testing.T) {
+		l, r := msgpair()
+		lc := Compress(config.CompressMinLen, DefaultCompressAlgos, l)
+		r.Write([]byte{byte(CompressNone), maskOf(CompressDeflate)})
+		lc.Read(make([]byte, 10))
+
+		_, err := lc.Write([]byte("hello"))
+		assert.NoError(t, err)
+		raw := <-r.in
+		assert.Equal(t, byte(CompressNone), raw[0])
+		assert.Equal(t, []byte("hello"), raw[compressHeaderLen:])
+	})
+
+	t.Run("decompression bomb", func(t *testing.T) {
+		l, r := msgpair()
+		lc := Compress(config.CompressMinLen, DefaultCompressAlgos, l)
+
+		buf := new(bytes.Buffer)
+		fw, _ := flate.NewWriter(buf, flate.BestCompression)
+		fw.Write(make([]byte, config.MaxInputLen*100))
+		fw.Close()
+		assert.Less(t, buf.Len(), config.MaxInputLen)
+
+		r.Write(append([]byte{byte(CompressDeflate), 0}, buf.Bytes()...))
+		_, err := lc.Read(make([]byte, config.MaxInputLen))
+		assert.ErrorContains(t, err, "too big")
+	})
+
+	t.Run("unsupported algo", func(t *testing.T) {
+		l, r := msgpair()
+		lc := Compress(config.CompressMinLen, []CompressAlgo{CompressDeflate}, l)
+		r.Write([]byte{byte(CompressLZW), 0, 1, 2, 3})
+		_, err := lc.Read(make([]byte, 10))
+		assert.ErrorContains(t, err, "unsupported compression")
+	})
+}
@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"crypto/ecdh"
+	"fmt"
 	"go-chat/config"
 	"go-chat/netcrypt"
 	"io"
@@ -30,7 +31,7 @@ func (c *Crypter) Read(b []byte) (int, error) {
 	}
 	decrypted, err := netcrypt.Decrypt(c.buf[:n], c.privkey, c.pubkey)
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("%w: decrypt: %v", ErrMalformed, err)
 	}
 
 	return copy(b, decrypted), nil
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrInvalidChecksum = errors.New("invalid checksum")
+	ErrInvalidSign     = errors.New("invalid sign")
+	ErrMalformed       = errors.New("malformed frame")
+)
+
+type Guard struct {
+	downstream io.ReadWriteCloser
+	report     func(error)
+}
+
+// Protect reports frames rejected by the lower layers and skips them instead
+// of failing the whole connection. Any other error is returned as is.
+func Protect(report func(error), rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	return &Guard{
+		downstream: rwc,
+		report:     report,
+	}
+}
+
+func (g *Guard) Read(b []byte) (int, error) {
+	for {
+		n, err := g.downstream.Read(b)
+		if err == nil {
+			return n, nil
+		}
+		if !IsFrameError(err) {
+			return n, err
+		}
+		g.report(err)
+	}
+}
+
+func (g *Guard) Write(b []byte) (int, error) {
+	return g.downstream.Write(b)
+}
+
+func (g *Guard) Close() error {
+	return g.downstream.Close()
+}
+
+func IsFrameError(err error) bool {
+	return errors.Is(err, ErrInvalidChecksum) ||
+		errors.Is(err, ErrInvalidSign) ||
+		errors.Is(err, ErrMalformed)
+}
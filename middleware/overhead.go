@@ -0,0 +1,11 @@
+package middleware
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"go-chat/netcrypt"
+)
+
+// Overhead is what Compress, Crypt, SignCheck and Checksum add to a frame
+// together, as network.UpgradeConn stacks them.
+const Overhead = compressHeaderLen + netcrypt.Overhead + ed25519.SignatureSize + sha256.Size
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"go-chat/config"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Overhead(t *testing.T) {
+	stack := func(conn net.Conn, key *ecdh.PrivateKey, peer *ecdh.PublicKey, sign ed25519.PrivateKey, peerSign ed25519.PublicKey) io.ReadWriteCloser {
+		rwc := Checksum(conn)
+		rwc = SignCheck(sign, peerSign, rwc)
+		rwc = Crypt(key, peer, rwc)
+		return Compress(config.CompressMinLen, DefaultCompressAlgos, rwc)
+	}
+	aKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	bKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	aPub, aSign, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	bPub, bSign, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ac, bc := net.Pipe()
+	defer ac.Close()
+	defer bc.Close()
+	a := stack(ac, aKey, bKey.PublicKey(), aSign, bPub)
+	b := stack(bc, bKey, aKey.PublicKey(), bSign, aPub)
+
+	// Random bytes don't compress, the frame is as long as it gets.
+	for _, n := range []int{config.MaxInputLen - Overhead, config.MaxInputLen - Overhead + 1} {
+		msg := make([]byte, n)
+		rand.Read(msg)
+		go a.Write(msg)
+		buf := make([]byte, config.MaxInputLen)
+		got, err := b.Read(buf)
+		if n > config.MaxInputLen-Overhead {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, msg, buf[:got])
+	}
+}
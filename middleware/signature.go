@@ -2,7 +2,6 @@ package middleware
 
 import (
 	"crypto/ed25519"
-	"errors"
 	"go-chat/config"
 	"io"
 )
@@ -27,9 +26,12 @@ func (s *SignChecker) Read(b []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	if n < ed25519.SignatureSize {
+		return 0, ErrInvalidSign
+	}
 	signature, payload := s.buf[:ed25519.SignatureSize], s.buf[ed25519.SignatureSize:n]
 	if !ed25519.Verify(s.pubsign, payload, signature) {
-		return 0, errors.New("invalid sign")
+		return 0, ErrInvalidSign
 	}
 	return copy(b, payload), nil
 }
@@ -3,6 +3,7 @@ package model
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"unsafe"
 )
@@ -14,6 +15,29 @@ type Signal []byte
 // Offer
 // Answer
 // Candidate
+// Ping
+// Pong
+// RelayAnnounce
+// RelayData
+// CallStart
+// CallAccept
+// CallEnd
+// FileOffer
+// FileAccept
+// FileReject
+// MailStore
+// MailFetch
+// MailDeliver
+// MailAck
+// PreKeyBundle
+// Direct
+// GroupUpdate
+// GroupMessage
+// DeviceSync
+// InviteRedeem
+// Presence
+// Typing
+// MailboxAnnounce
 // )
 type SignalType uint8
 
@@ -21,13 +45,15 @@ const (
 	TypeLen  = 1
 	KeyLen   = 16
 	NonceLen = 16
+	StampLen = 8
 
 	TypeStart    = 0
 	KeyStart     = TypeStart + TypeLen
 	NonceStart   = KeyStart + KeyLen
-	PayloadStart = NonceStart + NonceLen
+	StampStart   = NonceStart + NonceLen
+	PayloadStart = StampStart + StampLen
 
-	MinLen = TypeLen + KeyLen + NonceLen
+	MinLen = TypeLen + KeyLen + NonceLen + StampLen
 )
 
 func FormatSignal(b []byte) (Signal, error) {
@@ -50,6 +76,7 @@ func NewSignal(t SignalType, key []byte, payload []byte) (Signal, error) {
 
 	rand.Read(out[pos : pos+NonceLen])
 	pos += NonceLen
+	pos += StampLen
 
 	copy(out[pos:], payload)
 
@@ -72,6 +99,14 @@ func (s Signal) NonceString() string {
 	return unsafe.String(&s[NonceStart], NonceLen)
 }
 
+func (s Signal) Stamp() uint64 {
+	return binary.LittleEndian.Uint64(s[StampStart:PayloadStart])
+}
+
+func (s Signal) SetStamp(stamp uint64) {
+	binary.LittleEndian.PutUint64(s[StampStart:PayloadStart], stamp)
+}
+
 func (s Signal) Payload() []byte {
 	return s[PayloadStart:]
 }
@@ -20,17 +20,86 @@ const (
 	SignalTypeAnswer
 	// SignalTypeCandidate is a SignalType of type Candidate.
 	SignalTypeCandidate
+	// SignalTypePing is a SignalType of type Ping.
+	SignalTypePing
+	// SignalTypePong is a SignalType of type Pong.
+	SignalTypePong
+	// SignalTypeRelayAnnounce is a SignalType of type RelayAnnounce.
+	SignalTypeRelayAnnounce
+	// SignalTypeRelayData is a SignalType of type RelayData.
+	SignalTypeRelayData
+	// SignalTypeCallStart is a SignalType of type CallStart.
+	SignalTypeCallStart
+	// SignalTypeCallAccept is a SignalType of type CallAccept.
+	SignalTypeCallAccept
+	// SignalTypeCallEnd is a SignalType of type CallEnd.
+	SignalTypeCallEnd
+	// SignalTypeFileOffer is a SignalType of type FileOffer.
+	SignalTypeFileOffer
+	// SignalTypeFileAccept is a SignalType of type FileAccept.
+	SignalTypeFileAccept
+	// SignalTypeFileReject is a SignalType of type FileReject.
+	SignalTypeFileReject
+	// SignalTypeMailStore is a SignalType of type MailStore.
+	SignalTypeMailStore
+	// SignalTypeMailFetch is a SignalType of type MailFetch.
+	SignalTypeMailFetch
+	// SignalTypeMailDeliver is a SignalType of type MailDeliver.
+	SignalTypeMailDeliver
+	// SignalTypeMailAck is a SignalType of type MailAck.
+	SignalTypeMailAck
+	// SignalTypePreKeyBundle is a SignalType of type PreKeyBundle.
+	SignalTypePreKeyBundle
+	// SignalTypeDirect is a SignalType of type Direct.
+	SignalTypeDirect
+	// SignalTypeGroupUpdate is a SignalType of type GroupUpdate.
+	SignalTypeGroupUpdate
+	// SignalTypeGroupMessage is a SignalType of type GroupMessage.
+	SignalTypeGroupMessage
+	// SignalTypeDeviceSync is a SignalType of type DeviceSync.
+	SignalTypeDeviceSync
+	// SignalTypeInviteRedeem is a SignalType of type InviteRedeem.
+	SignalTypeInviteRedeem
+	// SignalTypePresence is a SignalType of type Presence.
+	SignalTypePresence
+	// SignalTypeTyping is a SignalType of type Typing.
+	SignalTypeTyping
+	// SignalTypeMailboxAnnounce is a SignalType of type MailboxAnnounce.
+	SignalTypeMailboxAnnounce
 )
 
 var ErrInvalidSignalType = errors.New("not a valid SignalType")
 
-const _SignalTypeName = "NeedConnectOfferAnswerCandidate"
+const _SignalTypeName = "NeedConnectOfferAnswerCandidatePingPongRelayAnnounceRelayDataCallStartCallAcceptCallEndFileOfferFileAcceptFileRejectMailStoreMailFetchMailDeliverMailAckPreKeyBundleDirectGroupUpdateGroupMessageDeviceSyncInviteRedeemPresenceTypingMailboxAnnounce"
 
 var _SignalTypeMap = map[SignalType]string{
-	SignalTypeNeedConnect: _SignalTypeName[0:11],
-	SignalTypeOffer:       _SignalTypeName[11:16],
-	SignalTypeAnswer:      _SignalTypeName[16:22],
-	SignalTypeCandidate:   _SignalTypeName[22:31],
+	SignalTypeNeedConnect:     _SignalTypeName[0:11],
+	SignalTypeOffer:           _SignalTypeName[11:16],
+	SignalTypeAnswer:          _SignalTypeName[16:22],
+	SignalTypeCandidate:       _SignalTypeName[22:31],
+	SignalTypePing:            _SignalTypeName[31:35],
+	SignalTypePong:            _SignalTypeName[35:39],
+	SignalTypeRelayAnnounce:   _SignalTypeName[39:52],
+	SignalTypeRelayData:       _SignalTypeName[52:61],
+	SignalTypeCallStart:       _SignalTypeName[61:70],
+	SignalTypeCallAccept:      _SignalTypeName[70:80],
+	SignalTypeCallEnd:         _SignalTypeName[80:87],
+	SignalTypeFileOffer:       _SignalTypeName[87:96],
+	SignalTypeFileAccept:      _SignalTypeName[96:106],
+	SignalTypeFileReject:      _SignalTypeName[106:116],
+	SignalTypeMailStore:       _SignalTypeName[116:125],
+	SignalTypeMailFetch:       _SignalTypeName[125:134],
+	SignalTypeMailDeliver:     _SignalTypeName[134:145],
+	SignalTypeMailAck:         _SignalTypeName[145:152],
+	SignalTypePreKeyBundle:    _SignalTypeName[152:164],
+	SignalTypeDirect:          _SignalTypeName[164:170],
+	SignalTypeGroupUpdate:     _SignalTypeName[170:181],
+	SignalTypeGroupMessage:    _SignalTypeName[181:193],
+	SignalTypeDeviceSync:      _SignalTypeName[193:203],
+	SignalTypeInviteRedeem:    _SignalTypeName[203:215],
+	SignalTypePresence:        _SignalTypeName[215:223],
+	SignalTypeTyping:          _SignalTypeName[223:229],
+	SignalTypeMailboxAnnounce: _SignalTypeName[229:244],
 }
 
 // String implements the Stringer interface.
@@ -49,10 +118,33 @@ func (x SignalType) IsValid() bool {
 }
 
 var _SignalTypeValue = map[string]SignalType{
-	_SignalTypeName[0:11]:  SignalTypeNeedConnect,
-	_SignalTypeName[11:16]: SignalTypeOffer,
-	_SignalTypeName[16:22]: SignalTypeAnswer,
-	_SignalTypeName[22:31]: SignalTypeCandidate,
+	_SignalTypeName[0:11]:    SignalTypeNeedConnect,
+	_SignalTypeName[11:16]:   SignalTypeOffer,
+	_SignalTypeName[16:22]:   SignalTypeAnswer,
+	_SignalTypeName[22:31]:   SignalTypeCandidate,
+	_SignalTypeName[31:35]:   SignalTypePing,
+	_SignalTypeName[35:39]:   SignalTypePong,
+	_SignalTypeName[39:52]:   SignalTypeRelayAnnounce,
+	_SignalTypeName[52:61]:   SignalTypeRelayData,
+	_SignalTypeName[61:70]:   SignalTypeCallStart,
+	_SignalTypeName[70:80]:   SignalTypeCallAccept,
+	_SignalTypeName[80:87]:   SignalTypeCallEnd,
+	_SignalTypeName[87:96]:   SignalTypeFileOffer,
+	_SignalTypeName[96:106]:  SignalTypeFileAccept,
+	_SignalTypeName[106:116]: SignalTypeFileReject,
+	_SignalTypeName[116:125]: SignalTypeMailStore,
+	_SignalTypeName[125:134]: SignalTypeMailFetch,
+	_SignalTypeName[134:145]: SignalTypeMailDeliver,
+	_SignalTypeName[145:152]: SignalTypeMailAck,
+	_SignalTypeName[152:164]: SignalTypePreKeyBundle,
+	_SignalTypeName[164:170]: SignalTypeDirect,
+	_SignalTypeName[170:181]: SignalTypeGroupUpdate,
+	_SignalTypeName[181:193]: SignalTypeGroupMessage,
+	_SignalTypeName[193:203]: SignalTypeDeviceSync,
+	_SignalTypeName[203:215]: SignalTypeInviteRedeem,
+	_SignalTypeName[215:223]: SignalTypePresence,
+	_SignalTypeName[223:229]: SignalTypeTyping,
+	_SignalTypeName[229:244]: SignalTypeMailboxAnnounce,
 }
 
 // ParseSignalType attempts to convert a string to a SignalType.
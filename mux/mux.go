@@ -0,0 +1,389 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-chat/config"
+	"go-chat/middleware"
+	"io"
+	"sync"
+)
+
+type Priority uint8
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+
+	prioritiesCount = 3
+)
+
+const (
+	StreamSignaling uint32 = iota + 1
+	StreamGossip
+	StreamBulk
+)
+
+type frameType uint8
+
+const (
+	frameOpen frameType = iota
+	frameData
+	frameWindow
+	frameClose
+)
+
+const (
+	headerLen = 5
+	// MaxPayload leaves room for the mux header and the middleware of a
+	// peer connection within a frame.
+	MaxPayload = config.MaxInputLen - middleware.Overhead - headerLen
+)
+
+var (
+	ErrSessionClosed = errors.New("session closed")
+	ErrStreamClosed  = errors.New("stream closed")
+	ErrTooBig        = errors.New("payload too big")
+)
+
+// Session multiplexes logical streams over one message oriented connection,
+// where every Write of the downstream is delivered by exactly one Read.
+type Session struct {
+	mu      sync.Mutex
+	rwc     io.ReadWriteCloser
+	streams map[uint32]*Stream
+	accept  chan *Stream
+	queues  [prioritiesCount][][]byte
+	pending *sync.Cond
+	window  int
+	closed  bool
+	err     error
+}
+
+type Stream struct {
+	id       uint32
+	prio     Priority
+	sess     *Session
+	cond     *sync.Cond
+	inbox    [][]byte
+	recvUsed int
+	consumed int
+	sendWin  int
+	local    bool
+	closed   bool
+	remote   bool
+}
+
+func New(rwc io.ReadWriteCloser) *Session {
+	return NewWithWindow(rwc, config.MuxWindowSize)
+}
+
+func NewWithWindow(rwc io.ReadWriteCloser, window int) *Session {
+	s := &Session{
+		rwc:     rwc,
+		streams: map[uint32]*Stream{},
+		accept:  make(chan *Stream, 16),
+		window:  window,
+	}
+	s.pending = sync.NewCond(&s.mu)
+
+	go s.writeLoop()
+	go s.readLoop()
+
+	return s
+}
+
+// Open returns the stream with the given id, creating it when needed. Both
+// sides may open the same id, e.g. the well known StreamSignaling.
+func (s *Session) Open(id uint32, prio Priority) (*Stream, error) {
+	if prio >= prioritiesCount {
+		return nil, fmt.Errorf("invalid priority: %d", prio)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrSessionClosed
+	}
+
+	st, ok := s.streams[id]
+	if !ok {
+		st = s.newStream(id, prio)
+	}
+	if st.local {
+		return st, nil
+	}
+	st.local = true
+	st.prio = prio
+	s.enqueue(prio, frame(frameOpen, id, []byte{byte(prio)}))
+
+	return st, nil
+}
+
+// Accept returns streams opened by the remote side.
+func (s *Session) Accept() (*Stream, error) {
+	st, ok := <-s.accept
+	if !ok {
+		return nil, ErrSessionClosed
+	}
+	return st, nil
+}
+
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.shutdown(ErrSessionClosed)
+}
+
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+func (s *Session) shutdown(err error) error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.err = err
+	for _, st := range s.streams {
+		st.closed = true
+		st.remote = true
+		st.cond.Broadcast()
+	}
+	close(s.accept)
+	s.pending.Broadcast()
+
+	return s.rwc.Close()
+}
+
+func (s *Session) newStream(id uint32, prio Priority) *Stream {
+	st := &Stream{
+		id:      id,
+		prio:    prio,
+		sess:    s,
+		cond:    sync.NewCond(&s.mu),
+		sendWin: s.window,
+	}
+	s.streams[id] = st
+	return st
+}
+
+func (s *Session) enqueue(prio Priority, f []byte) {
+	s.queues[prio] = append(s.queues[prio], f)
+	s.pending.Signal()
+}
+
+func (s *Session) next() ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if s.closed {
+			return nil, false
+		}
+		for p := prioritiesCount - 1; p >= 0; p-- {
+			q := s.queues[p]
+			if len(q) == 0 {
+				continue
+			}
+			f := q[0]
+			q[0] = nil
+			s.queues[p] = q[1:]
+			return f, true
+		}
+		s.pending.Wait()
+	}
+}
+
+func (s *Session) writeLoop() {
+	for {
+		f, ok := s.next()
+		if !ok {
+			return
+		}
+		if _, err := s.rwc.Write(f); err != nil {
+			s.mu.Lock()
+			s.shutdown(fmt.Errorf("write frame: %w", err))
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (s *Session) readLoop() {
+	buf := make([]byte, config.MaxInputLen)
+	for {
+		n, err := s.rwc.Read(buf)
+		if err != nil {
+			s.mu.Lock()
+			s.shutdown(fmt.Errorf("read frame: %w", err))
+			s.mu.Unlock()
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		err = s.handle(buf[:n])
+		if err != nil {
+			s.shutdown(err)
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Session) handle(f []byte) error {
+	if len(f) < headerLen {
+		return errors.New("frame too short")
+	}
+	t, id, body := frameType(f[0]), binary.LittleEndian.Uint32(f[1:headerLen]), f[headerLen:]
+
+	st, ok := s.streams[id]
+	switch t {
+	case frameOpen:
+		if len(body) != 1 || Priority(body[0]) >= prioritiesCount {
+			return errors.New("invalid open frame")
+		}
+		if ok {
+			return nil
+		}
+		st = s.newStream(id, Priority(body[0]))
+		select {
+		case s.accept <- st:
+		default:
+		}
+	case frameData:
+		if !ok {
+			return fmt.Errorf("data for unknown stream %d", id)
+		}
+		if st.recvUsed+len(body) > s.window {
+			return fmt.Errorf("stream %d window exceeded", id)
+		}
+		if st.closed || st.remote {
+			return nil
+		}
+		st.recvUsed += len(body)
+		st.inbox = append(st.inbox, append([]byte(nil), body...))
+		st.cond.Broadcast()
+	case frameWindow:
+		if !ok {
+			return nil
+		}
+		if len(body) != 4 {
+			return errors.New("invalid window frame")
+		}
+		st.sendWin += int(binary.LittleEndian.Uint32(body))
+		st.cond.Broadcast()
+	case frameClose:
+		if !ok {
+			return nil
+		}
+		st.remote = true
+		st.cond.Broadcast()
+		if st.closed {
+			delete(s.streams, id)
+		}
+	default:
+		return fmt.Errorf("unknown frame type: %d", t)
+	}
+	return nil
+}
+
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Priority() Priority {
+	return st.prio
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	s := st.sess
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(st.inbox) == 0 {
+		if st.remote || st.closed {
+			return 0, io.EOF
+		}
+		st.cond.Wait()
+	}
+
+	msg := st.inbox[0]
+	st.inbox[0] = nil
+	st.inbox = st.inbox[1:]
+	st.recvUsed -= len(msg)
+	st.consumed += len(msg)
+
+	if st.consumed >= s.window/2 && !s.closed {
+		delta := make([]byte, 4)
+		binary.LittleEndian.PutUint32(delta, uint32(st.consumed))
+		s.enqueue(PriorityHigh, frame(frameWindow, st.id, delta))
+		st.consumed = 0
+	}
+
+	return copy(b, msg), nil
+}
+
+func (st *Stream) Write(b []byte) (int, error) {
+	if len(b) > MaxPayload {
+		return 0, ErrTooBig
+	}
+
+	s := st.sess
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for st.sendWin < len(b) {
+		if st.closed || st.remote {
+			return 0, ErrStreamClosed
+		}
+		st.cond.Wait()
+	}
+	if st.closed || st.remote {
+		return 0, ErrStreamClosed
+	}
+
+	st.sendWin -= len(b)
+	s.enqueue(st.prio, frame(frameData, st.id, b))
+
+	return len(b), nil
+}
+
+func (st *Stream) Close() error {
+	s := st.sess
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if st.closed {
+		return nil
+	}
+	st.closed = true
+	st.cond.Broadcast()
+	if st.remote {
+		delete(s.streams, st.id)
+	}
+	if !s.closed {
+		s.enqueue(st.prio, frame(frameClose, st.id, nil))
+	}
+	return nil
+}
+
+func frame(t frameType, id uint32, body []byte) []byte {
+	out := make([]byte, headerLen+len(body))
+	out[0] = byte(t)
+	binary.LittleEndian.PutUint32(out[1:headerLen], id)
+	copy(out[headerLen:], body)
+	return out
+}
@@ -0,0 +1,122 @@
+package mux
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Session(t *testing.T) {
+	t.Run("open both sides", func(t *testing.T) {
+		lc, rc := net.Pipe()
+		l, r := New(lc), New(rc)
+		defer l.Close()
+		defer r.Close()
+
+		ls, err := l.Open(StreamSignaling, PriorityHigh)
+		assert.NoError(t, err)
+		rs, err := r.Open(StreamSignaling, PriorityHigh)
+		assert.NoError(t, err)
+
+		_, err = ls.Write([]byte("ping"))
+		assert.NoError(t, err)
+		buf := make([]byte, 100)
+		n, err := rs.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(buf[:n]))
+
+		_, err = rs.Write([]byte("pong"))
+		assert.NoError(t, err)
+		n, err = ls.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "pong", string(buf[:n]))
+	})
+
+	t.Run("accept remote stream", func(t *testing.T) {
+		lc, rc := net.Pipe()
+		l, r := New(lc), New(rc)
+		defer l.Close()
+		defer r.Close()
+
+		ls, err := l.Open(StreamBulk, PriorityLow)
+		assert.NoError(t, err)
+		ls.Write([]byte("data"))
+
+		rs, err := r.Accept()
+		assert.NoError(t, err)
+		assert.Equal(t, StreamBulk, rs.ID())
+		assert.Equal(t, PriorityLow, rs.Priority())
+
+		buf := make([]byte, 100)
+		n, err := rs.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "data", string(buf[:n]))
+
+		ls.Close()
+		_, err = rs.Read(buf)
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("flow control", func(t *testing.T) {
+		lc, rc := net.Pipe()
+		l, r := NewWithWindow(lc, 8), NewWithWindow(rc, 8)
+		defer l.Close()
+		defer r.Close()
+
+		ls, _ := l.Open(StreamGossip, PriorityNormal)
+		rs, _ := r.Open(StreamGossip, PriorityNormal)
+
+		_, err := ls.Write([]byte("12345678"))
+		assert.NoError(t, err)
+
+		written := make(chan struct{})
+		go func() {
+			defer close(written)
+			ls.Write([]byte("9"))
+		}()
+
+		select {
+		case <-written:
+			t.Fatal("write must block on exhausted window")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		buf := make([]byte, 100)
+		n, err := rs.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "12345678", string(buf[:n]))
+
+		select {
+		case <-written:
+		case <-time.After(time.Second):
+			t.Fatal("write must resume after window update")
+		}
+	})
+
+	t.Run("too big", func(t *testing.T) {
+		lc, rc := net.Pipe()
+		l, r := New(lc), New(rc)
+		defer l.Close()
+		defer r.Close()
+
+		ls, _ := l.Open(StreamBulk, PriorityLow)
+		_, err := ls.Write(make([]byte, MaxPayload+1))
+		assert.ErrorIs(t, err, ErrTooBig)
+	})
+
+	t.Run("session close", func(t *testing.T) {
+		lc, rc := net.Pipe()
+		l, r := New(lc), New(rc)
+		defer r.Close()
+
+		ls, _ := l.Open(StreamSignaling, PriorityHigh)
+		l.Close()
+		_, err := ls.Write([]byte("x"))
+		assert.ErrorIs(t, err, ErrStreamClosed)
+		_, err = l.Open(StreamGossip, PriorityNormal)
+		assert.ErrorIs(t, err, ErrSessionClosed)
+	})
+}
@@ -13,6 +13,10 @@ import (
 	"golang.org/x/crypto/hkdf"
 )
 
+// Overhead is what Encrypt adds to the plaintext: the sealed AES key, a nonce
+// and a tag.
+const Overhead = config.AESKeyLen + 12 + 16
+
 func Encrypt(plaintext []byte, senderPrivateKey *ecdh.PrivateKey, recipientPublicKey *ecdh.PublicKey) ([]byte, error) {
 	aesKey, err := generateAESKey()
 	if err != nil {
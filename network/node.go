@@ -1,12 +1,15 @@
 package network
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdh"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 	"go-chat/closer"
+	"go-chat/config"
 	"go-chat/handshake"
 	"go-chat/middleware"
 	"io"
@@ -15,68 +18,131 @@ import (
 	"time"
 )
 
+var ErrUnexpectedPeer = errors.New("peer has another identity")
+
 type Handler func(*Peer)
 
+type Filter func(net.Addr) bool
+
 type Peer struct {
 	io.ReadWriteCloser
 	hash []byte
+	sign ed25519.PublicKey
+	addr net.Addr
 }
 
-func Attach(ctx context.Context, addr string) (*Peer, error) {
-	d := net.Dialer{}
-	conn, err := d.DialContext(ctx, "tcp", addr)
-	closer.Add(conn.Close)
+// Node holds the keys the node uses for every connection it makes.
+type Node struct {
+	privkey  *ecdh.PrivateKey
+	pubsign  ed25519.PublicKey
+	privsign ed25519.PrivateKey
+}
+
+func NewNode() *Node {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
 	if err != nil {
-		return nil, err
+		panic(err)
 	}
 
-	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	_, privsign, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	return NewNodeWith(key, privsign)
+}
+
+func NewNodeWith(key *ecdh.PrivateKey, privsign ed25519.PrivateKey) *Node {
+	return &Node{
+		privkey:  key,
+		pubsign:  privsign.Public().(ed25519.PublicKey),
+		privsign: privsign,
+	}
+}
+
+func (n *Node) Hash() []byte {
+	sum := sha256.Sum256(n.privkey.PublicKey().Bytes())
+	return sum[:]
+}
+
+func (n *Node) PubKey() *ecdh.PublicKey {
+	return n.privkey.PublicKey()
+}
+
+func (n *Node) PrivKey() *ecdh.PrivateKey {
+	return n.privkey
+}
+
+func (n *Node) PubSign() ed25519.PublicKey {
+	return n.pubsign
+}
+
+func (n *Node) PrivSign() ed25519.PrivateKey {
+	return n.privsign
+}
+
+func (n *Node) Attach(ctx context.Context, addr string) (*Peer, error) {
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
+	closer.Add(conn.Close)
+
+	return n.NewPeer(ctx, conn)
+}
 
-	pubsign, privsign, err := ed25519.GenerateKey(rand.Reader)
+// AttachTo attaches only to the node holding the sign key. The peer proves
+// the key in the handshake and every frame is checked against it, so
+// another node can't pose as it.
+func (n *Node) AttachTo(ctx context.Context, addr string, sign ed25519.PublicKey) (*Peer, error) {
+	p, err := n.Attach(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
+	if !bytes.Equal(p.sign, sign) {
+		p.Close()
+		return nil, ErrUnexpectedPeer
+	}
+	return p, nil
+}
 
-	return UpgradeConn(ctx, key, pubsign, privsign, conn)
+func (n *Node) NewPeer(ctx context.Context, rwc io.ReadWriteCloser) (*Peer, error) {
+	return UpgradeConn(ctx, n.privkey, n.privsign, rwc)
 }
 
 func UpgradeConn(
 	ctx context.Context,
 	key *ecdh.PrivateKey,
-	pubsign ed25519.PublicKey,
 	privsign ed25519.PrivateKey,
 	rwc io.ReadWriteCloser,
 ) (*Peer, error) {
-	h, err := handshake.With(ctx, rwc, key.PublicKey(), pubsign)
+	h, err := handshake.With(ctx, rwc, key.PublicKey(), privsign)
 	if err != nil {
 		return nil, err
 	}
+
+	var addr net.Addr
+	if c, ok := rwc.(net.Conn); ok {
+		addr = c.RemoteAddr()
+	}
+
 	rwc = middleware.Checksum(rwc)
 	rwc = middleware.SignCheck(privsign, h.PubSign, rwc)
 	rwc = middleware.Crypt(key, h.PubKey, rwc)
+	rwc = middleware.Compress(config.CompressMinLen, middleware.DefaultCompressAlgos, rwc)
 
 	sum := sha256.Sum256(h.PubKey.Bytes())
 
 	return &Peer{
 		ReadWriteCloser: rwc,
 		hash:            sum[:],
+		sign:            h.PubSign,
+		addr:            addr,
 	}, nil
 }
 
-func Listen(addr string, connTimeout time.Duration, h Handler) error {
-	key, err := ecdh.P256().GenerateKey(rand.Reader)
-	if err != nil {
-		return err
-	}
-
-	pubsign, privsign, err := ed25519.GenerateKey(rand.Reader)
-	if err != nil {
-		return err
-	}
-
+func (n *Node) Listen(addr string, connTimeout time.Duration, h Handler, filters ...Filter) error {
 	listenAddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
 		return err
@@ -90,15 +156,23 @@ func Listen(addr string, connTimeout time.Duration, h Handler) error {
 	go func() {
 		for {
 			c, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			if err != nil {
 				log.Printf("accept conn: %v", err)
 				continue
 			}
+			if !accept(c.RemoteAddr(), filters) {
+				c.Close()
+				continue
+			}
 			go func() {
 				ctx, cancel := context.WithTimeout(context.Background(), connTimeout)
 				defer cancel()
-				p, err := UpgradeConn(ctx, key, pubsign, privsign, c)
+				p, err := n.NewPeer(ctx, c)
 				if err != nil {
+					log.Printf("upgrade conn: %v", err)
 					c.Close()
 					return
 				}
@@ -113,3 +187,22 @@ func Listen(addr string, connTimeout time.Duration, h Handler) error {
 func (p *Peer) Hash() []byte {
 	return p.hash
 }
+
+// Sign is the sign key the peer proved in the handshake, its frames are
+// checked against it.
+func (p *Peer) Sign() ed25519.PublicKey {
+	return p.sign
+}
+
+func (p *Peer) RemoteAddr() net.Addr {
+	return p.addr
+}
+
+func accept(addr net.Addr, filters []Filter) bool {
+	for _, f := range filters {
+		if !f(addr) {
+			return false
+		}
+	}
+	return true
+}
@@ -6,9 +6,12 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
+	"go-chat/handshake"
+	"go-chat/middleware"
 	"go-chat/netcrypt"
 	"go-chat/pack"
 	"io"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -38,11 +41,14 @@ func Test_NewPeer(t *testing.T) {
 	go func() {
 		payload := append(ppubsign, pprivkey.PublicKey().Bytes()...)
 		w.Write(payload)
+		signed := append([]byte("go-chat handshake"), pprivkey.PublicKey().Bytes()...)
+		signed = append(signed, n.privkey.PublicKey().Bytes()...)
+		w.Write(ed25519.Sign(pprivsign, signed))
 	}()
 
 	go func() {
-		b := make([]byte, 200)
-		r.Read(b)
+		b := make([]byte, ed25519.PublicKeySize+len(n.privkey.PublicKey().Bytes())+ed25519.SignatureSize)
+		io.ReadFull(r, b)
 	}()
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*1)
@@ -72,7 +78,8 @@ func Test_NewPeer(t *testing.T) {
 			assert.True(t, ed25519.Verify(n.pubsign, payload, sign))
 			decrypted, err := netcrypt.Decrypt(payload, pprivkey, n.privkey.PublicKey())
 			assert.NoError(t, err)
-			assert.Equal(t, source, decrypted)
+			assert.Equal(t, byte(middleware.CompressNone), decrypted[0])
+			assert.Equal(t, source, decrypted[2:])
 
 		}()
 		p.Write(source)
@@ -82,7 +89,7 @@ func Test_NewPeer(t *testing.T) {
 	t.Run("Read from peer", func(t *testing.T) {
 		source := make([]byte, 12)
 		rand.Read(source)
-		expected := source
+		expected := append([]byte{byte(middleware.CompressNone), 0}, source...)
 		expected, _ = netcrypt.Encrypt(expected, pprivkey, n.privkey.PublicKey())
 		expected = append(ed25519.Sign(pprivsign, expected), expected...)
 		sum := sha256.Sum256(expected)
@@ -128,6 +135,48 @@ func Test_Connection(t *testing.T) {
 	assert.Equal(t, fromServ, buf[:n])
 }
 
+func Test_AttachTo(t *testing.T) {
+	_, privsign, _ := ed25519.GenerateKey(rand.Reader)
+	key, _ := ecdh.P256().GenerateKey(rand.Reader)
+	serv := NewNodeWith(key, privsign)
+	att := NewNode()
+
+	addr := "127.0.0.1:9783"
+	serv.Listen(addr, time.Second*3, func(p *Peer) {})
+
+	t.Run("expected identity", func(t *testing.T) {
+		p, err := att.AttachTo(t.Context(), addr, serv.PubSign())
+		assert.NoError(t, err)
+		assert.Equal(t, serv.PubSign(), p.Sign())
+	})
+
+	t.Run("other identity", func(t *testing.T) {
+		other, _, _ := ed25519.GenerateKey(rand.Reader)
+		_, err := att.AttachTo(t.Context(), addr, other)
+		assert.ErrorIs(t, err, ErrUnexpectedPeer)
+	})
+
+	t.Run("claimed identity", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer l.Close()
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			// Knowing the sign key isn't enough without its private key.
+			c.Write(append(serv.PubSign(), key.PublicKey().Bytes()...))
+			c.Write(make([]byte, ed25519.SignatureSize))
+			io.Copy(io.Discard, c)
+		}()
+
+		_, err = att.AttachTo(t.Context(), l.Addr().String(), serv.PubSign())
+		assert.ErrorIs(t, err, handshake.ErrUnproven)
+	})
+}
+
 func (r *rwcadapter) Close() error {
 	return nil
 }
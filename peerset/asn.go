@@ -0,0 +1,68 @@
+package peerset
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type asnRange struct {
+	prefix netip.Prefix
+	asn    uint32
+}
+
+// ASNTable maps address prefixes to autonomous systems. It is loaded from a
+// local file with one "<cidr> <asn>" pair per line.
+type ASNTable struct {
+	ranges []asnRange
+}
+
+func LoadASN(r io.Reader) (*ASNTable, error) {
+	t := &ASNTable{}
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected cidr and asn", line)
+		}
+		prefix, err := netip.ParsePrefix(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(fields[1]), "AS"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		t.ranges = append(t.ranges, asnRange{prefix: prefix.Masked(), asn: uint32(asn)})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(t.ranges, func(i, j int) bool {
+		return t.ranges[i].prefix.Bits() > t.ranges[j].prefix.Bits()
+	})
+	return t, nil
+}
+
+// Lookup returns the ASN of the longest matching prefix.
+func (t *ASNTable) Lookup(addr netip.Addr) (uint32, bool) {
+	if t == nil {
+		return 0, false
+	}
+	addr = addr.Unmap()
+	for _, r := range t.ranges {
+		if r.prefix.Contains(addr) {
+			return r.asn, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,275 @@
+package peerset
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFull       = errors.New("no peer to evict")
+	ErrSubnetFull = errors.New("too many peers from subnet")
+	ErrASNFull    = errors.New("too many peers from asn")
+	ErrPrefixFull = errors.New("too many peers with identity prefix")
+	ErrKnown      = errors.New("peer already connected")
+)
+
+type Limits struct {
+	MaxPeers     int
+	PerSubnet    int
+	PerASN       int
+	PerPrefix    int
+	PrefixBits   int
+	ProtectRTT   int
+	ProtectAge   int
+	ProtectGroup int
+}
+
+type peer struct {
+	hash   string
+	subnet string
+	asn    string
+	prefix string
+	since  time.Time
+}
+
+// Manager admits peers while keeping the set diverse, so a single host or
+// network can't occupy every slot with freshly generated identities. The
+// identity prefix is taken from a hash keyed by a secret of the manager, an
+// attacker can't grind identities into the bucket of a chosen peer.
+type Manager struct {
+	mu     sync.Mutex
+	limits Limits
+	asn    *ASNTable
+	rtt    func(hash []byte) (time.Duration, bool)
+	key    []byte
+	peers  map[string]*peer
+	now    func() time.Time
+}
+
+// New creates a manager. rtt reports the measured round trip time of a
+// connected peer and may be nil.
+func New(limits Limits, asn *ASNTable, rtt func([]byte) (time.Duration, bool)) *Manager {
+	return &Manager{
+		limits: limits,
+		asn:    asn,
+		rtt:    rtt,
+		key:    []byte(rand.Text()),
+		peers:  map[string]*peer{},
+		now:    time.Now,
+	}
+}
+
+// Admit registers the peer. When the set is full it returns the hash of the
+// peer which has to be disconnected to make room.
+func (m *Manager) Admit(hash []byte, addr net.Addr) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.peers[string(hash)]; ok {
+		return nil, ErrKnown
+	}
+
+	p := &peer{
+		hash:   string(hash),
+		prefix: m.identityPrefix(hash),
+		since:  m.now(),
+	}
+	if ip, ok := addrOf(addr); ok {
+		p.subnet = subnet(ip)
+		if asn, ok := m.asn.Lookup(ip); ok {
+			p.asn = fmt.Sprintf("AS%d", asn)
+		}
+	}
+
+	if err := m.check(p); err != nil {
+		return nil, err
+	}
+
+	var evicted []byte
+	if m.limits.MaxPeers > 0 && len(m.peers) >= m.limits.MaxPeers {
+		victim, ok := m.victim()
+		if !ok {
+			return nil, ErrFull
+		}
+		delete(m.peers, victim)
+		evicted = []byte(victim)
+	}
+
+	m.peers[p.hash] = p
+	return evicted, nil
+}
+
+func (m *Manager) Remove(hash []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.peers, string(hash))
+}
+
+func (m *Manager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.peers)
+}
+
+func (m *Manager) HasFree() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.limits.MaxPeers <= 0 || len(m.peers) < m.limits.MaxPeers
+}
+
+func (m *Manager) check(p *peer) error {
+	var subnets, asns, prefixes int
+	for _, o := range m.peers {
+		if p.subnet != "" && o.subnet == p.subnet {
+			subnets++
+		}
+		if p.asn != "" && o.asn == p.asn {
+			asns++
+		}
+		if o.prefix == p.prefix {
+			prefixes++
+		}
+	}
+	switch {
+	case m.limits.PerSubnet > 0 && subnets >= m.limits.PerSubnet:
+		return ErrSubnetFull
+	case m.limits.PerASN > 0 && asns >= m.limits.PerASN:
+		return ErrASNFull
+	case m.limits.PrefixBits > 0 && m.limits.PerPrefix > 0 && prefixes >= m.limits.PerPrefix:
+		return ErrPrefixFull
+	}
+	return nil
+}
+
+// victim follows the eviction logic of bitcoin: protect the fastest and the
+// oldest peers and the sole members of their network groups, then evict the
+// youngest peer of the most populated group.
+func (m *Manager) victim() (string, bool) {
+	candidates := make([]*peer, 0, len(m.peers))
+	for _, p := range m.peers {
+		candidates = append(candidates, p)
+	}
+
+	rtt := func(p *peer) time.Duration {
+		if m.rtt == nil {
+			return time.Duration(1<<63 - 1)
+		}
+		d, ok := m.rtt([]byte(p.hash))
+		if !ok {
+			return time.Duration(1<<63 - 1)
+		}
+		return d
+	}
+	candidates = protect(candidates, m.limits.ProtectRTT, func(a, b *peer) bool {
+		return rtt(a) < rtt(b)
+	})
+	candidates = protect(candidates, m.limits.ProtectAge, func(a, b *peer) bool {
+		return a.since.Before(b.since)
+	})
+
+	groups := map[string][]*peer{}
+	for _, p := range m.peers {
+		groups[group(p)] = append(groups[group(p)], p)
+	}
+	candidates = protect(candidates, m.limits.ProtectGroup, func(a, b *peer) bool {
+		la, lb := len(groups[group(a)]), len(groups[group(b)])
+		if la != lb {
+			return la < lb
+		}
+		return a.hash < b.hash
+	})
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	byGroup := map[string][]*peer{}
+	for _, p := range candidates {
+		byGroup[group(p)] = append(byGroup[group(p)], p)
+	}
+
+	var worst []*peer
+	for _, ps := range byGroup {
+		if len(ps) > len(worst) || (len(ps) == len(worst) && youngest(ps).since.After(youngest(worst).since)) {
+			worst = ps
+		}
+	}
+	return youngest(worst).hash, true
+}
+
+func protect(ps []*peer, n int, less func(a, b *peer) bool) []*peer {
+	if n <= 0 {
+		return ps
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		return less(ps[i], ps[j])
+	})
+	if n >= len(ps) {
+		return nil
+	}
+	return ps[n:]
+}
+
+func youngest(ps []*peer) *peer {
+	var res *peer
+	for _, p := range ps {
+		if res == nil || p.since.After(res.since) || (p.since.Equal(res.since) && p.hash > res.hash) {
+			res = p
+		}
+	}
+	return res
+}
+
+func group(p *peer) string {
+	if p.asn != "" {
+		return p.asn
+	}
+	return p.subnet
+}
+
+func addrOf(addr net.Addr) (netip.Addr, bool) {
+	if addr == nil {
+		return netip.Addr{}, false
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
+
+func subnet(ip netip.Addr) string {
+	bits := 48
+	if ip.Is4() {
+		bits = 24
+	}
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.String()
+}
+
+func (m *Manager) identityPrefix(hash []byte) string {
+	bits := min(m.limits.PrefixBits, sha256.Size*8)
+	if bits <= 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write(hash)
+	out := mac.Sum(nil)[:(bits+7)/8]
+	if rem := bits % 8; rem != 0 {
+		out[len(out)-1] &= byte(0xff << (8 - rem))
+	}
+	return string(out)
+}
@@ -0,0 +1,118 @@
+package peerset
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tcp(addr string) net.Addr {
+	a, _ := net.ResolveTCPAddr("tcp", addr)
+	return a
+}
+
+func Test_Manager(t *testing.T) {
+	t.Run("subnet limit", func(t *testing.T) {
+		m := New(Limits{MaxPeers: 10, PerSubnet: 2}, nil, nil)
+		_, err := m.Admit([]byte{1}, tcp("10.0.0.1:1"))
+		assert.NoError(t, err)
+		_, err = m.Admit([]byte{2}, tcp("10.0.0.2:1"))
+		assert.NoError(t, err)
+		_, err = m.Admit([]byte{3}, tcp("10.0.0.3:1"))
+		assert.ErrorIs(t, err, ErrSubnetFull)
+		_, err = m.Admit([]byte{3}, tcp("10.0.1.3:1"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("ipv6 subnet", func(t *testing.T) {
+		m := New(Limits{MaxPeers: 10, PerSubnet: 1}, nil, nil)
+		_, err := m.Admit([]byte{1}, tcp("[2001:db8:1::1]:1"))
+		assert.NoError(t, err)
+		_, err = m.Admit([]byte{2}, tcp("[2001:db8:1:ffff::1]:1"))
+		assert.ErrorIs(t, err, ErrSubnetFull)
+		_, err = m.Admit([]byte{2}, tcp("[2001:db8:2::1]:1"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("asn limit", func(t *testing.T) {
+		asn, err := LoadASN(strings.NewReader("# test\n10.0.0.0/8 AS64500\n10.1.0.0/16 64501\n"))
+		assert.NoError(t, err)
+		m := New(Limits{MaxPeers: 10, PerASN: 1}, asn, nil)
+		_, err = m.Admit([]byte{1}, tcp("10.0.0.1:1"))
+		assert.NoError(t, err)
+		_, err = m.Admit([]byte{2}, tcp("10.1.0.1:1"))
+		assert.NoError(t, err)
+		_, err = m.Admit([]byte{3}, tcp("10.2.0.1:1"))
+		assert.ErrorIs(t, err, ErrASNFull)
+	})
+
+	t.Run("identity prefix limit", func(t *testing.T) {
+		m := New(Limits{MaxPeers: 100, PerPrefix: 1, PrefixBits: 4}, nil, nil)
+		full := 0
+		// 17 identities in 16 buckets, one at least shares a bucket.
+		for i := range 17 {
+			if _, err := m.Admit([]byte{byte(i)}, nil); errors.Is(err, ErrPrefixFull) {
+				full++
+			}
+		}
+		assert.Positive(t, full)
+		assert.Equal(t, 17-full, m.Len())
+	})
+
+	t.Run("identity prefix keyed", func(t *testing.T) {
+		a := New(Limits{PrefixBits: 8}, nil, nil)
+		b := New(Limits{PrefixBits: 8}, nil, nil)
+		differ := false
+		for i := range 16 {
+			differ = differ || a.identityPrefix([]byte{byte(i)}) != b.identityPrefix([]byte{byte(i)})
+		}
+		assert.True(t, differ)
+	})
+
+	t.Run("evict from largest group", func(t *testing.T) {
+		now := time.Now()
+		m := New(Limits{MaxPeers: 4, ProtectAge: 1}, nil, nil)
+		m.now = func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		}
+		m.Admit([]byte{1}, tcp("10.0.0.1:1"))
+		m.Admit([]byte{2}, tcp("10.0.0.2:1"))
+		m.Admit([]byte{3}, tcp("10.0.0.3:1"))
+		m.Admit([]byte{4}, tcp("10.0.1.1:1"))
+
+		evicted, err := m.Admit([]byte{5}, tcp("10.0.2.1:1"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{3}, evicted)
+		assert.Equal(t, 4, m.Len())
+	})
+
+	t.Run("protect fastest", func(t *testing.T) {
+		rtts := map[string]time.Duration{
+			string([]byte{1}): time.Millisecond,
+			string([]byte{2}): time.Second,
+		}
+		rtt := func(h []byte) (time.Duration, bool) {
+			d, ok := rtts[string(h)]
+			return d, ok
+		}
+		m := New(Limits{MaxPeers: 2, ProtectRTT: 1}, nil, rtt)
+		m.Admit([]byte{1}, tcp("10.0.0.1:1"))
+		m.Admit([]byte{2}, tcp("10.0.0.2:1"))
+
+		evicted, err := m.Admit([]byte{3}, tcp("10.0.1.1:1"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{2}, evicted)
+	})
+
+	t.Run("everyone protected", func(t *testing.T) {
+		m := New(Limits{MaxPeers: 1, ProtectAge: 1}, nil, nil)
+		m.Admit([]byte{1}, nil)
+		_, err := m.Admit([]byte{2}, nil)
+		assert.ErrorIs(t, err, ErrFull)
+	})
+}
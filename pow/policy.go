@@ -0,0 +1,125 @@
+package pow
+
+import (
+	"errors"
+	"go-chat/model"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrWeakStamp is a stamp below the base difficulty, which no honest
+	// sender mints.
+	ErrWeakStamp = errors.New("stamp below base difficulty")
+	// ErrBusy is a stamp good for the base difficulty but not for the one
+	// raised under load. Senders learn of a raise with the next pong, so it
+	// is no offence.
+	ErrBusy = errors.New("stamp below current difficulty")
+)
+
+// Policy holds the difficulty required per SignalType. Types with a non zero
+// base difficulty get harder while the inbound rate of such signals stays
+// above the high watermark and relax back once it drops below the low one.
+type Policy struct {
+	mu       sync.Mutex
+	base     map[model.SignalType]int
+	extra    int
+	maxExtra int
+	high     int
+	low      int
+	window   time.Duration
+	start    time.Time
+	count    int
+	now      func() time.Time
+}
+
+func NewPolicy(base map[model.SignalType]int, maxExtra, high, low int, window time.Duration) *Policy {
+	return &Policy{
+		base:     base,
+		maxExtra: maxExtra,
+		high:     high,
+		low:      low,
+		window:   window,
+		start:    time.Now(),
+		now:      time.Now,
+	}
+}
+
+func (p *Policy) Difficulty(t model.SignalType) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	base := p.base[t]
+	if base == 0 {
+		return 0
+	}
+	return base + p.extra
+}
+
+// Base returns the difficulty senders should mint with.
+func (p *Policy) Base(t model.SignalType) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.base[t]
+}
+
+// Extra is how far the difficulty is raised under load. Peers are told, so
+// their stamps keep passing.
+func (p *Policy) Extra() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.extra
+}
+
+// Raised returns the difficulty to mint signals of type t with for peers
+// that raised theirs by extra. A peer can't ask for more than this policy
+// ever raises.
+func (p *Policy) Raised(t model.SignalType, extra int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	base := p.base[t]
+	if base == 0 {
+		return 0
+	}
+	return base + min(max(extra, 0), p.maxExtra)
+}
+
+// Admit checks the signal against the current difficulty and accounts it
+// for load tracking.
+func (p *Policy) Admit(s model.Signal) error {
+	p.mu.Lock()
+	base := p.base[s.Type()]
+	if base == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	p.observe()
+	difficulty := base + p.extra
+	p.mu.Unlock()
+
+	switch work := Work(s); {
+	case work < base:
+		return ErrWeakStamp
+	case work < difficulty:
+		return ErrBusy
+	}
+	return nil
+}
+
+func (p *Policy) observe() {
+	now := p.now()
+	if now.Sub(p.start) >= p.window {
+		switch {
+		case p.count > p.high && p.extra < p.maxExtra:
+			p.extra++
+		case p.count < p.low && p.extra > 0:
+			p.extra--
+		}
+		p.start = now
+		p.count = 0
+	}
+	p.count++
+}
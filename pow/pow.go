@@ -0,0 +1,55 @@
+package pow
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"go-chat/model"
+	"math/bits"
+)
+
+// Work returns the number of leading zero bits of the signal digest. The
+// payload is hashed once so that minting cost doesn't depend on its size.
+func Work(s model.Signal) int {
+	return work(prefix(s), s.Stamp())
+}
+
+func Verify(s model.Signal, difficulty int) bool {
+	if difficulty <= 0 {
+		return true
+	}
+	return Work(s) >= difficulty
+}
+
+func Mint(s model.Signal, difficulty int) {
+	if difficulty <= 0 {
+		return
+	}
+	p := prefix(s)
+	for stamp := uint64(0); ; stamp++ {
+		if work(p, stamp) >= difficulty {
+			s.SetStamp(stamp)
+			return
+		}
+	}
+}
+
+func prefix(s model.Signal) []byte {
+	sum := sha256.Sum256(s.Payload())
+	out := make([]byte, 0, model.StampStart+sha256.Size+model.StampLen)
+	out = append(out, s[:model.StampStart]...)
+	out = append(out, sum[:]...)
+	return out
+}
+
+func work(prefix []byte, stamp uint64) int {
+	sum := sha256.Sum256(binary.LittleEndian.AppendUint64(prefix, stamp))
+	zeros := 0
+	for i := 0; i < len(sum); i += 8 {
+		n := bits.LeadingZeros64(binary.BigEndian.Uint64(sum[i:]))
+		zeros += n
+		if n < 64 {
+			break
+		}
+	}
+	return zeros
+}
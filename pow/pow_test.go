@@ -0,0 +1,88 @@
+package pow
+
+import (
+	"go-chat/model"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Mint(t *testing.T) {
+	s, _ := model.NewSignal(model.SignalTypeOffer, model.GenerateKey(), []byte("offer"))
+
+	t.Run("mint and verify", func(t *testing.T) {
+		Mint(s, 10)
+		assert.GreaterOrEqual(t, Work(s), 10)
+		assert.True(t, Verify(s, 10))
+	})
+
+	t.Run("tampered payload", func(t *testing.T) {
+		tampered := append(model.Signal(nil), s...)
+		tampered.Payload()[0] ^= 0xff
+		assert.Equal(t, Work(tampered) >= 10, Verify(tampered, 10))
+		assert.NotEqual(t, Work(s), Work(tampered))
+	})
+
+	t.Run("zero difficulty", func(t *testing.T) {
+		other, _ := model.NewSignal(model.SignalTypeOffer, model.GenerateKey(), nil)
+		Mint(other, 0)
+		assert.Equal(t, uint64(0), other.Stamp())
+		assert.True(t, Verify(other, 0))
+	})
+}
+
+func Test_Policy(t *testing.T) {
+	now := time.Now()
+	p := NewPolicy(map[model.SignalType]int{model.SignalTypeOffer: 4}, 2, 3, 3, time.Second)
+	p.start = now
+	p.now = func() time.Time { return now }
+
+	offer := func() model.Signal {
+		s, _ := model.NewSignal(model.SignalTypeOffer, model.GenerateKey(), nil)
+		Mint(s, 4)
+		return s
+	}
+
+	stamped := func(work int) model.Signal {
+		s, _ := model.NewSignal(model.SignalTypeOffer, model.GenerateKey(), nil)
+		for Work(s) != work {
+			s.SetStamp(s.Stamp() + 1)
+		}
+		return s
+	}
+
+	t.Run("ungated type", func(t *testing.T) {
+		s, _ := model.NewSignal(model.SignalTypeAnswer, model.GenerateKey(), nil)
+		assert.NoError(t, p.Admit(s))
+		assert.Equal(t, 0, p.Difficulty(model.SignalTypeAnswer))
+	})
+
+	t.Run("tighten under load", func(t *testing.T) {
+		for range 5 {
+			p.Admit(offer())
+		}
+		now = now.Add(time.Second)
+		p.Admit(offer())
+		assert.Equal(t, 5, p.Difficulty(model.SignalTypeOffer))
+		assert.Equal(t, 4, p.Base(model.SignalTypeOffer))
+	})
+
+	t.Run("mint for raised peers", func(t *testing.T) {
+		assert.Equal(t, 1, p.Extra())
+		assert.Equal(t, 5, p.Raised(model.SignalTypeOffer, p.Extra()))
+		assert.Equal(t, 6, p.Raised(model.SignalTypeOffer, 100))
+		assert.Equal(t, 0, p.Raised(model.SignalTypeAnswer, 1))
+	})
+
+	t.Run("reject weak stamp", func(t *testing.T) {
+		assert.ErrorIs(t, p.Admit(stamped(4)), ErrBusy)
+	})
+
+	t.Run("relax", func(t *testing.T) {
+		now = now.Add(time.Second)
+		p.Admit(offer())
+		assert.Equal(t, 4, p.Difficulty(model.SignalTypeOffer))
+		assert.ErrorIs(t, p.Admit(stamped(2)), ErrWeakStamp)
+	})
+}
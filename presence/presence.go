@@ -0,0 +1,273 @@
+package presence
+
+import (
+	"crypto/ed25519"
+	"go-chat/ratelimit"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Limits struct {
+	// Timeout turns a contact offline when no update came for that long.
+	Timeout time.Duration
+	// AwayAfter turns the own state away after no activity for that long.
+	AwayAfter time.Duration
+	// TypingTimeout ends a typing indicator that was not refreshed.
+	TypingTimeout time.Duration
+	// Skew bounds how old or early an update may be.
+	Skew time.Duration
+	// Rate and Burst limit the updates sent, and those taken from each
+	// sender.
+	Rate  float64
+	Burst int
+}
+
+// Sender makes the own signed updates.
+type Sender struct {
+	mu     sync.Mutex
+	priv   ed25519.PrivateKey
+	limits Limits
+	bucket *ratelimit.Bucket
+	seen   time.Time
+	now    func() time.Time
+}
+
+func NewSender(priv ed25519.PrivateKey, limits Limits) *Sender {
+	return &Sender{
+		priv:   priv,
+		limits: limits,
+		bucket: ratelimit.NewBucket(limits.Rate, limits.Burst),
+		seen:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// Touch records activity of the user.
+func (s *Sender) Touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seen = s.now()
+}
+
+// Presence returns the current state, online or away after a while
+// without activity. It reports false when over the rate.
+func (s *Sender) Presence() (Update, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := Online
+	if s.now().Sub(s.seen) >= s.limits.AwayAfter {
+		state = Away
+	}
+	return s.update(Update{State: state}, false)
+}
+
+// Offline says goodbye, it is never rate limited.
+func (s *Sender) Offline() (Update, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, _, err := s.update(Update{State: Offline}, true)
+	return u, err
+}
+
+// Typing starts or stops the indicator in conv. Typing is activity.
+func (s *Sender) Typing(conv string, typing bool) (Update, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seen = s.now()
+	return s.update(Update{State: Online, Conv: conv, Typing: typing}, !typing)
+}
+
+func (s *Sender) update(u Update, force bool) (Update, bool, error) {
+	if !s.bucket.Allow() && !force {
+		return Update{}, false, nil
+	}
+	u.Seen, u.Time = s.seen, s.now()
+	u, err := sign(s.priv, u)
+	return u, err == nil, err
+}
+
+// Status is what a node knows of a contact.
+type Status struct {
+	State State
+	Seen  time.Time
+	// Typing lists the rooms the contact types in, "" is the direct chat.
+	Typing []string
+}
+
+type entry struct {
+	state   State
+	seen    time.Time
+	last    time.Time
+	updated time.Time
+	typing  map[string]time.Time
+	bucket  *ratelimit.Bucket
+}
+
+// View is the presence of the contacts, by contact key. Nothing of it is
+// stored, it starts offline.
+type View struct {
+	mu      sync.Mutex
+	limits  Limits
+	entries map[string]*entry
+	now     func() time.Time
+}
+
+func NewView(limits Limits) *View {
+	return &View{limits: limits, entries: map[string]*entry{}, now: time.Now}
+}
+
+// ApplyPresence takes a presence update of the contact. It reports false
+// for updates that are stale, replayed or over the rate of the contact.
+func (v *View) ApplyPresence(key string, u Update) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	e, ok := v.admit(key, u)
+	if !ok {
+		return false
+	}
+	e.state = u.State
+	if u.State == Offline {
+		clear(e.typing)
+	}
+	return true
+}
+
+// ApplyTyping takes a typing indicator of the contact, see ApplyPresence.
+func (v *View) ApplyTyping(key string, u Update) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	e, ok := v.admit(key, u)
+	if !ok {
+		return false
+	}
+	e.state = Online
+	if u.Typing {
+		e.typing[u.Conv] = e.updated
+	} else {
+		delete(e.typing, u.Conv)
+	}
+	return true
+}
+
+func (v *View) admit(key string, u Update) (*entry, bool) {
+	now := v.now()
+	if u.Time.Before(now.Add(-v.limits.Skew)) || u.Time.After(now.Add(v.limits.Skew)) {
+		return nil, false
+	}
+	e, ok := v.entries[key]
+	if !ok {
+		e = &entry{typing: map[string]time.Time{}, bucket: ratelimit.NewBucket(v.limits.Rate, v.limits.Burst)}
+		v.entries[key] = e
+	}
+	if !u.Time.After(e.last) || !e.bucket.Allow() {
+		return nil, false
+	}
+	e.last, e.updated = u.Time, now
+	if u.Seen.After(e.seen) && !u.Seen.After(u.Time) {
+		e.seen = u.Seen
+	}
+	return e, true
+}
+
+// Get returns the status of the contact.
+func (v *View) Get(key string) Status {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	e, ok := v.entries[key]
+	if !ok {
+		return Status{}
+	}
+	now := v.now()
+	st := Status{State: e.state, Seen: e.seen}
+	if now.Sub(e.updated) >= v.limits.Timeout {
+		st.State = Offline
+	}
+	if st.State == Offline {
+		return st
+	}
+	for conv, at := range e.typing {
+		if now.Sub(at) < v.limits.TypingTimeout {
+			st.Typing = append(st.Typing, conv)
+		}
+	}
+	sort.Strings(st.Typing)
+	return st
+}
+
+// TypingIn returns the contacts typing in conv.
+func (v *View) TypingIn(conv string) []string {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.entries))
+	for k := range v.entries {
+		keys = append(keys, k)
+	}
+	v.mu.Unlock()
+
+	var out []string
+	for _, k := range keys {
+		for _, c := range v.Get(k).Typing {
+			if c == conv {
+				out = append(out, k)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Links are the connected peers by hash, with the sign key each gave in
+// the handshake. Presence goes only to the ones that are contacts.
+type Links struct {
+	mu    sync.Mutex
+	signs map[string]ed25519.PublicKey
+}
+
+func NewLinks() *Links {
+	return &Links{signs: map[string]ed25519.PublicKey{}}
+}
+
+func (l *Links) Add(hash []byte, sign ed25519.PublicKey) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.signs[string(hash)] = sign
+}
+
+func (l *Links) Remove(hash []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.signs, string(hash))
+}
+
+// Sign is the sign key the peer with hash gave in the handshake.
+func (l *Links) Sign(hash []byte) (ed25519.PublicKey, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sign, ok := l.signs[string(hash)]
+	return sign, ok
+}
+
+// To returns the hashes of the peers whose sign key passes the filter.
+func (l *Links) To(filter func(ed25519.PublicKey) bool) [][]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var out [][]byte
+	for hash, sign := range l.signs {
+		if filter(sign) {
+			out = append(out, []byte(hash))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return string(out[i]) < string(out[j]) })
+	return out
+}
@@ -0,0 +1,124 @@
+package presence
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var limits = Limits{
+	Timeout:       time.Minute,
+	AwayAfter:     5 * time.Minute,
+	TypingTimeout: 5 * time.Second,
+	Skew:          time.Minute,
+	Rate:          1,
+	Burst:         3,
+}
+
+func sender(t *testing.T, now *time.Time) *Sender {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	s := NewSender(priv, limits)
+	s.now = func() time.Time { return *now }
+	s.seen = *now
+	return s
+}
+
+func roundTrip(t *testing.T, u Update) Update {
+	b, err := u.Marshal()
+	require.NoError(t, err)
+	parsed, err := ParseUpdate(b)
+	require.NoError(t, err)
+	return parsed
+}
+
+func Test_Presence(t *testing.T) {
+	t.Run("signed updates", func(t *testing.T) {
+		now := time.Now()
+		u, ok, err := sender(t, &now).Presence()
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, Online, roundTrip(t, u).State)
+
+		u.State = Away
+		b, _ := u.Marshal()
+		_, err = ParseUpdate(b)
+		assert.ErrorIs(t, err, ErrInvalidUpdate)
+	})
+
+	t.Run("away, rate and offline", func(t *testing.T) {
+		now := time.Now()
+		s := sender(t, &now)
+		now = now.Add(limits.AwayAfter)
+		u, ok, _ := s.Presence()
+		require.True(t, ok)
+		assert.Equal(t, Away, u.State)
+
+		for range limits.Burst - 1 {
+			_, ok, _ = s.Presence()
+			assert.True(t, ok)
+		}
+		_, ok, _ = s.Presence()
+		assert.False(t, ok)
+
+		u, err := s.Offline()
+		require.NoError(t, err)
+		assert.Equal(t, Offline, u.State)
+	})
+
+	t.Run("view", func(t *testing.T) {
+		now := time.Now()
+		s, v := sender(t, &now), NewView(limits)
+		v.now = func() time.Time { return now }
+		assert.Equal(t, Offline, v.Get("alice").State)
+
+		u, _, _ := s.Presence()
+		assert.True(t, v.ApplyPresence("alice", roundTrip(t, u)))
+		assert.False(t, v.ApplyPresence("alice", roundTrip(t, u)), "replayed")
+		assert.Equal(t, Online, v.Get("alice").State)
+
+		now = now.Add(time.Second)
+		u, _, _ = s.Typing("", true)
+		assert.True(t, v.ApplyTyping("alice", roundTrip(t, u)))
+		assert.Equal(t, []string{""}, v.Get("alice").Typing)
+		assert.Equal(t, []string{"alice"}, v.TypingIn(""))
+
+		// A heartbeat leaves the indicator, which ends on its own.
+		now = now.Add(time.Second)
+		u, _, _ = s.Presence()
+		assert.True(t, v.ApplyPresence("alice", roundTrip(t, u)))
+		assert.Equal(t, []string{""}, v.Get("alice").Typing)
+		now = now.Add(limits.TypingTimeout)
+		assert.Empty(t, v.Get("alice").Typing)
+
+		seen := v.Get("alice").Seen
+		now = now.Add(limits.Timeout)
+		st := v.Get("alice")
+		assert.Equal(t, Offline, st.State)
+		assert.Equal(t, seen, st.Seen)
+	})
+
+	t.Run("stale updates", func(t *testing.T) {
+		now := time.Now()
+		s, v := sender(t, &now), NewView(limits)
+		u, _, _ := s.Presence()
+		v.now = func() time.Time { return now.Add(2 * limits.Skew) }
+		assert.False(t, v.ApplyPresence("alice", roundTrip(t, u)))
+	})
+
+	t.Run("links", func(t *testing.T) {
+		l := NewLinks()
+		a, _, _ := ed25519.GenerateKey(rand.Reader)
+		b, _, _ := ed25519.GenerateKey(rand.Reader)
+		l.Add([]byte("a"), a)
+		l.Add([]byte("b"), b)
+		contact := func(sign ed25519.PublicKey) bool { return sign.Equal(a) }
+		assert.Equal(t, [][]byte{[]byte("a")}, l.To(contact))
+		l.Remove([]byte("a"))
+		assert.Empty(t, l.To(contact))
+	})
+}
@@ -0,0 +1,77 @@
+package presence
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var ErrInvalidUpdate = errors.New("invalid presence update")
+
+type State uint8
+
+const (
+	Offline State = iota
+	Online
+	Away
+)
+
+func (s State) String() string {
+	switch s {
+	case Online:
+		return "online"
+	case Away:
+		return "away"
+	default:
+		return "offline"
+	}
+}
+
+// Update is the payload of Presence and Typing signals. It is signed with
+// the identity key of the sender, the receiver only takes it from a
+// contact or a member of the room typed in.
+type Update struct {
+	Sign  ed25519.PublicKey `json:"sign"`
+	State State             `json:"state"`
+	// Seen is the last activity of the sender.
+	Seen time.Time `json:"seen"`
+	// Conv is the room typed in, empty for a direct chat with the receiver.
+	Conv   string    `json:"conv,omitempty"`
+	Typing bool      `json:"typing,omitempty"`
+	Time   time.Time `json:"time"`
+	Sig    []byte    `json:"sig,omitempty"`
+}
+
+func (u Update) signed() ([]byte, error) {
+	u.Sig = nil
+	return json.Marshal(u)
+}
+
+func (u Update) Marshal() ([]byte, error) {
+	return json.Marshal(u)
+}
+
+func ParseUpdate(b []byte) (Update, error) {
+	var u Update
+	if err := json.Unmarshal(b, &u); err != nil || len(u.Sign) != ed25519.PublicKeySize || u.State > Away {
+		return Update{}, ErrInvalidUpdate
+	}
+	data, err := u.signed()
+	if err != nil || !ed25519.Verify(u.Sign, data, u.Sig) {
+		return Update{}, ErrInvalidUpdate
+	}
+	return u, nil
+}
+
+func sign(priv ed25519.PrivateKey, u Update) (Update, error) {
+	u.Sign = priv.Public().(ed25519.PublicKey)
+	// Signed as they read back on the other side, in UTC.
+	u.Seen, u.Time = u.Seen.UTC(), u.Time.UTC()
+	data, err := u.signed()
+	if err != nil {
+		return Update{}, err
+	}
+	u.Sig = ed25519.Sign(priv, data)
+	return u, nil
+}
@@ -0,0 +1,34 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Bucket(t *testing.T) {
+	now := time.Now()
+	b := NewBucket(10, 5)
+	b.last = now
+	b.now = func() time.Time { return now }
+
+	t.Run("burst", func(t *testing.T) {
+		for range 5 {
+			assert.True(t, b.Allow())
+		}
+		assert.False(t, b.Allow())
+	})
+
+	t.Run("refill", func(t *testing.T) {
+		now = now.Add(100 * time.Millisecond)
+		assert.True(t, b.Allow())
+		assert.False(t, b.Allow())
+	})
+
+	t.Run("cap by burst", func(t *testing.T) {
+		now = now.Add(time.Hour)
+		assert.True(t, b.AllowN(5))
+		assert.False(t, b.Allow())
+	})
+}
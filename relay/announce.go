@@ -0,0 +1,154 @@
+package relay
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	wrtc "go-chat/webrtc"
+)
+
+var (
+	ErrInvalidAnnounce = errors.New("invalid relay announce")
+	ErrExpired         = errors.New("relay announce expired")
+	ErrUntrusted       = errors.New("relay announce of an untrusted node")
+)
+
+// Announce offers a relay to a single peer, with credentials issued to it.
+// The payload of a RelayAnnounce signal is sig(64) | pubsign(32) | json.
+type Announce struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username"`
+	Credential string   `json:"credential"`
+	Expires    int64    `json:"expires"`
+}
+
+func (s *Server) Announce(user string, ttl time.Duration) (Announce, error) {
+	username, credential, err := s.Credentials(user, ttl)
+	if err != nil {
+		return Announce{}, err
+	}
+	return Announce{
+		URLs:       []string{s.url},
+		Username:   username,
+		Credential: credential,
+		Expires:    time.Now().Add(ttl).Unix(),
+	}, nil
+}
+
+func (a Announce) Marshal(privsign ed25519.PrivateKey) ([]byte, error) {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	pubsign := privsign.Public().(ed25519.PublicKey)
+	payload := make([]byte, ed25519.SignatureSize, ed25519.SignatureSize+len(pubsign)+len(body))
+	payload = append(payload, pubsign...)
+	payload = append(payload, body...)
+	copy(payload, ed25519.Sign(privsign, payload[ed25519.SignatureSize:]))
+	return payload, nil
+}
+
+func ParseAnnounce(payload []byte) (Announce, ed25519.PublicKey, error) {
+	if len(payload) < ed25519.SignatureSize+ed25519.PublicKeySize {
+		return Announce{}, nil, ErrInvalidAnnounce
+	}
+	sig, signed := payload[:ed25519.SignatureSize], payload[ed25519.SignatureSize:]
+	pubsign := ed25519.PublicKey(signed[:ed25519.PublicKeySize])
+	if !ed25519.Verify(pubsign, signed, sig) {
+		return Announce{}, nil, ErrInvalidAnnounce
+	}
+
+	var a Announce
+	if err := json.Unmarshal(signed[ed25519.PublicKeySize:], &a); err != nil || len(a.URLs) == 0 {
+		return Announce{}, nil, ErrInvalidAnnounce
+	}
+	return a, pubsign, nil
+}
+
+// Directory keeps the latest announce of every relay offered by a trusted
+// node, e.g. a contact. Anyone else could route the sessions through its
+// own relay.
+type Directory struct {
+	mu      sync.Mutex
+	max     int
+	trusted func(ed25519.PublicKey) bool
+	relays  map[string]Announce
+	now     func() time.Time
+}
+
+func NewDirectory(max int, trusted func(ed25519.PublicKey) bool) *Directory {
+	return &Directory{
+		max:     max,
+		trusted: trusted,
+		relays:  map[string]Announce{},
+		now:     time.Now,
+	}
+}
+
+// Add stores the announce and reports whether it is new.
+func (d *Directory) Add(payload []byte) (bool, error) {
+	a, pubsign, err := ParseAnnounce(payload)
+	if err != nil {
+		return false, err
+	}
+	if !d.trusted(pubsign) {
+		return false, ErrUntrusted
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	if a.Expires <= now.Unix() {
+		return false, ErrExpired
+	}
+	d.expire(now)
+
+	key := string(pubsign)
+	if old, ok := d.relays[key]; ok && old.Expires >= a.Expires {
+		return false, nil
+	}
+	if _, ok := d.relays[key]; !ok && d.max > 0 && len(d.relays) >= d.max {
+		return false, nil
+	}
+	d.relays[key] = a
+	return true, nil
+}
+
+// ICEServers lists known relays, the ones valid for longer first. They come
+// after the servers the node is configured with.
+func (d *Directory) ICEServers() []wrtc.ICEServer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire(d.now())
+	relays := make([]Announce, 0, len(d.relays))
+	for _, a := range d.relays {
+		relays = append(relays, a)
+	}
+	sort.Slice(relays, func(i, j int) bool {
+		return relays[i].Expires > relays[j].Expires
+	})
+
+	out := make([]wrtc.ICEServer, 0, len(relays))
+	for _, a := range relays {
+		out = append(out, wrtc.ICEServer{
+			URLs:       a.URLs,
+			Username:   a.Username,
+			Credential: a.Credential,
+		})
+	}
+	return out
+}
+
+func (d *Directory) expire(now time.Time) {
+	for k, a := range d.relays {
+		if a.Expires <= now.Unix() {
+			delete(d.relays, k)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package relay
+
+import (
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"go-chat/ratelimit"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/turn/v4"
+)
+
+const Realm = "go-chat"
+
+var ErrNoPublicIP = errors.New("public ip required")
+
+type Config struct {
+	Addr     string
+	PublicIP net.IP
+	// MaxClients limits the number of client IPs served at the same time.
+	MaxClients int
+	// Rate and Burst limit bytes per second accepted from every client IP.
+	Rate  float64
+	Burst int
+	// Idle is the time after which a silent client frees its slot.
+	Idle time.Duration
+}
+
+type Server struct {
+	turn   *turn.Server
+	conn   net.PacketConn
+	secret string
+	url    string
+}
+
+// Secret derives the shared TURN REST secret from the node identity, so it
+// survives restarts without being stored anywhere.
+func Secret(privsign ed25519.PrivateKey) (string, error) {
+	key, err := hkdf.Key(sha256.New, privsign.Seed(), nil, "go-chat turn relay", 32)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(key), nil
+}
+
+func Start(cfg Config, secret string) (*Server, error) {
+	if cfg.PublicIP == nil {
+		return nil, ErrNoPublicIP
+	}
+	conn, err := net.ListenPacket("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	q := newQuota(cfg)
+	auth := turn.LongTermTURNRESTAuthHandler(secret, nil)
+	s, err := turn.NewServer(turn.ServerConfig{
+		Realm: Realm,
+		AuthHandler: func(username, realm string, src net.Addr) ([]byte, bool) {
+			if !q.admit(src) {
+				return nil, false
+			}
+			return auth(username, realm, src)
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn: &quotaConn{PacketConn: conn, quota: q},
+			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+				RelayAddress: cfg.PublicIP,
+				Address:      "0.0.0.0",
+			},
+		}},
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("turn server: %w", err)
+	}
+
+	_, port, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return &Server{
+		turn:   s,
+		conn:   conn,
+		secret: secret,
+		url:    "turn:" + net.JoinHostPort(cfg.PublicIP.String(), port) + "?transport=udp",
+	}, nil
+}
+
+func (s *Server) URL() string {
+	return s.url
+}
+
+// Credentials issues a time limited username and password for the relay.
+func (s *Server) Credentials(user string, ttl time.Duration) (string, string, error) {
+	return turn.GenerateLongTermTURNRESTCredentials(s.secret, user, ttl)
+}
+
+func (s *Server) Close() error {
+	return s.turn.Close()
+}
+
+type client struct {
+	bucket *ratelimit.Bucket
+	seen   time.Time
+}
+
+type quota struct {
+	mu      sync.Mutex
+	cfg     Config
+	clients map[string]*client
+	now     func() time.Time
+}
+
+func newQuota(cfg Config) *quota {
+	return &quota{
+		cfg:     cfg,
+		clients: map[string]*client{},
+		now:     time.Now,
+	}
+}
+
+func (q *quota) admit(addr net.Addr) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	_, ok := q.client(addr)
+	return ok
+}
+
+func (q *quota) allow(addr net.Addr, n int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	c, ok := q.client(addr)
+	if !ok {
+		return false
+	}
+	return c.bucket == nil || c.bucket.AllowN(n)
+}
+
+func (q *quota) client(addr net.Addr) (*client, bool) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, false
+	}
+	now := q.now()
+	if c, ok := q.clients[host]; ok {
+		c.seen = now
+		return c, true
+	}
+
+	for h, c := range q.clients {
+		if q.cfg.Idle > 0 && now.Sub(c.seen) > q.cfg.Idle {
+			delete(q.clients, h)
+		}
+	}
+	if q.cfg.MaxClients > 0 && len(q.clients) >= q.cfg.MaxClients {
+		return nil, false
+	}
+
+	c := &client{seen: now}
+	if q.cfg.Rate > 0 {
+		c.bucket = ratelimit.NewBucket(q.cfg.Rate, q.cfg.Burst)
+	}
+	q.clients[host] = c
+	return c, true
+}
+
+// quotaConn drops packets of clients which are over their quota before they
+// reach the TURN server.
+type quotaConn struct {
+	net.PacketConn
+	quota *quota
+}
+
+func (c *quotaConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.quota.allow(addr, n) {
+			return n, addr, err
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package relay
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	wrtc "go-chat/webrtc"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Relay(t *testing.T) {
+	_, privsign, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	t.Run("secret is stable per identity", func(t *testing.T) {
+		a, err := Secret(privsign)
+		require.NoError(t, err)
+		b, err := Secret(privsign)
+		require.NoError(t, err)
+		assert.Equal(t, a, b)
+
+		_, other, _ := ed25519.GenerateKey(rand.Reader)
+		c, err := Secret(other)
+		require.NoError(t, err)
+		assert.NotEqual(t, a, c)
+	})
+
+	t.Run("peers discover and use announced relay", func(t *testing.T) {
+		secret, err := Secret(privsign)
+		require.NoError(t, err)
+		srv, err := Start(Config{Addr: "127.0.0.1:0", PublicIP: net.ParseIP("127.0.0.1")}, secret)
+		require.NoError(t, err)
+		defer srv.Close()
+
+		a, err := srv.Announce("", time.Minute)
+		require.NoError(t, err)
+		payload, err := a.Marshal(privsign)
+		require.NoError(t, err)
+
+		dir := NewDirectory(4, anyone)
+		fresh, err := dir.Add(payload)
+		require.NoError(t, err)
+		assert.True(t, fresh)
+		fresh, err = dir.Add(payload)
+		require.NoError(t, err)
+		assert.False(t, fresh)
+
+		pc, err := wrtc.Setup(wrtc.Config{ICEServers: dir.ICEServers(), RelayOnly: true})
+		require.NoError(t, err)
+		defer pc.Close()
+
+		ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+		defer cancel()
+		offer, err := pc.Offer(ctx, wrtc.GatherComplete)
+		require.NoError(t, err)
+
+		var desc webrtc.SessionDescription
+		require.NoError(t, json.Unmarshal(offer, &desc))
+		assert.Contains(t, desc.SDP, "typ relay")
+	})
+
+	t.Run("max clients", func(t *testing.T) {
+		q := newQuota(Config{MaxClients: 1})
+		assert.True(t, q.admit(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}))
+		assert.True(t, q.admit(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2}))
+		assert.False(t, q.admit(&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1}))
+	})
+
+	t.Run("idle clients free slots", func(t *testing.T) {
+		now := time.Now()
+		q := newQuota(Config{MaxClients: 1, Idle: time.Minute})
+		q.now = func() time.Time { return now }
+		assert.True(t, q.admit(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}))
+
+		now = now.Add(2 * time.Minute)
+		assert.True(t, q.admit(&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1}))
+	})
+
+	t.Run("byte quota per client", func(t *testing.T) {
+		q := newQuota(Config{Rate: 0.001, Burst: 100})
+		addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+		assert.True(t, q.allow(addr, 60))
+		assert.False(t, q.allow(addr, 60))
+		assert.True(t, q.allow(&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1}, 60))
+	})
+}
+
+func anyone(ed25519.PublicKey) bool { return true }
+
+func Test_Announce(t *testing.T) {
+	_, privsign, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	a := Announce{
+		URLs:     []string{"turn:203.0.113.1:3478?transport=udp"},
+		Username: "user",
+		Expires:  time.Now().Add(time.Minute).Unix(),
+	}
+
+	t.Run("reject tampered announce", func(t *testing.T) {
+		payload, err := a.Marshal(privsign)
+		require.NoError(t, err)
+		payload = []byte(strings.Replace(string(payload), "203.0.113.1", "203.0.113.2", 1))
+
+		_, err = NewDirectory(1, anyone).Add(payload)
+		assert.ErrorIs(t, err, ErrInvalidAnnounce)
+	})
+
+	t.Run("reject expired announce", func(t *testing.T) {
+		expired := a
+		expired.Expires = time.Now().Add(-time.Second).Unix()
+		payload, err := expired.Marshal(privsign)
+		require.NoError(t, err)
+
+		_, err = NewDirectory(1, anyone).Add(payload)
+		assert.ErrorIs(t, err, ErrExpired)
+	})
+
+	t.Run("limit directory size", func(t *testing.T) {
+		dir := NewDirectory(1, anyone)
+		payload, _ := a.Marshal(privsign)
+		fresh, _ := dir.Add(payload)
+		assert.True(t, fresh)
+
+		_, other, _ := ed25519.GenerateKey(rand.Reader)
+		payload, _ = a.Marshal(other)
+		fresh, _ = dir.Add(payload)
+		assert.False(t, fresh)
+		assert.Len(t, dir.ICEServers(), 1)
+	})
+
+	t.Run("reject untrusted node", func(t *testing.T) {
+		pubsign := privsign.Public().(ed25519.PublicKey)
+		dir := NewDirectory(1, func(sign ed25519.PublicKey) bool { return !sign.Equal(pubsign) })
+		payload, _ := a.Marshal(privsign)
+		_, err := dir.Add(payload)
+		assert.ErrorIs(t, err, ErrUntrusted)
+		assert.Empty(t, dir.ICEServers())
+	})
+}
@@ -0,0 +1,112 @@
+package session
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"go-chat/model"
+	"go-chat/netcrypt"
+)
+
+var ErrInvalidCall = errors.New("invalid call")
+
+// Call is the payload of CallStart, CallAccept and CallEnd. Start and accept
+// carry the description of the renegotiation, end none. The payload is
+// encrypted to the keys of the session, sig(64) | id(16) | sdp, and signed
+// by the node the session was negotiated with.
+type Call struct {
+	ID  []byte
+	SDP []byte
+}
+
+// SealCall signs the call for the signal of type t, so a start can't pass
+// for an accept or another session.
+func (s *Session) SealCall(t model.SignalType, privsign ed25519.PrivateKey, c Call) ([]byte, error) {
+	sig := ed25519.Sign(privsign, transcript(t.String(), s.key, s.privkey.PublicKey(), s.pubkey, c.ID, c.SDP))
+	body := make([]byte, 0, len(sig)+len(c.ID)+len(c.SDP))
+	body = append(body, sig...)
+	body = append(body, c.ID...)
+	body = append(body, c.SDP...)
+	return netcrypt.Encrypt(body, s.privkey, s.pubkey)
+}
+
+func (s *Session) OpenCall(t model.SignalType, b []byte) (Call, error) {
+	body, err := netcrypt.Decrypt(b, s.privkey, s.pubkey)
+	if err != nil || len(body) < ed25519.SignatureSize+model.KeyLen {
+		return Call{}, ErrInvalidCall
+	}
+	sig, rest := body[:ed25519.SignatureSize], body[ed25519.SignatureSize:]
+	c := Call{ID: rest[:model.KeyLen], SDP: rest[model.KeyLen:]}
+	if !ed25519.Verify(s.sign, transcript(t.String(), s.key, s.pubkey, s.privkey.PublicKey(), c.ID, c.SDP), sig) {
+		return Call{}, ErrInvalidCall
+	}
+	return c, nil
+}
+
+// OnCall registers fn for the call signals of the session. Signals received
+// before the registration are delivered right away.
+func (s *Session) OnCall(fn func(model.Signal)) {
+	s.mu.Lock()
+	pending := s.calls
+	s.calls = nil
+	s.onCall = fn
+	s.mu.Unlock()
+
+	for _, c := range pending {
+		fn(c)
+	}
+}
+
+// Called hands a call signal of the session to the function registered by
+// OnCall.
+func (s *Session) Called(c model.Signal) {
+	s.mu.Lock()
+	fn := s.onCall
+	if fn == nil && len(s.calls) < maxPendingCalls {
+		s.calls = append(s.calls, c)
+	}
+	s.mu.Unlock()
+
+	if fn != nil {
+		fn(c)
+	}
+}
+
+const maxPendingCalls = 4
+
+// Begin makes id the call of the session, stop ends its local media. A call
+// still running is stopped first.
+func (s *Session) Begin(id []byte, stop func()) {
+	s.mu.Lock()
+	prev := s.stop
+	s.call, s.stop = id, stop
+	s.mu.Unlock()
+
+	if prev != nil {
+		prev()
+	}
+}
+
+// End stops the call id, it reports false when id isn't the call of the
+// session.
+func (s *Session) End(id []byte) bool {
+	s.mu.Lock()
+	if s.call == nil || !bytes.Equal(s.call, id) {
+		s.mu.Unlock()
+		return false
+	}
+	stop := s.stop
+	s.call, s.stop = nil, nil
+	s.mu.Unlock()
+
+	stop()
+	return true
+}
+
+// Current is the id of the running call, nil without one.
+func (s *Session) Current() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.call
+}
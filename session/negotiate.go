@@ -0,0 +1,154 @@
+package session
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"go-chat/model"
+	"go-chat/netcrypt"
+)
+
+var ErrInvalidNegotiation = errors.New("invalid session negotiation")
+
+const pubKeyLen = 65
+
+// Request is the payload of NeedConnect, the ephemeral key of the requester.
+// Offers and answers are encrypted to the ephemeral keys, relaying peers see
+// neither the identities nor the descriptions. A request for one node names
+// the hash of its sign key in To, every other node passes it on.
+type Request struct {
+	PubKey *ecdh.PublicKey
+	To     []byte
+}
+
+func (r Request) Marshal() []byte {
+	return append(r.PubKey.Bytes(), r.To...)
+}
+
+func ParseRequest(b []byte) (Request, error) {
+	if len(b) != pubKeyLen && len(b) != pubKeyLen+sha256.Size {
+		return Request{}, ErrInvalidNegotiation
+	}
+	pubkey, err := ecdh.P256().NewPublicKey(b[:pubKeyLen])
+	if err != nil {
+		return Request{}, ErrInvalidNegotiation
+	}
+	r := Request{PubKey: pubkey}
+	if len(b) > pubKeyLen {
+		r.To = b[pubKeyLen:]
+	}
+	return r, nil
+}
+
+// Target is the To of a request for the node of sign.
+func Target(sign ed25519.PublicKey) []byte {
+	sum := sha256.Sum256(sign)
+	return sum[:]
+}
+
+// For reports whether the node of sign may offer to the request.
+func (r Request) For(sign ed25519.PublicKey) bool {
+	return r.To == nil || bytes.Equal(r.To, Target(sign))
+}
+
+// Offer answers a Request. It is sent with the key of the request and names
+// the key of the session the rest of the negotiation uses. The payload is
+// pubkey(65) | encrypted sign(32) | sig(64) | key(16) | sdp.
+type Offer struct {
+	PubKey *ecdh.PublicKey
+	Sign   ed25519.PublicKey
+	Key    []byte
+	SDP    []byte
+}
+
+// SealOffer signs the offer together with both ephemeral keys, so it can't
+// be replayed to another request.
+func SealOffer(reqKey []byte, req Request, privkey *ecdh.PrivateKey, privsign ed25519.PrivateKey, key, sdp []byte) ([]byte, error) {
+	pubsign := privsign.Public().(ed25519.PublicKey)
+	sig := ed25519.Sign(privsign, transcript("offer", reqKey, req.PubKey, privkey.PublicKey(), key, sdp))
+	body := make([]byte, 0, len(pubsign)+len(sig)+len(key)+len(sdp))
+	body = append(body, pubsign...)
+	body = append(body, sig...)
+	body = append(body, key...)
+	body = append(body, sdp...)
+
+	encrypted, err := netcrypt.Encrypt(body, privkey, req.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	return append(privkey.PublicKey().Bytes(), encrypted...), nil
+}
+
+// OpenOffer decrypts an offer made to the request sent with reqKey.
+func OpenOffer(b []byte, reqKey []byte, privkey *ecdh.PrivateKey) (Offer, error) {
+	if len(b) < pubKeyLen {
+		return Offer{}, ErrInvalidNegotiation
+	}
+	pubkey, err := ecdh.P256().NewPublicKey(b[:pubKeyLen])
+	if err != nil {
+		return Offer{}, ErrInvalidNegotiation
+	}
+	body, err := netcrypt.Decrypt(b[pubKeyLen:], privkey, pubkey)
+	if err != nil || len(body) < ed25519.PublicKeySize+ed25519.SignatureSize+model.KeyLen {
+		return Offer{}, ErrInvalidNegotiation
+	}
+	o := Offer{
+		PubKey: pubkey,
+		Sign:   ed25519.PublicKey(body[:ed25519.PublicKeySize]),
+	}
+	sig := body[ed25519.PublicKeySize : ed25519.PublicKeySize+ed25519.SignatureSize]
+	rest := body[ed25519.PublicKeySize+ed25519.SignatureSize:]
+	o.Key, o.SDP = rest[:model.KeyLen], rest[model.KeyLen:]
+	if !ed25519.Verify(o.Sign, transcript("offer", reqKey, privkey.PublicKey(), pubkey, o.Key, o.SDP), sig) {
+		return Offer{}, ErrInvalidNegotiation
+	}
+	return o, nil
+}
+
+// Answer completes the negotiation, it is sent with the key of the session.
+// The payload is encrypted sign(32) | sig(64) | sdp.
+type Answer struct {
+	Sign ed25519.PublicKey
+	SDP  []byte
+}
+
+func SealAnswer(o Offer, privkey *ecdh.PrivateKey, privsign ed25519.PrivateKey, sdp []byte) ([]byte, error) {
+	pubsign := privsign.Public().(ed25519.PublicKey)
+	sig := ed25519.Sign(privsign, transcript("answer", o.Key, o.PubKey, privkey.PublicKey(), nil, sdp))
+	body := make([]byte, 0, len(pubsign)+len(sig)+len(sdp))
+	body = append(body, pubsign...)
+	body = append(body, sig...)
+	body = append(body, sdp...)
+	return netcrypt.Encrypt(body, privkey, o.PubKey)
+}
+
+// OpenAnswer decrypts the answer of the requester to the offer made with
+// privkey.
+func OpenAnswer(b []byte, key []byte, privkey *ecdh.PrivateKey, pubkey *ecdh.PublicKey) (Answer, error) {
+	body, err := netcrypt.Decrypt(b, privkey, pubkey)
+	if err != nil || len(body) < ed25519.PublicKeySize+ed25519.SignatureSize {
+		return Answer{}, ErrInvalidNegotiation
+	}
+	a := Answer{
+		Sign: ed25519.PublicKey(body[:ed25519.PublicKeySize]),
+		SDP:  body[ed25519.PublicKeySize+ed25519.SignatureSize:],
+	}
+	sig := body[ed25519.PublicKeySize : ed25519.PublicKeySize+ed25519.SignatureSize]
+	if !ed25519.Verify(a.Sign, transcript("answer", key, privkey.PublicKey(), pubkey, nil, a.SDP), sig) {
+		return Answer{}, ErrInvalidNegotiation
+	}
+	return a, nil
+}
+
+func transcript(label string, key []byte, a, b *ecdh.PublicKey, extra, sdp []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(label)
+	buf.Write(key)
+	buf.Write(a.Bytes())
+	buf.Write(b.Bytes())
+	buf.Write(extra)
+	buf.Write(sdp)
+	return buf.Bytes()
+}
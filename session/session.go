@@ -0,0 +1,163 @@
+package session
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"go-chat/fallback"
+	"go-chat/model"
+	wrtc "go-chat/webrtc"
+	"io"
+	"net"
+	"sync"
+)
+
+var ErrNoChannel = errors.New("session has no channel")
+
+// Session is a connection to a node negotiated over the mesh. Like
+// network.Peer it is named by the hash of the remote key and knows the sign
+// key the remote proved in the negotiation. Every Read returns one message.
+type Session struct {
+	key     []byte
+	pc      *wrtc.Peer
+	privkey *ecdh.PrivateKey
+	pubkey  *ecdh.PublicKey
+	sign    ed25519.PublicKey
+	hash    []byte
+	release func()
+
+	mu     sync.Mutex
+	ch     fallback.Channel
+	onCall func(model.Signal)
+	calls  []model.Signal
+	call   []byte
+	stop   func()
+	inbox  chan []byte
+	done   chan struct{}
+	once   sync.Once
+}
+
+// New creates the session identified by key over pc. release runs once the
+// session is closed.
+func New(
+	key []byte,
+	pc *wrtc.Peer,
+	privkey *ecdh.PrivateKey,
+	pubkey *ecdh.PublicKey,
+	sign ed25519.PublicKey,
+	release func(),
+) *Session {
+	sum := sha256.Sum256(pubkey.Bytes())
+	return &Session{
+		key:     key,
+		pc:      pc,
+		privkey: privkey,
+		pubkey:  pubkey,
+		sign:    sign,
+		hash:    sum[:],
+		release: release,
+		inbox:   make(chan []byte, 64),
+		done:    make(chan struct{}),
+	}
+}
+
+func (s *Session) Key() []byte {
+	return s.key
+}
+
+func (s *Session) Peer() *wrtc.Peer {
+	return s.pc
+}
+
+func (s *Session) PrivKey() *ecdh.PrivateKey {
+	return s.privkey
+}
+
+func (s *Session) PubKey() *ecdh.PublicKey {
+	return s.pubkey
+}
+
+func (s *Session) Hash() []byte {
+	return s.hash
+}
+
+func (s *Session) Sign() ed25519.PublicKey {
+	return s.sign
+}
+
+// RemoteAddr is the address of the remote candidate ICE selected, nil for
+// a session carried by a relay link only.
+func (s *Session) RemoteAddr() net.Addr {
+	return s.pc.RemoteAddr()
+}
+
+// Use makes ch the channel the session writes.
+func (s *Session) Use(ch fallback.Channel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ch = ch
+}
+
+// Listen makes the session read ch. The remote side may write to the
+// DataChannel and to the link, whichever it uses.
+func (s *Session) Listen(ch fallback.Channel) {
+	ch.OnMessage(func(b []byte) {
+		select {
+		case s.inbox <- b:
+		case <-s.done:
+		}
+	})
+}
+
+func (s *Session) Read(b []byte) (int, error) {
+	select {
+	case <-s.done:
+		return 0, io.EOF
+	case msg := <-s.inbox:
+		return copy(b, msg), nil
+	}
+}
+
+func (s *Session) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	ch := s.ch
+	s.mu.Unlock()
+
+	if ch == nil {
+		return 0, ErrNoChannel
+	}
+	select {
+	case <-s.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	// Channels keep the buffer until it is sent.
+	msg := make([]byte, len(b))
+	copy(msg, b)
+	if err := ch.Send(msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (s *Session) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		if id := s.Current(); id != nil {
+			s.End(id)
+		}
+		err = s.pc.Close()
+		if s.release != nil {
+			s.release()
+		}
+	})
+	return err
+}
+
+// Done is closed once the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
@@ -0,0 +1,202 @@
+package session
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"go-chat/model"
+	wrtc "go-chat/webrtc"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type pipe struct {
+	peer *pipe
+	fn   func([]byte)
+}
+
+func (p *pipe) Send(b []byte) error       { p.peer.fn(b); return nil }
+func (p *pipe) OnMessage(fn func([]byte)) { p.fn = fn }
+
+func keys(t *testing.T) (*ecdh.PrivateKey, ed25519.PrivateKey) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, sign, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return key, sign
+}
+
+func Test_Negotiate(t *testing.T) {
+	reqKey := model.GenerateKey()
+	rkey, rsign := keys(t)
+	okey, osign := keys(t)
+	req, err := ParseRequest(Request{PubKey: rkey.PublicKey()}.Marshal())
+	require.NoError(t, err)
+
+	t.Run("offer and answer", func(t *testing.T) {
+		mkey := model.GenerateKey()
+		b, err := SealOffer(reqKey, req, okey, osign, mkey, []byte("offer sdp"))
+		require.NoError(t, err)
+		assert.NotContains(t, string(b), "offer sdp")
+
+		o, err := OpenOffer(b, reqKey, rkey)
+		require.NoError(t, err)
+		assert.Equal(t, mkey, o.Key)
+		assert.Equal(t, []byte("offer sdp"), o.SDP)
+		assert.Equal(t, osign.Public(), o.Sign)
+		assert.True(t, o.PubKey.Equal(okey.PublicKey()))
+
+		b, err = SealAnswer(o, rkey, rsign, []byte("answer sdp"))
+		require.NoError(t, err)
+		a, err := OpenAnswer(b, mkey, okey, rkey.PublicKey())
+		require.NoError(t, err)
+		assert.Equal(t, []byte("answer sdp"), a.SDP)
+		assert.Equal(t, rsign.Public(), a.Sign)
+	})
+
+	t.Run("reject offer of another request", func(t *testing.T) {
+		b, err := SealOffer(reqKey, req, okey, osign, model.GenerateKey(), []byte("sdp"))
+		require.NoError(t, err)
+		_, err = OpenOffer(b, model.GenerateKey(), rkey)
+		assert.ErrorIs(t, err, ErrInvalidNegotiation)
+
+		other, _ := keys(t)
+		_, err = OpenOffer(b, reqKey, other)
+		assert.ErrorIs(t, err, ErrInvalidNegotiation)
+	})
+
+	t.Run("reject answer of another session", func(t *testing.T) {
+		b, err := SealOffer(reqKey, req, okey, osign, model.GenerateKey(), []byte("sdp"))
+		require.NoError(t, err)
+		o, err := OpenOffer(b, reqKey, rkey)
+		require.NoError(t, err)
+		b, err = SealAnswer(o, rkey, rsign, []byte("sdp"))
+		require.NoError(t, err)
+		_, err = OpenAnswer(b, model.GenerateKey(), okey, rkey.PublicKey())
+		assert.ErrorIs(t, err, ErrInvalidNegotiation)
+	})
+
+	t.Run("request for one node", func(t *testing.T) {
+		assert.True(t, req.For(osign.Public().(ed25519.PublicKey)))
+
+		to := Request{PubKey: rkey.PublicKey(), To: Target(osign.Public().(ed25519.PublicKey))}
+		parsed, err := ParseRequest(to.Marshal())
+		require.NoError(t, err)
+		assert.True(t, parsed.For(osign.Public().(ed25519.PublicKey)))
+		assert.False(t, parsed.For(rsign.Public().(ed25519.PublicKey)))
+	})
+
+	t.Run("reject malformed request", func(t *testing.T) {
+		_, err := ParseRequest([]byte("short"))
+		assert.ErrorIs(t, err, ErrInvalidNegotiation)
+	})
+}
+
+func Test_Session(t *testing.T) {
+	lkey, _ := keys(t)
+	rkey, _ := keys(t)
+	pc, err := wrtc.Setup(wrtc.Config{})
+	require.NoError(t, err)
+	released := false
+	s := New(model.GenerateKey(), pc, lkey, rkey.PublicKey(), nil, func() { released = true })
+
+	_, err = s.Write([]byte("early"))
+	assert.ErrorIs(t, err, ErrNoChannel)
+
+	local, remote := &pipe{}, &pipe{}
+	local.peer, remote.peer = remote, local
+	var got []byte
+	remote.OnMessage(func(b []byte) { got = b })
+	s.Listen(local)
+	s.Use(local)
+
+	buf := []byte("hello")
+	_, err = s.Write(buf)
+	require.NoError(t, err)
+	buf[0] = 'j'
+	assert.Equal(t, []byte("hello"), got)
+
+	go remote.Send([]byte("world"))
+	b := make([]byte, 16)
+	n, err := s.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(b[:n]))
+
+	require.NoError(t, s.Close())
+	assert.True(t, released)
+	_, err = s.Read(b)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Nil(t, s.RemoteAddr())
+}
+
+func Test_Call(t *testing.T) {
+	lkey, lsign := keys(t)
+	rkey, rsign := keys(t)
+	key := model.GenerateKey()
+	pair := func(t *testing.T) (*Session, *Session) {
+		lpc, err := wrtc.Setup(wrtc.Config{})
+		require.NoError(t, err)
+		rpc, err := wrtc.Setup(wrtc.Config{})
+		require.NoError(t, err)
+		l := New(key, lpc, lkey, rkey.PublicKey(), rsign.Public().(ed25519.PublicKey), nil)
+		r := New(key, rpc, rkey, lkey.PublicKey(), lsign.Public().(ed25519.PublicKey), nil)
+		t.Cleanup(func() { l.Close(); r.Close() })
+		return l, r
+	}
+
+	t.Run("seal and open", func(t *testing.T) {
+		l, r := pair(t)
+		c := Call{ID: model.GenerateKey(), SDP: []byte("call sdp")}
+		b, err := l.SealCall(model.SignalTypeCallStart, lsign, c)
+		require.NoError(t, err)
+		assert.NotContains(t, string(b), "call sdp")
+
+		got, err := r.OpenCall(model.SignalTypeCallStart, b)
+		require.NoError(t, err)
+		assert.Equal(t, c, got)
+
+		_, err = r.OpenCall(model.SignalTypeCallAccept, b)
+		assert.ErrorIs(t, err, ErrInvalidCall)
+	})
+
+	t.Run("reject other signer", func(t *testing.T) {
+		l, r := pair(t)
+		_, other := keys(t)
+		b, err := l.SealCall(model.SignalTypeCallEnd, other, Call{ID: model.GenerateKey()})
+		require.NoError(t, err)
+		_, err = r.OpenCall(model.SignalTypeCallEnd, b)
+		assert.ErrorIs(t, err, ErrInvalidCall)
+	})
+
+	t.Run("end stops the call", func(t *testing.T) {
+		l, _ := pair(t)
+		stopped := 0
+		first, second := model.GenerateKey(), model.GenerateKey()
+		l.Begin(first, func() { stopped++ })
+		l.Begin(second, func() { stopped++ })
+		assert.Equal(t, 1, stopped)
+
+		assert.False(t, l.End(first))
+		assert.Equal(t, second, l.Current())
+		assert.True(t, l.End(second))
+		assert.Equal(t, 2, stopped)
+		assert.Nil(t, l.Current())
+
+		l.Begin(first, func() { stopped++ })
+		require.NoError(t, l.Close())
+		assert.Equal(t, 3, stopped)
+	})
+
+	t.Run("calls before registration", func(t *testing.T) {
+		l, _ := pair(t)
+		s, _ := model.NewSignal(model.SignalTypeCallStart, key, nil)
+		l.Called(s)
+		var got []model.Signal
+		l.OnCall(func(s model.Signal) { got = append(got, s) })
+		l.Called(s)
+		assert.Equal(t, []model.Signal{s, s}, got)
+	})
+}
@@ -0,0 +1,40 @@
+package storage
+
+// Store keeps values by key. Sessions, contacts, devices and delivery state
+// are kept in one, a Bucket in the binary.
+type Store interface {
+	Save(key string, value []byte) error
+	Load(key string) ([]byte, error)
+	List() ([]string, error)
+	Delete(key string) error
+}
+
+// Bucket is a view of one bucket, a Store in the encrypted database.
+type Bucket struct {
+	db   *DB
+	name string
+}
+
+func (db *DB) Bucket(name string) Bucket {
+	return Bucket{db: db, name: name}
+}
+
+func (b Bucket) Save(key string, value []byte) error {
+	return b.db.Put(b.name, key, value)
+}
+
+func (b Bucket) Load(key string) ([]byte, error) {
+	v, ok := b.db.Get(b.name, key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return v, nil
+}
+
+func (b Bucket) List() ([]string, error) {
+	return b.db.Keys(b.name), nil
+}
+
+func (b Bucket) Delete(key string) error {
+	return b.db.Delete(b.name, key)
+}
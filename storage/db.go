@@ -0,0 +1,462 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrPassphrase = errors.New("wrong passphrase")
+	ErrCorrupt    = errors.New("corrupt database")
+	ErrNotFound   = errors.New("not found")
+	ErrClosed     = errors.New("database closed")
+	ErrKeyTooLong = errors.New("bucket or key too long")
+)
+
+const (
+	magic     = "GOCHATDB"
+	saltLen   = 16
+	headerLen = len(magic) + 4 + saltLen + sha256.Size
+	nonceLen  = 12
+	// compactMin keeps small logs from being rewritten over and over.
+	compactMin = 1024
+)
+
+const (
+	opPut byte = iota + 1
+	opDelete
+)
+
+// kdfRounds is stored in the header, so raising it keeps old files readable.
+var kdfRounds = 600_000
+
+// DB is an append-only log of encrypted records, replayed into memory on
+// open. Overwritten and deleted records stay in the file until Compact.
+type DB struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	header []byte
+	aead   cipher.AEAD
+	seq    uint64
+	data   map[string]map[string][]byte
+	dead   int
+}
+
+// Open opens or creates the database at path. The key is derived from the
+// passphrase with PBKDF2.
+func Open(path string, passphrase string) (*DB, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{path: path, f: f, data: map[string]map[string][]byte{}}
+	if err := db.load(passphrase); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *DB) load(passphrase string) error {
+	header := make([]byte, headerLen)
+	_, err := io.ReadFull(db.f, header)
+	if err == io.EOF {
+		return db.create(passphrase)
+	}
+	if err != nil || string(header[:len(magic)]) != magic {
+		return ErrCorrupt
+	}
+
+	rounds := int(binary.BigEndian.Uint32(header[len(magic):]))
+	salt := header[len(magic)+4 : len(magic)+4+saltLen]
+	key, check, err := deriveKey(passphrase, salt, rounds)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(check, header[len(magic)+4+saltLen:]) {
+		return ErrPassphrase
+	}
+	if db.aead, err = newAEAD(key); err != nil {
+		return err
+	}
+	db.header = header
+
+	r := bufio.NewReader(db.f)
+	offset := int64(headerLen)
+	for {
+		n, err := db.replay(r)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			// A crash in the middle of a write leaves a torn last record.
+			// A corrupt length runs into the end of the file the same way,
+			// but records follow it.
+			if db.followed(offset) {
+				return ErrCorrupt
+			}
+			if err := db.f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		offset += n
+	}
+	_, err = db.f.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (db *DB) create(passphrase string) error {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	key, check, err := deriveKey(passphrase, salt, kdfRounds)
+	if err != nil {
+		return err
+	}
+	if db.aead, err = newAEAD(key); err != nil {
+		return err
+	}
+	header := append([]byte(magic), binary.BigEndian.AppendUint32(nil, uint32(kdfRounds))...)
+	header = append(append(header, salt...), check...)
+	db.header = header
+	if _, err := db.f.Write(header); err != nil {
+		return err
+	}
+	return db.f.Sync()
+}
+
+func (db *DB) replay(r *bufio.Reader) (int64, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, err
+	}
+	sealed := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	record, err := db.open(sealed)
+	if err != nil {
+		// The last record may be torn inside its payload as well.
+		if _, peekErr := r.Peek(1); peekErr == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	op, bucket, key, value, err := decodeRecord(record)
+	if err != nil {
+		return 0, err
+	}
+	db.apply(op, bucket, key, value)
+	return int64(len(size) + len(sealed)), nil
+}
+
+// followed reports whether the next record starts anywhere after the
+// length prefix at offset, i.e. the short record isn't the last one.
+func (db *DB) followed(offset int64) bool {
+	info, err := db.f.Stat()
+	if err != nil || info.Size() < offset+4 {
+		return false
+	}
+	rest := make([]byte, info.Size()-offset-4)
+	if _, err := db.f.ReadAt(rest, offset+4); err != nil {
+		return false
+	}
+	ad := binary.BigEndian.AppendUint64(nil, db.seq+1)
+	for p := 0; p+4 <= len(rest); p++ {
+		n := int(binary.BigEndian.Uint32(rest[p:]))
+		if n < nonceLen || n > len(rest)-p-4 {
+			continue
+		}
+		sealed := rest[p+4 : p+4+n]
+		if _, err := db.aead.Open(nil, sealed[:nonceLen], sealed[nonceLen:], ad); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *DB) apply(op byte, bucket, key string, value []byte) {
+	b, ok := db.data[bucket]
+	if !ok {
+		b = map[string][]byte{}
+		db.data[bucket] = b
+	}
+	if _, ok := b[key]; ok {
+		db.dead++
+	}
+	switch op {
+	case opPut:
+		b[key] = value
+	case opDelete:
+		db.dead++
+		delete(b, key)
+		if len(b) == 0 {
+			delete(db.data, bucket)
+		}
+	}
+}
+
+func (db *DB) Put(bucket, key string, value []byte) error {
+	return db.write(opPut, bucket, key, value)
+}
+
+func (db *DB) Delete(bucket, key string) error {
+	db.mu.Lock()
+	_, ok := db.data[bucket][key]
+	db.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return db.write(opDelete, bucket, key, nil)
+}
+
+func (db *DB) Get(bucket, key string) ([]byte, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	v, ok := db.data[bucket][key]
+	return v, ok
+}
+
+// Keys returns the keys of the bucket in ascending order.
+func (db *DB) Keys(bucket string) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	keys := make([]string, 0, len(db.data[bucket]))
+	for k := range db.data[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Buckets returns the names of the non empty buckets with the prefix.
+func (db *DB) Buckets(prefix string) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var out []string
+	for b := range db.data {
+		if len(b) >= len(prefix) && b[:len(prefix)] == prefix {
+			out = append(out, b)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (db *DB) write(op byte, bucket, key string, value []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.f == nil {
+		return ErrClosed
+	}
+	if len(bucket) > 0xffff || len(key) > 0xffff {
+		return ErrKeyTooLong
+	}
+	pos, err := db.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	seq := db.seq
+	err = db.append(db.f, encodeRecord(op, bucket, key, value))
+	if err == nil {
+		err = db.f.Sync()
+	}
+	if err != nil {
+		// Cut a partial record, the next one would land behind garbage.
+		db.seq = seq
+		db.f.Truncate(pos)
+		db.f.Seek(pos, io.SeekStart)
+		return err
+	}
+	db.apply(op, bucket, key, value)
+
+	if db.dead > compactMin && db.dead > db.live() {
+		return db.compact()
+	}
+	return nil
+}
+
+func (db *DB) append(w io.Writer, record []byte) error {
+	nonce := make([]byte, nonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	// The sequence number binds every record to its place in the log, so
+	// records can't be reordered or dropped from the middle unnoticed.
+	ad := binary.BigEndian.AppendUint64(nil, db.seq)
+	sealed := db.aead.Seal(nonce, nonce, record, ad)
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(sealed)))
+	if _, err := w.Write(append(out, sealed...)); err != nil {
+		return err
+	}
+	db.seq++
+	return nil
+}
+
+func (db *DB) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < nonceLen {
+		return nil, ErrCorrupt
+	}
+	ad := binary.BigEndian.AppendUint64(nil, db.seq)
+	record, err := db.aead.Open(nil, sealed[:nonceLen], sealed[nonceLen:], ad)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	db.seq++
+	return record, nil
+}
+
+func (db *DB) live() int {
+	n := 0
+	for _, b := range db.data {
+		n += len(b)
+	}
+	return n
+}
+
+// Compact rewrites the log with the live records only.
+func (db *DB) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.f == nil {
+		return ErrClosed
+	}
+	return db.compact()
+}
+
+func (db *DB) compact() error {
+	tmp, err := os.OpenFile(db.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	seq := db.seq
+	db.seq = 0
+	err = db.rewrite(tmp)
+	if err == nil {
+		err = os.Rename(tmp.Name(), db.path)
+	}
+	if err != nil {
+		db.seq = seq
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	db.f.Close()
+	db.f = tmp
+	db.dead = 0
+	return nil
+}
+
+func (db *DB) rewrite(f *os.File) error {
+	w := bufio.NewWriter(f)
+	if _, err := w.Write(db.header); err != nil {
+		return err
+	}
+	for bucket, b := range db.data {
+		for key, value := range b {
+			if err := db.append(w, encodeRecord(opPut, bucket, key, value)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.f == nil {
+		return nil
+	}
+	err := db.f.Close()
+	db.f = nil
+	return err
+}
+
+func deriveKey(passphrase string, salt []byte, rounds int) ([]byte, []byte, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, rounds, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("go-chat storage check"))
+	return key, mac.Sum(nil), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encodeRecord(op byte, bucket, key string, value []byte) []byte {
+	out := []byte{op}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(bucket)))
+	out = append(out, bucket...)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(key)))
+	out = append(out, key...)
+	return append(out, value...)
+}
+
+func decodeRecord(b []byte) (byte, string, string, []byte, error) {
+	r := bytes.NewReader(b)
+	op, err := r.ReadByte()
+	if err != nil || (op != opPut && op != opDelete) {
+		return 0, "", "", nil, ErrCorrupt
+	}
+	bucket, err := readString(r)
+	if err != nil {
+		return 0, "", "", nil, err
+	}
+	key, err := readString(r)
+	if err != nil {
+		return 0, "", "", nil, err
+	}
+	value := make([]byte, r.Len())
+	r.Read(value)
+	return op, bucket, key, value, nil
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return "", ErrCorrupt
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", ErrCorrupt
+	}
+	return string(b), nil
+}
@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const historyPrefix = "history:"
+
+type Message struct {
+	ID   string    `json:"id"`
+	From string    `json:"from"`
+	Time time.Time `json:"time"`
+	Body []byte    `json:"body"`
+}
+
+// Retention limits the history kept per conversation. Zero values keep
+// everything.
+type Retention struct {
+	MaxAge   time.Duration
+	MaxCount int
+}
+
+// Query selects a page of a conversation by time or by message id. Pages
+// are in ascending order; without an After bound they end at the newest
+// message before the Before bound.
+type Query struct {
+	Before   time.Time
+	After    time.Time
+	BeforeID string
+	AfterID  string
+	Limit    int
+}
+
+// History keeps the messages of every conversation in its own bucket,
+// keyed by time so keys sort chronologically.
+type History struct {
+	mu        sync.Mutex
+	db        *DB
+	retention Retention
+	ids       map[string]map[string]string
+	now       func() time.Time
+}
+
+func NewHistory(db *DB, retention Retention) *History {
+	h := &History{
+		db:        db,
+		retention: retention,
+		ids:       map[string]map[string]string{},
+		now:       time.Now,
+	}
+	for _, bucket := range db.Buckets(historyPrefix) {
+		conv := strings.TrimPrefix(bucket, historyPrefix)
+		h.ids[conv] = map[string]string{}
+		for _, key := range db.Keys(bucket) {
+			_, id, _ := strings.Cut(key, "/")
+			h.ids[conv][id] = key
+		}
+	}
+	return h
+}
+
+// Append stores the message unless one with the same id is already kept.
+func (h *History) Append(conv string, m Message) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.ids[conv][m.ID]; ok {
+		return nil
+	}
+	if m.Time.IsZero() {
+		m.Time = h.now()
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	key := timeKey(m.Time) + "/" + m.ID
+	if err := h.db.Put(historyPrefix+conv, key, b); err != nil {
+		return err
+	}
+	if h.ids[conv] == nil {
+		h.ids[conv] = map[string]string{}
+	}
+	h.ids[conv][m.ID] = key
+	_, err = h.prune(conv)
+	return err
+}
+
+func (h *History) Get(conv, id string) (Message, bool) {
+	h.mu.Lock()
+	key, ok := h.ids[conv][id]
+	h.mu.Unlock()
+	if !ok {
+		return Message{}, false
+	}
+	m, err := h.load(conv, key)
+	return m, err == nil
+}
+
+// Put replaces a stored message, keeping its place in the history.
+func (h *History) Put(conv string, m Message) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key, ok := h.ids[conv][m.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return h.db.Put(historyPrefix+conv, key, b)
+}
+
+func (h *History) Delete(conv, id string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key, ok := h.ids[conv][id]
+	if !ok {
+		return nil
+	}
+	if err := h.db.Delete(historyPrefix+conv, key); err != nil {
+		return err
+	}
+	delete(h.ids[conv], id)
+	return nil
+}
+
+func (h *History) Page(conv string, q Query) ([]Message, error) {
+	h.mu.Lock()
+	keys := h.db.Keys(historyPrefix + conv)
+	lo, hi := 0, len(keys)
+	if q.AfterID != "" {
+		key, ok := h.ids[conv][q.AfterID]
+		if !ok {
+			h.mu.Unlock()
+			return nil, ErrNotFound
+		}
+		lo = sort.SearchStrings(keys, key) + 1
+	}
+	if q.BeforeID != "" {
+		key, ok := h.ids[conv][q.BeforeID]
+		if !ok {
+			h.mu.Unlock()
+			return nil, ErrNotFound
+		}
+		hi = sort.SearchStrings(keys, key)
+	}
+	h.mu.Unlock()
+
+	if !q.After.IsZero() {
+		lo = max(lo, sort.SearchStrings(keys, timeKey(q.After.Add(time.Nanosecond))))
+	}
+	if !q.Before.IsZero() {
+		hi = min(hi, sort.SearchStrings(keys, timeKey(q.Before)))
+	}
+	if lo >= hi {
+		return nil, nil
+	}
+	keys = keys[lo:hi]
+	if q.Limit > 0 && len(keys) > q.Limit {
+		if q.AfterID != "" || !q.After.IsZero() {
+			keys = keys[:q.Limit]
+		} else {
+			keys = keys[len(keys)-q.Limit:]
+		}
+	}
+
+	out := make([]Message, 0, len(keys))
+	for _, key := range keys {
+		m, err := h.load(conv, key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+func (h *History) Conversations() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	out := make([]string, 0, len(h.ids))
+	for conv, ids := range h.ids {
+		if len(ids) > 0 {
+			out = append(out, conv)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Prune applies the retention to every conversation and returns the number
+// of messages dropped.
+func (h *History) Prune() (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	total := 0
+	for conv := range h.ids {
+		n, err := h.prune(conv)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (h *History) prune(conv string) (int, error) {
+	bucket := historyPrefix + conv
+	keys := h.db.Keys(bucket)
+	drop := 0
+	if h.retention.MaxCount > 0 && len(keys) > h.retention.MaxCount {
+		drop = len(keys) - h.retention.MaxCount
+	}
+	if h.retention.MaxAge > 0 {
+		oldest := timeKey(h.now().Add(-h.retention.MaxAge))
+		drop = max(drop, sort.SearchStrings(keys, oldest))
+	}
+	for _, key := range keys[:drop] {
+		if err := h.db.Delete(bucket, key); err != nil {
+			return 0, err
+		}
+		_, id, _ := strings.Cut(key, "/")
+		delete(h.ids[conv], id)
+	}
+	return drop, nil
+}
+
+func (h *History) load(conv, key string) (Message, error) {
+	b, ok := h.db.Get(historyPrefix+conv, key)
+	if !ok {
+		return Message{}, ErrNotFound
+	}
+	var m Message
+	if err := json.Unmarshal(b, &m); err != nil {
+		return Message{}, ErrCorrupt
+	}
+	return m, nil
+}
+
+// timeKey sorts like the time for any time after 1970.
+func timeKey(t time.Time) string {
+	return fmt.Sprintf("%016x", max(t.UnixNano(), 0))
+}
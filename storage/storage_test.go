@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	kdfRounds = 1000
+}
+
+func open(t *testing.T, path string) *DB {
+	db, err := Open(path, "secret")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func Test_DB(t *testing.T) {
+	t.Run("persists encrypted", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "chat.db")
+		db := open(t, path)
+		require.NoError(t, db.Put("contacts", "bob", []byte("plain value")))
+		require.NoError(t, db.Put("contacts", "carol", []byte("x")))
+		require.NoError(t, db.Delete("contacts", "carol"))
+		require.NoError(t, db.Close())
+
+		raw, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.False(t, bytes.Contains(raw, []byte("plain value")))
+		assert.False(t, bytes.Contains(raw, []byte("contacts")))
+
+		_, err = Open(path, "wrong")
+		assert.ErrorIs(t, err, ErrPassphrase)
+
+		db = open(t, path)
+		v, ok := db.Get("contacts", "bob")
+		assert.True(t, ok)
+		assert.Equal(t, []byte("plain value"), v)
+		assert.Equal(t, []string{"bob"}, db.Keys("contacts"))
+	})
+
+	t.Run("torn tail", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "chat.db")
+		db := open(t, path)
+		require.NoError(t, db.Put("b", "1", []byte("one")))
+		require.NoError(t, db.Put("b", "2", []byte("two")))
+		require.NoError(t, db.Close())
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(path, info.Size()-3))
+
+		db = open(t, path)
+		assert.Equal(t, []string{"1"}, db.Keys("b"))
+		require.NoError(t, db.Put("b", "3", []byte("three")))
+		require.NoError(t, db.Close())
+		db = open(t, path)
+		assert.Equal(t, []string{"1", "3"}, db.Keys("b"))
+	})
+
+	t.Run("corrupt length mid file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "chat.db")
+		db := open(t, path)
+		require.NoError(t, db.Put("b", "1", []byte("one")))
+		require.NoError(t, db.Put("b", "2", []byte("two")))
+		require.NoError(t, db.Put("b", "3", []byte("three")))
+		require.NoError(t, db.Close())
+
+		raw, _ := os.ReadFile(path)
+		before := len(raw)
+		raw[headerLen] = 0x7f
+		require.NoError(t, os.WriteFile(path, raw, 0o600))
+		_, err := Open(path, "secret")
+		assert.ErrorIs(t, err, ErrCorrupt)
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, int64(before), info.Size())
+	})
+
+	t.Run("tampered record", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "chat.db")
+		db := open(t, path)
+		require.NoError(t, db.Put("b", "1", []byte("one")))
+		require.NoError(t, db.Put("b", "2", []byte("two")))
+		require.NoError(t, db.Close())
+
+		raw, _ := os.ReadFile(path)
+		raw[headerLen+10] ^= 1
+		require.NoError(t, os.WriteFile(path, raw, 0o600))
+		_, err := Open(path, "secret")
+		assert.ErrorIs(t, err, ErrCorrupt)
+	})
+
+	t.Run("compaction", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "chat.db")
+		db := open(t, path)
+		for i := range 100 {
+			require.NoError(t, db.Put("b", "k", []byte(fmt.Sprint(i))))
+		}
+		before, _ := os.Stat(path)
+		require.NoError(t, db.Compact())
+		after, _ := os.Stat(path)
+		assert.Less(t, after.Size(), before.Size())
+
+		require.NoError(t, db.Put("b", "other", []byte("x")))
+		require.NoError(t, db.Close())
+		db = open(t, path)
+		v, _ := db.Get("b", "k")
+		assert.Equal(t, []byte("99"), v)
+		assert.Len(t, db.Keys("b"), 2)
+	})
+}
+
+func Test_History(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fill := func(t *testing.T, h *History, n int) {
+		for i := range n {
+			require.NoError(t, h.Append("bob", Message{
+				ID:   fmt.Sprint("m", i),
+				From: "bob",
+				Time: start.Add(time.Duration(i) * time.Minute),
+				Body: []byte(fmt.Sprint(i)),
+			}))
+		}
+	}
+	ids := func(ms []Message) []string {
+		var out []string
+		for _, m := range ms {
+			out = append(out, m.ID)
+		}
+		return out
+	}
+
+	t.Run("pagination", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "chat.db")
+		h := NewHistory(open(t, path), Retention{})
+		fill(t, h, 10)
+		require.NoError(t, h.Append("bob", Message{ID: "m3", Time: start}))
+
+		page, err := h.Page("bob", Query{Limit: 3})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"m7", "m8", "m9"}, ids(page))
+
+		page, err = h.Page("bob", Query{BeforeID: "m7", Limit: 3})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"m4", "m5", "m6"}, ids(page))
+
+		page, err = h.Page("bob", Query{AfterID: "m1", Limit: 2})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"m2", "m3"}, ids(page))
+
+		page, err = h.Page("bob", Query{After: start.Add(7 * time.Minute)})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"m8", "m9"}, ids(page))
+
+		page, err = h.Page("bob", Query{Before: start.Add(2 * time.Minute)})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"m0", "m1"}, ids(page))
+
+		_, err = h.Page("bob", Query{BeforeID: "missing"})
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		require.NoError(t, h.Delete("bob", "m9"))
+		h = NewHistory(open(t, path), Retention{})
+		m, ok := h.Get("bob", "m8")
+		assert.True(t, ok)
+		assert.Equal(t, []byte("8"), m.Body)
+		_, ok = h.Get("bob", "m9")
+		assert.False(t, ok)
+		assert.Equal(t, []string{"bob"}, h.Conversations())
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		h := NewHistory(open(t, filepath.Join(t.TempDir(), "chat.db")), Retention{MaxCount: 5})
+		fill(t, h, 8)
+		page, _ := h.Page("bob", Query{})
+		assert.Equal(t, []string{"m3", "m4", "m5", "m6", "m7"}, ids(page))
+
+		h.retention = Retention{MaxAge: 3 * time.Minute}
+		h.now = func() time.Time { return start.Add(7 * time.Minute) }
+		n, err := h.Prune()
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		page, _ = h.Page("bob", Query{})
+		assert.Equal(t, []string{"m4", "m5", "m6", "m7"}, ids(page))
+	})
+}
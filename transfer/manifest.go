@@ -0,0 +1,78 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+)
+
+var ErrInvalidManifest = errors.New("invalid manifest")
+
+// idLen is the length of the manifest id, the head of the hex of the file
+// hash.
+const idLen = 32
+
+// Manifest describes an offered file. The id is derived from the content, an
+// offer of the same file again resumes its partial file.
+type Manifest struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func NewManifest(name string, r io.Reader) (Manifest, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return Manifest{}, err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	return Manifest{
+		ID:     sum[:idLen],
+		Name:   filepath.Base(name),
+		Size:   size,
+		SHA256: sum,
+	}, nil
+}
+
+func ParseManifest(b []byte) (Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return Manifest{}, ErrInvalidManifest
+	}
+	// The name and the id come from the remote side and must not escape the
+	// download directory.
+	if sum, err := hex.DecodeString(m.SHA256); err != nil || len(sum) != sha256.Size {
+		return Manifest{}, ErrInvalidManifest
+	}
+	if !validID(m.ID) || m.ID != m.SHA256[:idLen] || m.Size < 0 ||
+		m.Name != filepath.Base(m.Name) || m.Name == "." || m.Name == ".." {
+		return Manifest{}, ErrInvalidManifest
+	}
+	return m, nil
+}
+
+func (m Manifest) Marshal() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// Label names the DataChannel carrying the file.
+func (m Manifest) Label() string {
+	return "file:" + m.ID
+}
+
+func validID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,236 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"go-chat/config"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	msgResume byte = iota
+	msgData
+	msgDone
+)
+
+const (
+	statusOK byte = iota
+	statusCorrupted
+)
+
+var (
+	ErrProtocol  = errors.New("file transfer protocol violation")
+	ErrIntegrity = errors.New("file checksum mismatch")
+	ErrRejected  = errors.New("file rejected")
+	ErrExists    = errors.New("file exists")
+)
+
+// Conn is a reliable ordered message channel, e.g. wrtc.Channel.
+type Conn interface {
+	Ready() <-chan struct{}
+	Send(b []byte) error
+	OnMessage(fn func([]byte))
+	BufferedAmount() uint64
+	SetBufferedAmountLowThreshold(th uint64)
+	OnBufferedAmountLow(fn func())
+}
+
+type Progress struct {
+	ID    string
+	Done  int64
+	Total int64
+}
+
+// Send streams the file described by m starting at the offset requested by
+// the receiver, so an interrupted transfer continues where it stopped.
+func Send(ctx context.Context, c Conn, m Manifest, r io.ReadSeeker, progress func(Progress)) error {
+	inbox, stop := listen(c)
+	defer stop()
+	low := make(chan struct{}, 1)
+	c.SetBufferedAmountLowThreshold(config.FileBufferLow)
+	c.OnBufferedAmountLow(func() {
+		select {
+		case low <- struct{}{}:
+		default:
+		}
+	})
+
+	msg, err := next(ctx, inbox)
+	if err != nil {
+		return err
+	}
+	if len(msg) != 9 || msg[0] != msgResume {
+		return ErrProtocol
+	}
+	offset := int64(binary.LittleEndian.Uint64(msg[1:]))
+	if offset < 0 || offset > m.Size {
+		return ErrProtocol
+	}
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	for done := offset; done < m.Size; {
+		// Chunks are queued by the channel, so every one gets its own buffer.
+		chunk := make([]byte, 1+min(int64(config.FileChunkSize), m.Size-done))
+		chunk[0] = msgData
+		n, err := io.ReadFull(r, chunk[1:])
+		if err != nil {
+			return err
+		}
+		for c.BufferedAmount() > config.FileBufferHigh {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-low:
+			}
+		}
+		if err := c.Send(chunk); err != nil {
+			return err
+		}
+		done += int64(n)
+		report(progress, m, done)
+	}
+
+	msg, err = next(ctx, inbox)
+	if err != nil {
+		return err
+	}
+	if len(msg) != 2 || msg[0] != msgDone {
+		return ErrProtocol
+	}
+	if msg[1] != statusOK {
+		return ErrIntegrity
+	}
+	return nil
+}
+
+// Receive writes the file into dir. It goes to a partial file named by the
+// manifest id first, data already there is kept and only the rest is
+// requested. The file takes its name only once the checksum matches, a file
+// of that name already in dir is never touched.
+func Receive(ctx context.Context, c Conn, m Manifest, dir string, progress func(Progress)) error {
+	path := filepath.Join(dir, m.Name)
+	if _, err := os.Lstat(path); err == nil {
+		return ErrExists
+	}
+	partial := Partial(dir, m)
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := st.Size()
+	if offset > m.Size {
+		offset = 0
+	}
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	inbox, stop := listen(c)
+	defer stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.Ready():
+	}
+	resume := make([]byte, 9)
+	resume[0] = msgResume
+	binary.LittleEndian.PutUint64(resume[1:], uint64(offset))
+	if err := c.Send(resume); err != nil {
+		return err
+	}
+
+	for done := offset; done < m.Size; {
+		msg, err := next(ctx, inbox)
+		if err != nil {
+			return err
+		}
+		if len(msg) < 2 || msg[0] != msgData || done+int64(len(msg)-1) > m.Size {
+			return ErrProtocol
+		}
+		if _, err := f.Write(msg[1:]); err != nil {
+			return err
+		}
+		done += int64(len(msg) - 1)
+		report(progress, m, done)
+	}
+
+	status := statusOK
+	ok, err := verify(f, m)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		status = statusCorrupted
+	}
+	if err := c.Send([]byte{msgDone, status}); err != nil {
+		return err
+	}
+	f.Close()
+	if !ok {
+		os.Remove(partial)
+		return ErrIntegrity
+	}
+	if _, err := os.Lstat(path); err == nil {
+		return ErrExists
+	}
+	return os.Rename(partial, path)
+}
+
+// Partial is where the file of m is kept until it is complete.
+func Partial(dir string, m Manifest) string {
+	return filepath.Join(dir, "."+m.ID+".part")
+}
+
+func verify(f *os.File, m Manifest) (bool, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)) == m.SHA256, nil
+}
+
+func listen(c Conn) (<-chan []byte, func()) {
+	inbox := make(chan []byte, 16)
+	done := make(chan struct{})
+	c.OnMessage(func(b []byte) {
+		select {
+		case inbox <- b:
+		case <-done:
+		}
+	})
+	return inbox, func() { close(done) }
+}
+
+func next(ctx context.Context, inbox <-chan []byte) ([]byte, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case b := <-inbox:
+		return b, nil
+	}
+}
+
+func report(progress func(Progress), m Manifest, done int64) {
+	if progress != nil {
+		progress(Progress{ID: m.ID, Done: done, Total: m.Size})
+	}
+}
@@ -0,0 +1,307 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"go-chat/config"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConn delivers messages to its peer in order and reports queued bytes
+// as buffered amount.
+type fakeConn struct {
+	mu        sync.Mutex
+	peer      *fakeConn
+	queue     chan []byte
+	buffered  uint64
+	maxBuffer uint64
+	threshold uint64
+	onMessage func([]byte)
+	pending   [][]byte
+	onLow     func()
+	ready     chan struct{}
+	drop      int
+	corrupt   bool
+}
+
+func fakePair() (*fakeConn, *fakeConn) {
+	ready := make(chan struct{})
+	close(ready)
+	l := &fakeConn{queue: make(chan []byte, 1024), ready: ready}
+	r := &fakeConn{queue: make(chan []byte, 1024), ready: ready}
+	l.peer, r.peer = r, l
+	go l.deliver()
+	go r.deliver()
+	return l, r
+}
+
+func (c *fakeConn) deliver() {
+	for b := range c.queue {
+		time.Sleep(time.Microsecond)
+		c.mu.Lock()
+		c.buffered -= uint64(len(b))
+		low := c.onLow
+		fire := c.buffered <= c.threshold
+		c.mu.Unlock()
+		if fire && low != nil {
+			low()
+		}
+
+		c.peer.mu.Lock()
+		fn := c.peer.onMessage
+		if fn == nil {
+			c.peer.pending = append(c.peer.pending, b)
+		}
+		c.peer.mu.Unlock()
+		if fn != nil {
+			fn(b)
+		}
+	}
+}
+
+func (c *fakeConn) Ready() <-chan struct{} { return c.ready }
+
+func (c *fakeConn) Send(b []byte) error {
+	c.mu.Lock()
+	if c.drop > 0 {
+		c.drop--
+		c.mu.Unlock()
+		return errors.New("disconnected")
+	}
+	if c.corrupt && b[0] == msgData {
+		b = append([]byte(nil), b...)
+		b[len(b)-1] ^= 0xff
+	}
+	c.buffered += uint64(len(b))
+	c.maxBuffer = max(c.maxBuffer, c.buffered)
+	c.mu.Unlock()
+
+	c.queue <- b
+	return nil
+}
+
+func (c *fakeConn) OnMessage(fn func([]byte)) {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = nil
+	c.onMessage = fn
+	c.mu.Unlock()
+
+	for _, b := range pending {
+		fn(b)
+	}
+}
+
+func (c *fakeConn) BufferedAmount() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buffered
+}
+
+func (c *fakeConn) SetBufferedAmountLowThreshold(th uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.threshold = th
+}
+
+func (c *fakeConn) OnBufferedAmountLow(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onLow = fn
+}
+
+func file(t *testing.T, size int) ([]byte, Manifest) {
+	data := make([]byte, size)
+	rand.Read(data)
+	m, err := NewManifest("dir/photo.jpg", bytes.NewReader(data))
+	require.NoError(t, err)
+	return data, m
+}
+
+func run(t *testing.T, sender, receiver *fakeConn, data []byte, m Manifest, dir string) (error, error) {
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+	defer cancel()
+
+	var sendErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sendErr = Send(ctx, sender, m, bytes.NewReader(data), nil)
+	}()
+	recvErr := Receive(ctx, receiver, m, dir, nil)
+	<-done
+	return sendErr, recvErr
+}
+
+func Test_Transfer(t *testing.T) {
+	t.Run("send file with flow control", func(t *testing.T) {
+		data, m := file(t, 3*config.FileBufferHigh)
+		assert.Equal(t, "photo.jpg", m.Name)
+		l, r := fakePair()
+		dir := t.TempDir()
+		path := filepath.Join(dir, m.Name)
+
+		var events []Progress
+		ctx := t.Context()
+		errs := make(chan error, 1)
+		go func() { errs <- Send(ctx, l, m, bytes.NewReader(data), nil) }()
+		err := Receive(ctx, r, m, dir, func(p Progress) { events = append(events, p) })
+		require.NoError(t, err)
+		require.NoError(t, <-errs)
+
+		got, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+		assert.LessOrEqual(t, l.maxBuffer, uint64(config.FileBufferHigh+config.FileChunkSize+1))
+		require.NotEmpty(t, events)
+		assert.Equal(t, Progress{ID: m.ID, Done: m.Size, Total: m.Size}, events[len(events)-1])
+		assert.NoFileExists(t, Partial(dir, m))
+	})
+
+	t.Run("resume from offset", func(t *testing.T) {
+		data, m := file(t, 5*config.FileChunkSize+7)
+		dir := t.TempDir()
+		path := filepath.Join(dir, m.Name)
+		require.NoError(t, os.WriteFile(Partial(dir, m), data[:2*config.FileChunkSize+3], 0o600))
+
+		l, r := fakePair()
+		var sent int64
+		ctx := t.Context()
+		errs := make(chan error, 1)
+		go func() {
+			errs <- Send(ctx, l, m, bytes.NewReader(data), func(p Progress) {
+				if sent == 0 {
+					sent = p.Done
+				}
+			})
+		}()
+		require.NoError(t, Receive(ctx, r, m, dir, nil))
+		require.NoError(t, <-errs)
+
+		assert.Equal(t, int64(3*config.FileChunkSize+3), sent)
+		got, _ := os.ReadFile(path)
+		assert.Equal(t, data, got)
+	})
+
+	t.Run("resume after disconnect", func(t *testing.T) {
+		data, m := file(t, 4*config.FileChunkSize)
+		dir := t.TempDir()
+		path := filepath.Join(dir, m.Name)
+
+		l, r := fakePair()
+		ctx, cancel := context.WithCancel(t.Context())
+		go func() {
+			defer cancel()
+			err := Send(ctx, l, m, bytes.NewReader(data), func(p Progress) {
+				if p.Done == 2*config.FileChunkSize {
+					l.mu.Lock()
+					l.drop = 1
+					l.mu.Unlock()
+				}
+			})
+			assert.Error(t, err)
+		}()
+		assert.ErrorIs(t, Receive(ctx, r, m, dir, nil), context.Canceled)
+		assert.NoFileExists(t, path)
+		st, err := os.Stat(Partial(dir, m))
+		require.NoError(t, err)
+		require.Less(t, st.Size(), m.Size)
+
+		l, r = fakePair()
+		var first int64
+		ctx = t.Context()
+		errs := make(chan error, 1)
+		go func() {
+			errs <- Send(ctx, l, m, bytes.NewReader(data), func(p Progress) {
+				if first == 0 {
+					first = p.Done
+				}
+			})
+		}()
+		require.NoError(t, Receive(ctx, r, m, dir, nil))
+		require.NoError(t, <-errs)
+
+		assert.Equal(t, st.Size()+config.FileChunkSize, first)
+		got, _ := os.ReadFile(path)
+		assert.Equal(t, data, got)
+	})
+
+	t.Run("reject corrupted file", func(t *testing.T) {
+		data, m := file(t, config.FileChunkSize+1)
+		dir := t.TempDir()
+		l, r := fakePair()
+		l.corrupt = true
+
+		sendErr, recvErr := run(t, l, r, data, m, dir)
+		assert.ErrorIs(t, sendErr, ErrIntegrity)
+		assert.ErrorIs(t, recvErr, ErrIntegrity)
+		assert.NoFileExists(t, filepath.Join(dir, m.Name))
+		assert.NoFileExists(t, Partial(dir, m))
+	})
+
+	t.Run("empty file", func(t *testing.T) {
+		data, m := file(t, 0)
+		dir := t.TempDir()
+		l, r := fakePair()
+
+		sendErr, recvErr := run(t, l, r, data, m, dir)
+		assert.NoError(t, sendErr)
+		assert.NoError(t, recvErr)
+		assert.FileExists(t, filepath.Join(dir, m.Name))
+	})
+
+	t.Run("keep existing file", func(t *testing.T) {
+		_, m := file(t, 10)
+		dir := t.TempDir()
+		path := filepath.Join(dir, m.Name)
+		require.NoError(t, os.WriteFile(path, []byte("mine"), 0o600))
+		_, r := fakePair()
+
+		assert.ErrorIs(t, Receive(t.Context(), r, m, dir, nil), ErrExists)
+		got, _ := os.ReadFile(path)
+		assert.Equal(t, []byte("mine"), got)
+		assert.NoFileExists(t, Partial(dir, m))
+	})
+}
+
+func Test_Manifest(t *testing.T) {
+	_, m := file(t, 10)
+	b, err := m.Marshal()
+	require.NoError(t, err)
+	parsed, err := ParseManifest(b)
+	require.NoError(t, err)
+	assert.Equal(t, m, parsed)
+
+	for _, name := range []string{"../secret", "a/b", "..", ""} {
+		bad := m
+		bad.Name = name
+		b, _ := bad.Marshal()
+		_, err := ParseManifest(b)
+		assert.ErrorIs(t, err, ErrInvalidManifest, name)
+	}
+	for _, id := range []string{"../secret", "a/b", "", m.SHA256[1 : idLen+1]} {
+		bad := m
+		bad.ID = id
+		b, _ := bad.Marshal()
+		_, err := ParseManifest(b)
+		assert.ErrorIs(t, err, ErrInvalidManifest, id)
+	}
+
+	t.Run("id of the content", func(t *testing.T) {
+		same, err := NewManifest("other", bytes.NewReader(make([]byte, 10)))
+		require.NoError(t, err)
+		zeros, err := NewManifest("zeros", bytes.NewReader(make([]byte, 10)))
+		require.NoError(t, err)
+		assert.Equal(t, zeros.ID, same.ID)
+		assert.NotEqual(t, m.ID, zeros.ID)
+	})
+}
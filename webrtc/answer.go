@@ -0,0 +1,27 @@
+package wrtc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Answer applies the remote offer and returns the local answer. With
+// GatherComplete the answer carries every local candidate.
+func (p *Peer) Answer(ctx context.Context, offer []byte, mode Gathering) ([]byte, error) {
+	desc, err := decode(offer, webrtc.SDPTypeOffer)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.setRemote(desc); err != nil {
+		return nil, err
+	}
+
+	answer, err := p.pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCreateAnswer, err)
+	}
+
+	return p.describe(ctx, answer, mode)
+}
@@ -0,0 +1,89 @@
+package wrtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func loopbackSettings() webrtc.SettingEngine {
+	se := webrtc.SettingEngine{}
+	se.SetIncludeLoopbackCandidate(true)
+	se.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	se.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	se.SetInterfaceFilter(func(name string) bool { return name == "lo" })
+	return se
+}
+
+func loopbackPeer(t *testing.T) *Peer {
+	return configuredPeer(t, Config{})
+}
+
+func configuredPeer(t *testing.T, cfg Config) *Peer {
+	p, err := setup(cfg, loopbackSettings())
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func Test_Answer(t *testing.T) {
+	t.Run("connect over loopback", func(t *testing.T) {
+		offerer, answerer := loopbackPeer(t), loopbackPeer(t)
+
+		offer, err := offerer.Offer(t.Context(), GatherComplete)
+		require.NoError(t, err)
+		answer, err := answerer.Answer(t.Context(), offer, GatherComplete)
+		require.NoError(t, err)
+		require.NoError(t, offerer.Accept(answer))
+
+		for _, p := range []*Peer{offerer, answerer} {
+			select {
+			case <-p.Ready():
+			case <-time.After(10 * time.Second):
+				t.Fatal("data channel not opened")
+			}
+		}
+
+		got := make(chan []byte, 1)
+		answerer.OnMessage(func(b []byte) { got <- b })
+		require.NoError(t, offerer.Send([]byte("hello")))
+		select {
+		case b := <-got:
+			assert.Equal(t, []byte("hello"), b)
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not delivered")
+		}
+	})
+
+	t.Run("invalid offer", func(t *testing.T) {
+		p := loopbackPeer(t)
+		_, err := p.Answer(t.Context(), []byte("{"), GatherComplete)
+		assert.ErrorIs(t, err, ErrInvalidSDP)
+	})
+
+	t.Run("answer instead of offer", func(t *testing.T) {
+		offerer, answerer := loopbackPeer(t), loopbackPeer(t)
+		offer, err := offerer.Offer(t.Context(), GatherComplete)
+		require.NoError(t, err)
+		answer, err := answerer.Answer(t.Context(), offer, GatherComplete)
+		require.NoError(t, err)
+
+		_, err = loopbackPeer(t).Answer(t.Context(), answer, GatherComplete)
+		assert.ErrorIs(t, err, ErrInvalidSDP)
+	})
+
+	t.Run("malformed sdp", func(t *testing.T) {
+		p := loopbackPeer(t)
+		_, err := p.Answer(t.Context(), []byte(`{"type":"offer","sdp":"garbage"}`), GatherComplete)
+		assert.ErrorIs(t, err, ErrSetRemote)
+	})
+
+	t.Run("send before connect", func(t *testing.T) {
+		p := loopbackPeer(t)
+		assert.ErrorIs(t, p.Send([]byte("x")), ErrNotConnected)
+	})
+}
@@ -0,0 +1,119 @@
+package wrtc
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const chatLabel = "chat"
+
+// Channel is an extra DataChannel next to the chat one, e.g. for a file
+// transfer.
+type Channel struct {
+	dc        *webrtc.DataChannel
+	mu        sync.Mutex
+	open      chan struct{}
+	openOnce  sync.Once
+	onMessage func([]byte)
+}
+
+func newChannel(dc *webrtc.DataChannel) *Channel {
+	c := &Channel{
+		dc:   dc,
+		open: make(chan struct{}),
+	}
+	dc.OnOpen(func() {
+		c.openOnce.Do(func() { close(c.open) })
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		c.mu.Lock()
+		fn := c.onMessage
+		c.mu.Unlock()
+		if fn != nil {
+			fn(msg.Data)
+		}
+	})
+	return c
+}
+
+// OpenChannel creates a reliable ordered DataChannel. It can be called only
+// after the connection is established.
+func (p *Peer) OpenChannel(label string) (*Channel, error) {
+	if label == chatLabel {
+		return nil, fmt.Errorf("%w: reserved label %s", ErrOpenChannel, label)
+	}
+	dc, err := p.pc.CreateDataChannel(label, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOpenChannel, err)
+	}
+	return newChannel(dc), nil
+}
+
+// OnChannel registers fn for channels opened by the remote side. Channels
+// opened before the registration are delivered right away.
+func (p *Peer) OnChannel(fn func(*Channel)) {
+	p.mu.Lock()
+	pending := p.channels
+	p.channels = nil
+	p.onChannel = fn
+	p.mu.Unlock()
+
+	for _, c := range pending {
+		fn(c)
+	}
+}
+
+func (p *Peer) channel(dc *webrtc.DataChannel) {
+	c := newChannel(dc)
+
+	p.mu.Lock()
+	fn := p.onChannel
+	if fn == nil {
+		p.channels = append(p.channels, c)
+	}
+	p.mu.Unlock()
+
+	if fn != nil {
+		fn(c)
+	}
+}
+
+func (c *Channel) Label() string {
+	return c.dc.Label()
+}
+
+func (c *Channel) Ready() <-chan struct{} {
+	return c.open
+}
+
+func (c *Channel) OnMessage(fn func([]byte)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onMessage = fn
+}
+
+func (c *Channel) Send(b []byte) error {
+	if c.dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return ErrNotConnected
+	}
+	return c.dc.Send(b)
+}
+
+func (c *Channel) BufferedAmount() uint64 {
+	return c.dc.BufferedAmount()
+}
+
+func (c *Channel) SetBufferedAmountLowThreshold(th uint64) {
+	c.dc.SetBufferedAmountLowThreshold(th)
+}
+
+func (c *Channel) OnBufferedAmountLow(fn func()) {
+	c.dc.OnBufferedAmountLow(fn)
+}
+
+func (c *Channel) Close() error {
+	return c.dc.Close()
+}
@@ -0,0 +1,50 @@
+package wrtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Channel(t *testing.T) {
+	t.Run("open extra channel", func(t *testing.T) {
+		offerer, answerer := loopbackPeer(t), loopbackPeer(t)
+		connect(t, offerer, answerer)
+
+		remote := make(chan *Channel, 1)
+		answerer.OnChannel(func(c *Channel) { remote <- c })
+		local, err := offerer.OpenChannel("file:1")
+		require.NoError(t, err)
+
+		var c *Channel
+		select {
+		case c = <-remote:
+		case <-time.After(5 * time.Second):
+			t.Fatal("channel not opened")
+		}
+		assert.Equal(t, "file:1", c.Label())
+
+		got := make(chan []byte, 1)
+		c.OnMessage(func(b []byte) { got <- b })
+		<-local.Ready()
+		require.NoError(t, local.Send([]byte("chunk")))
+		select {
+		case b := <-got:
+			assert.Equal(t, []byte("chunk"), b)
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not delivered")
+		}
+
+		chat := make(chan []byte, 1)
+		answerer.OnMessage(func(b []byte) { chat <- b })
+		require.NoError(t, offerer.Send([]byte("hello")))
+		assert.Equal(t, []byte("hello"), <-chat)
+	})
+
+	t.Run("reserved label", func(t *testing.T) {
+		_, err := loopbackPeer(t).OpenChannel(chatLabel)
+		assert.ErrorIs(t, err, ErrOpenChannel)
+	})
+}
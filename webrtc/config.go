@@ -0,0 +1,81 @@
+package wrtc
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+type ICEServer struct {
+	URLs       []string
+	Username   string
+	Credential string
+	// Secret switches the server to time limited TURN REST credentials,
+	// Username is then used as the user id part of the generated name.
+	Secret string
+	TTL    time.Duration
+}
+
+type Config struct {
+	ICEServers []ICEServer
+	RelayOnly  bool
+	PortMin    uint16
+	PortMax    uint16
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ICEServers: []ICEServer{
+			{URLs: []string{"stun:stun.l.google.com:19302"}},
+		},
+	}
+}
+
+// TURNCredentials generates credentials accepted by TURN servers sharing
+// secret: the name is "<expiry>:<user>" and the password is the base64
+// encoded HMAC-SHA1 of the name.
+func TURNCredentials(secret, user string, ttl time.Duration) (string, string) {
+	username := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	if user != "" {
+		username += ":" + user
+	}
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (c Config) configuration() webrtc.Configuration {
+	out := webrtc.Configuration{
+		ICEServers: make([]webrtc.ICEServer, 0, len(c.ICEServers)),
+	}
+	for _, s := range c.ICEServers {
+		username, credential := s.Username, s.Credential
+		if s.Secret != "" {
+			username, credential = TURNCredentials(s.Secret, s.Username, s.TTL)
+		}
+		out.ICEServers = append(out.ICEServers, webrtc.ICEServer{
+			URLs:       s.URLs,
+			Username:   username,
+			Credential: credential,
+		})
+	}
+	if c.RelayOnly {
+		out.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+	return out
+}
+
+func (c Config) settings(se webrtc.SettingEngine) (webrtc.SettingEngine, error) {
+	if c.PortMin == 0 && c.PortMax == 0 {
+		return se, nil
+	}
+	if err := se.SetEphemeralUDPPortRange(c.PortMin, c.PortMax); err != nil {
+		return se, fmt.Errorf("port range: %w", err)
+	}
+	return se, nil
+}
@@ -0,0 +1,141 @@
+package wrtc
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v4"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRealm = "go-chat"
+
+func turnServer(t *testing.T, auth turn.AuthHandler) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s, err := turn.NewServer(turn.ServerConfig{
+		Realm:       testRealm,
+		AuthHandler: auth,
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn: conn,
+			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+				RelayAddress: net.ParseIP("127.0.0.1"),
+				Address:      "127.0.0.1",
+			},
+		}},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return "turn:" + conn.LocalAddr().String() + "?transport=udp"
+}
+
+func connect(t *testing.T, offerer, answerer *Peer) {
+	offer, err := offerer.Offer(t.Context(), GatherComplete)
+	require.NoError(t, err)
+	answer, err := answerer.Answer(t.Context(), offer, GatherComplete)
+	require.NoError(t, err)
+	require.NoError(t, offerer.Accept(answer))
+
+	waitReady(t, offerer, answerer)
+}
+
+func waitReady(t *testing.T, peers ...*Peer) {
+	for _, p := range peers {
+		select {
+		case <-p.Ready():
+		case <-time.After(10 * time.Second):
+			t.Fatal("data channel not opened")
+		}
+	}
+}
+
+func candidates(t *testing.T, sdp []byte) []string {
+	var desc webrtc.SessionDescription
+	require.NoError(t, json.Unmarshal(sdp, &desc))
+
+	var out []string
+	for _, line := range strings.Split(desc.SDP, "\r\n") {
+		if strings.HasPrefix(line, "a=candidate:") {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+func Test_Config(t *testing.T) {
+	t.Run("relay only with static credentials", func(t *testing.T) {
+		url := turnServer(t, func(username, realm string, _ net.Addr) ([]byte, bool) {
+			if username != "alice" {
+				return nil, false
+			}
+			return turn.GenerateAuthKey(username, realm, "secret"), true
+		})
+		cfg := Config{
+			ICEServers: []ICEServer{{URLs: []string{url}, Username: "alice", Credential: "secret"}},
+			RelayOnly:  true,
+		}
+		offerer, answerer := configuredPeer(t, cfg), configuredPeer(t, cfg)
+
+		offer, err := offerer.Offer(t.Context(), GatherComplete)
+		require.NoError(t, err)
+		cands := candidates(t, offer)
+		require.NotEmpty(t, cands)
+		for _, c := range cands {
+			assert.Contains(t, c, "typ relay")
+		}
+
+		answer, err := answerer.Answer(t.Context(), offer, GatherComplete)
+		require.NoError(t, err)
+		require.NoError(t, offerer.Accept(answer))
+		waitReady(t, offerer, answerer)
+	})
+
+	t.Run("time limited credentials", func(t *testing.T) {
+		url := turnServer(t, turn.LongTermTURNRESTAuthHandler("shared", nil))
+		cfg := Config{
+			ICEServers: []ICEServer{{URLs: []string{url}, Username: "bob", Secret: "shared", TTL: time.Hour}},
+			RelayOnly:  true,
+		}
+		connect(t, configuredPeer(t, cfg), configuredPeer(t, cfg))
+	})
+
+	t.Run("wrong credentials", func(t *testing.T) {
+		url := turnServer(t, turn.LongTermTURNRESTAuthHandler("shared", nil))
+		cfg := Config{
+			ICEServers: []ICEServer{{URLs: []string{url}, Username: "bob", Secret: "other", TTL: time.Hour}},
+			RelayOnly:  true,
+		}
+		offer, err := configuredPeer(t, cfg).Offer(t.Context(), GatherComplete)
+		require.NoError(t, err)
+		assert.Empty(t, candidates(t, offer))
+	})
+
+	t.Run("turn rest credentials", func(t *testing.T) {
+		username, password := TURNCredentials("shared", "bob", time.Hour)
+		expUser, expPass, err := turn.GenerateLongTermTURNRESTCredentials("shared", "bob", time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, expUser, username)
+		assert.Equal(t, expPass, password)
+	})
+
+	t.Run("port range", func(t *testing.T) {
+		_, err := Setup(Config{PortMin: 20000, PortMax: 10000})
+		assert.Error(t, err)
+
+		p := configuredPeer(t, Config{PortMin: 40000, PortMax: 40100})
+		offer, err := p.Offer(t.Context(), GatherComplete)
+		require.NoError(t, err)
+		for _, c := range candidates(t, offer) {
+			port := strings.Fields(c)[5]
+			assert.GreaterOrEqual(t, port, "40000")
+			assert.LessOrEqual(t, port, "40100")
+		}
+	})
+}
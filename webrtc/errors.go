@@ -0,0 +1,17 @@
+package wrtc
+
+import "errors"
+
+var (
+	ErrInvalidSDP       = errors.New("invalid session description")
+	ErrSetRemote        = errors.New("set remote description")
+	ErrCreateOffer      = errors.New("create offer")
+	ErrCreateAnswer     = errors.New("create answer")
+	ErrSetLocal         = errors.New("set local description")
+	ErrGatherTimeout    = errors.New("ice gathering timeout")
+	ErrNotConnected     = errors.New("data channel not connected")
+	ErrInvalidCandidate = errors.New("invalid candidate")
+	ErrUnsupportedCodec = errors.New("unsupported codec")
+	ErrAddTrack         = errors.New("add track")
+	ErrOpenChannel      = errors.New("open data channel")
+)
@@ -0,0 +1,144 @@
+package wrtc
+
+import (
+	"fmt"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+type Codec string
+
+const (
+	CodecOpus Codec = webrtc.MimeTypeOpus
+	CodecVP8  Codec = webrtc.MimeTypeVP8
+)
+
+func (c Codec) capability() (webrtc.RTPCodecCapability, error) {
+	switch c {
+	case CodecOpus:
+		return webrtc.RTPCodecCapability{MimeType: string(c), ClockRate: 48000, Channels: 2}, nil
+	case CodecVP8:
+		return webrtc.RTPCodecCapability{MimeType: string(c), ClockRate: 90000}, nil
+	default:
+		return webrtc.RTPCodecCapability{}, fmt.Errorf("%w: %s", ErrUnsupportedCodec, c)
+	}
+}
+
+type Track struct {
+	local  *webrtc.TrackLocalStaticSample
+	sender *webrtc.RTPSender
+}
+
+func (t *Track) Codec() Codec {
+	return Codec(t.local.Codec().MimeType)
+}
+
+func (t *Track) WriteSample(s media.Sample) error {
+	return t.local.WriteSample(s)
+}
+
+type RemoteTrack struct {
+	track *webrtc.TrackRemote
+	pc    *webrtc.PeerConnection
+}
+
+func (t *RemoteTrack) ID() string {
+	return t.track.ID()
+}
+
+func (t *RemoteTrack) Codec() Codec {
+	return Codec(t.track.Codec().MimeType)
+}
+
+func (t *RemoteTrack) ReadRTP() (*rtp.Packet, error) {
+	pkt, _, err := t.track.ReadRTP()
+	return pkt, err
+}
+
+// RequestKeyframe asks the sender of a video track for a full frame, e.g.
+// after packet loss.
+func (t *RemoteTrack) RequestKeyframe() error {
+	return t.pc.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(t.track.SSRC())},
+	})
+}
+
+// AddTrack adds a local track. Tracks are negotiated by the next Offer or
+// Answer, so a call on a connected peer needs a new offer/answer round.
+func (p *Peer) AddTrack(codec Codec, id string) (*Track, error) {
+	capability, err := codec.capability()
+	if err != nil {
+		return nil, err
+	}
+	local, err := webrtc.NewTrackLocalStaticSample(capability, id, "go-chat")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAddTrack, err)
+	}
+	sender, err := p.pc.AddTrack(local)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAddTrack, err)
+	}
+
+	// RTCP has to be read for interceptors such as NACK to work.
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	p.mu.Lock()
+	p.senders = append(p.senders, sender)
+	p.mu.Unlock()
+
+	return &Track{local: local, sender: sender}, nil
+}
+
+// RemoveTracks stops sending every local track.
+func (p *Peer) RemoveTracks() error {
+	p.mu.Lock()
+	senders := p.senders
+	p.senders = nil
+	p.mu.Unlock()
+
+	for _, s := range senders {
+		if err := p.pc.RemoveTrack(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OnTrack registers fn for remote tracks. Tracks received before the
+// registration are delivered right away.
+func (p *Peer) OnTrack(fn func(*RemoteTrack)) {
+	p.mu.Lock()
+	pending := p.tracks
+	p.tracks = nil
+	p.onTrack = fn
+	p.mu.Unlock()
+
+	for _, t := range pending {
+		fn(t)
+	}
+}
+
+func (p *Peer) track(t *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+	rt := &RemoteTrack{track: t, pc: p.pc}
+
+	p.mu.Lock()
+	fn := p.onTrack
+	if fn == nil {
+		p.tracks = append(p.tracks, rt)
+	}
+	p.mu.Unlock()
+
+	if fn != nil {
+		fn(rt)
+	}
+}
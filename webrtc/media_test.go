@@ -0,0 +1,126 @@
+package wrtc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func remoteTracks(t *testing.T, p *Peer, n int) map[Codec]*RemoteTrack {
+	ch := make(chan *RemoteTrack, n)
+	p.OnTrack(func(rt *RemoteTrack) { ch <- rt })
+
+	out := map[Codec]*RemoteTrack{}
+	for range n {
+		select {
+		case rt := <-ch:
+			out[rt.Codec()] = rt
+		case <-time.After(10 * time.Second):
+			t.Fatal("remote track not received")
+		}
+	}
+	return out
+}
+
+func play(t *testing.T, p *Peer, codec Codec) {
+	track, err := p.AddTrack(codec, string(codec[:5]))
+	require.NoError(t, err)
+	go Play(t.Context(), track, TestPattern(codec, 0))
+}
+
+func Test_Media(t *testing.T) {
+	t.Run("negotiate tracks with the connection", func(t *testing.T) {
+		offerer, answerer := loopbackPeer(t), loopbackPeer(t)
+		play(t, offerer, CodecOpus)
+		play(t, offerer, CodecVP8)
+		play(t, answerer, CodecOpus)
+
+		connect(t, offerer, answerer)
+
+		tracks := remoteTracks(t, answerer, 2)
+		require.Contains(t, tracks, CodecOpus)
+		require.Contains(t, tracks, CodecVP8)
+		pkt, err := tracks[CodecVP8].ReadRTP()
+		require.NoError(t, err)
+		assert.NotEmpty(t, pkt.Payload)
+		assert.NoError(t, tracks[CodecVP8].RequestKeyframe())
+
+		back := remoteTracks(t, offerer, 1)
+		pkt, err = back[CodecOpus].ReadRTP()
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0xf8, 0xff, 0xfe}, pkt.Payload[:3])
+	})
+
+	t.Run("start call on connected peers", func(t *testing.T) {
+		caller, callee := loopbackPeer(t), loopbackPeer(t)
+		connect(t, caller, callee)
+
+		play(t, caller, CodecOpus)
+		offer, err := caller.Offer(t.Context(), GatherComplete)
+		require.NoError(t, err)
+		play(t, callee, CodecOpus)
+		answer, err := callee.Answer(t.Context(), offer, GatherComplete)
+		require.NoError(t, err)
+		require.NoError(t, caller.Accept(answer))
+
+		assert.Contains(t, remoteTracks(t, callee, 1), CodecOpus)
+		assert.Contains(t, remoteTracks(t, caller, 1), CodecOpus)
+
+		assert.NoError(t, caller.RemoveTracks())
+		assert.NoError(t, caller.Send([]byte("still connected")))
+	})
+
+	t.Run("unsupported codec", func(t *testing.T) {
+		_, err := loopbackPeer(t).AddTrack("video/H265", "video")
+		assert.ErrorIs(t, err, ErrUnsupportedCodec)
+	})
+}
+
+func Test_Source(t *testing.T) {
+	t.Run("test pattern ends at limit", func(t *testing.T) {
+		src := TestPattern(CodecOpus, 2)
+		for range 2 {
+			s, err := src.Next()
+			require.NoError(t, err)
+			assert.Equal(t, 20*time.Millisecond, s.Duration)
+		}
+		_, err := src.Next()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("read ivf frames", func(t *testing.T) {
+		var b bytes.Buffer
+		header := make([]byte, 32)
+		copy(header, "DKIF")
+		binary.LittleEndian.PutUint16(header[6:], 32)
+		copy(header[8:], "VP80")
+		binary.LittleEndian.PutUint32(header[16:], 30)
+		binary.LittleEndian.PutUint32(header[20:], 1)
+		binary.LittleEndian.PutUint32(header[24:], 1)
+		b.Write(header)
+		frame := make([]byte, 12)
+		binary.LittleEndian.PutUint32(frame, 3)
+		b.Write(frame)
+		b.Write([]byte{1, 2, 3})
+
+		src, err := IVFSource(&b)
+		require.NoError(t, err)
+		assert.Equal(t, CodecVP8, src.Codec())
+		s, err := src.Next()
+		require.NoError(t, err)
+		assert.Equal(t, []byte{1, 2, 3}, s.Data)
+		assert.Equal(t, time.Second/30, s.Duration)
+		_, err = src.Next()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("reject unknown file", func(t *testing.T) {
+		_, err := OpenFile("testdata/missing.mp4")
+		assert.Error(t, err)
+	})
+}
@@ -1,68 +1,191 @@
 package wrtc
 
 import (
-	"crypto/ecdh"
-	"crypto/ed25519"
+	"context"
 	"encoding/json"
+	"fmt"
+	"go-chat/config"
+	"sync"
 
 	"github.com/pion/webrtc/v4"
 )
 
+type Gathering uint8
+
+const (
+	// GatherComplete waits until all local candidates are embedded into the
+	// session description.
+	GatherComplete Gathering = iota
+	// GatherTrickle returns the description right away, candidates are
+	// delivered separately.
+	GatherTrickle
+)
+
 type Peer struct {
-	pc *webrtc.PeerConnection
+	pc          *webrtc.PeerConnection
+	mu          sync.Mutex
+	dc          *webrtc.DataChannel
+	open        chan struct{}
+	openOnce    sync.Once
+	onMessage   func([]byte)
+	onCandidate func([]byte)
+	localCands  [][]byte
+	remoteCands []webrtc.ICECandidateInit
+	remoteSet   bool
+	senders     []*webrtc.RTPSender
+	onTrack     func(*RemoteTrack)
+	tracks      []*RemoteTrack
+	onChannel   func(*Channel)
+	channels    []*Channel
 }
 
-func BuildConnReq(pubkey *ecdh.PublicKey, pubsign ed25519.PublicKey) []byte {
-	out := make([]byte, len(pubsign)+len(pubkey.Bytes()))
-	pos := 0
-	pos += copy(out[pos:], pubsign)
-	copy(out[pos:], pubkey.Bytes())
-	return out
+func Setup(cfg Config) (*Peer, error) {
+	return setup(cfg, webrtc.SettingEngine{})
 }
 
-func Setup() (*Peer, error) {
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-		},
+func setup(cfg Config, se webrtc.SettingEngine) (*Peer, error) {
+	se, err := cfg.settings(se)
+	if err != nil {
+		return nil, err
 	}
-	pc, err := webrtc.NewPeerConnection(config)
+	return newPeer(webrtc.NewAPI(webrtc.WithSettingEngine(se)), cfg.configuration())
+}
+
+func newPeer(api *webrtc.API, config webrtc.Configuration) (*Peer, error) {
+	pc, err := api.NewPeerConnection(config)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Peer{pc: pc}, nil
+	p := &Peer{
+		pc:   pc,
+		open: make(chan struct{}),
+	}
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() != chatLabel {
+			p.channel(dc)
+			return
+		}
+		p.attach(dc)
+	})
+	pc.OnICECandidate(p.trickle)
+	pc.OnTrack(p.track)
+
+	return p, nil
 }
 
 func BuildOffer(pc *Peer) ([]byte, error) {
-	offerSDP, err := pc.pc.CreateOffer(nil)
-	if err != nil {
-		return nil, err
+	ctx, cancel := context.WithTimeout(context.Background(), config.GatherTimeout)
+	defer cancel()
+
+	return pc.Offer(ctx, GatherComplete)
+}
+
+func BuildAnswer(ctx context.Context, input []byte, pc *Peer) ([]byte, error) {
+	return pc.Answer(ctx, input, GatherComplete)
+}
+
+func (p *Peer) Offer(ctx context.Context, mode Gathering) ([]byte, error) {
+	p.mu.Lock()
+	if p.dc == nil {
+		dc, err := p.pc.CreateDataChannel(chatLabel, nil)
+		if err != nil {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("%w: %v", ErrCreateOffer, err)
+		}
+		p.attachLocked(dc)
 	}
+	p.mu.Unlock()
 
-	data, err := json.Marshal(offerSDP)
+	offer, err := p.pc.CreateOffer(nil)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrCreateOffer, err)
 	}
 
-	return data, nil
+	return p.describe(ctx, offer, mode)
 }
 
-func BuildAnswer(input []byte, pc Peer) ([]byte, error) {
-	var offerSDP webrtc.SessionDescription
-	json.Unmarshal(input, &offerSDP)
-	err := pc.pc.SetRemoteDescription(offerSDP)
+// Accept applies the answer of the remote side to the offer made by Offer.
+func (p *Peer) Accept(answer []byte) error {
+	desc, err := decode(answer, webrtc.SDPTypeAnswer)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	answerSDP, err := pc.pc.CreateAnswer(nil)
-	err = pc.pc.SetLocalDescription(answerSDP)
-	if err != nil {
-		return nil, err
+	return p.setRemote(desc)
+}
+
+func (p *Peer) Ready() <-chan struct{} {
+	return p.open
+}
+
+func (p *Peer) OnMessage(fn func([]byte)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.onMessage = fn
+}
+
+func (p *Peer) Send(b []byte) error {
+	p.mu.Lock()
+	dc := p.dc
+	p.mu.Unlock()
+
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return ErrNotConnected
 	}
-	data, err := json.Marshal(answerSDP)
-	if err != nil {
-		return nil, err
+	return dc.Send(b)
+}
+
+func (p *Peer) Close() error {
+	return p.pc.Close()
+}
+
+func (p *Peer) describe(ctx context.Context, desc webrtc.SessionDescription, mode Gathering) ([]byte, error) {
+	gathered := webrtc.GatheringCompletePromise(p.pc)
+	if err := p.pc.SetLocalDescription(desc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSetLocal, err)
+	}
+
+	if mode == GatherComplete {
+		select {
+		case <-ctx.Done():
+			return nil, ErrGatherTimeout
+		case <-gathered:
+		}
+	}
+
+	return json.Marshal(p.pc.LocalDescription())
+}
+
+func (p *Peer) attach(dc *webrtc.DataChannel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.attachLocked(dc)
+}
+
+func (p *Peer) attachLocked(dc *webrtc.DataChannel) {
+	p.dc = dc
+	dc.OnOpen(func() {
+		p.openOnce.Do(func() { close(p.open) })
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		p.mu.Lock()
+		fn := p.onMessage
+		p.mu.Unlock()
+		if fn != nil {
+			fn(msg.Data)
+		}
+	})
+}
+
+func decode(b []byte, expected webrtc.SDPType) (webrtc.SessionDescription, error) {
+	var desc webrtc.SessionDescription
+	if err := json.Unmarshal(b, &desc); err != nil {
+		return desc, fmt.Errorf("%w: %v", ErrInvalidSDP, err)
+	}
+	if desc.Type != expected {
+		return desc, fmt.Errorf("%w: expected %s, got %s", ErrInvalidSDP, expected, desc.Type)
 	}
-	return data, err
+	return desc, nil
 }
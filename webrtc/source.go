@@ -0,0 +1,176 @@
+package wrtc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v4/pkg/media/oggreader"
+)
+
+// Source produces encoded media samples, io.EOF ends the stream.
+type Source interface {
+	Codec() Codec
+	Next() (media.Sample, error)
+}
+
+// Play writes samples of src to the track in real time until the source
+// ends or ctx is done.
+func Play(ctx context.Context, t *Track, src Source) error {
+	for {
+		s, err := src.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := t.WriteSample(s); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.Duration):
+		}
+	}
+}
+
+type FileSource struct {
+	Source
+	f *os.File
+}
+
+// OpenFile opens an IVF file with VP8 video or an Ogg file with Opus audio.
+func OpenFile(path string) (*FileSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var src Source
+	switch filepath.Ext(path) {
+	case ".ivf":
+		src, err = IVFSource(f)
+	case ".ogg", ".opus":
+		src, err = OggSource(f)
+	default:
+		err = fmt.Errorf("%w: %s", ErrUnsupportedCodec, filepath.Ext(path))
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileSource{Source: src, f: f}, nil
+}
+
+func (s *FileSource) Close() error {
+	return s.f.Close()
+}
+
+type ivfSource struct {
+	r        *ivfreader.IVFReader
+	duration time.Duration
+}
+
+func IVFSource(r io.Reader) (Source, error) {
+	reader, header, err := ivfreader.NewWith(r)
+	if err != nil {
+		return nil, err
+	}
+	if header.FourCC != "VP80" {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedCodec, header.FourCC)
+	}
+	return &ivfSource{
+		r:        reader,
+		duration: time.Second * time.Duration(header.TimebaseNumerator) / time.Duration(header.TimebaseDenominator),
+	}, nil
+}
+
+func (s *ivfSource) Codec() Codec {
+	return CodecVP8
+}
+
+func (s *ivfSource) Next() (media.Sample, error) {
+	frame, _, err := s.r.ParseNextFrame()
+	if err != nil {
+		return media.Sample{}, err
+	}
+	return media.Sample{Data: frame, Duration: s.duration}, nil
+}
+
+type oggSource struct {
+	r       *oggreader.OggReader
+	granule uint64
+}
+
+func OggSource(r io.Reader) (Source, error) {
+	reader, _, err := oggreader.NewWith(r)
+	if err != nil {
+		return nil, err
+	}
+	return &oggSource{r: reader}, nil
+}
+
+func (s *oggSource) Codec() Codec {
+	return CodecOpus
+}
+
+func (s *oggSource) Next() (media.Sample, error) {
+	page, header, err := s.r.ParseNextPage()
+	if err != nil {
+		return media.Sample{}, err
+	}
+	// Opus granule position counts 48kHz samples.
+	samples := header.GranulePosition - s.granule
+	s.granule = header.GranulePosition
+	return media.Sample{
+		Data:     page,
+		Duration: time.Duration(samples) * time.Second / 48000,
+	}, nil
+}
+
+type pattern struct {
+	codec Codec
+	n     int
+	limit int
+}
+
+// TestPattern generates frames carrying a counter instead of real media,
+// enough to exercise negotiation and transport without a camera. Zero limit
+// generates frames forever.
+func TestPattern(codec Codec, limit int) Source {
+	return &pattern{codec: codec, limit: limit}
+}
+
+func (p *pattern) Codec() Codec {
+	return p.codec
+}
+
+func (p *pattern) Next() (media.Sample, error) {
+	if p.limit > 0 && p.n >= p.limit {
+		return media.Sample{}, io.EOF
+	}
+	p.n++
+
+	switch p.codec {
+	case CodecOpus:
+		// Opus TOC of a 20ms silent frame followed by the counter.
+		return media.Sample{Data: []byte{0xf8, 0xff, 0xfe, byte(p.n)}, Duration: 20 * time.Millisecond}, nil
+	case CodecVP8:
+		frame := make([]byte, 64)
+		for i := range frame {
+			frame[i] = byte(p.n + i)
+		}
+		return media.Sample{Data: frame, Duration: 33 * time.Millisecond}, nil
+	default:
+		return media.Sample{}, fmt.Errorf("%w: %s", ErrUnsupportedCodec, p.codec)
+	}
+}
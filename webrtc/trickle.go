@@ -0,0 +1,118 @@
+package wrtc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// OnCandidate registers fn for local candidates. Empty candidate marks the
+// end of candidates. Candidates gathered before the registration are
+// delivered right away.
+func (p *Peer) OnCandidate(fn func(candidate []byte)) {
+	p.mu.Lock()
+	pending := p.localCands
+	p.localCands = nil
+	p.onCandidate = fn
+	p.mu.Unlock()
+
+	for _, c := range pending {
+		fn(c)
+	}
+}
+
+// AddCandidate applies a remote candidate. Candidates arriving before the
+// remote description are kept until it is set.
+func (p *Peer) AddCandidate(candidate []byte) error {
+	init, err := decodeCandidate(candidate)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	if !p.remoteSet {
+		p.remoteCands = append(p.remoteCands, init)
+		p.mu.Unlock()
+		return nil
+	}
+	p.mu.Unlock()
+
+	return p.pc.AddICECandidate(init)
+}
+
+func (p *Peer) trickle(c *webrtc.ICECandidate) {
+	var b []byte
+	if c != nil {
+		var err error
+		b, err = json.Marshal(c.ToJSON())
+		if err != nil {
+			return
+		}
+	}
+
+	p.mu.Lock()
+	fn := p.onCandidate
+	if fn == nil {
+		p.localCands = append(p.localCands, b)
+	}
+	p.mu.Unlock()
+
+	if fn != nil {
+		fn(b)
+	}
+}
+
+func (p *Peer) setRemote(desc webrtc.SessionDescription) error {
+	if err := p.pc.SetRemoteDescription(desc); err != nil {
+		return fmt.Errorf("%w: %v", ErrSetRemote, err)
+	}
+
+	p.mu.Lock()
+	pending := p.remoteCands
+	p.remoteCands = nil
+	p.remoteSet = true
+	p.mu.Unlock()
+
+	for _, c := range pending {
+		if err := p.pc.AddICECandidate(c); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidCandidate, err)
+		}
+	}
+	return nil
+}
+
+func decodeCandidate(b []byte) (webrtc.ICECandidateInit, error) {
+	var init webrtc.ICECandidateInit
+	if len(b) == 0 {
+		return init, nil
+	}
+	if err := json.Unmarshal(b, &init); err != nil {
+		return init, fmt.Errorf("%w: %v", ErrInvalidCandidate, err)
+	}
+	return init, nil
+}
+
+// RemoteAddr is the address of the remote candidate ICE selected, nil before
+// a pair is selected or for a remote hidden behind an mDNS name.
+func (p *Peer) RemoteAddr() net.Addr {
+	sctp := p.pc.SCTP()
+	if sctp == nil || sctp.Transport() == nil {
+		return nil
+	}
+	pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil || pair.Remote == nil {
+		return nil
+	}
+	ip, err := netip.ParseAddr(pair.Remote.Address)
+	if err != nil {
+		return nil
+	}
+	ap := netip.AddrPortFrom(ip.Unmap(), pair.Remote.Port)
+	if pair.Remote.Protocol == webrtc.ICEProtocolTCP {
+		return net.TCPAddrFromAddrPort(ap)
+	}
+	return net.UDPAddrFromAddrPort(ap)
+}
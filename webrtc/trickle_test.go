@@ -0,0 +1,60 @@
+package wrtc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Trickle(t *testing.T) {
+	t.Run("connect with trickled candidates", func(t *testing.T) {
+		offerer, answerer := loopbackPeer(t), loopbackPeer(t)
+
+		offer, err := offerer.Offer(t.Context(), GatherTrickle)
+		require.NoError(t, err)
+
+		ended := make(chan struct{}, 2)
+		relay := func(to *Peer) func([]byte) {
+			return func(c []byte) {
+				if len(c) == 0 {
+					ended <- struct{}{}
+				}
+				assert.NoError(t, to.AddCandidate(c))
+			}
+		}
+		offerer.OnCandidate(relay(answerer))
+		answerer.OnCandidate(relay(offerer))
+
+		answer, err := answerer.Answer(t.Context(), offer, GatherTrickle)
+		require.NoError(t, err)
+		require.NoError(t, offerer.Accept(answer))
+
+		for _, p := range []*Peer{offerer, answerer} {
+			select {
+			case <-p.Ready():
+			case <-time.After(10 * time.Second):
+				t.Fatal("data channel not opened")
+			}
+		}
+		for _, p := range []*Peer{offerer, answerer} {
+			addr, ok := p.RemoteAddr().(*net.UDPAddr)
+			require.True(t, ok)
+			assert.True(t, addr.IP.IsLoopback())
+		}
+		for range 2 {
+			select {
+			case <-ended:
+			case <-time.After(5 * time.Second):
+				t.Fatal("end of candidates not signaled")
+			}
+		}
+	})
+
+	t.Run("invalid candidate", func(t *testing.T) {
+		p := loopbackPeer(t)
+		assert.ErrorIs(t, p.AddCandidate([]byte("{")), ErrInvalidCandidate)
+	})
+}